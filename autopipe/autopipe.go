@@ -0,0 +1,371 @@
+// Package autopipe implements a thread-safe redis client which multiplexes
+// the commands of many go-routines onto one or a few connections, by
+// implicitly pipelining them.
+//
+// Whereas a pool.Pool needs a connection per go-routine performing a command,
+// a Client queues the commands of all go-routines and writes them in batches,
+// as if they had been pipelined using PipeAppend, then hands each go-routine
+// the reply to its command. Under concurrency this results in far fewer
+// connections, system calls and round trips.
+//
+//	c, err := autopipe.New("tcp", "localhost:6379", autopipe.Opts{})
+//	if err != nil {
+//		// handle err
+//	}
+//	defer c.Close()
+//
+//	// From any number of go-routines
+//	foo, err := c.Cmd("GET", "foo").Str()
+//
+// Blocking commands (BLPOP, XREAD with BLOCK, etc...) would hold up every
+// other command queued behind them, so they're performed on dedicated
+// connections taken from a regular pool instead. Pub/sub is done on a
+// dedicated connection as well, made using PubSub, since the messages
+// subscribing results in keep arriving long after the reply to SUBSCRIBE:
+//
+//	sc, err := c.PubSub()
+//	if err != nil {
+//		// handle err
+//	}
+//	defer sc.Client.Close()
+//	sr := sc.Subscribe("news")
+//
+// Commands which change the state of the connection they're performed on
+// (MULTI, SELECT, SUBSCRIBE, etc...) can't be performed using Cmd, and result
+// in ErrNotMultiplexable. A dedicated connection for those can be made using
+// Dedicated, or PubSub for the pub/sub ones.
+package autopipe
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gallir/radix.improved/pool"
+	"github.com/gallir/radix.improved/pubsub"
+	"github.com/gallir/radix.improved/redis"
+)
+
+var (
+	// ErrClosed is returned from Cmd once Close has been called
+	ErrClosed = errors.New("autopipe: client closed")
+
+	// ErrNotMultiplexable is returned from Cmd for commands which change the
+	// state of the connection they're performed on, and therefore can't be
+	// performed on a connection shared with other go-routines. Subscribing is
+	// done using PubSub instead.
+	ErrNotMultiplexable = errors.New("autopipe: command can't be multiplexed, use a dedicated connection")
+)
+
+// The commands which block until something happens, and are therefore
+// performed on a dedicated connection
+var blockingCmds = map[string]bool{
+	"BLPOP":      true,
+	"BRPOP":      true,
+	"BRPOPLPUSH": true,
+	"BLMOVE":     true,
+	"BLMPOP":     true,
+	"BZPOPMIN":   true,
+	"BZPOPMAX":   true,
+	"BZMPOP":     true,
+	"WAIT":       true,
+	"WAITAOF":    true,
+}
+
+// The commands which only block if given the BLOCK option
+var maybeBlockingCmds = map[string]bool{
+	"XREAD":      true,
+	"XREADGROUP": true,
+}
+
+// The commands which change the state of the connection
+var statefulCmds = map[string]bool{
+	"MULTI":        true,
+	"EXEC":         true,
+	"DISCARD":      true,
+	"WATCH":        true,
+	"UNWATCH":      true,
+	"SELECT":       true,
+	"AUTH":         true,
+	"HELLO":        true,
+	"RESET":        true,
+	"QUIT":         true,
+	"MONITOR":      true,
+	"SUBSCRIBE":    true,
+	"PSUBSCRIBE":   true,
+	"SSUBSCRIBE":   true,
+	"UNSUBSCRIBE":  true,
+	"PUNSUBSCRIBE": true,
+	"SUNSUBSCRIBE": true,
+}
+
+// Opts are options which can be passed into New. If any are set to their zero
+// value the default value will be used instead
+type Opts struct {
+	// The number of connections commands are multiplexed onto. A batch of
+	// commands is written to a connection, and the next batch is formed while
+	// the connection waits for the replies, so more connections mean more
+	// batches in flight at once. Default is 1
+	Conns int
+
+	// The time the first command of a batch waits for other commands to join
+	// it before the batch is written. A longer window makes for bigger
+	// batches, at the cost of latency when there's little concurrency. If
+	// negative, batches are written as soon as a connection is free, with
+	// whatever commands are already queued. Default is 150 microseconds
+	FlushInterval time.Duration
+
+	// The maximum number of commands in a batch. A batch which reaches it is
+	// written right away. Default is 128
+	MaxBatch int
+
+	// The size of the pool.Pool of dedicated connections which blocking
+	// commands are performed on. Default is 10
+	PoolSize int
+
+	// Used to make the multiplexed connections as well as the dedicated ones.
+	// Default is redis.Dial
+	DialFunc pool.DialFunc
+}
+
+// Client is a thread-safe redis client which multiplexes commands onto a few
+// connections. See the package docs for more.
+type Client struct {
+	o Opts
+
+	// The network/address that the Client is connecting to. These are going
+	// to be whatever was passed into New. These should not be changed after
+	// the Client is initialized
+	Network, Addr string
+
+	callCh  chan *call
+	closeCh chan struct{}
+	once    sync.Once
+	wg      sync.WaitGroup
+	pool    *pool.Pool
+}
+
+// call is a single command queued by Cmd, along with where its reply goes
+type call struct {
+	cmd   string
+	args  []interface{}
+	reply chan *redis.Resp
+}
+
+// New creates a Client for the redis instance at the given address, making
+// its multiplexed connections right away. An error is returned if any of them
+// can't be made.
+func New(network, addr string, o Opts) (*Client, error) {
+	if o.Conns < 1 {
+		o.Conns = 1
+	}
+	if o.FlushInterval == 0 {
+		o.FlushInterval = 150 * time.Microsecond
+	}
+	if o.MaxBatch < 1 {
+		o.MaxBatch = 128
+	}
+	if o.PoolSize < 1 {
+		o.PoolSize = 10
+	}
+	if o.DialFunc == nil {
+		o.DialFunc = redis.Dial
+	}
+
+	conns := make([]*redis.Client, o.Conns)
+	for i := range conns {
+		var err error
+		if conns[i], err = o.DialFunc(network, addr); err != nil {
+			for _, conn := range conns[:i] {
+				conn.Close()
+			}
+			return nil, err
+		}
+	}
+
+	p, err := pool.NewCustom(network, addr, o.PoolSize, o.DialFunc)
+	if err != nil {
+		p.Empty()
+		for _, conn := range conns {
+			conn.Close()
+		}
+		return nil, err
+	}
+
+	c := &Client{
+		o:       o,
+		Network: network,
+		Addr:    addr,
+		callCh:  make(chan *call),
+		closeCh: make(chan struct{}),
+		pool:    p,
+	}
+	c.wg.Add(len(conns))
+	for _, conn := range conns {
+		go c.spin(conn)
+	}
+	return c, nil
+}
+
+// Cmd performs the given command and returns its reply. It's safe to call
+// from many go-routines at once, which is the point.
+func (c *Client) Cmd(cmd string, args ...interface{}) *redis.Resp {
+	return c.CmdContext(context.Background(), cmd, args...)
+}
+
+// CmdContext is like Cmd, but stops waiting for the reply once the given
+// context is done, in which case the context's error is returned as an IOErr.
+// A command which was already written is still performed, its reply is just
+// discarded.
+func (c *Client) CmdContext(
+	ctx context.Context, cmd string, args ...interface{},
+) *redis.Resp {
+	ucmd := strings.ToUpper(cmd)
+	if statefulCmds[ucmd] {
+		return redis.NewResp(ErrNotMultiplexable)
+	} else if isBlocking(ucmd, args) {
+		return c.pool.CmdContext(ctx, cmd, args...)
+	}
+
+	ca := &call{cmd: cmd, args: args, reply: make(chan *redis.Resp, 1)}
+	select {
+	case c.callCh <- ca:
+	case <-c.closeCh:
+		return redis.NewResp(ErrClosed)
+	case <-ctx.Done():
+		return redis.NewRespIOErr(ctx.Err())
+	}
+
+	select {
+	case r := <-ca.reply:
+		return r
+	case <-ctx.Done():
+		return redis.NewRespIOErr(ctx.Err())
+	}
+}
+
+func isBlocking(ucmd string, args []interface{}) bool {
+	if blockingCmds[ucmd] {
+		return true
+	} else if !maybeBlockingCmds[ucmd] {
+		return false
+	}
+	// The args are flattened the same way they're sent, so that BLOCK is found
+	// whether it's given as a string, a []byte or within a slice
+	flat, err := redis.NewRespFlattenedStrings(args).List()
+	if err != nil {
+		return false
+	}
+	for _, arg := range flat {
+		if strings.EqualFold(arg, "BLOCK") {
+			return true
+		}
+	}
+	return false
+}
+
+// Dedicated makes a new connection to the redis instance, which isn't shared
+// with anything else. This is meant for commands which can't be multiplexed,
+// like SUBSCRIBE or MULTI. The caller is responsible for closing it.
+func (c *Client) Dedicated() (*redis.Client, error) {
+	return c.o.DialFunc(c.Network, c.Addr)
+}
+
+// PubSub makes a new dedicated connection, like Dedicated, and wraps it in a
+// pubsub.SubClient for subscribing to channels and receiving their messages.
+// PUBLISH itself can be performed using Cmd like any other command. The caller
+// is responsible for closing the SubClient's Client.
+func (c *Client) PubSub() (*pubsub.SubClient, error) {
+	conn, err := c.Dedicated()
+	if err != nil {
+		return nil, err
+	}
+	return pubsub.NewSubClient(conn), nil
+}
+
+// Close stops the Client, closing all of its connections once the commands
+// which were already queued have been performed
+func (c *Client) Close() {
+	c.once.Do(func() {
+		close(c.closeCh)
+		c.wg.Wait()
+		c.pool.Empty()
+	})
+}
+
+// spin takes batches of commands off of callCh and performs them on the given
+// connection, until the Client is closed
+func (c *Client) spin(conn *redis.Client) {
+	defer c.wg.Done()
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+
+	batch := make([]*call, 0, c.o.MaxBatch)
+	for {
+		select {
+		case ca := <-c.callCh:
+			batch = append(batch[:0], ca)
+		case <-c.closeCh:
+			return
+		}
+		batch = c.fillBatch(batch)
+
+		// The connection is made again if it was lost during the previous
+		// batch. If that fails the whole batch fails with the error.
+		if conn == nil {
+			var err error
+			if conn, err = c.o.DialFunc(c.Network, c.Addr); err != nil {
+				conn = nil
+				for _, ca := range batch {
+					ca.reply <- redis.NewRespIOErr(err)
+				}
+				continue
+			}
+		}
+
+		for _, ca := range batch {
+			conn.PipeAppend(ca.cmd, ca.args...)
+		}
+		for _, ca := range batch {
+			ca.reply <- conn.PipeResp()
+		}
+
+		if conn.LastCritical != nil {
+			conn.Close()
+			conn = nil
+		}
+	}
+}
+
+// fillBatch adds any more commands to the batch which arrive within the
+// FlushInterval, up to MaxBatch
+func (c *Client) fillBatch(batch []*call) []*call {
+	if c.o.FlushInterval < 0 {
+		for len(batch) < c.o.MaxBatch {
+			select {
+			case ca := <-c.callCh:
+				batch = append(batch, ca)
+			default:
+				return batch
+			}
+		}
+		return batch
+	}
+
+	timer := time.NewTimer(c.o.FlushInterval)
+	defer timer.Stop()
+	for len(batch) < c.o.MaxBatch {
+		select {
+		case ca := <-c.callCh:
+			batch = append(batch, ca)
+		case <-timer.C:
+			return batch
+		}
+	}
+	return batch
+}
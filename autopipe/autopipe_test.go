@@ -0,0 +1,191 @@
+package autopipe
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	. "testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/gallir/radix.improved/redis"
+	"github.com/gallir/radix.improved/redistest"
+)
+
+// testClient returns a Client connected to an in-memory server, along with
+// the largest pipeline its connections have written so far
+func testClient(t *T, o Opts) (*Client, *redistest.Server, func() int) {
+	s := redistest.NewPipeServer()
+	t.Cleanup(func() { s.Close() })
+
+	var mu sync.Mutex
+	var maxPipeline int
+	df := s.DialFunc()
+	o.DialFunc = func(network, addr string) (*redis.Client, error) {
+		c, err := df(network, addr)
+		if err != nil {
+			return nil, err
+		}
+		c.Hooks = []redis.Hook{redis.HookFuncs{Before: func(ci *redis.CmdInfo) {
+			mu.Lock()
+			defer mu.Unlock()
+			if ci.PipelineSize > maxPipeline {
+				maxPipeline = ci.PipelineSize
+			}
+		}}}
+		return c, nil
+	}
+
+	c, err := New("tcp", "", o)
+	require.Nil(t, err)
+	t.Cleanup(c.Close)
+	return c, s, func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return maxPipeline
+	}
+}
+
+func TestCmd(t *T) {
+	c, _, maxPipeline := testClient(t, Opts{FlushInterval: time.Millisecond})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key := "key" + strconv.Itoa(i)
+			require.Nil(t, c.Cmd("SET", key, i).Err)
+			n, err := c.Cmd("GET", key).Int()
+			require.Nil(t, err)
+			assert.Equal(t, i, n)
+			require.Nil(t, c.Cmd("INCR", "counter").Err)
+		}(i)
+	}
+	wg.Wait()
+
+	n, err := c.Cmd("GET", "counter").Int()
+	require.Nil(t, err)
+	assert.Equal(t, 100, n)
+
+	// With that many go-routines the commands must have been batched
+	assert.True(t, maxPipeline() > 1)
+
+	// Application errors only affect their own command
+	require.Nil(t, c.Cmd("HSET", "hash", "a", 1).Err)
+	assert.NotNil(t, c.Cmd("GET", "hash").Err)
+	assert.Nil(t, c.Cmd("PING").Err)
+}
+
+func TestNotMultiplexable(t *T) {
+	c, _, _ := testClient(t, Opts{})
+	for _, cmd := range []string{"MULTI", "select", "SUBSCRIBE"} {
+		assert.Equal(t, ErrNotMultiplexable, c.Cmd(cmd, "foo").Err)
+	}
+
+	dc, err := c.Dedicated()
+	require.Nil(t, err)
+	defer dc.Close()
+	require.Nil(t, dc.Cmd("MULTI").Err)
+	require.Nil(t, dc.Cmd("SET", "foo", "bar").Err)
+	require.Nil(t, dc.Cmd("EXEC").Err)
+	s, err := c.Cmd("GET", "foo").Str()
+	require.Nil(t, err)
+	assert.Equal(t, "bar", s)
+}
+
+func TestPubSub(t *T) {
+	c, _, _ := testClient(t, Opts{})
+	sc, err := c.PubSub()
+	require.Nil(t, err)
+	defer sc.Client.Close()
+	require.Nil(t, sc.Subscribe("news").Err)
+
+	// Publishing goes through the multiplexed connections, while the message
+	// arrives on the dedicated one
+	n, err := c.Cmd("PUBLISH", "news", "hi").Int()
+	require.Nil(t, err)
+	assert.Equal(t, 1, n)
+	sr := sc.Receive()
+	require.Nil(t, sr.Err)
+	assert.Equal(t, "news", sr.Channel)
+	assert.Equal(t, "hi", sr.Message)
+}
+
+func TestBlockingDedicated(t *T) {
+	c, s, _ := testClient(t, Opts{Conns: 1})
+
+	// The in-memory server doesn't implement BLPOP, so it's made to take a
+	// while to fail instead. If it weren't performed on a dedicated
+	// connection the GET would be stuck behind it.
+	s.Inject(redistest.Fault{Cmd: "BLPOP", Latency: 500 * time.Millisecond})
+	done := make(chan struct{})
+	go func() {
+		c.Cmd("BLPOP", "list", 0)
+		close(done)
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	start := time.Now()
+	require.Nil(t, c.Cmd("GET", "foo").Err)
+	assert.True(t, time.Since(start) < 250*time.Millisecond)
+	<-done
+}
+
+func TestCmdContext(t *T) {
+	c, s, _ := testClient(t, Opts{})
+	s.Inject(redistest.Fault{Cmd: "GET", Latency: 200 * time.Millisecond, Times: 1})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	r := c.CmdContext(ctx, "GET", "foo")
+	assert.True(t, redis.IsTimeout(r))
+
+	// The abandoned reply doesn't get mixed up with later ones
+	require.Nil(t, c.Cmd("SET", "foo", "bar").Err)
+	str, err := c.Cmd("GET", "foo").Str()
+	require.Nil(t, err)
+	assert.Equal(t, "bar", str)
+}
+
+func TestReconnect(t *T) {
+	c, s, _ := testClient(t, Opts{})
+	s.Inject(redistest.Fault{Cmd: "GET", Close: true, Times: 1})
+	assert.True(t, c.Cmd("GET", "foo").IsType(redis.IOErr))
+	assert.Nil(t, c.Cmd("GET", "foo").Err)
+}
+
+func TestClose(t *T) {
+	c, _, _ := testClient(t, Opts{})
+	require.Nil(t, c.Cmd("PING").Err)
+	c.Close()
+	assert.Equal(t, ErrClosed, c.Cmd("PING").Err)
+}
+
+func TestIsBlocking(t *T) {
+	assert.True(t, isBlocking("BLPOP", []interface{}{"list", 0}))
+	assert.True(t, isBlocking("XREAD", []interface{}{"BLOCK", 0, "STREAMS", "s", "$"}))
+	assert.True(t, isBlocking("XREAD", []interface{}{[]byte("block"), 0, "STREAMS", "s", "$"}))
+	assert.True(t, isBlocking("XREAD", []interface{}{[]string{"BLOCK", "0"}, "STREAMS", "s", "$"}))
+	assert.False(t, isBlocking("XREAD", []interface{}{"COUNT", 1, "STREAMS", "s", "$"}))
+	assert.False(t, isBlocking("GET", []interface{}{"BLOCK"}))
+}
+
+func TestNewDialError(t *T) {
+	s := redistest.NewPipeServer()
+	defer s.Close()
+
+	// The pool failing to dial doesn't leave anything behind to clean up
+	var dials int
+	df := s.DialFunc()
+	_, err := New("tcp", "", Opts{Conns: 1, DialFunc: func(network, addr string) (*redis.Client, error) {
+		if dials++; dials > 1 {
+			return nil, errors.New("dial failed")
+		}
+		return df(network, addr)
+	}})
+	assert.NotNil(t, err)
+}
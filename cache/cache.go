@@ -0,0 +1,458 @@
+// Package cache implements server-assisted client-side caching on top of a
+// pool.Pool or cluster.Cluster, using redis' CLIENT TRACKING.
+//
+// Replies to read commands (GET, HGETALL, etc...) are kept in a bounded, local
+// LRU cache, and redis notifies the cache whenever a key which was read has
+// been modified so that its entries can be dropped. Notifications are received
+// on a dedicated invalidation connection per redis instance, which the
+// connections doing the reads redirect their notifications to.
+//
+//	p, err := pool.New("tcp", "localhost:6379", 10)
+//	if err != nil {
+//		// handle err
+//	}
+//
+//	c, err := cache.NewPool(p, cache.Opts{MaxEntries: 100000})
+//	if err != nil {
+//		// handle err
+//	}
+//	defer c.Close()
+//
+//	// The first call goes to redis, subsequent ones don't until "foo" is
+//	// modified or its entry is evicted/expired
+//	foo, err := c.Cmd("GET", "foo").Str()
+//
+// If an invalidation connection is lost every entry read through it is
+// dropped, and replies won't be cached for that redis instance until a new
+// invalidation connection is made, so stale data is never served.
+//
+// Resps returned from the cache are shared between callers, and must not be
+// modified or have ReleaseBuffers called on them.
+package cache
+
+import (
+	"bytes"
+	"container/list"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gallir/radix.improved/cluster"
+	"github.com/gallir/radix.improved/pool"
+	"github.com/gallir/radix.improved/redis"
+)
+
+// DefaultCommands are the read commands whose replies are cached if
+// Opts.Commands isn't set. All of them take a single key as their first
+// argument.
+var DefaultCommands = []string{
+	"GET", "GETRANGE", "STRLEN",
+	"HGET", "HGETALL", "HMGET", "HKEYS", "HVALS", "HLEN", "HEXISTS",
+	"LINDEX", "LLEN", "LRANGE",
+	"SCARD", "SISMEMBER", "SMEMBERS",
+	"ZCARD", "ZCOUNT", "ZRANGE", "ZRANGEBYSCORE", "ZRANK", "ZSCORE",
+	"EXISTS", "TYPE",
+}
+
+// ErrClosed is returned from Cmd once Close has been called
+var ErrClosed = errors.New("cache closed")
+
+// Opts are options which can be passed into NewPool and NewCluster. If any are
+// set to their zero value the default value will be used instead
+type Opts struct {
+	// The maximum number of replies which will be kept in the cache. Once it's
+	// reached the least recently used ones are evicted. Default is 10000
+	MaxEntries int
+
+	// The maximum time a reply is kept in the cache, even if its key is never
+	// invalidated. Default is one minute
+	MaxTTL time.Duration
+
+	// If set this is called for every key whose replies are about to be
+	// cached, and returns the maximum time they're kept in the cache for. If
+	// it returns zero MaxTTL is used, if it returns a negative duration the
+	// replies aren't cached at all
+	KeyTTL func(key string) time.Duration
+
+	// The commands whose replies are cached. Each must be a read-only command
+	// which takes a single key as its first argument. Default is
+	// DefaultCommands
+	Commands []string
+
+	// If true the invalidation connections are switched to RESP3 and receive
+	// invalidations as push messages. Otherwise they use RESP2 and receive
+	// them by subscribing to the __redis__:invalidate channel. Redis 6 or
+	// above is needed either way
+	Resp3 bool
+
+	// How often the invalidation connections are pinged while idle, so that a
+	// lost connection is noticed. Default is one second
+	PingInterval time.Duration
+}
+
+// backend abstracts away the Pool or Cluster which the cache sits on top of
+type backend interface {
+	passthrough() cmder
+	getForKey(key string) (*redis.Client, error)
+	getForAddr(addr string) (*redis.Client, error)
+	put(*redis.Client)
+}
+
+type cmder interface {
+	Cmd(cmd string, args ...interface{}) *redis.Resp
+}
+
+type poolBackend struct{ *pool.Pool }
+
+func (b poolBackend) passthrough() cmder                       { return b.Pool }
+func (b poolBackend) getForKey(string) (*redis.Client, error)  { return b.Get() }
+func (b poolBackend) getForAddr(string) (*redis.Client, error) { return b.Get() }
+func (b poolBackend) put(c *redis.Client)                      { b.Put(c) }
+
+type clusterBackend struct{ *cluster.Cluster }
+
+func (b clusterBackend) passthrough() cmder { return b.Cluster }
+func (b clusterBackend) getForKey(key string) (*redis.Client, error) {
+	return b.GetForKey(key)
+}
+func (b clusterBackend) getForAddr(addr string) (*redis.Client, error) {
+	return b.GetForAddr(addr)
+}
+func (b clusterBackend) put(c *redis.Client) { b.Put(c) }
+
+// entry is a single cached reply. Entries are kept in the lru list as well as
+// being indexed by the key they were read from
+type entry struct {
+	id, key, addr string
+	r             *redis.Resp
+	expires       time.Time
+}
+
+// flight tracks a reply which is being read from redis, so that an
+// invalidation of its key which arrives in the meantime prevents it from being
+// cached
+type flight struct {
+	invalidated bool
+}
+
+// Cache is a client-side cache in front of a Pool or Cluster. Its Cmd method
+// is thread-safe, and it can be used as a util.Cmder.
+type Cache struct {
+	o        Opts
+	b        backend
+	commands map[string]bool
+
+	l            sync.Mutex
+	lru          *list.List
+	entries      map[string]*list.Element
+	byKey        map[string]map[string]*list.Element
+	flights      map[string][]*flight
+	invalidators map[string]*invalidator
+	closed       bool
+}
+
+// NewPool returns a Cache which caches replies to commands performed on the
+// given Pool.
+func NewPool(p *pool.Pool, o Opts) (*Cache, error) {
+	return newCache(poolBackend{p}, p.Addr, o)
+}
+
+// NewCluster returns a Cache which caches replies to commands performed on the
+// given Cluster. An invalidation connection is made to each master as it's
+// first needed.
+func NewCluster(c *cluster.Cluster, o Opts) (*Cache, error) {
+	return newCache(clusterBackend{c}, "", o)
+}
+
+func newCache(b backend, addr string, o Opts) (*Cache, error) {
+	if o.MaxEntries == 0 {
+		o.MaxEntries = 10000
+	}
+	if o.MaxTTL == 0 {
+		o.MaxTTL = time.Minute
+	}
+	if o.Commands == nil {
+		o.Commands = DefaultCommands
+	}
+	if o.PingInterval == 0 {
+		o.PingInterval = time.Second
+	}
+
+	c := &Cache{
+		o:            o,
+		b:            b,
+		commands:     map[string]bool{},
+		lru:          list.New(),
+		entries:      map[string]*list.Element{},
+		byKey:        map[string]map[string]*list.Element{},
+		flights:      map[string][]*flight{},
+		invalidators: map[string]*invalidator{},
+	}
+	for _, cmd := range o.Commands {
+		c.commands[strings.ToUpper(cmd)] = true
+	}
+
+	// Connecting the invalidation connection up front means configuration
+	// problems, e.g. a server without CLIENT TRACKING, are found immediately
+	if addr != "" {
+		if _, err := c.getInvalidator(addr); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// Cmd performs the given command. If it's one of the cached commands and its
+// reply is in the cache the cached reply is returned without contacting redis,
+// otherwise the reply is read from redis and cached. Any other commands are
+// passed straight through to the Pool or Cluster, and entries for their first
+// key are dropped from the cache.
+func (c *Cache) Cmd(cmd string, args ...interface{}) *redis.Resp {
+	ucmd := strings.ToUpper(cmd)
+	if !c.commands[ucmd] {
+		r := c.b.passthrough().Cmd(cmd, args...)
+		if key, err := redis.KeyFromArgs(args...); err == nil {
+			c.l.Lock()
+			c.invalidateKey(key)
+			c.l.Unlock()
+		}
+		return r
+	}
+
+	key, err := redis.KeyFromArgs(args...)
+	if err != nil {
+		return redis.NewResp(err)
+	}
+	id := entryID(ucmd, args)
+
+	c.l.Lock()
+	if c.closed {
+		c.l.Unlock()
+		return redis.NewResp(ErrClosed)
+	}
+	if r, ok := c.getInner(id); ok {
+		c.l.Unlock()
+		return r
+	}
+	f := &flight{}
+	c.flights[key] = append(c.flights[key], f)
+	c.l.Unlock()
+
+	r, addr, inv := c.fetch(key, cmd, args)
+
+	c.l.Lock()
+	defer c.l.Unlock()
+	c.removeFlight(key, f)
+	if r.Err == nil && inv != nil && !inv.dead && !f.invalidated && !c.closed {
+		c.setInner(id, key, addr, r)
+	}
+	return r
+}
+
+// fetch performs the command on a connection which has tracking enabled, with
+// its invalidations redirected to the invalidation connection for its redis
+// instance. The invalidator is nil if tracking couldn't be enabled, in which
+// case the reply mustn't be cached.
+func (c *Cache) fetch(
+	key, cmd string, args []interface{},
+) (
+	*redis.Resp, string, *invalidator,
+) {
+	client, err := c.b.getForKey(key)
+	if err != nil {
+		return redis.NewResp(err), "", nil
+	}
+	defer c.b.put(client)
+
+	inv, err := c.getInvalidator(client.Addr)
+	if err != nil {
+		return client.Cmd(cmd, args...), client.Addr, nil
+	}
+
+	client.PipeAppend("CLIENT", "TRACKING", "ON", "REDIRECT", inv.id)
+	client.PipeAppend(cmd, args...)
+	trackR, r := client.PipeResp(), client.PipeResp()
+	if trackR.Err != nil {
+		return r, client.Addr, nil
+	}
+	return r, client.Addr, inv
+}
+
+// getInvalidator returns the invalidator for the given address, creating it if
+// there isn't a live one
+func (c *Cache) getInvalidator(addr string) (*invalidator, error) {
+	c.l.Lock()
+	inv, ok := c.invalidators[addr]
+	c.l.Unlock()
+	if ok {
+		return inv, nil
+	}
+
+	client, err := c.b.getForAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	if client.Addr != addr {
+		c.b.put(client)
+		return nil, errors.New("could not connect to " + addr)
+	}
+	if inv, err = newInvalidator(c, client); err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	c.l.Lock()
+	defer c.l.Unlock()
+	if c.closed {
+		inv.close()
+		return nil, ErrClosed
+	}
+	// Another routine may have beaten us to it, in which case we use theirs
+	if existing, ok := c.invalidators[client.Addr]; ok {
+		inv.close()
+		return existing, nil
+	}
+	c.invalidators[client.Addr] = inv
+	go inv.spin()
+	return inv, nil
+}
+
+// Flush drops every entry in the cache
+func (c *Cache) Flush() {
+	c.l.Lock()
+	defer c.l.Unlock()
+	c.flushInner(func(*entry) bool { return true })
+}
+
+// Len returns the number of entries currently in the cache
+func (c *Cache) Len() int {
+	c.l.Lock()
+	defer c.l.Unlock()
+	return c.lru.Len()
+}
+
+// Close closes every invalidation connection and drops every entry in the
+// cache. It doesn't close the underlying Pool or Cluster. Once this is called
+// Cmd will always return ErrClosed
+func (c *Cache) Close() {
+	c.l.Lock()
+	defer c.l.Unlock()
+	c.closed = true
+	for addr, inv := range c.invalidators {
+		inv.close()
+		delete(c.invalidators, addr)
+	}
+	c.flushInner(func(*entry) bool { return true })
+}
+
+// entryID returns an identifier for a command which is the same for any two
+// identical commands
+func entryID(cmd string, args []interface{}) string {
+	buf := new(bytes.Buffer)
+	redis.NewRespFlattenedStrings(args).WriteTo(buf)
+	return cmd + " " + buf.String()
+}
+
+// All of the methods below must be called with the lock held
+
+func (c *Cache) getInner(id string) (*redis.Resp, bool) {
+	el, ok := c.entries[id]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*entry)
+	if time.Now().After(e.expires) {
+		c.removeInner(el)
+		return nil, false
+	}
+	c.lru.MoveToFront(el)
+
+	// Return a copy so the caller can't affect the cached Resp itself
+	r := *e.r
+	return &r, true
+}
+
+func (c *Cache) setInner(id, key, addr string, r *redis.Resp) {
+	ttl := c.o.MaxTTL
+	if c.o.KeyTTL != nil {
+		if keyTTL := c.o.KeyTTL(key); keyTTL < 0 {
+			return
+		} else if keyTTL > 0 {
+			ttl = keyTTL
+		}
+	}
+
+	if el, ok := c.entries[id]; ok {
+		c.removeInner(el)
+	}
+	e := &entry{
+		id:      id,
+		key:     key,
+		addr:    addr,
+		r:       r,
+		expires: time.Now().Add(ttl),
+	}
+	el := c.lru.PushFront(e)
+	c.entries[id] = el
+	if c.byKey[key] == nil {
+		c.byKey[key] = map[string]*list.Element{}
+	}
+	c.byKey[key][id] = el
+
+	for c.lru.Len() > c.o.MaxEntries {
+		c.removeInner(c.lru.Back())
+	}
+}
+
+func (c *Cache) removeInner(el *list.Element) {
+	e := c.lru.Remove(el).(*entry)
+	delete(c.entries, e.id)
+	if ids := c.byKey[e.key]; ids != nil {
+		delete(ids, e.id)
+		if len(ids) == 0 {
+			delete(c.byKey, e.key)
+		}
+	}
+}
+
+func (c *Cache) removeFlight(key string, f *flight) {
+	fs := c.flights[key]
+	for i := range fs {
+		if fs[i] == f {
+			fs = append(fs[:i], fs[i+1:]...)
+			break
+		}
+	}
+	if len(fs) == 0 {
+		delete(c.flights, key)
+	} else {
+		c.flights[key] = fs
+	}
+}
+
+func (c *Cache) invalidateKey(key string) {
+	for _, el := range c.byKey[key] {
+		c.removeInner(el)
+	}
+	for _, f := range c.flights[key] {
+		f.invalidated = true
+	}
+}
+
+// flushInner removes every entry for which fn returns true, and marks every
+// flight as invalidated, since it's not known which instance they're for
+func (c *Cache) flushInner(fn func(*entry) bool) {
+	for el := c.lru.Front(); el != nil; {
+		next := el.Next()
+		if fn(el.Value.(*entry)) {
+			c.removeInner(el)
+		}
+		el = next
+	}
+	for _, fs := range c.flights {
+		for _, f := range fs {
+			f.invalidated = true
+		}
+	}
+}
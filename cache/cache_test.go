@@ -0,0 +1,133 @@
+package cache
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	. "testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/gallir/radix.improved/pool"
+	"github.com/gallir/radix.improved/redis"
+)
+
+// These tests assume there is a redis 6 (or above) instance on port 6379
+
+func randStr() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+func TestLRU(t *T) {
+	c, err := newCache(nil, "", Opts{
+		MaxEntries: 2,
+		KeyTTL: func(key string) time.Duration {
+			if key == "short" {
+				return time.Nanosecond
+			} else if key == "never" {
+				return -1
+			}
+			return 0
+		},
+	})
+	require.Nil(t, err)
+
+	c.setInner("GET a", "a", "addr", redis.NewResp("A"))
+	c.setInner("GET b", "b", "addr", redis.NewResp("B"))
+	_, ok := c.getInner("GET a")
+	assert.True(t, ok)
+
+	// b is the least recently used, so it's the one to go
+	c.setInner("GET c", "c", "addr", redis.NewResp("C"))
+	assert.Equal(t, 2, c.lru.Len())
+	_, ok = c.getInner("GET b")
+	assert.False(t, ok)
+	r, ok := c.getInner("GET a")
+	assert.True(t, ok)
+	s, err := r.Str()
+	assert.Nil(t, err)
+	assert.Equal(t, "A", s)
+
+	c.invalidateKey("a")
+	_, ok = c.getInner("GET a")
+	assert.False(t, ok)
+	assert.Equal(t, 1, c.lru.Len())
+	assert.Equal(t, 1, len(c.byKey))
+
+	c.setInner("GET never", "never", "addr", redis.NewResp("N"))
+	_, ok = c.getInner("GET never")
+	assert.False(t, ok)
+
+	c.setInner("GET short", "short", "addr", redis.NewResp("S"))
+	time.Sleep(time.Millisecond)
+	_, ok = c.getInner("GET short")
+	assert.False(t, ok)
+
+	c.flushInner(func(e *entry) bool { return e.addr == "addr" })
+	assert.Equal(t, 0, c.lru.Len())
+	assert.Equal(t, 0, len(c.entries))
+	assert.Equal(t, 0, len(c.byKey))
+}
+
+func testCache(t *T, o Opts) {
+	p, err := pool.New("tcp", "127.0.0.1:6379", 10)
+	require.Nil(t, err)
+	defer p.Empty()
+
+	c, err := NewPool(p, o)
+	require.Nil(t, err)
+	defer c.Close()
+
+	key := randStr()
+	require.Nil(t, c.Cmd("SET", key, "foo").Err)
+
+	s, err := c.Cmd("GET", key).Str()
+	require.Nil(t, err)
+	assert.Equal(t, "foo", s)
+	assert.Equal(t, 1, c.Len())
+
+	// Modify the key behind the cache's back, the invalidation should remove
+	// it from the cache shortly
+	require.Nil(t, p.Cmd("SET", key, "bar").Err)
+	for i := 0; i < 100 && c.Len() > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, 0, c.Len())
+
+	s, err = c.Cmd("GET", key).Str()
+	require.Nil(t, err)
+	assert.Equal(t, "bar", s)
+
+	// Writing through the cache invalidates immediately
+	require.Nil(t, c.Cmd("SET", key, "baz").Err)
+	s, err = c.Cmd("GET", key).Str()
+	require.Nil(t, err)
+	assert.Equal(t, "baz", s)
+
+	// Losing the invalidation connection should flush the cache
+	c.l.Lock()
+	var inv *invalidator
+	for _, inv = range c.invalidators {
+	}
+	c.l.Unlock()
+	require.NotNil(t, inv)
+	require.Nil(t, p.Cmd("CLIENT", "KILL", "ID", inv.id).Err)
+	for i := 0; i < 100 && c.Len() > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, 0, c.Len())
+	assert.True(t, inv.dead)
+}
+
+func TestCache(t *T) {
+	testCache(t, Opts{})
+}
+
+func TestCacheResp3(t *T) {
+	testCache(t, Opts{Resp3: true})
+}
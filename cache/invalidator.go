@@ -0,0 +1,188 @@
+package cache
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/gallir/radix.improved/pubsub"
+	"github.com/gallir/radix.improved/redis"
+)
+
+const invalidateChannel = "__redis__:invalidate"
+
+// invalidator owns the connection which a single redis instance sends its
+// invalidation messages to, and applies them to the cache
+type invalidator struct {
+	c      *Cache
+	client *redis.Client
+	sub    *pubsub.SubClient
+	addr   string
+	id     int64
+
+	// dead is set, with the cache's lock held, once the connection has been
+	// lost. Replies which were read with tracking redirected to this
+	// invalidator mustn't be cached after that.
+	dead bool
+
+	closeOnce sync.Once
+	closeCh   chan struct{}
+}
+
+func newInvalidator(c *Cache, client *redis.Client) (*invalidator, error) {
+	inv := &invalidator{
+		c:       c,
+		client:  client,
+		addr:    client.Addr,
+		closeCh: make(chan struct{}),
+	}
+
+	if c.o.Resp3 {
+		if err := client.Hello(3).Err; err != nil {
+			return nil, err
+		}
+	}
+
+	id, err := client.Cmd("CLIENT", "ID").Int64()
+	if err != nil {
+		return nil, err
+	}
+	inv.id = id
+
+	// Receive needs to time out regularly so the connection can be pinged
+	client.ReadTimeout = inv.c.o.PingInterval
+	if client.WriteTimeout == 0 {
+		client.WriteTimeout = inv.c.o.PingInterval
+	}
+
+	if c.o.Resp3 {
+		client.OnPush = inv.handlePush
+		return inv, nil
+	}
+
+	inv.sub = pubsub.NewSubClient(client)
+	if r := inv.sub.Subscribe(invalidateChannel); r.Err != nil {
+		return nil, r.Err
+	}
+	return inv, nil
+}
+
+func (inv *invalidator) spin() {
+	if inv.sub != nil {
+		inv.spinSub()
+	} else {
+		inv.spinResp3()
+	}
+
+	select {
+	case <-inv.closeCh:
+		return
+	default:
+	}
+
+	// The connection has been lost. Since there's no knowing which
+	// invalidations were missed everything read from this instance is dropped,
+	// and the next read from it will create a new invalidator.
+	c := inv.c
+	c.l.Lock()
+	defer c.l.Unlock()
+	inv.dead = true
+	if c.invalidators[inv.addr] == inv {
+		delete(c.invalidators, inv.addr)
+	}
+	c.flushInner(func(e *entry) bool { return e.addr == inv.addr })
+	inv.close()
+}
+
+func (inv *invalidator) spinSub() error {
+	for {
+		r := inv.sub.Receive()
+		if inv.isClosed() {
+			return nil
+		}
+		if r.Timeout() {
+			if r := inv.sub.Ping(); r.Err != nil {
+				return r.Err
+			}
+			continue
+		} else if r.Err != nil {
+			return r.Err
+		}
+
+		if r.Type != pubsub.Message || r.Channel != invalidateChannel {
+			continue
+		}
+		elems, err := r.Resp.Array()
+		if err != nil || len(elems) < 3 {
+			return errors.New("malformed invalidation message")
+		}
+		inv.invalidate(elems[2])
+	}
+}
+
+func (inv *invalidator) spinResp3() error {
+	for {
+		r := inv.client.ReadResp()
+		if inv.isClosed() {
+			return nil
+		}
+		if redis.IsTimeout(r) {
+			// Any push messages which arrive while waiting for the reply are
+			// passed to OnPush
+			if r := inv.client.Cmd("PING"); r.Err != nil {
+				return r.Err
+			}
+			continue
+		} else if r.Err != nil {
+			return r.Err
+		}
+
+		if r.IsType(redis.Push) {
+			inv.handlePush(r)
+		}
+	}
+}
+
+func (inv *invalidator) handlePush(r *redis.Resp) {
+	elems, err := r.Array()
+	if err != nil || len(elems) < 2 {
+		return
+	}
+	if kind, _ := elems[0].Str(); kind != "invalidate" {
+		return
+	}
+	inv.invalidate(elems[1])
+}
+
+// invalidate applies an invalidation message's payload, which is either the
+// list of keys which were modified or Nil if the whole instance was flushed
+func (inv *invalidator) invalidate(payload *redis.Resp) {
+	c := inv.c
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	if payload.IsType(redis.Nil) {
+		c.flushInner(func(e *entry) bool { return e.addr == inv.addr })
+		return
+	}
+
+	keys, _ := payload.List()
+	for _, key := range keys {
+		c.invalidateKey(key)
+	}
+}
+
+func (inv *invalidator) isClosed() bool {
+	select {
+	case <-inv.closeCh:
+		return true
+	default:
+		return false
+	}
+}
+
+func (inv *invalidator) close() {
+	inv.closeOnce.Do(func() {
+		close(inv.closeCh)
+		inv.client.Close()
+	})
+}
@@ -6,18 +6,33 @@
 //
 // This package will initially call `cluster slots` in order to retrieve an
 // initial idea of the topology of the cluster, but other than that will not
-// make any other extraneous calls.
+// make any other extraneous calls. A MOVED redirect remaps just its slot, and
+// an ASK redirect, which happens while a slot is being migrated, is followed
+// without remapping anything. TRYAGAIN and CLUSTERDOWN errors are retried with
+// a backoff, see Opts. Stats returns counters of how often each happened.
+//
+// Each master has a circuit breaker, which opens when it keeps failing so that
+// only commands for the slots it owns fail, see BreakerState and NodeHealth.
+//
+// Read-only commands can be performed on the replicas of the masters instead,
+// see ReadPolicy.
+//
+// The keys of a command must all belong to the same slot. MGet, MSet, Del,
+// Unlink and Exists don't have that limitation, they split the keys by slot
+// and perform the command on every node involved at once. Commands without
+// keys can be performed on a given node with CmdNode, on a random one with
+// CmdRandom, or on all of them with CmdAll.
 //
 // All methods on a Cluster are thread-safe, and connections are automatically
 // pooled
 package cluster
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"log"
 	"strconv"
-	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -25,10 +40,6 @@ import (
 	"github.com/gallir/radix.improved/redis"
 )
 
-const (
-	faultyCheckPeriod = 2 * time.Second
-)
-
 type mapping [NumSlots]string
 
 func errorResp(err error) *redis.Resp {
@@ -40,12 +51,23 @@ func errorRespf(format string, args ...interface{}) *redis.Resp {
 }
 
 var (
-	// ErrBadCmdNoKey is an error reply returned when no key is given to the Cmd
-	// method
+	// ErrBadCmdNoKey is an error reply returned when no arguments at all are
+	// given to the Cmd method. See CmdNode, CmdRandom and CmdAll for commands
+	// without keys
 	ErrBadCmdNoKey = errors.New("bad command, no key")
 
-	// ErrClusterUnavailable is a faulty or unavailable cluster
+	// ErrClusterUnavailable is a faulty or unavailable cluster. Commands for
+	// the slots of a master whose circuit breaker is open fail with a
+	// *NodeUnavailableError, which errors.Is matches with it
 	ErrClusterUnavailable = errors.New("cluster not available")
+
+	// errCrossSlot is returned without the command being sent when the keys
+	// of a command belong to different slots. It's the same error redis would
+	// return, so errors.Is with redis.ErrCrossSlot works on it.
+	errCrossSlot = &redis.Error{
+		Code: "CROSSSLOT",
+		Msg:  "Keys in request don't hash to the same slot",
+	}
 )
 
 // DialFunc is a function which can be incorporated into Opts. Note that network
@@ -56,13 +78,17 @@ type DialFunc func(network, addr string) (*redis.Client, error)
 type Cluster struct {
 	o Opts
 	mapping
-	pools            map[string]clusterPool
-	poolThrottles    map[string]<-chan time.Time
-	resetThrottle    *time.Ticker
-	callCh           chan func(*Cluster)
-	stopCh           chan struct{}
-	ioError          int32
-	ioMonitorRunning int32
+	pools         map[string]clusterPool
+	replicas      map[string][]string
+	replicaPools  map[string]clusterPool
+	latencies     map[string]*int64
+	poolThrottles map[string]<-chan time.Time
+	resetThrottle *time.Ticker
+	callCh        chan func(*Cluster)
+	stopCh        chan struct{}
+	breakers      sync.Map
+	stats         *Stats
+	hooks         []redis.Hook
 
 	// This is written to whenever a slot miss (either a MOVED or ASK) is
 	// encountered. This is mainly for informational purposes, it's not meant to
@@ -84,9 +110,16 @@ type Opts struct {
 
 	// Read and write timeout which should be used on individual redis clients.
 	// Default is to not set the timeout and let the connection use it's
-	// default. This will be ignored if the Dialer field is set.
+	// default. This will be ignored if the Dialer field is set, or if any of
+	// the timeouts in DialOpts are set.
 	Timeout time.Duration
 
+	// Options used to connect to and initialize connections to each redis
+	// cluster instance, e.g. for authentication or TLS. They're used for every
+	// node, including those only learned about through CLUSTER SLOTS or a
+	// MOVED/ASK redirect. This will be ignored if the Dialer field is set.
+	DialOpts redis.DialOpts
+
 	// The size of the connection pool to use for each host. Default is 10
 	PoolSize int
 
@@ -100,9 +133,47 @@ type Opts struct {
 	ResetThrottle time.Duration
 
 	// The function which will be used to create connections within the pool for
-	// each redis cluster instance. The common use-case is to do authentication
-	// for new connections. Defaults to using redis.DialTimeout if not set.
+	// each redis cluster instance. Defaults to using redis.DialWithOpts with
+	// DialOpts if not set.
 	Dialer DialFunc
+
+	// Which nodes read-only commands are performed on, see ReadPolicy. Unless
+	// it's ReadMaster a pool of connections, on which READONLY is performed,
+	// is kept for each replica. Default is ReadMaster
+	ReadPolicy ReadPolicy
+
+	// The table used to find the keys of commands, and so which node to route
+	// them to. See RefreshCommands for loading the commands of the cluster
+	// itself into it. Default is redis.DefaultCommandTable
+	Commands *redis.CommandTable
+
+	// The most MOVED or ASK redirects a single command follows before the
+	// last one is returned to the caller. Negative means redirects aren't
+	// followed at all. Default is 5
+	MaxRedirects int
+
+	// The most times a single command is retried after a TRYAGAIN or
+	// CLUSTERDOWN error, which happen while slots are being migrated or the
+	// cluster is failing over, before the error is returned to the caller.
+	// Negative means those errors are returned straight away. Default is 3
+	MaxRetries int
+
+	// How long to wait before the first retry after a TRYAGAIN or CLUSTERDOWN
+	// error. The wait doubles with each further retry of the command, up to a
+	// second, and is jittered. Negative means retries aren't waited for.
+	// Default is 25 milliseconds
+	RetryBackoff time.Duration
+
+	// The number of network errors in a row on a node, with it not replying
+	// to anything in between, after which its circuit breaker opens and
+	// commands for the slots it owns fail with a *NodeUnavailableError, or
+	// for a replica reads aren't routed to it, until it recovers, see
+	// BreakerState. Default is 3
+	FaultyThreshold int
+
+	// How often a node whose circuit breaker is open is probed with CLUSTER
+	// INFO to find out whether it has recovered. Default is 2 seconds
+	ProbeInterval time.Duration
 }
 
 // New will perform the following steps to initialize:
@@ -136,9 +207,35 @@ func NewWithOpts(o Opts) (*Cluster, error) {
 	if o.ResetThrottle == 0 {
 		o.ResetThrottle = 500 * time.Millisecond
 	}
+	if o.Commands == nil {
+		o.Commands = redis.DefaultCommandTable
+	}
+	if o.MaxRedirects == 0 {
+		o.MaxRedirects = 5
+	}
+	if o.MaxRetries == 0 {
+		o.MaxRetries = 3
+	}
+	if o.RetryBackoff == 0 {
+		o.RetryBackoff = 25 * time.Millisecond
+	} else if o.RetryBackoff < 0 {
+		o.RetryBackoff = 0
+	}
+	if o.FaultyThreshold == 0 {
+		o.FaultyThreshold = 3
+	}
+	if o.ProbeInterval == 0 {
+		o.ProbeInterval = 2 * time.Second
+	}
 	if o.Dialer == nil {
+		do := o.DialOpts
+		if do.ConnectTimeout == 0 && do.ReadTimeout == 0 && do.WriteTimeout == 0 {
+			do.ConnectTimeout = o.Timeout
+			do.ReadTimeout = o.Timeout
+			do.WriteTimeout = o.Timeout
+		}
 		o.Dialer = func(_, addr string) (*redis.Client, error) {
-			return redis.DialTimeout("tcp", addr, o.Timeout)
+			return redis.DialWithOpts("tcp", addr, do)
 		}
 	}
 
@@ -146,14 +243,18 @@ func NewWithOpts(o Opts) (*Cluster, error) {
 		o:             o,
 		mapping:       mapping{},
 		pools:         map[string]clusterPool{},
+		replicas:      map[string][]string{},
+		replicaPools:  map[string]clusterPool{},
+		latencies:     map[string]*int64{},
 		poolThrottles: map[string]<-chan time.Time{},
+		stats:         &Stats{},
 		callCh:        make(chan func(*Cluster)),
 		stopCh:        make(chan struct{}),
 		MissCh:        make(chan struct{}),
 		ChangeCh:      make(chan struct{}),
 	}
 
-	initialPool, err := c.newPool(o.Addr, true)
+	initialPool, err := c.newPool(o.Addr, true, false)
 	if err != nil {
 		return nil, err
 	}
@@ -166,7 +267,11 @@ func NewWithOpts(o Opts) (*Cluster, error) {
 	return &c, nil
 }
 
-func (c *Cluster) newPool(addr string, clearThrottle bool) (clusterPool, error) {
+func (c *Cluster) newPool(
+	addr string, clearThrottle, readOnly bool,
+) (
+	clusterPool, error,
+) {
 	if clearThrottle {
 		delete(c.poolThrottles, addr)
 	} else if throttle, ok := c.poolThrottles[addr]; ok {
@@ -179,13 +284,26 @@ func (c *Cluster) newPool(addr string, clearThrottle bool) (clusterPool, error)
 	}
 
 	df := func(network, addr string) (*redis.Client, error) {
-		return c.o.Dialer(network, addr)
+		client, err := c.o.Dialer(network, addr)
+		if err != nil || !readOnly {
+			return client, err
+		}
+		if err := client.Cmd("READONLY").Err; err != nil {
+			client.Close()
+			return nil, err
+		}
+		return client, nil
 	}
 	p, err := pool.NewCustom("tcp", addr, c.o.PoolSize, df)
 	if err != nil {
+		// Stops the failed pool's pinging
+		p.Empty()
 		c.poolThrottles[addr] = time.After(c.o.PoolThrottle)
 		return clusterPool{}, err
 	}
+	for _, h := range c.hooks {
+		p.AddHook(h)
+	}
 
 	return newClusterPool(p), nil
 }
@@ -202,29 +320,73 @@ func (c *Cluster) spin() {
 	}
 }
 
+// AddHook adds a Hook which is called around every command performed by the
+// Cluster's Clients, on every node, see redis.Hook. When a command is retried
+// on another node after being redirected with MOVED or ASK the Hook is called
+// for each attempt, with the CmdInfo's Attempt and RetryCause set.
+func (c *Cluster) AddHook(h redis.Hook) {
+	doneCh := make(chan struct{})
+	c.callCh <- func(c *Cluster) {
+		c.hooks = append(c.hooks, h)
+		for _, p := range c.pools {
+			p.AddHook(h)
+		}
+		for _, p := range c.replicaPools {
+			p.AddHook(h)
+		}
+		close(doneCh)
+	}
+	<-doneCh
+}
+
 // Returns a connection for the given key or given address, depending on which
 // is set. If the given pool couldn't be used a connection from a random pool
 // will (attempt) to be returned
-func (c *Cluster) getConn(key, addr string) (*redis.Client, error) {
-	respCh := make(chan clusterPool)
+func (c *Cluster) getConn(
+	ctx context.Context, key, addr string,
+) (
+	*redis.Client, error,
+) {
+	type resp struct {
+		p   clusterPool
+		err error
+	}
+	respCh := make(chan resp)
 	c.callCh <- func(c *Cluster) {
 		if key != "" {
 			addr = keyToAddr(key, &c.mapping)
 		}
+		if !c.nodeAvailable(addr) {
+			respCh <- resp{err: &NodeUnavailableError{Addr: addr}}
+			return
+		}
 
 		var err error
 		p, ok := c.pools[addr]
 		if !ok {
-			if p, err = c.newPool(addr, false); err == nil {
+			if p, err = c.newPool(addr, false, false); err == nil {
 				c.pools[addr] = p
 			} else {
 				p = c.getRandomPoolInner()
 			}
 		}
-		respCh <- p
+		respCh <- resp{p: p}
+	}
+
+	r := <-respCh
+	if r.err != nil {
+		return nil, r.err
+	} else if r.p.Pool == nil {
+		return nil, ErrClusterUnavailable
 	}
 
-	return (<-respCh).Get()
+	// Not being able to connect to a node counts against it the same as a
+	// network error on a command
+	client, err := r.p.GetContext(ctx)
+	if err != nil && ctx.Err() == nil {
+		c.ioFailed(r.p.Addr, err)
+	}
+	return client, err
 }
 
 // Put putss the connection back in its pool. To be used alongside any of the
@@ -232,7 +394,11 @@ func (c *Cluster) getConn(key, addr string) (*redis.Client, error) {
 func (c *Cluster) Put(conn *redis.Client) {
 	respCh := make(chan clusterPool)
 	c.callCh <- func(c *Cluster) {
-		respCh <- c.pools[conn.Addr]
+		if p, ok := c.pools[conn.Addr]; ok {
+			respCh <- p
+		} else {
+			respCh <- c.replicaPools[conn.Addr]
+		}
 	}
 	if p := <-respCh; p.Pool != nil {
 		p.Put(conn)
@@ -248,6 +414,17 @@ func (c *Cluster) getRandomPoolInner() clusterPool {
 	return clusterPool{}
 }
 
+// getAvailablePoolInner is like getRandomPoolInner, but prefers a pool whose
+// node's circuit breaker isn't open
+func (c *Cluster) getAvailablePoolInner() clusterPool {
+	for addr, pool := range c.pools {
+		if c.nodeAvailable(addr) {
+			return pool
+		}
+	}
+	return c.getRandomPoolInner()
+}
+
 // Reset will re-retrieve the cluster topology and set up/teardown connections
 // as necessary. It begins by calling CLUSTER SLOTS on a random known
 // connection. The return from that is used to re-create the topology, create
@@ -278,7 +455,7 @@ func (c *Cluster) resetInner() error {
 		c.resetThrottle = time.NewTicker(c.o.ResetThrottle)
 	}
 
-	p := c.getRandomPoolInner()
+	p := c.getAvailablePoolInner()
 	if p.Pool == nil {
 		return fmt.Errorf("no available nodes to call CLUSTER SLOTS on")
 	}
@@ -299,6 +476,7 @@ func (c *Cluster) resetInnerUsingPool(p clusterPool) error {
 	defer p.Put(client)
 
 	pools := map[string]clusterPool{}
+	replicas := map[string][]string{}
 
 	elems, err := client.Cmd("CLUSTER", "SLOTS").Array()
 	if err != nil {
@@ -347,23 +525,32 @@ func (c *Cluster) resetInnerUsingPool(p clusterPool) error {
 		if slotPool, ok = c.pools[slotAddr]; ok {
 			pools[slotAddr] = slotPool
 		} else {
-			slotPool, err = c.newPool(slotAddr, true)
+			slotPool, err = c.newPool(slotAddr, true, false)
 			if err != nil {
 				return err
 			}
 			changed = true
 			pools[slotAddr] = slotPool
 		}
+
+		// The rest of the elements are the master's replicas
+		if replicas[slotAddr], err = replicaAddrs(slotElems[3:]); err != nil {
+			return err
+		}
 	}
 
 	for addr := range c.pools {
 		if _, ok := pools[addr]; !ok {
 			c.pools[addr].Empty()
 			delete(c.poolThrottles, addr)
+			c.breakers.Delete(addr)
 			changed = true
 		}
 	}
 	c.pools = pools
+	if c.setReplicas(replicas) {
+		changed = true
+	}
 
 	if changed {
 		select {
@@ -394,226 +581,199 @@ func (c *Cluster) resetInnerUsingPool(p clusterPool) error {
 //		  it with)
 
 // Cmd performs the given command on the correct cluster node and gives back the
-// command's reply. The command *must* have a key parameter (i.e. len(args) >=
-// 1). If any MOVED or ASK errors are returned they will be transparently
-// handled by this method.
+// command's reply. The command is routed on its keys, as found by the Commands
+// table (see Opts), and if it has more than one they must all belong to the
+// same slot, otherwise a CROSSSLOT error is returned without the command being
+// sent. A command without keys (e.g. PUBLISH) is routed on its first argument,
+// for compatibility, and one without any arguments fails with ErrBadCmdNoKey.
+// If any MOVED or ASK errors are returned they will be transparently handled by
+// this method. Read-only commands are performed according to the ReadPolicy
+// (see Opts and CmdRead).
 //
 // NOTE if you're doing any lua or scan operations through this method you might
 // save yourself some time and effort by checking out the LuaEval and NewScanner
 // functions in the util package. They properly handle the cluster client being
 // used.
 func (c *Cluster) Cmd(cmd string, args ...interface{}) *redis.Resp {
-	if len(args) < 1 {
-		return errorResp(ErrBadCmdNoKey)
-	}
-
-	if c.isFaulty() {
-		return errorResp(ErrClusterUnavailable)
-	}
+	return c.CmdContext(context.Background(), cmd, args...)
+}
 
-	key, err := redis.KeyFromArgs(args)
+// CmdContext is like Cmd, but the command, including any redirects, is
+// abandoned if the given context is cancelled or its deadline passes. See
+// redis.Client's CmdContext for how the context is applied to each node's
+// connection.
+func (c *Cluster) CmdContext(
+	ctx context.Context, cmd string, args ...interface{},
+) *redis.Resp {
+	key, err := c.KeyForCmd(cmd, args...)
 	if err != nil {
 		return errorResp(err)
 	}
 
-	client, err := c.getConn(key, "")
+	if c.o.ReadPolicy != ReadMaster && c.o.Commands.ReadOnly(cmd, args...) {
+		return c.readCmd(ctx, key, cmd, args)
+	}
+
+	client, err := c.getConn(ctx, key, "")
 	if err != nil {
 		return errorResp(err)
 	}
 
-	return c.clientCmd(client, cmd, args, false, nil, false)
+	return c.clientCmd(ctx, client, key, cmd, args)
 }
 
-func haveTried(tried map[string]bool, addr string) bool {
-	if tried == nil {
-		return false
+// KeyForCmd returns the key which determines the node the given command is
+// routed to, i.e. its first key as found by the Commands table (see Opts). If
+// the command doesn't have any keys its first argument is returned instead
+// (see redis.KeyFromArgs), and ErrBadCmdNoKey if it has no arguments. An error
+// is returned if the keys don't all belong to the same slot.
+func (c *Cluster) KeyForCmd(cmd string, args ...interface{}) (string, error) {
+	keys, err := c.o.Commands.Keys(cmd, args...)
+	if err != nil {
+		return "", err
+	} else if len(keys) == 0 {
+		if len(args) == 0 {
+			return "", ErrBadCmdNoKey
+		}
+		return redis.KeyFromArgs(args...)
 	}
-	return tried[addr]
-}
-
-func justTried(tried map[string]bool, addr string) map[string]bool {
-	if tried == nil {
-		tried = map[string]bool{}
+	slot := Slot(keys[0])
+	for _, key := range keys[1:] {
+		if Slot(key) != slot {
+			return "", errCrossSlot
+		}
 	}
-	tried[addr] = true
-	return tried
+	return keys[0], nil
 }
 
-func (c *Cluster) checkFaulty() {
-	notRunning := atomic.CompareAndSwapInt32(&c.ioMonitorRunning, 0, 1)
-	if notRunning {
-		go c.faultyMonitor()
+// RefreshCommands performs COMMAND on a random node of the cluster, and loads
+// its reply into the Commands table (see Opts), so that commands the built-in
+// table doesn't know about, like those of modules, are routed correctly
+func (c *Cluster) RefreshCommands() error {
+	respCh := make(chan clusterPool)
+	c.callCh <- func(c *Cluster) {
+		respCh <- c.getRandomPoolInner()
 	}
-}
-
-func (c *Cluster) setFaulty(s bool) {
-	if s {
-		atomic.StoreInt32(&c.ioError, 1)
-	} else {
-		atomic.StoreInt32(&c.ioError, 0)
+	p := <-respCh
+	if p.Pool == nil {
+		return ErrClusterUnavailable
 	}
-}
 
-func (c *Cluster) isFaulty() bool {
-	s := atomic.LoadInt32(&c.ioError)
-	return s > 0
+	client, err := p.Get()
+	if err != nil {
+		return err
+	}
+	defer p.Put(client)
+	return c.o.Commands.Refresh(client)
 }
 
-func (c *Cluster) faultyMonitor() {
-	defer func() {
-		atomic.StoreInt32(&c.ioMonitorRunning, 0)
-	}()
-
-	failures := 0
-	checked := make(chan bool)
-	for {
-		c.callCh <- func(c *Cluster) {
-			defer func() {
-				checked <- true
-			}()
-
-			p := c.getRandomPoolInner()
-			if p.Pool == nil {
-				c.setFaulty(true)
-				return
-			}
-
-			if e := c.resetInnerUsingPool(p); e != nil {
-				c.setFaulty(true)
-				return
-			}
-
-			if len(c.pools) == 0 {
-				c.setFaulty(true)
-				return
-			}
-
-			// Check that all pools in the cluster are available
-			for _, p := range c.pools {
-				client, err := p.Get()
-				if err != nil {
-					c.setFaulty(true)
-					return
-				}
-				r := client.Cmd("CLUSTER", "INFO")
-				if r.Err != nil {
-					c.setFaulty(true)
-					return
-				}
-				p.Put(client)
-				// Check the node in the cluster and it's ok
-				if !strings.Contains(r.String(), "cluster_state:ok") {
-					c.setFaulty(true)
-					return
-				}
-			}
-			if c.isFaulty() {
-				c.setFaulty(false)
-				log.Printf("Cluster %s recovered", c.o.Addr)
-			}
-		} // End of spinner func
-
-		<-checked
-		if !c.isFaulty() {
-			return
+// clientCmd performs the command for the given key on the given client, which
+// is put back into its pool afterwards. MOVED and ASK redirects are followed,
+// up to MaxRedirects of them, and TRYAGAIN and CLUSTERDOWN errors are retried,
+// up to MaxRetries times, see Opts. A MOVED remaps just the one slot, while an
+// ASK only applies to this command and doesn't remap anything.
+func (c *Cluster) clientCmd(
+	ctx context.Context, client *redis.Client, key, cmd string, args []interface{},
+) *redis.Resp {
+	var ask bool
+	var redirects, retries int
+	var cause error
+	for attempt := 0; ; attempt++ {
+		actx := ctx
+		if attempt > 0 {
+			// This is a redirected or retried attempt, which the client's Hooks
+			// are told
+			actx = redis.ContextWithAttempt(ctx, attempt, cause)
 		}
 
-		failures++
-		if failures == 1 {
-			log.Printf("Cluster %s entered into faulty mode", c.o.Addr)
+		var r *redis.Resp
+		if ask {
+			r = client.CmdContext(actx, "ASKING")
 		}
-		if failures%2 == 0 {
-			log.Printf("Trying reset on cluster %s after %d failures", c.o.Addr, failures)
-			c.Reset()
+
+		// If we asked and got an error, we continue on with error handling as
+		// we would normally do. If we didn't ask or the ask succeeded we do the
+		// command normally, and see how that goes
+		if r == nil || r.Err == nil {
+			r = client.CmdContext(actx, cmd, args...)
 		}
-		time.Sleep(faultyCheckPeriod)
-	}
-}
+		c.Put(client)
 
-func (c *Cluster) clientCmd(
-	client *redis.Client, cmd string, args []interface{}, ask bool,
-	tried map[string]bool, haveReset bool,
-) *redis.Resp {
-	var err error
-	var r *redis.Resp
-	defer c.Put(client)
+		err := r.Err
+		if err == nil {
+			c.ioSucceeded(client.Addr)
+			return r
+		}
 
-	if ask {
-		r = client.Cmd("ASKING")
-		ask = false
-	}
+		// An abandoned command says nothing about the health of the cluster
+		if ctxErr := ctx.Err(); ctxErr != nil && ctxErr == err {
+			return r
+		}
 
-	// If we asked and got an error, we continue on with error handling as we
-	// would normally do. If we didn't ask or the ask succeeded we do the
-	// command normally, and see how that goes
-	if r == nil || r.Err == nil {
-		r = client.Cmd(cmd, args...)
-	}
+		// Deal with network error. Give up and return the most recent error,
+		// the node's circuit breaker will open if it keeps happening
+		if r.IsType(redis.IOErr) {
+			c.ioFailed(client.Addr, err)
+			return r
+		}
+		c.ioSucceeded(client.Addr)
 
-	if err = r.Err; err == nil {
-		return r
-	}
+		// Here we deal with application errors that are either MOVED or ASK,
+		// or TRYAGAIN or CLUSTERDOWN
+		var rerr *redis.Error
+		if !errors.As(err, &rerr) {
+			return r
+		}
 
-	// Deal with network error
-	if r.IsType(redis.IOErr) {
-		c.checkFaulty()
-		// Give up and return the most recent error
-		// The faulty monitor will recover
-		return r
-	}
+		var addr string
+		if slot, redirectAddr, ok := rerr.Redirect(); ok {
+			if redirects++; redirects > c.o.MaxRedirects {
+				atomic.AddInt64(&c.stats.RedirectsExhausted, 1)
+				return r
+			}
+			ask = errors.Is(rerr, redis.ErrAsk)
+			if ask {
+				atomic.AddInt64(&c.stats.Ask, 1)
+			} else {
+				atomic.AddInt64(&c.stats.Moved, 1)
+			}
+			c.slotMiss(slot, redirectAddr, !ask)
+			addr = redirectAddr
 
-	// Here we deal with application errors that are either MOVED or ASK
-	msg := err.Error()
-	moved := strings.HasPrefix(msg, "MOVED ")
-	ask = strings.HasPrefix(msg, "ASK ")
-	if moved || ask {
-		_, addr := redirectInfo(msg)
-		c.callCh <- func(c *Cluster) {
-			select {
-			case c.MissCh <- struct{}{}:
-			default:
+		} else if errors.Is(rerr, redis.ErrTryAgain) || errors.Is(rerr, redis.ErrClusterDown) {
+			if retries++; retries > c.o.MaxRetries {
+				atomic.AddInt64(&c.stats.RetriesExhausted, 1)
+				return r
 			}
-		}
+			if errors.Is(rerr, redis.ErrTryAgain) {
+				atomic.AddInt64(&c.stats.TryAgain, 1)
+			} else {
+				atomic.AddInt64(&c.stats.ClusterDown, 1)
+			}
+			if sleepErr := c.retrySleep(ctx, retries); sleepErr != nil {
+				return redis.NewRespIOErr(sleepErr)
+			}
+			// The retry starts over from the node the slot is mapped to, any
+			// ASK which led here doesn't apply anymore
+			ask = false
 
-		// If we've already called Reset and we're getting MOVED again than the
-		// cluster is having problems, likely telling us to try a node which is
-		// not reachable. Not much which can be done at this point
-		if haveReset {
-			return errorRespf("Cluster doesn't make sense, %s might be gone", addr)
-		}
-		if resetErr := c.Reset(); resetErr != nil {
-			return errorRespf("Could not get cluster info: %s", resetErr)
+		} else {
+			// It's a normal application error (like WRONG KEY TYPE or
+			// whatever), return that to the client
+			return r
 		}
-		haveReset = true
-
-		// At this point addr is whatever redis told us it should be. However,
-		// if we can't get a connection to it we'll never actually mark it as
-		// tried, resulting in an infinite loop. Here we mark it as tried
-		// regardless of if it actually was or not
-		tried = justTried(tried, addr)
 
-		client, getErr := c.getConn("", addr)
+		cause = err
+		var getErr error
+		if addr != "" {
+			client, getErr = c.getConn(ctx, "", addr)
+		} else {
+			client, getErr = c.getConn(ctx, key, "")
+		}
 		if getErr != nil {
 			return errorResp(getErr)
 		}
-		return c.clientCmd(client, cmd, args, ask, tried, haveReset)
 	}
-
-	// It's a normal application error (like WRONG KEY TYPE or whatever), return
-	// that to the client
-	return r
-}
-
-func redirectInfo(msg string) (int, string) {
-	parts := strings.Split(msg, " ")
-	slotStr := parts[1]
-	slot, err := strconv.Atoi(slotStr)
-	if err != nil {
-		// if redis is returning bad integers, we have problems
-		panic(err)
-	}
-	addr := parts[2]
-	return slot, addr
 }
 
 func keyToAddr(key string, mapping *mapping) string {
@@ -626,7 +786,15 @@ func keyToAddr(key string, mapping *mapping) string {
 // random client is returned. The client must be returned back to its pool using
 // Put when through
 func (c *Cluster) GetForKey(key string) (*redis.Client, error) {
-	return c.getConn(key, "")
+	return c.getConn(context.Background(), key, "")
+}
+
+// GetForAddr returns a Client for the node at the given address, creating a
+// pool for it if the cluster doesn't know about it yet. If there is an error
+// contacting the node, a random client is returned. The client must be
+// returned back to its pool using Put when through
+func (c *Cluster) GetForAddr(addr string) (*redis.Client, error) {
+	return c.getConn(context.Background(), "", addr)
 }
 
 // GetEvery returns a single *redis.Client per master that the cluster currently
@@ -678,6 +846,10 @@ func (c *Cluster) Close() {
 			p.Empty()
 			delete(c.pools, addr)
 		}
+		for addr, p := range c.replicaPools {
+			p.Empty()
+			delete(c.replicaPools, addr)
+		}
 		if c.resetThrottle != nil {
 			c.resetThrottle.Stop()
 		}
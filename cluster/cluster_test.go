@@ -1,12 +1,18 @@
 package cluster
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/hex"
+	"errors"
+	"net"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	. "testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 
 	"github.com/gallir/radix.improved/pool"
 	"github.com/gallir/radix.improved/redis"
@@ -50,6 +56,119 @@ func keyForNode(c *Cluster, addr string) string {
 	}
 }
 
+// fakeNode is a redis.Server pretending to be a node of a cluster, see
+// fakeCluster. While the node is sick it closes the connection of every
+// command instead of replying.
+type fakeNode struct {
+	addr string
+	srv  *redis.Server
+
+	// The slots the node serves if it's a master, or its master if it's a
+	// replica
+	start, end int
+	master     *fakeNode
+
+	sick int32
+}
+
+func (n *fakeNode) setSick(sick bool) {
+	var i int32
+	if sick {
+		i = 1
+	}
+	atomic.StoreInt32(&n.sick, i)
+}
+
+// fakeMaster describes a master started by fakeCluster: the range of slots it
+// serves and its number of replicas. A master whose end is before its start
+// serves no slots, like a node which has just joined the cluster, and isn't
+// listed by CLUSTER SLOTS.
+type fakeMaster struct {
+	start, end int
+	replicas   int
+}
+
+// evenMasters returns n fakeMasters, each serving an equal share of the slots
+func evenMasters(n int) []fakeMaster {
+	masters := make([]fakeMaster, n)
+	for i := range masters {
+		masters[i] = fakeMaster{start: i * NumSlots / n, end: (i+1)*NumSlots/n - 1}
+	}
+	return masters
+}
+
+// fakeCluster starts a fakeNode for each of the given masters and each of
+// their replicas, and returns them with every master followed by its replicas.
+// They all reply to CLUSTER SLOTS with the cluster's layout, and to CLUSTER
+// INFO with it being ok. handle is called with each node, and its index in the
+// returned slice, before the node is started, to add the handlers of whatever
+// other commands the test needs to its ServeMux.
+func fakeCluster(
+	t *T, masters []fakeMaster, handle func(i int, n *fakeNode, mux *redis.ServeMux),
+) []*fakeNode {
+	var nodes []*fakeNode
+	var ls []net.Listener
+	listen := func(n *fakeNode) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.Nil(t, err)
+		n.addr = l.Addr().String()
+		nodes, ls = append(nodes, n), append(ls, l)
+	}
+	for _, m := range masters {
+		master := &fakeNode{start: m.start, end: m.end}
+		listen(master)
+		for i := 0; i < m.replicas; i++ {
+			listen(&fakeNode{master: master})
+		}
+	}
+
+	slots := func() []interface{} {
+		nodeElems := func(n *fakeNode) []interface{} {
+			host, port, _ := net.SplitHostPort(n.addr)
+			p, _ := strconv.Atoi(port)
+			return []interface{}{host, p, n.addr}
+		}
+		var elems []interface{}
+		for _, n := range nodes {
+			if n.master != nil || n.end < n.start {
+				continue
+			}
+			elem := []interface{}{n.start, n.end, nodeElems(n)}
+			for _, r := range nodes {
+				if r.master == n {
+					elem = append(elem, nodeElems(r))
+				}
+			}
+			elems = append(elems, elem)
+		}
+		return elems
+	}
+
+	for i, n := range nodes {
+		n := n
+		mux := redis.NewServeMux()
+		mux.HandleFunc("CLUSTER", func(w redis.ResponseWriter, r *redis.Request) {
+			if strings.EqualFold(string(r.Args[0]), "INFO") {
+				w.WriteResp(redis.NewResp("cluster_state:ok\r\n"))
+				return
+			}
+			w.WriteResp(redis.NewResp(slots()))
+		})
+		handle(i, n, mux)
+
+		n.srv = &redis.Server{Handler: redis.HandlerFunc(func(w redis.ResponseWriter, r *redis.Request) {
+			if atomic.LoadInt32(&n.sick) == 1 {
+				r.Conn.Close()
+				return
+			}
+			mux.ServeRESP(w, r)
+		})}
+		go n.srv.Serve(ls[i])
+		t.Cleanup(func() { n.srv.Close() })
+	}
+	return nodes
+}
+
 const (
 	addr1 = "127.0.0.1:7000"
 	addr2 = "127.0.0.1:7001"
@@ -108,6 +227,52 @@ func TestCmd(t *T) {
 	assert.Equal(t, "foo", s)
 }
 
+func TestCmdKeys(t *T) {
+	cluster := getCluster(t)
+	k1 := keyForNode(cluster, addr1)
+	k2 := keyForNode(cluster, addr2)
+
+	// The script's key is routed to the right node, even though it's not the
+	// first argument
+	r := cluster.Cmd("EVAL", "return redis.call('SET', KEYS[1], 'bar')", 1, k2)
+	assert.Nil(t, r.Err)
+	s, err := cluster.Cmd("GET", k2).Str()
+	assert.Nil(t, err)
+	assert.Equal(t, "bar", s)
+
+	// Keys in different slots are caught before anything is sent
+	r = cluster.Cmd("MGET", k1, k2)
+	assert.True(t, errors.Is(r.Err, redis.ErrCrossSlot))
+	assert.Equal(t, ErrBadCmdNoKey, cluster.Cmd("PING").Err)
+
+	assert.Nil(t, cluster.RefreshCommands())
+}
+
+func TestKeyForCmd(t *T) {
+	c := &Cluster{o: Opts{Commands: redis.DefaultCommandTable}}
+	for _, tc := range []struct {
+		cmd  string
+		args []interface{}
+		key  string
+	}{
+		{"GET", []interface{}{"foo"}, "foo"},
+		{"EVAL", []interface{}{"return 1", 1, "foo"}, "foo"},
+		// Commands without keys are routed on their first argument
+		{"PUBLISH", []interface{}{"ch", "msg"}, "ch"},
+		{"EVAL", []interface{}{"return 1", 0}, "return 1"},
+		{"SCRIPT", []interface{}{"LOAD", "return 1"}, "LOAD"},
+	} {
+		key, err := c.KeyForCmd(tc.cmd, tc.args...)
+		require.Nil(t, err, "%s %v", tc.cmd, tc.args)
+		assert.Equal(t, tc.key, key, "%s %v", tc.cmd, tc.args)
+	}
+
+	_, err := c.KeyForCmd("PING")
+	assert.Equal(t, ErrBadCmdNoKey, err)
+	_, err = c.KeyForCmd("MGET", "a", "b")
+	assert.True(t, errors.Is(err, redis.ErrCrossSlot))
+}
+
 func TestCmdMiss(t *T) {
 	cluster := getCluster(t)
 	key := keyForNode(cluster, addr1)
@@ -117,11 +282,11 @@ func TestCmdMiss(t *T) {
 
 	assert.Nil(t, cluster.Cmd("SET", key, "baz").Err)
 
-	client, err := cluster.getConn("", addr2)
+	client, err := cluster.getConn(context.Background(), "", addr2)
 	assert.Nil(t, err)
 
 	args := []interface{}{key}
-	r := cluster.clientCmd(client, "GET", args, false, nil, false)
+	r := cluster.clientCmd(context.Background(), client, key, "GET", args)
 	s, err := r.Str()
 	assert.Nil(t, err)
 	assert.Equal(t, "baz", s)
@@ -138,9 +303,9 @@ func TestCmdAsk(t *T) {
 	// just in case
 	assert.Nil(t, cluster.Cmd("DEL", key).Err)
 
-	src, err := cluster.getConn("", addr1)
+	src, err := cluster.getConn(context.Background(), "", addr1)
 	assert.Nil(t, err)
-	dst, err := cluster.getConn("", addr2)
+	dst, err := cluster.getConn(context.Background(), "", addr2)
 	assert.Nil(t, err)
 
 	// We need the node ids. Unfortunately, this is the best way to get them
@@ -0,0 +1,301 @@
+package cluster
+
+import (
+	"errors"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var errClusterNotOK = errors.New("cluster_state isn't ok")
+
+// BreakerState is the state of the circuit breaker of a node, which keeps
+// commands from being sent to it while it's failing. While the breaker of a
+// replica is open the reads which would be routed to it according to the
+// ReadPolicy are performed on its master instead, or fail with ErrNoReplica.
+type BreakerState int
+
+// The states a circuit breaker goes through
+const (
+	// The node is healthy, and commands are sent to it
+	BreakerClosed BreakerState = iota
+
+	// The node has failed FaultyThreshold times in a row (see Opts), and
+	// commands for the slots it owns fail with a *NodeUnavailableError
+	// without being sent. The node is probed with CLUSTER INFO every
+	// ProbeInterval until it replies that the cluster is ok.
+	BreakerOpen
+
+	// The node has replied to a probe, and commands are sent to it again. The
+	// next command or probe it replies to closes the breaker, while a network
+	// error opens it again straight away.
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// NodeUnavailableError is returned for commands routed to a master whose
+// circuit breaker is open. errors.Is with ErrClusterUnavailable works on it,
+// though only the slots owned by that master are unavailable.
+type NodeUnavailableError struct {
+	Addr string
+}
+
+func (e *NodeUnavailableError) Error() string {
+	return "cluster node " + e.Addr + " not available"
+}
+
+// Is makes errors.Is(err, ErrClusterUnavailable) true
+func (e *NodeUnavailableError) Is(target error) bool {
+	return target == ErrClusterUnavailable
+}
+
+// NodeHealth describes the health of a master, as returned by the Cluster's
+// NodeHealth method
+type NodeHealth struct {
+	Addr  string
+	State BreakerState
+
+	// The number of slots the master owns
+	Slots int
+
+	// The number of network errors in a row the master has had, and the most
+	// recent one. LastErr isn't cleared once the master recovers.
+	Failures int
+	LastErr  error
+
+	// When the breaker entered its current state, zero if it never left
+	// BreakerClosed
+	Since time.Time
+}
+
+// NodeHealth returns the health of every master the Cluster knows of, sorted
+// by address
+func (c *Cluster) NodeHealth() []NodeHealth {
+	respCh := make(chan []NodeHealth)
+	c.callCh <- func(c *Cluster) {
+		slots := map[string]int{}
+		for _, addr := range c.mapping {
+			slots[addr]++
+		}
+		nhs := make([]NodeHealth, 0, len(c.pools))
+		for addr := range c.pools {
+			nh := NodeHealth{Addr: addr, Slots: slots[addr]}
+			if b := c.breakerOf(addr); b != nil {
+				b.mu.Lock()
+				nh.State, nh.Failures = b.state, b.failures
+				nh.LastErr, nh.Since = b.lastErr, b.since
+				b.mu.Unlock()
+			}
+			nhs = append(nhs, nh)
+		}
+		respCh <- nhs
+	}
+	nhs := <-respCh
+	sort.Slice(nhs, func(i, j int) bool { return nhs[i].Addr < nhs[j].Addr })
+	return nhs
+}
+
+// breaker is the circuit breaker of a single node. Breakers are only
+// created once their node has a network error, and are kept in a sync.Map
+// so commands can check them without going through spin.
+type breaker struct {
+	mu       sync.Mutex
+	state    BreakerState
+	failures int
+	lastErr  error
+	since    time.Time
+	probing  bool
+}
+
+// breakerOf returns the breaker of the node at the given address, or nil if
+// it never had a network error
+func (c *Cluster) breakerOf(addr string) *breaker {
+	if b, ok := c.breakers.Load(addr); ok {
+		return b.(*breaker)
+	}
+	return nil
+}
+
+// nodeAvailable returns whether commands may be sent to the node at the given
+// address
+func (c *Cluster) nodeAvailable(addr string) bool {
+	b := c.breakerOf(addr)
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state != BreakerOpen
+}
+
+// ioFailed is called whenever a command on the node at the given address fails
+// with a network error. Once FaultyThreshold of them have happened in a row,
+// or one happens while the breaker is half-open, the node's breaker opens.
+func (c *Cluster) ioFailed(addr string, err error) {
+	atomic.AddInt64(&c.stats.IOErrs, 1)
+	v, _ := c.breakers.LoadOrStore(addr, &breaker{})
+	b := v.(*breaker)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	b.lastErr = err
+	if b.state == BreakerOpen {
+		return
+	} else if b.state == BreakerClosed && b.failures < c.o.FaultyThreshold {
+		return
+	}
+	b.setState(BreakerOpen)
+	log.Printf("Cluster %s node %s unavailable: %s", c.o.Addr, addr, err)
+	if !b.probing {
+		b.probing = true
+		go c.probeNode(addr, b)
+	}
+}
+
+// ioSucceeded is called whenever the node at the given address replies to a
+// command, even with an error
+func (c *Cluster) ioSucceeded(addr string) {
+	if b := c.breakerOf(addr); b != nil {
+		b.succeeded(c.o.Addr, addr)
+	}
+}
+
+func (b *breaker) setState(s BreakerState) {
+	b.state = s
+	b.since = time.Now()
+}
+
+func (b *breaker) succeeded(clusterAddr, addr string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+	if b.state != BreakerClosed {
+		b.setState(BreakerClosed)
+		log.Printf("Cluster %s node %s recovered", clusterAddr, addr)
+	}
+}
+
+// probeNode probes the node at the given address every ProbeInterval for as
+// long as its breaker is open. Once it's probed successfully the breaker goes
+// half-open, and the next successful probe closes it. Every other failed probe
+// the topology is reset, in case the node's slots have been failed over to
+// another master, and once the node is neither a master nor a replica anymore
+// its breaker is dropped.
+func (c *Cluster) probeNode(addr string, b *breaker) {
+	var failures int
+	for {
+		select {
+		case <-time.After(c.o.ProbeInterval):
+		case <-c.stopCh:
+			b.stopProbing()
+			return
+		}
+
+		b.mu.Lock()
+		if b.state == BreakerClosed {
+			// A command got through while the breaker was half-open
+			b.probing = false
+			b.mu.Unlock()
+			return
+		}
+		b.mu.Unlock()
+
+		respCh := make(chan clusterPool, 1)
+		select {
+		case c.callCh <- func(c *Cluster) {
+			p, ok := c.pools[addr]
+			if !ok {
+				p = c.replicaPools[addr]
+			}
+			respCh <- p
+		}:
+		case <-c.stopCh:
+			b.stopProbing()
+			return
+		}
+		p := <-respCh
+		if p.Pool == nil {
+			c.breakers.Delete(addr)
+			b.stopProbing()
+			return
+		}
+
+		if err := probe(p); err != nil {
+			b.mu.Lock()
+			b.lastErr = err
+			if b.state == BreakerHalfOpen {
+				b.setState(BreakerOpen)
+			}
+			b.mu.Unlock()
+
+			if failures++; failures%2 == 0 {
+				log.Printf("Trying reset on cluster %s after %d failed probes of %s", c.o.Addr, failures, addr)
+				select {
+				case c.callCh <- func(c *Cluster) { c.resetInner() }:
+				case <-c.stopCh:
+					b.stopProbing()
+					return
+				}
+			}
+			continue
+		}
+
+		b.mu.Lock()
+		if b.state == BreakerOpen {
+			b.setState(BreakerHalfOpen)
+			b.mu.Unlock()
+			continue
+		}
+		b.probing = false
+		recovered := b.state == BreakerHalfOpen
+		if recovered {
+			b.failures = 0
+			b.setState(BreakerClosed)
+		}
+		b.mu.Unlock()
+		if recovered {
+			log.Printf("Cluster %s node %s recovered", c.o.Addr, addr)
+		}
+		return
+	}
+}
+
+// stopProbing marks the breaker as no longer being probed
+func (b *breaker) stopProbing() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+}
+
+// probe performs CLUSTER INFO on a connection from the given pool, and returns
+// an error unless the node replies that the cluster is ok
+func probe(p clusterPool) error {
+	client, err := p.Get()
+	if err != nil {
+		return err
+	}
+	defer p.Put(client)
+	info, err := client.Cmd("CLUSTER", "INFO").Str()
+	if err != nil {
+		return err
+	} else if !strings.Contains(info, "cluster_state:ok") {
+		return errClusterNotOK
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+package cluster
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	. "testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/gallir/radix.improved/pool"
+	"github.com/gallir/radix.improved/redis"
+)
+
+// fakeSickCluster starts two masters, each serving half of the slots. GET and
+// MGET reply with the node's name, "a" or "b".
+func fakeSickCluster(t *T) []*fakeNode {
+	return fakeCluster(t, evenMasters(2), func(i int, n *fakeNode, mux *redis.ServeMux) {
+		name := string(rune('a' + i))
+		mux.HandleFunc("GET", func(w redis.ResponseWriter, r *redis.Request) {
+			w.WriteResp(redis.NewResp(name))
+		})
+		mux.HandleFunc("MGET", func(w redis.ResponseWriter, r *redis.Request) {
+			vals := make([]string, len(r.Args))
+			for i := range vals {
+				vals[i] = name
+			}
+			w.WriteResp(redis.NewResp(vals))
+		})
+	})
+}
+
+// keyInSlots returns a key belonging to one of the slots of the given node
+func keyInSlots(node *fakeNode) string {
+	for i := 0; ; i++ {
+		key := "key" + strconv.Itoa(i)
+		if slot := int(Slot(key)); slot >= node.start && slot <= node.end {
+			return key
+		}
+	}
+}
+
+func TestCircuitBreaker(t *T) {
+	nodes := fakeSickCluster(t)
+	c, err := NewWithOpts(Opts{
+		Addr:            nodes[0].addr,
+		FaultyThreshold: 2,
+		ProbeInterval:   20 * time.Millisecond,
+	})
+	require.Nil(t, err)
+	defer c.Close()
+
+	keyA, keyB := keyInSlots(nodes[0]), keyInSlots(nodes[1])
+	nodes[1].setSick(true)
+
+	// The breaker only opens once the threshold is reached
+	for i := 0; i < 2; i++ {
+		r := c.Cmd("GET", keyB)
+		assert.True(t, r.IsType(redis.IOErr), "err: %v", r.Err)
+	}
+	err = c.Cmd("GET", keyB).Err
+	var nerr *NodeUnavailableError
+	require.True(t, errors.As(err, &nerr), "err: %v", err)
+	assert.Equal(t, nodes[1].addr, nerr.Addr)
+	assert.True(t, errors.Is(err, ErrClusterUnavailable))
+
+	// The other node's slots are unaffected
+	s, err := c.Cmd("GET", keyA).Str()
+	require.Nil(t, err)
+	assert.Equal(t, "a", s)
+
+	rr, err := c.MGet(keyA, keyB)
+	var merr *MultiKeyError
+	require.True(t, errors.As(err, &merr), "err: %v", err)
+	assert.Len(t, merr.Errs, 1)
+	assert.True(t, errors.Is(merr.Errs[keyB], ErrClusterUnavailable))
+	s, err = rr[0].Str()
+	require.Nil(t, err)
+	assert.Equal(t, "a", s)
+
+	nhs := c.NodeHealth()
+	require.Len(t, nhs, 2)
+	byAddr := map[string]NodeHealth{}
+	for _, nh := range nhs {
+		byAddr[nh.Addr] = nh
+	}
+	healthy, sick := byAddr[nodes[0].addr], byAddr[nodes[1].addr]
+	assert.Equal(t, BreakerClosed, healthy.State)
+	assert.Equal(t, NumSlots/2, healthy.Slots)
+	assert.Equal(t, BreakerOpen, sick.State)
+	assert.Equal(t, NumSlots/2, sick.Slots)
+	assert.True(t, sick.Failures >= 2)
+	assert.NotNil(t, sick.LastErr)
+	assert.False(t, sick.Since.IsZero())
+
+	// Once the node is well again the probes close its breaker, going through
+	// half-open first
+	nodes[1].setSick(false)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var state BreakerState
+		for _, nh := range c.NodeHealth() {
+			if nh.Addr == nodes[1].addr {
+				state = nh.State
+			}
+		}
+		if state == BreakerClosed {
+			break
+		}
+		require.True(t, time.Now().Before(deadline), "breaker still %s", state)
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	s, err = c.Cmd("GET", keyB).Str()
+	require.Nil(t, err)
+	assert.Equal(t, "b", s)
+}
+
+func TestProbe(t *T) {
+	infoCh := make(chan *redis.Resp, 1)
+	mux := redis.NewServeMux()
+	mux.HandleFunc("CLUSTER", func(w redis.ResponseWriter, r *redis.Request) {
+		w.WriteResp(<-infoCh)
+	})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	s := &redis.Server{Handler: mux}
+	go s.Serve(l)
+	defer s.Close()
+
+	p, err := pool.New("tcp", l.Addr().String(), 1)
+	require.Nil(t, err)
+	defer p.Empty()
+	cp := newClusterPool(p)
+
+	infoCh <- redis.NewResp("cluster_enabled:1\r\ncluster_state:ok\r\n")
+	assert.Nil(t, probe(cp))
+	infoCh <- redis.NewResp("cluster_enabled:1\r\ncluster_state:fail\r\n")
+	assert.Equal(t, errClusterNotOK, probe(cp))
+
+	// Only a string reply will do
+	infoCh <- redis.NewResp([]string{"cluster_state:ok"})
+	assert.NotNil(t, probe(cp))
+	infoCh <- redis.NewResp(&redis.Error{Code: "ERR", Msg: "cluster_state:ok"})
+	assert.NotNil(t, probe(cp))
+}
+
+func TestBreakerHalfOpen(t *T) {
+	c := &Cluster{o: Opts{FaultyThreshold: 3}, stats: &Stats{}}
+	b := &breaker{state: BreakerHalfOpen, probing: true}
+	c.breakers.Store("node", b)
+
+	// A single failure while half-open opens the breaker again
+	c.ioFailed("node", errors.New("boom"))
+	assert.Equal(t, BreakerOpen, b.state)
+	assert.False(t, c.nodeAvailable("node"))
+
+	// While a reply from the node closes it
+	b.setState(BreakerHalfOpen)
+	assert.True(t, c.nodeAvailable("node"))
+	c.ioSucceeded("node")
+	assert.Equal(t, BreakerClosed, b.state)
+	assert.Equal(t, 0, b.failures)
+	assert.True(t, c.nodeAvailable("unknown"))
+}
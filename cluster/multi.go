@@ -0,0 +1,285 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gallir/radix.improved/redis"
+)
+
+// MultiKeyError is returned from the multi-key methods (MGet, MSet, Del,
+// etc...) when the command failed for some of the keys, while it may have
+// succeeded for the others. It holds the error of each key which failed.
+type MultiKeyError struct {
+	Errs map[string]error
+}
+
+func (e *MultiKeyError) Error() string {
+	keys := make([]string, 0, len(e.Errs))
+	for key := range e.Errs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var first error
+	if len(keys) > 0 {
+		first = e.Errs[keys[0]]
+	}
+	return fmt.Sprintf(
+		"command failed for %d key(s) (%s): %v",
+		len(keys), strings.Join(keys, ", "), first,
+	)
+}
+
+// slotCmd is the command performed for the keys of a multi-key command which
+// belong to a single slot
+type slotCmd struct {
+	key  string
+	args []interface{}
+
+	// The indexes of the slot's keys within the keys given to the multi-key
+	// method
+	idxs []int
+
+	r *redis.Resp
+}
+
+// scatter performs the given command once for each slot the given keys belong
+// to, with the arguments argsOf returns for each of the slot's keys. The
+// commands for the slots of a single node are pipelined on one of its
+// connections, and all nodes are sent their commands at once. Commands which
+// get redirected are performed again using CmdContext, which follows the
+// redirect.
+func (c *Cluster) scatter(
+	ctx context.Context, cmd string, keys []string,
+	argsOf func(i int) []interface{},
+) []*slotCmd {
+	var cmds []*slotCmd
+	bySlot := map[uint16]*slotCmd{}
+	for i, key := range keys {
+		slot := Slot(key)
+		sc, ok := bySlot[slot]
+		if !ok {
+			sc = &slotCmd{key: key}
+			bySlot[slot] = sc
+			cmds = append(cmds, sc)
+		}
+		sc.args = append(sc.args, argsOf(i)...)
+		sc.idxs = append(sc.idxs, i)
+	}
+
+	respCh := make(chan map[string][]*slotCmd)
+	c.callCh <- func(c *Cluster) {
+		byAddr := map[string][]*slotCmd{}
+		for _, sc := range cmds {
+			addr := keyToAddr(sc.key, &c.mapping)
+			byAddr[addr] = append(byAddr[addr], sc)
+		}
+		respCh <- byAddr
+	}
+	byAddr := <-respCh
+
+	var wg sync.WaitGroup
+	for addr, scs := range byAddr {
+		wg.Add(1)
+		go func(addr string, scs []*slotCmd) {
+			defer wg.Done()
+			c.scatterNode(ctx, cmd, addr, scs)
+		}(addr, scs)
+	}
+	wg.Wait()
+	return cmds
+}
+
+// scatterNode pipelines the given commands on a connection to the node at the
+// given address
+func (c *Cluster) scatterNode(
+	ctx context.Context, cmd, addr string, scs []*slotCmd,
+) {
+	var client *redis.Client
+	var err error
+	if addr == "" {
+		client, err = c.getConn(ctx, scs[0].key, "")
+	} else {
+		client, err = c.getConn(ctx, "", addr)
+	}
+	if err != nil {
+		for _, sc := range scs {
+			sc.r = errorResp(err)
+		}
+		return
+	}
+
+	for _, sc := range scs {
+		client.PipeAppend(cmd, sc.args...)
+	}
+	var ioErr *redis.Resp
+	for _, sc := range scs {
+		if ioErr != nil {
+			sc.r = ioErr
+			continue
+		}
+		if sc.r = client.PipeRespContext(ctx); sc.r.IsType(redis.IOErr) {
+			client.PipeClear()
+			ioErr = sc.r
+		}
+	}
+	c.Put(client)
+
+	if ioErr != nil {
+		if ctx.Err() == nil {
+			c.ioFailed(client.Addr, ioErr.Err)
+		}
+		return
+	}
+	c.ioSucceeded(client.Addr)
+	for _, sc := range scs {
+		if isRedirect(sc.r.Err) {
+			sc.r = c.CmdContext(ctx, cmd, sc.args...)
+		}
+	}
+}
+
+// MGet performs MGET for the given keys, which may belong to any number of
+// slots. The reply of each key is returned in the same order as the keys, and
+// is of type Nil if the key doesn't exist. If the command failed for some of
+// the keys their replies hold the error, and a *MultiKeyError is returned.
+func (c *Cluster) MGet(keys ...string) ([]*redis.Resp, error) {
+	return c.MGetContext(context.Background(), keys...)
+}
+
+// MGetContext is like MGet, but with a context, see CmdContext
+func (c *Cluster) MGetContext(
+	ctx context.Context, keys ...string,
+) (
+	[]*redis.Resp, error,
+) {
+	rr := make([]*redis.Resp, len(keys))
+	errs := map[string]error{}
+	cmds := c.scatter(ctx, "MGET", keys, func(i int) []interface{} {
+		return []interface{}{keys[i]}
+	})
+	for _, sc := range cmds {
+		arr, err := sc.r.Array()
+		if err == nil && len(arr) != len(sc.idxs) {
+			err = fmt.Errorf("MGET returned %d replies for %d keys", len(arr), len(sc.idxs))
+		}
+		for j, i := range sc.idxs {
+			if err != nil {
+				rr[i] = redis.NewResp(err)
+				errs[keys[i]] = err
+			} else {
+				rr[i] = arr[j]
+			}
+		}
+	}
+	return rr, multiKeyErr(errs)
+}
+
+// MSet performs MSET for the given key/value pairs, which may belong to any
+// number of slots. The arguments are flattened the same way as with Cmd, so
+// they may be given as a map as well. The keys are set atomically within each
+// slot, but not across slots. If the command failed for some of the keys a
+// *MultiKeyError is returned.
+func (c *Cluster) MSet(pairs ...interface{}) error {
+	return c.MSetContext(context.Background(), pairs...)
+}
+
+// MSetContext is like MSet, but with a context, see CmdContext
+func (c *Cluster) MSetContext(ctx context.Context, pairs ...interface{}) error {
+	kvs, err := redis.NewRespFlattenedStrings(pairs).List()
+	if err != nil {
+		return err
+	} else if len(kvs)%2 != 0 {
+		return fmt.Errorf("MSET needs an even number of arguments, got %d", len(kvs))
+	}
+
+	keys := make([]string, len(kvs)/2)
+	for i := range keys {
+		keys[i] = kvs[i*2]
+	}
+	errs := map[string]error{}
+	cmds := c.scatter(ctx, "MSET", keys, func(i int) []interface{} {
+		return []interface{}{kvs[i*2], kvs[i*2+1]}
+	})
+	for _, sc := range cmds {
+		if sc.r.Err != nil {
+			for _, i := range sc.idxs {
+				errs[keys[i]] = sc.r.Err
+			}
+		}
+	}
+	return multiKeyErr(errs)
+}
+
+// Del performs DEL for the given keys, which may belong to any number of
+// slots, and returns the number of keys which were deleted. If the command
+// failed for some of the keys a *MultiKeyError is returned, along with the
+// number of the other keys which were deleted.
+func (c *Cluster) Del(keys ...string) (int, error) {
+	return c.DelContext(context.Background(), keys...)
+}
+
+// DelContext is like Del, but with a context, see CmdContext
+func (c *Cluster) DelContext(ctx context.Context, keys ...string) (int, error) {
+	return c.countKeys(ctx, "DEL", keys)
+}
+
+// Unlink is like Del, but performs UNLINK
+func (c *Cluster) Unlink(keys ...string) (int, error) {
+	return c.UnlinkContext(context.Background(), keys...)
+}
+
+// UnlinkContext is like Unlink, but with a context, see CmdContext
+func (c *Cluster) UnlinkContext(ctx context.Context, keys ...string) (int, error) {
+	return c.countKeys(ctx, "UNLINK", keys)
+}
+
+// Exists performs EXISTS for the given keys, which may belong to any number of
+// slots, and returns the number of keys which exist. As with redis, a key
+// given more than once is counted as many times. If the command failed for
+// some of the keys a *MultiKeyError is returned, along with the number of the
+// other keys which exist.
+func (c *Cluster) Exists(keys ...string) (int, error) {
+	return c.ExistsContext(context.Background(), keys...)
+}
+
+// ExistsContext is like Exists, but with a context, see CmdContext
+func (c *Cluster) ExistsContext(ctx context.Context, keys ...string) (int, error) {
+	return c.countKeys(ctx, "EXISTS", keys)
+}
+
+// countKeys performs a multi-key command which replies with a number of keys,
+// and returns the sum of those numbers
+func (c *Cluster) countKeys(
+	ctx context.Context, cmd string, keys []string,
+) (
+	int, error,
+) {
+	var total int
+	errs := map[string]error{}
+	cmds := c.scatter(ctx, cmd, keys, func(i int) []interface{} {
+		return []interface{}{keys[i]}
+	})
+	for _, sc := range cmds {
+		n, err := sc.r.Int()
+		if err != nil {
+			for _, i := range sc.idxs {
+				errs[keys[i]] = err
+			}
+			continue
+		}
+		total += n
+	}
+	return total, multiKeyErr(errs)
+}
+
+func multiKeyErr(errs map[string]error) error {
+	if len(errs) == 0 {
+		return nil
+	}
+	return &MultiKeyError{Errs: errs}
+}
@@ -0,0 +1,209 @@
+package cluster
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	. "testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/gallir/radix.improved/redis"
+)
+
+// kvNode is a fakeNode master which implements a few commands on an in-memory
+// key/value store, and like redis replies with MOVED for keys of the slots it
+// doesn't serve, and CROSSSLOT for keys of different slots.
+type kvNode struct {
+	*fakeNode
+
+	mu sync.Mutex
+	kv map[string]string
+}
+
+// fakeKVCluster starts n kvNodes, each serving an equal share of the slots,
+// and returns them
+func fakeKVCluster(t *T, n int) []*kvNode {
+	nodes := make([]*kvNode, n)
+	for i := range nodes {
+		nodes[i] = &kvNode{kv: map[string]string{}}
+	}
+	owner := func(slot uint16) *kvNode {
+		for _, node := range nodes {
+			if int(slot) >= node.start && int(slot) <= node.end {
+				return node
+			}
+		}
+		return nil
+	}
+
+	fakeCluster(t, evenMasters(n), func(i int, fn *fakeNode, mux *redis.ServeMux) {
+		node := nodes[i]
+		node.fakeNode = fn
+
+		// keyed wraps a handler, making sure the keys at the given step are
+		// all in a slot the node serves
+		keyed := func(step int, fn func(args []string) interface{}) redis.HandlerFunc {
+			return func(w redis.ResponseWriter, r *redis.Request) {
+				var args []string
+				for _, a := range r.Args {
+					args = append(args, string(a))
+				}
+				slot := Slot(args[0])
+				for i := 0; i < len(args); i += step {
+					if Slot(args[i]) != slot {
+						w.WriteResp(redis.NewResp(errCrossSlot))
+						return
+					}
+				}
+				if o := owner(slot); o != node {
+					w.WriteResp(redis.NewResp(&redis.Error{
+						Code: "MOVED",
+						Msg:  strconv.Itoa(int(slot)) + " " + o.addr,
+					}))
+					return
+				}
+				node.mu.Lock()
+				defer node.mu.Unlock()
+				w.WriteResp(redis.NewResp(fn(args)))
+			}
+		}
+		mux.Handle("GET", keyed(1, func(args []string) interface{} {
+			if v, ok := node.kv[args[0]]; ok {
+				return v
+			}
+			return nil
+		}))
+		mux.Handle("SET", keyed(2, func(args []string) interface{} {
+			node.kv[args[0]] = args[1]
+			return redis.NewRespSimple("OK")
+		}))
+		mux.Handle("MGET", keyed(1, func(args []string) interface{} {
+			vals := make([]interface{}, len(args))
+			for i, key := range args {
+				if v, ok := node.kv[key]; ok {
+					vals[i] = v
+				}
+			}
+			return vals
+		}))
+		mux.Handle("MSET", keyed(2, func(args []string) interface{} {
+			for i := 0; i < len(args); i += 2 {
+				node.kv[args[i]] = args[i+1]
+			}
+			return redis.NewRespSimple("OK")
+		}))
+		count := func(del bool) redis.HandlerFunc {
+			return keyed(1, func(args []string) interface{} {
+				var n int
+				for _, key := range args {
+					if _, ok := node.kv[key]; ok {
+						n++
+						if del {
+							delete(node.kv, key)
+						}
+					}
+				}
+				return n
+			})
+		}
+		mux.HandleFunc("PING", func(w redis.ResponseWriter, r *redis.Request) {
+			w.WriteResp(redis.NewRespSimple("PONG"))
+		})
+		mux.HandleFunc("DBSIZE", func(w redis.ResponseWriter, r *redis.Request) {
+			node.mu.Lock()
+			defer node.mu.Unlock()
+			w.WriteResp(redis.NewResp(len(node.kv)))
+		})
+		mux.HandleFunc("KEYS", func(w redis.ResponseWriter, r *redis.Request) {
+			node.mu.Lock()
+			defer node.mu.Unlock()
+			keys := []string{}
+			for key := range node.kv {
+				keys = append(keys, key)
+			}
+			w.WriteResp(redis.NewResp(keys))
+		})
+		mux.HandleFunc("FLUSHALL", func(w redis.ResponseWriter, r *redis.Request) {
+			node.mu.Lock()
+			defer node.mu.Unlock()
+			node.kv = map[string]string{}
+			w.WriteResp(redis.NewRespSimple("OK"))
+		})
+		mux.Handle("DEL", count(true))
+		mux.Handle("UNLINK", count(true))
+		mux.Handle("EXISTS", count(false))
+	})
+	return nodes
+}
+
+func TestMultiKey(t *T) {
+	nodes := fakeKVCluster(t, 3)
+	c, err := New(nodes[0].addr)
+	require.Nil(t, err)
+	defer c.Close()
+
+	var keys []string
+	var pairs []interface{}
+	for i := 0; i < 30; i++ {
+		key := "key" + strconv.Itoa(i)
+		keys = append(keys, key)
+		pairs = append(pairs, key, i)
+	}
+	require.Nil(t, c.MSet(pairs...))
+
+	rr, err := c.MGet(append(keys, "missing")...)
+	require.Nil(t, err)
+	require.Len(t, rr, 31)
+	for i := range keys {
+		n, err := rr[i].Int()
+		require.Nil(t, err)
+		assert.Equal(t, i, n)
+	}
+	assert.True(t, rr[30].IsType(redis.Nil))
+
+	n, err := c.Exists(keys[0], keys[0], keys[1], "missing")
+	require.Nil(t, err)
+	assert.Equal(t, 3, n)
+	n, err = c.Del(keys[:10]...)
+	require.Nil(t, err)
+	assert.Equal(t, 10, n)
+	n, err = c.Unlink(keys...)
+	require.Nil(t, err)
+	assert.Equal(t, 20, n)
+}
+
+func TestMultiKeyPartialFailure(t *T) {
+	nodes := fakeKVCluster(t, 2)
+	c, err := New(nodes[0].addr)
+	require.Nil(t, err)
+	defer c.Close()
+
+	var keys []string
+	var pairs []interface{}
+	for i := 0; i < 20; i++ {
+		key := "key" + strconv.Itoa(i)
+		keys = append(keys, key)
+		pairs = append(pairs, key, i)
+	}
+	require.Nil(t, c.MSet(pairs...))
+
+	nodes[1].srv.Close()
+	rr, err := c.MGet(keys...)
+	var mkErr *MultiKeyError
+	require.True(t, errors.As(err, &mkErr))
+
+	for i, key := range keys {
+		_, failed := mkErr.Errs[key]
+		if int(Slot(key)) <= nodes[0].end {
+			n, err := rr[i].Int()
+			require.Nil(t, err)
+			assert.Equal(t, i, n)
+			assert.False(t, failed)
+		} else {
+			assert.NotNil(t, rr[i].Err)
+			assert.True(t, failed)
+		}
+	}
+}
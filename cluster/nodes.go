@@ -0,0 +1,290 @@
+package cluster
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gallir/radix.improved/redis"
+)
+
+// ErrUnknownNode is returned from CmdNode when the Cluster doesn't know of a
+// node with the given address
+var ErrUnknownNode = errors.New("unknown cluster node")
+
+// NodeReplies holds the reply of each node a command was performed on by
+// CmdAll or CmdAllWithReplicas, keyed by the node's address
+type NodeReplies map[string]*redis.Resp
+
+// NodesError is returned from the methods of NodeReplies when the command
+// failed on some of the nodes. It holds the error of each node which failed,
+// keyed by the node's address.
+type NodesError struct {
+	Errs map[string]error
+}
+
+func (e *NodesError) Error() string {
+	addrs := make([]string, 0, len(e.Errs))
+	for addr := range e.Errs {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+
+	var first error
+	if len(addrs) > 0 {
+		first = e.Errs[addrs[0]]
+	}
+	return fmt.Sprintf(
+		"command failed on %d node(s) (%s): %v",
+		len(addrs), strings.Join(addrs, ", "), first,
+	)
+}
+
+// addrs returns the addresses of the nodes, sorted
+func (nr NodeReplies) addrs() []string {
+	addrs := make([]string, 0, len(nr))
+	for addr := range nr {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+// Err returns a *NodesError if the command failed on any of the nodes,
+// otherwise nil
+func (nr NodeReplies) Err() error {
+	errs := map[string]error{}
+	for addr, r := range nr {
+		if r.Err != nil {
+			errs[addr] = r.Err
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return &NodesError{Errs: errs}
+}
+
+// Sum returns the sum of the integer replies of the nodes, e.g. for DBSIZE. If
+// the command failed on some of the nodes the sum of the others is returned,
+// along with a *NodesError.
+func (nr NodeReplies) Sum() (int64, error) {
+	var total int64
+	errs := map[string]error{}
+	for addr, r := range nr {
+		n, err := r.Int64()
+		if err != nil {
+			errs[addr] = err
+			continue
+		}
+		total += n
+	}
+	if len(errs) > 0 {
+		return total, &NodesError{Errs: errs}
+	}
+	return total, nil
+}
+
+// AllOK returns nil if every node replied with OK, e.g. for FLUSHALL or CONFIG
+// SET, otherwise a *NodesError
+func (nr NodeReplies) AllOK() error {
+	errs := map[string]error{}
+	for addr, r := range nr {
+		if s, err := r.Str(); err != nil {
+			errs[addr] = err
+		} else if s != "OK" {
+			errs[addr] = fmt.Errorf("unexpected reply %q", s)
+		}
+	}
+	if len(errs) > 0 {
+		return &NodesError{Errs: errs}
+	}
+	return nil
+}
+
+// Concat returns the list replies of the nodes concatenated, e.g. for KEYS.
+// The lists are concatenated in the order of the nodes' addresses. If the
+// command failed on some of the nodes the lists of the others are returned,
+// along with a *NodesError.
+func (nr NodeReplies) Concat() ([]string, error) {
+	var all []string
+	errs := map[string]error{}
+	for _, addr := range nr.addrs() {
+		l, err := nr[addr].List()
+		if err != nil {
+			errs[addr] = err
+			continue
+		}
+		all = append(all, l...)
+	}
+	if len(errs) > 0 {
+		return all, &NodesError{Errs: errs}
+	}
+	return all, nil
+}
+
+// CmdNode performs the given command on the node with the given address, which
+// may be a master or, if the Cluster has connections to it, a replica. Unlike
+// with Cmd the command doesn't need to have a key, and isn't redirected. If
+// the Cluster doesn't know of the node a reply with ErrUnknownNode is
+// returned.
+func (c *Cluster) CmdNode(addr, cmd string, args ...interface{}) *redis.Resp {
+	return c.CmdNodeContext(context.Background(), addr, cmd, args...)
+}
+
+// CmdNodeContext is like CmdNode, but with a context, see CmdContext
+func (c *Cluster) CmdNodeContext(
+	ctx context.Context, addr, cmd string, args ...interface{},
+) *redis.Resp {
+	respCh := make(chan clusterPool)
+	c.callCh <- func(c *Cluster) {
+		if p, ok := c.pools[addr]; ok {
+			respCh <- p
+		} else {
+			respCh <- c.replicaPools[addr]
+		}
+	}
+	p := <-respCh
+	if p.Pool == nil {
+		return errorResp(ErrUnknownNode)
+	}
+	return nodeCmd(ctx, p, cmd, args)
+}
+
+// CmdRandom performs the given command on a random master. Unlike with Cmd
+// the command doesn't need to have a key, and isn't redirected.
+func (c *Cluster) CmdRandom(cmd string, args ...interface{}) *redis.Resp {
+	return c.CmdRandomContext(context.Background(), cmd, args...)
+}
+
+// CmdRandomContext is like CmdRandom, but with a context, see CmdContext
+func (c *Cluster) CmdRandomContext(
+	ctx context.Context, cmd string, args ...interface{},
+) *redis.Resp {
+	respCh := make(chan clusterPool)
+	c.callCh <- func(c *Cluster) {
+		if len(c.pools) == 0 {
+			respCh <- clusterPool{}
+			return
+		}
+		var i int
+		n := rand.Intn(len(c.pools))
+		for _, p := range c.pools {
+			if i == n {
+				respCh <- p
+				return
+			}
+			i++
+		}
+	}
+	p := <-respCh
+	if p.Pool == nil {
+		return errorResp(ErrClusterUnavailable)
+	}
+	return nodeCmd(ctx, p, cmd, args)
+}
+
+// CmdAll performs the given command on every master at once, and returns the
+// reply of each. The methods of NodeReplies can be used to check for errors
+// and to combine the replies. Unlike with Cmd the command doesn't need to have
+// a key.
+//
+//	n, err := c.CmdAll("DBSIZE").Sum()
+//	err = c.CmdAll("FLUSHALL").AllOK()
+//	keys, err := c.CmdAll("KEYS", "user:*").Concat()
+//
+func (c *Cluster) CmdAll(cmd string, args ...interface{}) NodeReplies {
+	return c.CmdAllContext(context.Background(), cmd, args...)
+}
+
+// CmdAllContext is like CmdAll, but with a context, see CmdContext
+func (c *Cluster) CmdAllContext(
+	ctx context.Context, cmd string, args ...interface{},
+) NodeReplies {
+	return c.cmdAll(ctx, false, cmd, args)
+}
+
+// CmdAllWithReplicas is like CmdAll, but the command is performed on every
+// replica as well, using connections on which READONLY has been performed. A
+// replica which can't be connected to gets an error reply.
+func (c *Cluster) CmdAllWithReplicas(cmd string, args ...interface{}) NodeReplies {
+	return c.CmdAllWithReplicasContext(context.Background(), cmd, args...)
+}
+
+// CmdAllWithReplicasContext is like CmdAllWithReplicas, but with a context,
+// see CmdContext
+func (c *Cluster) CmdAllWithReplicasContext(
+	ctx context.Context, cmd string, args ...interface{},
+) NodeReplies {
+	return c.cmdAll(ctx, true, cmd, args)
+}
+
+func (c *Cluster) cmdAll(
+	ctx context.Context, withReplicas bool, cmd string, args []interface{},
+) NodeReplies {
+	type resp struct {
+		pools map[string]clusterPool
+		errs  map[string]error
+	}
+	respCh := make(chan resp)
+	c.callCh <- func(c *Cluster) {
+		r := resp{pools: map[string]clusterPool{}, errs: map[string]error{}}
+		for addr, p := range c.pools {
+			r.pools[addr] = p
+		}
+		if withReplicas {
+			for _, addrs := range c.replicas {
+				for _, addr := range addrs {
+					p, ok := c.replicaPools[addr]
+					if !ok {
+						var err error
+						if p, err = c.newPool(addr, false, true); err != nil {
+							r.errs[addr] = err
+							continue
+						}
+						c.replicaPools[addr] = p
+					}
+					r.pools[addr] = p
+				}
+			}
+		}
+		respCh <- r
+	}
+	r := <-respCh
+
+	nr := NodeReplies{}
+	for addr, err := range r.errs {
+		nr[addr] = errorResp(err)
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for addr, p := range r.pools {
+		wg.Add(1)
+		go func(addr string, p clusterPool) {
+			defer wg.Done()
+			reply := nodeCmd(ctx, p, cmd, args)
+			mu.Lock()
+			nr[addr] = reply
+			mu.Unlock()
+		}(addr, p)
+	}
+	wg.Wait()
+	return nr
+}
+
+// nodeCmd performs the command on a connection from the given pool
+func nodeCmd(
+	ctx context.Context, p clusterPool, cmd string, args []interface{},
+) *redis.Resp {
+	client, err := p.GetContext(ctx)
+	if err != nil {
+		return errorResp(err)
+	}
+	defer p.Put(client)
+	return client.CmdContext(ctx, cmd, args...)
+}
@@ -0,0 +1,84 @@
+package cluster
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	. "testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCmdAll(t *T) {
+	nodes := fakeKVCluster(t, 3)
+	c, err := New(nodes[0].addr)
+	require.Nil(t, err)
+	defer c.Close()
+
+	var keys []string
+	for i := 0; i < 20; i++ {
+		key := "key" + strconv.Itoa(i)
+		keys = append(keys, key)
+		require.Nil(t, c.Cmd("SET", key, i).Err)
+	}
+
+	nr := c.CmdAll("PING")
+	require.Nil(t, nr.Err())
+	assert.Len(t, nr, 3)
+
+	n, err := c.CmdAll("DBSIZE").Sum()
+	require.Nil(t, err)
+	assert.Equal(t, int64(20), n)
+
+	all, err := c.CmdAll("KEYS", "*").Concat()
+	require.Nil(t, err)
+	sort.Strings(all)
+	sort.Strings(keys)
+	assert.Equal(t, keys, all)
+
+	// AllOK catches a node whose reply isn't OK
+	assert.NotNil(t, c.CmdAll("PING").AllOK())
+	require.Nil(t, c.CmdAll("FLUSHALL").AllOK())
+	n, err = c.CmdAll("DBSIZE").Sum()
+	require.Nil(t, err)
+	assert.Equal(t, int64(0), n)
+
+	s, err := c.CmdNode(nodes[1].addr, "PING").Str()
+	require.Nil(t, err)
+	assert.Equal(t, "PONG", s)
+	assert.Equal(t, ErrUnknownNode, c.CmdNode("127.0.0.1:1", "PING").Err)
+	s, err = c.CmdRandom("PING").Str()
+	require.Nil(t, err)
+	assert.Equal(t, "PONG", s)
+
+	// A node failing only affects its own reply
+	nodes[2].srv.Close()
+	_, err = c.CmdAll("DBSIZE").Sum()
+	var nErr *NodesError
+	require.True(t, errors.As(err, &nErr))
+	assert.Len(t, nErr.Errs, 1)
+	assert.NotNil(t, nErr.Errs[nodes[2].addr])
+}
+
+func TestCmdAllWithReplicas(t *T) {
+	master, _ := fakeReplicaCluster(t)
+	c, err := New(master.addr)
+	require.Nil(t, err)
+	defer c.Close()
+
+	nr := c.CmdAll("SET", "foo", "bar")
+	require.Nil(t, nr.Err())
+	assert.Len(t, nr, 1)
+
+	nr = c.CmdAllWithReplicas("SET", "foo", "bar")
+	require.Nil(t, nr.Err())
+	var names []string
+	for _, r := range nr {
+		s, err := r.Str()
+		require.Nil(t, err)
+		names = append(names, s)
+	}
+	sort.Strings(names)
+	assert.Equal(t, []string{"master", "replica"}, names)
+}
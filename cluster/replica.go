@@ -0,0 +1,318 @@
+package cluster
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/gallir/radix.improved/redis"
+)
+
+// ReadPolicy determines which nodes read-only commands are performed on. Since
+// replication is asynchronous, a read performed on a replica might not see
+// the most recent writes made to the master.
+type ReadPolicy int
+
+// The available ReadPolicies
+const (
+	// Reads are performed on the master, like every other command
+	ReadMaster ReadPolicy = iota
+
+	// Reads are performed on a random replica of the key's master, or on the
+	// master itself if it doesn't have any replica which is up
+	ReadPreferReplica
+
+	// Reads are performed on a random replica of the key's master, and fail
+	// with ErrNoReplica if it doesn't have any which is up
+	ReadReplicaOnly
+
+	// Reads are performed on whichever of the key's master and its replicas
+	// has had the lowest latency recently
+	ReadLowestLatency
+
+	// Reads are performed on a random one of the key's master and its
+	// replicas
+	ReadRandom
+)
+
+// ErrNoReplica is returned for reads with the ReadReplicaOnly policy when the
+// key's master has no replica which is up
+var ErrNoReplica = errors.New("no replica available for the key's slot")
+
+// CmdRead is like Cmd, but the command is performed according to the
+// ReadPolicy (see Opts) whether or not the Commands table knows it to be
+// read-only, e.g. for a script which only reads. It's up to the caller to make
+// sure the command doesn't write anything.
+func (c *Cluster) CmdRead(cmd string, args ...interface{}) *redis.Resp {
+	return c.CmdReadContext(context.Background(), cmd, args...)
+}
+
+// CmdReadContext is like CmdRead, but with a context, see CmdContext
+func (c *Cluster) CmdReadContext(
+	ctx context.Context, cmd string, args ...interface{},
+) *redis.Resp {
+	key, err := c.KeyForCmd(cmd, args...)
+	if err != nil {
+		return errorResp(err)
+	}
+	return c.readCmd(ctx, key, cmd, args)
+}
+
+// readCmd performs a read-only command according to the ReadPolicy. If it's
+// performed on a replica which turns out to be down it's performed again on
+// the master, unless the policy is ReadReplicaOnly. A replica failing counts
+// against its own circuit breaker rather than its master's, and once it's open
+// reads aren't routed to the replica until it's been probed healthy again. If
+// the replica redirects the command, because its master doesn't have the slot
+// anymore, it's performed like any other command so that the redirect is
+// followed.
+func (c *Cluster) readCmd(
+	ctx context.Context, key, cmd string, args []interface{},
+) *redis.Resp {
+	client, rc, err := c.getReadConn(ctx, key)
+	if err != nil {
+		return errorResp(err)
+	}
+
+	start := time.Now()
+	if !rc.replica {
+		r := c.clientCmd(ctx, client, key, cmd, args)
+		if !r.IsType(redis.IOErr) {
+			rc.observe(time.Since(start))
+		}
+		return r
+	}
+
+	r := client.CmdContext(ctx, cmd, args...)
+	c.Put(client)
+	if r.IsType(redis.IOErr) {
+		if ctx.Err() != nil {
+			return r
+		}
+		c.ioFailed(rc.addr, r.Err)
+		if c.o.ReadPolicy == ReadReplicaOnly {
+			return r
+		}
+	} else {
+		c.ioSucceeded(rc.addr)
+		if !isRedirect(r.Err) {
+			rc.observe(time.Since(start))
+			return r
+		}
+	}
+
+	if client, err = c.getConn(ctx, key, ""); err != nil {
+		return errorResp(err)
+	}
+	return c.clientCmd(ctx, client, key, cmd, args)
+}
+
+func isRedirect(err error) bool {
+	return errors.Is(err, redis.ErrMoved) || errors.Is(err, redis.ErrAsk)
+}
+
+// readConn describes the node a read was routed to
+type readConn struct {
+	replica bool
+
+	// Only set for a replica
+	addr string
+
+	// Only set with the ReadLowestLatency policy
+	latency *int64
+}
+
+// observe adds the given latency of a read to the moving average of its node
+func (rc readConn) observe(d time.Duration) {
+	if rc.latency == nil {
+		return
+	}
+	old := atomic.LoadInt64(rc.latency)
+	if old == 0 {
+		atomic.StoreInt64(rc.latency, int64(d))
+	} else {
+		atomic.StoreInt64(rc.latency, old+(int64(d)-old)/8)
+	}
+}
+
+// getReadConn returns a connection to the node a read of the given key should
+// be performed on, according to the ReadPolicy
+func (c *Cluster) getReadConn(
+	ctx context.Context, key string,
+) (
+	*redis.Client, readConn, error,
+) {
+	type resp struct {
+		p   clusterPool
+		rc  readConn
+		err error
+	}
+	respCh := make(chan resp)
+	c.callCh <- func(c *Cluster) {
+		master := keyToAddr(key, &c.mapping)
+		var replicas []string
+		for _, addr := range c.replicas[master] {
+			if _, ok := c.replicaPools[addr]; ok && c.nodeAvailable(addr) {
+				replicas = append(replicas, addr)
+			}
+		}
+
+		var addr string
+		switch c.o.ReadPolicy {
+		case ReadPreferReplica, ReadReplicaOnly:
+			if len(replicas) > 0 {
+				addr = replicas[rand.Intn(len(replicas))]
+			} else if c.o.ReadPolicy == ReadReplicaOnly {
+				respCh <- resp{err: ErrNoReplica}
+				return
+			}
+		case ReadRandom:
+			if i := rand.Intn(len(replicas) + 1); i < len(replicas) {
+				addr = replicas[i]
+			}
+		case ReadLowestLatency:
+			addr = c.lowestLatency(master, replicas)
+		}
+
+		rc := readConn{replica: addr != "" && addr != master}
+		if c.o.ReadPolicy == ReadLowestLatency {
+			if addr == "" {
+				addr = master
+			}
+			rc.latency = c.latencyOf(addr)
+		}
+		if !rc.replica {
+			respCh <- resp{rc: rc}
+			return
+		}
+		rc.addr = addr
+		respCh <- resp{p: c.replicaPools[addr], rc: rc}
+	}
+
+	r := <-respCh
+	if r.err != nil {
+		return nil, r.rc, r.err
+	} else if !r.rc.replica {
+		client, err := c.getConn(ctx, key, "")
+		return client, r.rc, err
+	}
+
+	client, err := r.p.GetContext(ctx)
+	if err == nil {
+		return client, r.rc, nil
+	} else if ctx.Err() == nil {
+		c.ioFailed(r.rc.addr, err)
+	}
+	if c.o.ReadPolicy == ReadReplicaOnly {
+		return nil, r.rc, err
+	}
+
+	// The replica is down, the master is used instead
+	r.rc.replica, r.rc.addr = false, ""
+	r.rc.latency = nil
+	client, err = c.getConn(ctx, key, "")
+	return client, r.rc, err
+}
+
+// lowestLatency returns whichever of the master and its replicas has the
+// lowest average latency. Those which haven't been used yet come first, so that
+// each gets measured. Must be called from within spin.
+func (c *Cluster) lowestLatency(master string, replicas []string) string {
+	best, bestLatency := master, atomic.LoadInt64(c.latencyOf(master))
+	for _, addr := range replicas {
+		if l := atomic.LoadInt64(c.latencyOf(addr)); l < bestLatency {
+			best, bestLatency = addr, l
+		}
+	}
+	return best
+}
+
+// latencyOf returns the average latency of the node at the given address,
+// which is zero if it hasn't been measured yet. Must be called from within
+// spin.
+func (c *Cluster) latencyOf(addr string) *int64 {
+	l, ok := c.latencies[addr]
+	if !ok {
+		l = new(int64)
+		c.latencies[addr] = l
+	}
+	return l
+}
+
+// replicaAddrs returns the addresses of the replicas found in the elements
+// following the master of a slot range in the reply to CLUSTER SLOTS
+func replicaAddrs(elems []*redis.Resp) ([]string, error) {
+	var addrs []string
+	for _, elem := range elems {
+		addrElems, err := elem.Array()
+		if err != nil {
+			return nil, err
+		} else if len(addrElems) < 2 {
+			return nil, errors.New("malformed CLUSTER SLOTS response")
+		}
+		ip, err := addrElems[0].Str()
+		if err != nil {
+			return nil, err
+		}
+		port, err := addrElems[1].Int()
+		if err != nil {
+			return nil, err
+		}
+		if ip != "" {
+			addrs = append(addrs, ip+":"+strconv.Itoa(port))
+		}
+	}
+	return addrs, nil
+}
+
+// setReplicas sets the replicas of each master, and empties the pools of the
+// replicas which are gone. Unless the ReadPolicy is ReadMaster a pool is
+// created for every new replica, otherwise they're only created when needed
+// (see CmdAllWithReplicas). A replica whose pool can't be created is skipped,
+// reads just won't be performed on it until the next reset. It returns whether
+// any pool changed. Must be called from within spin.
+func (c *Cluster) setReplicas(replicas map[string][]string) bool {
+	var changed bool
+	pools := map[string]clusterPool{}
+	for _, addrs := range replicas {
+		for _, addr := range addrs {
+			if p, ok := c.replicaPools[addr]; ok {
+				pools[addr] = p
+				continue
+			} else if c.o.ReadPolicy == ReadMaster {
+				continue
+			}
+			p, err := c.newPool(addr, false, true)
+			if err != nil {
+				continue
+			}
+			pools[addr] = p
+			changed = true
+		}
+	}
+
+	for addr, p := range c.replicaPools {
+		if _, ok := pools[addr]; !ok {
+			p.Empty()
+			delete(c.poolThrottles, addr)
+			if _, ok := c.pools[addr]; !ok {
+				c.breakers.Delete(addr)
+			}
+			changed = true
+		}
+	}
+	for addr := range c.latencies {
+		if _, ok := pools[addr]; !ok {
+			if _, ok := c.pools[addr]; !ok {
+				delete(c.latencies, addr)
+			}
+		}
+	}
+
+	c.replicas = replicas
+	c.replicaPools = pools
+	return changed
+}
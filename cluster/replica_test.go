@@ -0,0 +1,131 @@
+package cluster
+
+import (
+	"errors"
+	. "testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/gallir/radix.improved/redis"
+)
+
+// fakeReplicaCluster starts a master serving every slot and a replica of it.
+// Reads reply with "master" or "replica", and on the replica only work once
+// READONLY has been performed on the connection, like with redis.
+func fakeReplicaCluster(t *T) (master, replica *fakeNode) {
+	masters := []fakeMaster{{end: NumSlots - 1, replicas: 1}}
+	nodes := fakeCluster(t, masters, func(i int, n *fakeNode, mux *redis.ServeMux) {
+		name := "master"
+		if n.master != nil {
+			name = "replica"
+		}
+		mux.HandleFunc("READONLY", func(w redis.ResponseWriter, r *redis.Request) {
+			r.Conn.SetValue("readonly", true)
+			w.WriteResp(redis.NewRespSimple("OK"))
+		})
+		read := func(w redis.ResponseWriter, r *redis.Request) {
+			if ro, _ := r.Conn.Value("readonly").(bool); n.master != nil && !ro {
+				w.WriteResp(redis.NewResp(&redis.Error{Code: "MOVED", Msg: "0 " + n.master.addr}))
+				return
+			}
+			w.WriteResp(redis.NewResp(name))
+		}
+		mux.HandleFunc("GET", read)
+		mux.HandleFunc("EVAL_RO", read)
+		mux.HandleFunc("SET", func(w redis.ResponseWriter, r *redis.Request) {
+			w.WriteResp(redis.NewResp(name))
+		})
+	})
+	return nodes[0], nodes[1]
+}
+
+func TestReadPolicy(t *T) {
+	master, _ := fakeReplicaCluster(t)
+
+	for _, tc := range []struct {
+		policy ReadPolicy
+		reads  []string
+	}{
+		{ReadMaster, []string{"master"}},
+		{ReadPreferReplica, []string{"replica"}},
+		{ReadReplicaOnly, []string{"replica"}},
+		{ReadRandom, []string{"master", "replica"}},
+		{ReadLowestLatency, []string{"master", "replica"}},
+	} {
+		c, err := NewWithOpts(Opts{Addr: master.addr, ReadPolicy: tc.policy})
+		require.Nil(t, err)
+
+		seen := map[string]bool{}
+		for i := 0; i < 50; i++ {
+			s, err := c.Cmd("GET", "foo").Str()
+			require.Nil(t, err)
+			seen[s] = true
+
+			// Writes always go to the master
+			s, err = c.Cmd("SET", "foo", "bar").Str()
+			require.Nil(t, err)
+			assert.Equal(t, "master", s)
+		}
+		for _, read := range tc.reads {
+			assert.True(t, seen[read], "policy %d never read from %s", tc.policy, read)
+		}
+		assert.Len(t, seen, len(tc.reads), "policy %d", tc.policy)
+
+		// CmdRead follows the policy for commands the table doesn't know to
+		// be read-only
+		s, err := c.CmdRead("SET", "foo", "bar").Str()
+		require.Nil(t, err)
+		if tc.policy == ReadPreferReplica || tc.policy == ReadReplicaOnly {
+			assert.Equal(t, "replica", s)
+		}
+		c.Close()
+	}
+}
+
+func TestReadReplicaDown(t *T) {
+	master, replica := fakeReplicaCluster(t)
+
+	// Both Clusters connect to the replica before it goes down
+	var cs []*Cluster
+	for _, policy := range []ReadPolicy{ReadPreferReplica, ReadReplicaOnly} {
+		c, err := NewWithOpts(Opts{Addr: master.addr, ReadPolicy: policy})
+		require.Nil(t, err)
+		defer c.Close()
+		s, err := c.Cmd("GET", "foo").Str()
+		require.Nil(t, err)
+		assert.Equal(t, "replica", s)
+		cs = append(cs, c)
+	}
+	lc, err := NewWithOpts(Opts{Addr: master.addr, ReadPolicy: ReadLowestLatency})
+	require.Nil(t, err)
+	defer lc.Close()
+	replica.srv.Close()
+
+	// The first read finds the pooled connection closed, the next ones can't
+	// make a new one
+	for i := 0; i < 3; i++ {
+		s, err := cs[0].Cmd("GET", "foo").Str()
+		require.Nil(t, err)
+		assert.Equal(t, "master", s)
+		assert.NotNil(t, cs[1].Cmd("GET", "foo").Err)
+	}
+
+	// Once the replica's breaker is open it isn't tried anymore
+	err = cs[1].Cmd("GET", "foo").Err
+	assert.True(t, errors.Is(err, ErrNoReplica), "err: %v", err)
+	ioErrs := cs[0].Stats().IOErrs
+	s, err := cs[0].Cmd("GET", "foo").Str()
+	require.Nil(t, err)
+	assert.Equal(t, "master", s)
+	assert.Equal(t, ioErrs, cs[0].Stats().IOErrs)
+
+	// Which keeps a replica which never replied from always being picked as
+	// the one with the lowest latency
+	for i := 0; i < 10; i++ {
+		s, err := lc.Cmd("GET", "foo").Str()
+		require.Nil(t, err)
+		assert.Equal(t, "master", s)
+	}
+	assert.Equal(t, int64(3), lc.Stats().IOErrs)
+}
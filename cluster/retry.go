@@ -0,0 +1,92 @@
+package cluster
+
+import (
+	"context"
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+// The longest a command waits before being retried after a TRYAGAIN or
+// CLUSTERDOWN, however many times it has been retried already
+const maxRetryBackoff = time.Second
+
+// Stats holds counters of how the commands performed through a Cluster fared,
+// as returned by its Stats method. Each counts from when the Cluster was
+// created.
+type Stats struct {
+	// Redirects with MOVED, each of which remapped its slot
+	Moved int64
+
+	// Redirects with ASK, which don't remap anything
+	Ask int64
+
+	// Retries after a TRYAGAIN error
+	TryAgain int64
+
+	// Retries after a CLUSTERDOWN error
+	ClusterDown int64
+
+	// Commands given up on after MaxRedirects redirects, see Opts
+	RedirectsExhausted int64
+
+	// Commands given up on after MaxRetries retries, see Opts
+	RetriesExhausted int64
+
+	// Commands which failed with a network error
+	IOErrs int64
+}
+
+// Stats returns the current value of the Cluster's counters
+func (c *Cluster) Stats() Stats {
+	return Stats{
+		Moved:              atomic.LoadInt64(&c.stats.Moved),
+		Ask:                atomic.LoadInt64(&c.stats.Ask),
+		TryAgain:           atomic.LoadInt64(&c.stats.TryAgain),
+		ClusterDown:        atomic.LoadInt64(&c.stats.ClusterDown),
+		RedirectsExhausted: atomic.LoadInt64(&c.stats.RedirectsExhausted),
+		RetriesExhausted:   atomic.LoadInt64(&c.stats.RetriesExhausted),
+		IOErrs:             atomic.LoadInt64(&c.stats.IOErrs),
+	}
+}
+
+// slotMiss is called for every MOVED or ASK redirect. If remap is set the slot
+// is mapped to the given address from then on.
+func (c *Cluster) slotMiss(slot int, addr string, remap bool) {
+	c.callCh <- func(c *Cluster) {
+		if remap && slot >= 0 && slot < NumSlots {
+			c.mapping[slot] = addr
+		}
+		select {
+		case c.MissCh <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// retrySleep waits before the given retry of a command, starting at
+// RetryBackoff and doubling with each retry, up to maxRetryBackoff. The wait is
+// jittered so that the commands which failed together aren't all retried at
+// once. The context's error is returned if it's done before the wait is over.
+func (c *Cluster) retrySleep(ctx context.Context, retry int) error {
+	d := c.o.RetryBackoff
+	if d <= 0 {
+		return ctx.Err()
+	}
+	for i := 1; i < retry && d < maxRetryBackoff; i++ {
+		d *= 2
+	}
+	if d > maxRetryBackoff {
+		d = maxRetryBackoff
+	}
+	d = d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
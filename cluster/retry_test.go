@@ -0,0 +1,215 @@
+package cluster
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	. "testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/gallir/radix.improved/redis"
+)
+
+// retryNode is a fakeNode whose replies to GET can be scripted. GET replies
+// with the node's name, unless errs has anything left, in which case the first
+// of them is replied instead, or redirect is set, in which case it's always
+// replied. Like with redis, a command preceded by ASKING isn't redirected.
+type retryNode struct {
+	*fakeNode
+	name string
+
+	mu       sync.Mutex
+	errs     []*redis.Error
+	redirect func(slot uint16) *redis.Error
+	gets     int
+}
+
+func (n *retryNode) script(errs ...*redis.Error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.errs = errs
+}
+
+func (n *retryNode) setRedirect(fn func(slot uint16) *redis.Error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.redirect = fn
+}
+
+func (n *retryNode) getCount() int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.gets
+}
+
+// fakeRetryCluster starts two retryNodes, the first of which serves every
+// slot as far as CLUSTER SLOTS is concerned
+func fakeRetryCluster(t *T) (*retryNode, *retryNode) {
+	nodes := []*retryNode{{name: "src"}, {name: "dst"}}
+	masters := []fakeMaster{{end: NumSlots - 1}, {start: 0, end: -1}}
+	fakeCluster(t, masters, func(i int, n *fakeNode, mux *redis.ServeMux) {
+		node := nodes[i]
+		node.fakeNode = n
+		mux.HandleFunc("ASKING", func(w redis.ResponseWriter, r *redis.Request) {
+			r.Conn.SetValue("asking", true)
+			w.WriteResp(redis.NewRespSimple("OK"))
+		})
+		mux.HandleFunc("GET", func(w redis.ResponseWriter, r *redis.Request) {
+			asking, _ := r.Conn.Value("asking").(bool)
+			r.Conn.SetValue("asking", false)
+
+			node.mu.Lock()
+			defer node.mu.Unlock()
+			node.gets++
+			if len(node.errs) > 0 {
+				err := node.errs[0]
+				node.errs = node.errs[1:]
+				w.WriteResp(redis.NewResp(err))
+				return
+			}
+			if node.redirect != nil && !asking {
+				w.WriteResp(redis.NewResp(node.redirect(Slot(string(r.Args[0])))))
+				return
+			}
+			w.WriteResp(redis.NewResp(node.name))
+		})
+	})
+	return nodes[0], nodes[1]
+}
+
+func redirectTo(code string, node *retryNode) func(uint16) *redis.Error {
+	return func(slot uint16) *redis.Error {
+		return &redis.Error{
+			Code: code,
+			Msg:  strconv.Itoa(int(slot)) + " " + node.addr,
+		}
+	}
+}
+
+func TestAskRedirect(t *T) {
+	src, dst := fakeRetryCluster(t)
+	c, err := New(src.addr)
+	require.Nil(t, err)
+	defer c.Close()
+
+	// The slot is being migrated, so src asks for the key to be looked for on
+	// dst, but that doesn't change which node the slot is mapped to
+	src.setRedirect(redirectTo("ASK", dst))
+	for i := 0; i < 3; i++ {
+		s, err := c.Cmd("GET", "foo").Str()
+		require.Nil(t, err)
+		assert.Equal(t, "dst", s)
+	}
+	assert.Equal(t, src.addr, c.GetAddrForKey("foo"))
+	assert.Equal(t, 3, src.getCount())
+
+	stats := c.Stats()
+	assert.Equal(t, int64(3), stats.Ask)
+	assert.Equal(t, int64(0), stats.Moved)
+}
+
+func TestMovedRedirect(t *T) {
+	src, dst := fakeRetryCluster(t)
+	c, err := New(src.addr)
+	require.Nil(t, err)
+	defer c.Close()
+
+	src.setRedirect(redirectTo("MOVED", dst))
+	for i := 0; i < 3; i++ {
+		s, err := c.Cmd("GET", "foo").Str()
+		require.Nil(t, err)
+		assert.Equal(t, "dst", s)
+	}
+
+	// Only the one slot got remapped, and only src's first reply was a
+	// redirect
+	assert.Equal(t, dst.addr, c.GetAddrForKey("foo"))
+	assert.Equal(t, src.addr, c.GetAddrForKey("bar"))
+	assert.Equal(t, 1, src.getCount())
+	assert.Equal(t, int64(1), c.Stats().Moved)
+
+	// Nodes which keep redirecting to each other are only followed so far
+	dst.setRedirect(redirectTo("MOVED", src))
+	err = c.Cmd("GET", "foo").Err
+	assert.True(t, errors.Is(err, redis.ErrMoved), "err: %v", err)
+	assert.Equal(t, int64(1), c.Stats().RedirectsExhausted)
+}
+
+func TestTryAgain(t *T) {
+	src, _ := fakeRetryCluster(t)
+	c, err := NewWithOpts(Opts{
+		Addr:         src.addr,
+		MaxRetries:   2,
+		RetryBackoff: time.Millisecond,
+	})
+	require.Nil(t, err)
+	defer c.Close()
+
+	tryAgain := &redis.Error{Code: "TRYAGAIN", Msg: "Multiple keys request during rehashing of slot"}
+	clusterDown := &redis.Error{Code: "CLUSTERDOWN", Msg: "The cluster is down"}
+
+	src.script(tryAgain, clusterDown)
+	s, err := c.Cmd("GET", "foo").Str()
+	require.Nil(t, err)
+	assert.Equal(t, "src", s)
+	stats := c.Stats()
+	assert.Equal(t, int64(1), stats.TryAgain)
+	assert.Equal(t, int64(1), stats.ClusterDown)
+	assert.Equal(t, int64(0), stats.RetriesExhausted)
+
+	// Once the budget is spent the error is returned
+	src.script(tryAgain, tryAgain, tryAgain, tryAgain)
+	err = c.Cmd("GET", "foo").Err
+	assert.True(t, errors.Is(err, redis.ErrTryAgain), "err: %v", err)
+	assert.Equal(t, int64(1), c.Stats().RetriesExhausted)
+	assert.Equal(t, 6, src.getCount())
+
+	// Applications errors aren't retried
+	src.script(&redis.Error{Code: "WRONGTYPE", Msg: "wrong kind of value"})
+	err = c.Cmd("GET", "foo").Err
+	assert.True(t, errors.Is(err, redis.ErrWrongType), "err: %v", err)
+	assert.Equal(t, 7, src.getCount())
+}
+
+func TestTryAgainContext(t *T) {
+	src, _ := fakeRetryCluster(t)
+	c, err := NewWithOpts(Opts{Addr: src.addr, RetryBackoff: time.Minute})
+	require.Nil(t, err)
+	defer c.Close()
+
+	// The backoff is abandoned along with the command
+	src.script(&redis.Error{Code: "TRYAGAIN"})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	r := c.CmdContext(ctx, "GET", "foo")
+	assert.True(t, errors.Is(r.Err, context.DeadlineExceeded), "err: %v", r.Err)
+	assert.True(t, time.Since(start) < time.Second)
+
+	// Retries can be turned off altogether
+	c2, err := NewWithOpts(Opts{Addr: src.addr, MaxRetries: -1})
+	require.Nil(t, err)
+	defer c2.Close()
+	src.script(&redis.Error{Code: "CLUSTERDOWN"})
+	err = c2.Cmd("GET", "foo").Err
+	assert.True(t, errors.Is(err, redis.ErrClusterDown), "err: %v", err)
+	assert.Equal(t, int64(0), c2.Stats().ClusterDown)
+}
+
+func TestTryAgainNoBackoff(t *T) {
+	src, _ := fakeRetryCluster(t)
+	c, err := NewWithOpts(Opts{Addr: src.addr, RetryBackoff: -1})
+	require.Nil(t, err)
+	defer c.Close()
+
+	// A negative backoff retries straight away
+	src.script(&redis.Error{Code: "TRYAGAIN"}, &redis.Error{Code: "TRYAGAIN"})
+	s, err := c.Cmd("GET", "foo").Str()
+	require.Nil(t, err)
+	assert.Equal(t, "src", s)
+	assert.Equal(t, int64(2), c.Stats().TryAgain)
+}
@@ -72,4 +72,25 @@
 //		return client, nil
 //	}
 //	p, err := pool.NewCustom("tcp", "127.0.0.1:6379", 10, df)
+//
+// The common cases of authenticating, selecting a database and naming the
+// connection are covered by redis.DialOpts, which can be given to
+// NewWithDialOpts instead of writing a DialFunc
+//
+//	p, err := pool.NewWithDialOpts("tcp", "127.0.0.1:6379", 10, redis.DialOpts{
+//		Password: "SUPERSECRET",
+//		DB:       2,
+//	})
+//
+// DialOpts is also where the redis.BufferPool shared by all of a Pool's
+// connections is set, so that each Pool can reuse the buffers of its replies
+// according to its own workload:
+//
+//	p, err := pool.NewWithDialOpts("tcp", "127.0.0.1:6379", 10, redis.DialOpts{
+//		BufferPool: redis.NewBufferPool(4096, 1024*1024, 64),
+//	})
+//
+//	r := p.Cmd("GET", "foo")
+//	// use r
+//	r.ReleaseBuffers()
 package pool
@@ -1,7 +1,9 @@
 package pool
 
 import (
+	"context"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gallir/radix.improved/redis"
@@ -18,6 +20,9 @@ type Pool struct {
 	stopOnce sync.Once
 	stopCh   chan bool
 
+	hooksL sync.Mutex
+	hooks  atomic.Value // []redis.Hook
+
 	// The network/address that the pool is connecting to. These are going to be
 	// whatever was passed into the New function. These should not be
 	// changed after the pool is initialized
@@ -31,21 +36,20 @@ type DialFunc func(network, addr string) (*redis.Client, error)
 // used when creating new connections for the pool. The common use-case is to do
 // authentication for new connections.
 func NewCustom(network, addr string, size int, df DialFunc) (*Pool, error) {
-	var client *redis.Client
 	var err error
 	pool := make([]*redis.Client, 0, size)
 	for i := 0; i < size; i++ {
-		client, err = df(network, addr)
-		if err != nil {
+		var client *redis.Client
+		if client, err = df(network, addr); err != nil {
+			// The pool is returned empty, never holding a nil Client
 			for _, client = range pool {
 				client.Close()
 			}
 			pool = pool[:0]
 			break
 		}
-		pool = pool[0:]
+		pool = append(pool, client)
 	}
-	pool = append(pool, client)
 	p := Pool{
 		Network: network,
 		Addr:    addr,
@@ -88,14 +92,97 @@ func New(network, addr string, size int) (*Pool, error) {
 	return NewCustom(network, addr, size, redis.Dial)
 }
 
+// NewWithDialOpts is like New, but connections are created using
+// redis.DialWithOpts with the given DialOpts, so that they are authenticated,
+// have their database selected, etc... before being used
+func NewWithDialOpts(
+	network, addr string, size int, o redis.DialOpts,
+) (
+	*Pool, error,
+) {
+	return NewCustom(network, addr, size, o.DialFunc())
+}
+
 // Get retrieves an available redis client. If there are none available it will
 // create a new one on the fly
 func (p *Pool) Get() (*redis.Client, error) {
 	select {
 	case conn := <-p.pool:
-		return conn, nil
+		return p.withHooks(conn, nil)
 	default:
-		return p.df(p.Network, p.Addr)
+		return p.withHooks(p.df(p.Network, p.Addr))
+	}
+}
+
+// AddHook adds a Hook which is called around every command performed by the
+// Pool's Clients, see redis.Hook. The Pool's Hooks are set as the Hooks of
+// every Client as it's gotten from the Pool, including by Cmd, replacing any
+// Hooks the Client had of its own, e.g. from redis.DialOpts.
+func (p *Pool) AddHook(h redis.Hook) {
+	p.hooksL.Lock()
+	defer p.hooksL.Unlock()
+	hs, _ := p.hooks.Load().([]redis.Hook)
+	p.hooks.Store(append(hs[:len(hs):len(hs)], h))
+}
+
+// withHooks sets the Pool's Hooks, if it has any, on a Client which is about
+// to be returned from Get or GetContext
+func (p *Pool) withHooks(conn *redis.Client, err error) (*redis.Client, error) {
+	if err != nil {
+		return conn, err
+	}
+	if hs, _ := p.hooks.Load().([]redis.Hook); hs != nil {
+		conn.Hooks = hs
+	}
+	return conn, nil
+}
+
+// GetContext is like Get, but gives up and returns the context's error if the
+// context is cancelled or its deadline passes before a client is available. If
+// a new connection was being created at that moment it will be put into the
+// pool once it's ready.
+func (p *Pool) GetContext(ctx context.Context) (*redis.Client, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	select {
+	case conn := <-p.pool:
+		return p.withHooks(conn, nil)
+	default:
+	}
+
+	if ctx.Done() == nil {
+		return p.withHooks(p.df(p.Network, p.Addr))
+	}
+
+	type dialRet struct {
+		conn *redis.Client
+		err  error
+	}
+	dialCh := make(chan dialRet, 1)
+	go func() {
+		conn, err := p.df(p.Network, p.Addr)
+		dialCh <- dialRet{conn, err}
+	}()
+
+	// putDialed is used if the new connection ends up not being returned, so
+	// that it isn't wasted
+	putDialed := func() {
+		if ret := <-dialCh; ret.err == nil {
+			p.Put(ret.conn)
+		}
+	}
+
+	select {
+	case ret := <-dialCh:
+		return p.withHooks(ret.conn, ret.err)
+	case conn := <-p.pool:
+		go putDialed()
+		return p.withHooks(conn, nil)
+	case <-ctx.Done():
+		go putDialed()
+		return nil, ctx.Err()
 	}
 }
 
@@ -124,6 +211,21 @@ func (p *Pool) Cmd(cmd string, args ...interface{}) *redis.Resp {
 	return c.Cmd(cmd, args...)
 }
 
+// CmdContext is like Cmd, but uses GetContext to retrieve the client and the
+// client's CmdContext to execute the command, so that both can be abandoned
+// when the given context is cancelled or its deadline passes
+func (p *Pool) CmdContext(
+	ctx context.Context, cmd string, args ...interface{},
+) *redis.Resp {
+	c, err := p.GetContext(ctx)
+	if err != nil {
+		return redis.NewResp(err)
+	}
+	defer p.Put(c)
+
+	return c.CmdContext(ctx, cmd, args...)
+}
+
 // Empty removes and calls Close() on all the connections currently in the pool.
 // Assuming there are no other connections waiting to be Put back this method
 // effectively closes and cleans up the pool.
@@ -1,11 +1,17 @@
 package pool
 
 import (
+	"context"
+	"errors"
 	"sync"
 	. "testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+
+	"github.com/gallir/radix.improved/redis"
+	"github.com/gallir/radix.improved/redistest"
 )
 
 func TestPool(t *T) {
@@ -71,3 +77,93 @@ func TestPut(t *T) {
 	// network error
 	assert.Equal(t, 9, len(pool.pool))
 }
+
+func TestGetContext(t *T) {
+	pool, err := New("tcp", "localhost:6379", 1)
+	require.Nil(t, err)
+
+	conn, err := pool.GetContext(context.Background())
+	require.Nil(t, err)
+	assert.Nil(t, conn.CmdContext(context.Background(), "PING").Err)
+	pool.Put(conn)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = pool.GetContext(ctx)
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, context.Canceled, pool.CmdContext(ctx, "PING").Err)
+
+	// The pool's connection shouldn't have been touched
+	assert.Equal(t, 1, len(pool.pool))
+}
+
+func TestPoolHooks(t *T) {
+	pool, err := New("tcp", "localhost:6379", 1)
+	require.Nil(t, err)
+	defer pool.Empty()
+
+	var l sync.Mutex
+	var cmds []string
+	pool.AddHook(redis.HookFuncs{
+		After: func(ci *redis.CmdInfo) {
+			l.Lock()
+			defer l.Unlock()
+			cmds = append(cmds, ci.Cmd)
+			assert.Equal(t, "localhost:6379", ci.Addr)
+		},
+	})
+
+	require.Nil(t, pool.Cmd("ECHO", "foo").Err)
+
+	// Clients which were dialed before the Hook was added get it too
+	conn, err := pool.Get()
+	require.Nil(t, err)
+	require.Nil(t, conn.Cmd("ECHO", "bar").Err)
+	pool.Put(conn)
+
+	l.Lock()
+	defer l.Unlock()
+	assert.Equal(t, []string{"ECHO", "ECHO"}, cmds)
+}
+
+func TestNewCustomDialError(t *T) {
+	s, err := redistest.NewServer()
+	require.Nil(t, err)
+	defer s.Close()
+
+	// Every connection dialed is kept, until one fails
+	var l sync.Mutex
+	var dialed []*redis.Client
+	dials := 3
+	df := func(network, addr string) (*redis.Client, error) {
+		l.Lock()
+		defer l.Unlock()
+		if len(dialed) == dials {
+			return nil, errors.New("dial failed")
+		}
+		c, err := s.DialFunc()(network, addr)
+		dialed = append(dialed, c)
+		return c, err
+	}
+	p, err := NewCustom("tcp", s.Addr(), dials, df)
+	require.Nil(t, err)
+	assert.Equal(t, dials, p.Avail())
+	p.Empty()
+
+	// If one fails the pool is returned empty, and the others are closed.
+	// Having the pinging go-routine run shows that the pool holds no nil
+	// Client.
+	l.Lock()
+	dialed = nil
+	l.Unlock()
+	p, err = NewCustom("tcp", s.Addr(), 50, df)
+	assert.NotNil(t, err)
+	assert.Equal(t, 0, p.Avail())
+	time.Sleep(300 * time.Millisecond)
+	p.Empty()
+	l.Lock()
+	defer l.Unlock()
+	for _, c := range dialed {
+		assert.NotNil(t, c.Cmd("PING").Err)
+	}
+}
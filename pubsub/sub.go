@@ -38,7 +38,7 @@ type SubResp struct {
 	Channel  string // Channel resp is on (Message)
 	Pattern  string // Pattern which was matched for publishes captured by a PSubscribe
 	SubCount int    // Count of subs active after this action (Subscribe or Unsubscribe)
-	Message  string // Publish message (Message)
+	Message  string // Publish message (Message), if it was a string
 	Err      error  // SubResp error (Error)
 }
 
@@ -122,7 +122,9 @@ func (c *SubClient) parseResp(resp *redis.Resp) *SubResp {
 	var elems []*redis.Resp
 
 	switch {
-	case resp.IsType(redis.Array):
+	// Servers speaking RESP3 send subscription messages as Push instead of
+	// Array, but they are otherwise formatted the same
+	case resp.IsType(redis.Array | redis.Push):
 		elems, _ = resp.Array()
 		if len(elems) < 2 {
 			sr.Err = errors.New("resp is not formatted as a subscription resp")
@@ -197,6 +199,12 @@ func (c *SubClient) parseResp(resp *redis.Resp) *SubResp {
 			return sr
 		}
 		sr.Channel = channel
+
+		// Some messages published by redis itself, e.g. client-side caching
+		// invalidations, aren't strings. Those can be read using the Resp
+		if elems[msgI].IsType(redis.Aggregate | redis.Nil) {
+			break
+		}
 		msg, err := elems[msgI].Str()
 		if err != nil {
 			sr.Err = fmt.Errorf("message msg: %s", err)
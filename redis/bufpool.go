@@ -0,0 +1,101 @@
+package redis
+
+import (
+	"math/bits"
+
+	"github.com/gallir/bytebufferpool"
+)
+
+// BufferPool is used by a Client to allocate the buffers which bulk strings
+// are read into, so that they can be reused once the Resp they belong to is no
+// longer needed (see Resp.ReleaseBuffers). Implementations must be safe to use
+// from multiple go-routines, since a BufferPool is usually shared by all the
+// Clients of a pool.Pool or cluster.Cluster.
+type BufferPool interface {
+	// Get returns a byte slice of length size. Its contents don't matter, it
+	// will be completely overwritten.
+	Get(size int) []byte
+
+	// Put is given a byte slice previously returned by Get once it's no longer
+	// being used. Byte slices which the BufferPool doesn't want to keep can
+	// simply be dropped.
+	Put(b []byte)
+}
+
+// NewBufferPool returns a BufferPool which keeps the buffers it's given back
+// in size classes, one for each power of two from minSize to maxSize. Up to
+// keep buffers are kept in each size class, any more are garbage collected.
+// Buffers smaller than minSize or larger than maxSize are allocated normally
+// and never kept, since the former are cheap to allocate and the latter would
+// hold on to too much memory.
+//
+//	// Pool buffers between 4KB and 1MB, keeping at most 128 of each size
+//	bp := redis.NewBufferPool(4096, 1024*1024, 128)
+//	p, err := pool.NewWithDialOpts("tcp", "localhost:6379", 10, redis.DialOpts{
+//		BufferPool: bp,
+//	})
+//
+func NewBufferPool(minSize, maxSize, keep int) BufferPool {
+	if minSize < 1 {
+		minSize = 1
+	}
+	p := &sizeClassPool{
+		minClass: sizeClass(minSize),
+		maxClass: sizeClass(maxSize),
+	}
+	p.classes = make([]chan []byte, p.maxClass-p.minClass+1)
+	for i := range p.classes {
+		p.classes[i] = make(chan []byte, keep)
+	}
+	return p
+}
+
+// sizeClassPool keeps free buffers in buffered channels, which unlike
+// sync.Pool don't need the slices to be boxed, and so don't allocate
+type sizeClassPool struct {
+	minClass, maxClass int
+	classes            []chan []byte
+}
+
+// sizeClass returns the smallest n for which 1<<n is at least size
+func sizeClass(size int) int {
+	return bits.Len(uint(size - 1))
+}
+
+func (p *sizeClassPool) Get(size int) []byte {
+	class := sizeClass(size)
+	if size < 1 || class < p.minClass || class > p.maxClass {
+		return make([]byte, size)
+	}
+	select {
+	case b := <-p.classes[class-p.minClass]:
+		return b[:size]
+	default:
+		return make([]byte, size, 1<<uint(class))
+	}
+}
+
+func (p *sizeClassPool) Put(b []byte) {
+	// Only buffers which were made by Get have a capacity which is exactly a
+	// size class
+	class := sizeClass(cap(b))
+	if cap(b) != 1<<uint(class) || class < p.minClass || class > p.maxClass {
+		return
+	}
+	select {
+	case p.classes[class-p.minClass] <- b[:0]:
+	default:
+	}
+}
+
+// byteBufferPool is the BufferPool used for the deprecated UsePool setting,
+// and for Resps made from a *bytebufferpool.ByteBuffer
+type byteBufferPool struct{}
+
+func (byteBufferPool) Get(size int) []byte {
+	return bytebufferpool.GetLen(size).B
+}
+
+func (byteBufferPool) Put(b []byte) {
+	bytebufferpool.Put(&bytebufferpool.ByteBuffer{B: b[:0]})
+}
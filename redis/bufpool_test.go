@@ -0,0 +1,146 @@
+package redis
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	. "testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBufferPool(t *T) {
+	p := NewBufferPool(16, 1024, 1)
+
+	b := p.Get(20)
+	assert.Len(t, b, 20)
+	assert.Equal(t, 32, cap(b))
+	p.Put(b)
+	b2 := p.Get(30)
+	assert.Len(t, b2, 30)
+	assert.True(t, &b[0] == &b2[0])
+
+	// Only one buffer is kept per class
+	p.Put(b2)
+	p.Put(make([]byte, 32))
+	assert.True(t, &b2[0] == &p.Get(32)[0])
+
+	// Sizes outside of the range aren't pooled
+	assert.Equal(t, 8, cap(p.Get(8)))
+	assert.Equal(t, 2000, cap(p.Get(2000)))
+	p.Put(make([]byte, 2048))
+	assert.Equal(t, 2000, cap(p.Get(2000)))
+
+	// Neither are buffers not made by the pool
+	p.Put(make([]byte, 100))
+	assert.Equal(t, 128, cap(p.Get(100)))
+}
+
+func TestReleaseBuffers(t *T) {
+	p := NewBufferPool(1, 1024, 10)
+	rr := NewRespReader(bytes.NewBufferString("*2\r\n$3\r\nfoo\r\n$3\r\nbar\r\n$3\r\nbaz\r\n"))
+	rr.BufferPool = p
+
+	r := rr.Read()
+	l, err := r.ListBytes()
+	require.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("foo"), []byte("bar")}, l)
+	r.ReleaseBuffers()
+	elems, err := r.Array()
+	require.Nil(t, err)
+	_, err = elems[0].Bytes()
+	assert.NotNil(t, err)
+
+	// The released buffers are reused for the next reply
+	r = rr.Read()
+	b, err := r.Bytes()
+	require.Nil(t, err)
+	assert.Equal(t, "baz", string(b))
+	assert.True(t, &b[0] == &l[0][0] || &b[0] == &l[1][0])
+
+	// Resps which didn't come from a pool are left alone
+	r = NewResp("foo")
+	r.ReleaseBuffers()
+	s, err := r.Str()
+	require.Nil(t, err)
+	assert.Equal(t, "foo", s)
+}
+
+func TestClientBufferPool(t *T) {
+	cmdCh := make(chan []string, 10)
+	conn := pipeServer(t, cmdCh, func([]string) *Resp {
+		return NewResp("hello")
+	})
+	c := NewClient(conn)
+	defer c.Close()
+	c.BufferPool = NewBufferPool(1, 1024, 10)
+
+	r := c.Cmd("GET", "foo")
+	b1, err := r.Bytes()
+	require.Nil(t, err)
+	assert.Equal(t, 8, cap(b1))
+	r.ReleaseBuffers()
+
+	b2, err := c.Cmd("GET", "foo").Bytes()
+	require.Nil(t, err)
+	assert.True(t, &b1[0] == &b2[0])
+}
+
+// repeatReader endlessly repeats the same bytes
+type repeatReader struct {
+	b []byte
+	i int
+}
+
+func (r *repeatReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		c := copy(p[n:], r.b[r.i:])
+		n += c
+		r.i = (r.i + c) % len(r.b)
+	}
+	return n, nil
+}
+
+func benchmarkRead(b *B, size int, pool BufferPool) {
+	var buf bytes.Buffer
+	NewResp(strings.Repeat("a", size)).WriteTo(&buf)
+	rr := NewRespReader(&repeatReader{b: buf.Bytes()})
+	rr.BufferPool = pool
+
+	b.ReportAllocs()
+	b.SetBytes(int64(size))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r := rr.Read()
+		if r.Err != nil {
+			b.Fatal(r.Err)
+		}
+		r.ReleaseBuffers()
+	}
+}
+
+func BenchmarkReadBulk1K(b *B) {
+	benchmarkRead(b, 1024, nil)
+}
+
+func BenchmarkReadBulk1KPooled(b *B) {
+	benchmarkRead(b, 1024, NewBufferPool(512, 1<<20, 16))
+}
+
+func BenchmarkReadBulk64K(b *B) {
+	benchmarkRead(b, 64*1024, nil)
+}
+
+func BenchmarkReadBulk64KPooled(b *B) {
+	benchmarkRead(b, 64*1024, NewBufferPool(512, 1<<20, 16))
+}
+
+func BenchmarkWriteSimpleStr(b *B) {
+	r := NewRespSimple(strings.Repeat("a", 1024))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		r.WriteTo(ioutil.Discard)
+	}
+}
@@ -0,0 +1,28 @@
+// Package chacha provides redis.EnvelopeKeys which use ChaCha20-Poly1305. It's
+// kept apart from the redis package so that only those who use it depend on
+// golang.org/x/crypto.
+//
+//	k, err := chacha.NewKey("2024-01", key)
+//	if err != nil {
+//		// handle err
+//	}
+//	e, err := redis.NewEnvelope([]byte("\x00enc:"), k)
+//
+package chacha
+
+import (
+	"golang.org/x/crypto/chacha20poly1305"
+
+	"github.com/gallir/radix.improved/redis"
+)
+
+// NewKey returns an EnvelopeKey using ChaCha20-Poly1305, which is faster than
+// AES-GCM on machines without hardware AES support. The key must be 32 bytes
+// long.
+func NewKey(id string, key []byte) (redis.EnvelopeKey, error) {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return redis.EnvelopeKey{}, err
+	}
+	return redis.EnvelopeKey{ID: id, AEAD: aead}, nil
+}
@@ -0,0 +1,27 @@
+package chacha
+
+import (
+	"bytes"
+	. "testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/gallir/radix.improved/redis"
+)
+
+func TestNewKey(t *T) {
+	k, err := NewKey("k", bytes.Repeat([]byte{1}, 32))
+	require.Nil(t, err)
+	e, err := redis.NewEnvelope([]byte("\x00enc:"), k)
+	require.Nil(t, err)
+
+	sealed, err := e.Seal(nil, []byte("secret value"), "foo")
+	require.Nil(t, err)
+	opened, err := e.Open(nil, sealed, "foo")
+	require.Nil(t, err)
+	assert.Equal(t, []byte("secret value"), opened)
+
+	_, err = NewKey("bad", []byte("short"))
+	assert.NotNil(t, err)
+}
@@ -2,6 +2,8 @@ package redis
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"net"
@@ -45,12 +47,91 @@ type Client struct {
 	// methods which deal with a command-then-response (e.g. Cmd, PipeResp) do
 	// set this and close the connection in the event of a timeout
 	LastCritical error
+
+	// OnPush, if set, is called with every Push message (e.g. a client-side
+	// caching invalidation) read off the connection while waiting for the
+	// reply to a command, and the command's actual reply is then read. If not
+	// set Push messages are returned like any other reply. Push messages are
+	// only sent by servers speaking RESP3 (see Hello)
+	OnPush func(r *Resp)
+
+	// Limits on the size of the replies read off the connection. A reply
+	// which exceeds them is a critical network error, whose error is a
+	// *ProtocolError. These may be set after the Client is initialized, but
+	// not while any methods are being called. See RespLimits for the defaults
+	Limits RespLimits
+
+	// If set, the buffers which the bulk strings of replies are read into are
+	// taken from this pool, and are returned to it by calling ReleaseBuffers
+	// on the reply once it's no longer needed. Replies which aren't released
+	// are simply garbage collected. This may be set after the Client is
+	// initialized, but not while any methods are being called
+	BufferPool BufferPool
+
+	// If Compression's Codec is set, the values of at least its MinSize
+	// which are stored by SET, SETNX, GETSET, SETEX, PSETEX, MSET, MSETNX,
+	// HSET, HSETNX and HMSET are compressed using it before being sent, and
+	// any string in a reply which starts with the marker of that Codec or of
+	// a registered one (see RegisterCodec) is decompressed before being
+	// returned. A reply which can't be decompressed is returned as an error,
+	// while strings inside of an aggregate reply which can't be are left as
+	// they are. Other arguments, e.g. keys, field names and scripts, are
+	// never compressed. Replies read using CmdStream aren't decompressed.
+	// This may be set after the Client is initialized, but not while any
+	// methods are being called
+	Compression CompressOpts
+
+	// Hooks are called around every command the Client performs, see Hook.
+	// Commands performed using CmdStream don't call them. These may be set
+	// after the Client is initialized, but not while any methods are being
+	// called
+	Hooks []Hook
+
+	proto int
+
+	// stream is the RespStream returned by the last call to CmdStream, if it
+	// hasn't been closed yet
+	stream *RespStream
+
+	// ctxDeadline is the deadline of the context of the *Context method
+	// currently being called, if any. ctxUsed indicates that a *Context method
+	// has been called at least once, and therefore the connection's deadlines
+	// must always be reset, even if no timeouts are set
+	ctxDeadline time.Time
+	ctxUsed     bool
+
+	// ctx is the context of the *Context method currently being called, if
+	// any, which is given to Hooks
+	ctx context.Context
 }
 
+// aLongTimeAgo is a deadline used to interrupt blocking reads and writes on a
+// connection whose context has been cancelled
+var aLongTimeAgo = time.Unix(1, 0)
+
 // request describes a client's request to the redis server
 type request struct {
 	cmd  string
 	args []interface{}
+
+	// err is set if the args couldn't be marshaled, in which case the request
+	// isn't sent and err is returned as its reply
+	err error
+}
+
+func newRequest(cmd string, args []interface{}) request {
+	args, err := marshalArgs(args)
+	return request{cmd: cmd, args: args, err: err}
+}
+
+// newRequest is like the newRequest function, but also compresses the args
+// according to the Client's Compression
+func (c *Client) newRequest(cmd string, args []interface{}) request {
+	req := newRequest(cmd, args)
+	if req.err == nil && c.Compression.Codec != nil {
+		req.args, req.err = c.Compression.compressArgs(cmd, req.args)
+	}
+	return req
 }
 
 // DialTimeout connects to the given Redis server with the given timeout, which
@@ -62,19 +143,37 @@ func DialTimeout(network, addr string, timeout time.Duration) (*Client, error) {
 		return nil, err
 	}
 
+	c := newClient(conn, network, addr)
+	c.ReadTimeout = timeout
+	c.WriteTimeout = timeout
+	return c, nil
+}
+
+// NewClient wraps an existing, already connected net.Conn in a Client. Network
+// and Addr are taken from the connection's remote address, and no read/write
+// timeouts are set. The Client takes ownership of the connection, it shouldn't
+// be used by anything else afterwards. See NewClientWithOpts for a version
+// which also initializes the connection.
+func NewClient(conn net.Conn) *Client {
+	var network, addr string
+	if ra := conn.RemoteAddr(); ra != nil {
+		network, addr = ra.Network(), ra.String()
+	}
+	return newClient(conn, network, addr)
+}
+
+func newClient(conn net.Conn, network, addr string) *Client {
 	completed := make([]*Resp, 0, 10)
 	return &Client{
 		conn:          conn,
 		respReader:    NewRespReader(conn),
-		ReadTimeout:   timeout,
-		WriteTimeout:  timeout,
 		writeScratch:  make([]byte, 0, 128),
 		writeBuf:      bufio.NewWriterSize(conn, 8192),
 		completed:     completed,
 		completedHead: completed,
 		Network:       network,
 		Addr:          addr,
-	}, nil
+	}
 }
 
 // Dial connects to the given Redis server.
@@ -89,17 +188,170 @@ func (c *Client) Close() error {
 
 // Cmd calls the given Redis command.
 func (c *Client) Cmd(cmd string, args ...interface{}) *Resp {
-	err := c.writeRequest(request{cmd, args})
+	req := c.newRequest(cmd, args)
+	ci := c.hookBefore(req, 1, time.Now())
+	r := c.doRequest(req)
+	c.hookAfter(ci, r)
+	return r
+}
+
+func (c *Client) doRequest(req request) *Resp {
+	if req.err != nil {
+		return NewResp(req.err)
+	}
+	err := c.writeRequest(req)
 	if err != nil {
 		return NewRespIOErr(err)
 	}
 	return c.readResp(true)
 }
 
+// Hello sends the HELLO command, switching the connection to the given version
+// of the redis protocol (2 or 3) if the server supports it. Any extra args
+// (e.g. "AUTH", username, password) are sent along with it. The reply is a map
+// of information about the server. Once switched to RESP3, replies may contain
+// any of the RESP3 types, e.g. Map instead of Array for HGETALL
+func (c *Client) Hello(proto int, args ...interface{}) *Resp {
+	r := c.Cmd("HELLO", proto, args)
+	if r.Err == nil {
+		c.proto = proto
+	}
+	return r
+}
+
+// Proto returns the version of the redis protocol which was negotiated using
+// Hello. This will be 2 if Hello was never successfully called
+func (c *Client) Proto() int {
+	if c.proto == 0 {
+		return 2
+	}
+	return c.proto
+}
+
+// CmdContext is like Cmd, but the command is abandoned if the given context is
+// cancelled or its deadline passes before the reply is read. The context's
+// deadline is used as the read/write deadline if it is sooner than the one
+// given by ReadTimeout/WriteTimeout. If the command is abandoned after being
+// written the connection is closed, and both LastCritical and the Err field of
+// the returned IOErr Resp are set to the context's error.
+func (c *Client) CmdContext(
+	ctx context.Context, cmd string, args ...interface{},
+) *Resp {
+	return c.withContext(ctx, func() *Resp {
+		return c.Cmd(cmd, args...)
+	})
+}
+
+// PipeRespContext is like PipeResp, but the pipeline is abandoned if the given
+// context is cancelled or its deadline passes while writing the pipeline or
+// reading the reply, in the same way as with CmdContext.
+func (c *Client) PipeRespContext(ctx context.Context) *Resp {
+	return c.withContext(ctx, c.PipeResp)
+}
+
+// withContext calls fn with the connection's deadlines bound by the context's
+// deadline, and interrupts any blocking read or write fn makes if the context
+// is cancelled
+func (c *Client) withContext(ctx context.Context, fn func() *Resp) *Resp {
+	if err := ctx.Err(); err != nil {
+		return NewRespIOErr(err)
+	}
+
+	c.ctxUsed = true
+	c.ctxDeadline, _ = ctx.Deadline()
+	c.ctx = ctx
+	defer func() {
+		c.ctxDeadline = time.Time{}
+		c.ctx = nil
+	}()
+
+	var doneCh chan struct{}
+	var interruptedCh chan bool
+	if ctx.Done() != nil {
+		doneCh = make(chan struct{})
+		interruptedCh = make(chan bool, 1)
+		go func() {
+			select {
+			case <-ctx.Done():
+				c.conn.SetDeadline(aLongTimeAgo)
+				interruptedCh <- true
+			case <-doneCh:
+				interruptedCh <- false
+			}
+		}()
+	}
+
+	r := fn()
+	if doneCh != nil {
+		close(doneCh)
+		<-interruptedCh
+	}
+
+	// If the context is done and the command hit a network error then the
+	// context is the most likely culprit, either through our interruption or
+	// through its deadline being used. The error is reported as the
+	// context's, so callers can tell it apart from a real network failure.
+	if r.IsType(IOErr) && ctx.Err() != nil {
+		err := ctx.Err()
+		if c.LastCritical != nil {
+			c.LastCritical = err
+		}
+		r = NewRespIOErr(err)
+	}
+	return r
+}
+
+// CmdStream is like Cmd, but returns the reply as a RespStream, which allows
+// for reading very large replies incrementally instead of all at once. The
+// stream should be read to its end or closed before anything else is done
+// with the Client. If it isn't it will be closed, discarding the rest of the
+// reply, when the next reply is read.
+//
+//	s := client.CmdStream("GET", "bigkey")
+//	if err := s.Err(); err != nil {
+//		// handle err
+//	}
+//	defer s.Close()
+//	_, err := s.WriteTo(file)
+//
+func (c *Client) CmdStream(cmd string, args ...interface{}) *RespStream {
+	req := c.newRequest(cmd, args)
+	if req.err != nil {
+		return &RespStream{typ: AppErr, resp: NewResp(req.err), done: true}
+	}
+	var err error
+	if c.stream != nil {
+		err = c.stream.Close()
+	}
+	if err == nil {
+		err = c.writeRequest(req)
+	}
+	if err != nil {
+		return newRespStreamIOErr(err)
+	}
+
+	c.respReader.Limits = c.Limits
+	c.respReader.BufferPool = c.BufferPool
+	s := &RespStream{r: c.respReader.reader(), c: c}
+	for {
+		s.prepareRead()
+		s.readHeader()
+		if c.OnPush == nil || !s.IsType(Push) {
+			break
+		}
+		c.OnPush(s.Resp())
+		s = &RespStream{r: c.respReader.reader(), c: c}
+	}
+	if !s.done {
+		c.stream = s
+	}
+	return s
+}
+
 // PipeAppend adds the given call to the pipeline queue.
 // Use PipeResp() to read the response.
 func (c *Client) PipeAppend(cmd string, args ...interface{}) {
-	c.pending = append(c.pending, request{cmd, args})
+	c.pending = append(c.pending, c.newRequest(cmd, args))
 }
 
 // PipeResp returns the reply for the next request in the pipeline queue. Err
@@ -115,15 +367,36 @@ func (c *Client) PipeResp() *Resp {
 		return NewResp(ErrPipelineEmpty)
 	}
 
-	nreqs := len(c.pending)
-	err := c.writeRequest(c.pending...)
+	pending := c.pending
+	var cis []*CmdInfo
+	if len(c.Hooks) > 0 {
+		start := time.Now()
+		cis = make([]*CmdInfo, len(pending))
+		for i := range pending {
+			cis[i] = c.hookBefore(pending[i], len(pending), start)
+		}
+	}
+
+	err := c.writeRequest(pending...)
 	c.pending = nil
 	if err != nil {
-		return NewRespIOErr(err)
+		r := NewRespIOErr(err)
+		for i := range cis {
+			c.hookAfter(cis[i], r)
+		}
+		return r
 	}
 	c.completed = c.completedHead
-	for i := 0; i < nreqs; i++ {
-		r := c.readResp(true)
+	for i := range pending {
+		var r *Resp
+		if pending[i].err != nil {
+			r = NewResp(pending[i].err)
+		} else {
+			r = c.readResp(true)
+		}
+		if cis != nil {
+			c.hookAfter(cis[i], r)
+		}
 		c.completed = append(c.completed, r)
 	}
 
@@ -161,24 +434,68 @@ func (c *Client) ReadResp() *Resp {
 // strict indicates whether or not to consider timeouts as critical network
 // errors
 func (c *Client) readResp(strict bool) *Resp {
-	if c.ReadTimeout != 0 {
-		c.conn.SetReadDeadline(time.Now().Add(c.ReadTimeout))
+	if c.stream != nil {
+		if err := c.stream.Close(); err != nil {
+			return NewRespIOErr(err)
+		}
 	}
+	if c.ReadTimeout != 0 || c.ctxUsed {
+		c.conn.SetReadDeadline(c.deadline(c.ReadTimeout))
+	}
+	c.respReader.Limits = c.Limits
+	c.respReader.BufferPool = c.BufferPool
 	r := c.respReader.Read()
 	if r.IsType(IOErr) && (strict || !IsTimeout(r)) {
 		c.LastCritical = r.Err
 		c.Close()
 	}
+	if strict && c.OnPush != nil && r.IsType(Push) {
+		c.OnPush(r)
+		return c.readResp(strict)
+	}
+	if c.Compression.Codec != nil {
+		// An element of an aggregate which can't be decompressed is left as
+		// it was, so that it doesn't take the rest of the reply with it
+		if err := r.decompress(c.codecFor); err != nil && r.IsType(Str) {
+			return NewResp(err)
+		}
+	}
 	return r
 }
 
+// codecFor returns the Codec of the Client's Compression if the given data
+// starts with its marker, or the registered Codec it starts with the marker of
+func (c *Client) codecFor(b []byte) Codec {
+	if cc := c.Compression.Codec; bytes.HasPrefix(b, cc.Marker()) {
+		return cc
+	}
+	return CodecFor(b)
+}
+
+// deadline returns the deadline which should be used for the next read or
+// write given its timeout, taking into account the deadline of the context of
+// the current call, if any. The zero time is returned if there's no deadline
+func (c *Client) deadline(timeout time.Duration) time.Time {
+	var d time.Time
+	if timeout != 0 {
+		d = time.Now().Add(timeout)
+	}
+	if !c.ctxDeadline.IsZero() && (d.IsZero() || c.ctxDeadline.Before(d)) {
+		d = c.ctxDeadline
+	}
+	return d
+}
+
 func (c *Client) writeRequest(requests ...request) error {
-	if c.WriteTimeout != 0 {
-		c.conn.SetWriteDeadline(time.Now().Add(c.WriteTimeout))
+	if c.WriteTimeout != 0 || c.ctxUsed {
+		c.conn.SetWriteDeadline(c.deadline(c.WriteTimeout))
 	}
 	var err error
 outer:
 	for i := range requests {
+		if requests[i].err != nil {
+			continue
+		}
 		elems := flattenedLength(requests[i].args...) + 1
 		_, err = writeArrayHeader(c.writeBuf, c.writeScratch, int64(elems))
 		if err != nil {
@@ -218,6 +535,9 @@ var errBadCmdNoKey = errors.New("bad command, no key")
 // not always as straightforward as it might seem, so this helper function is
 // provided.
 //
+// The first argument isn't the key of every command (e.g. EVAL or XREAD), and
+// some commands have more than one. CmdKeys knows about those.
+//
 // An error is returned if no key can be determined
 func KeyFromArgs(args ...interface{}) (string, error) {
 	if len(args) == 0 {
@@ -1,6 +1,7 @@
 package redis
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/hex"
 	. "testing"
@@ -162,6 +163,40 @@ func TestLastCritical(t *T) {
 	assert.NotNil(t, c.LastCritical)
 }
 
+func TestCmdContext(t *T) {
+	c := dial(t)
+	echo := randStr()
+	v, err := c.CmdContext(context.Background(), "echo", echo).Str()
+	require.Nil(t, err)
+	assert.Equal(t, echo, v)
+
+	// An already cancelled context shouldn't touch the connection
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	r := c.CmdContext(ctx, "echo", echo)
+	assert.Equal(t, context.Canceled, r.Err)
+	assert.Nil(t, c.LastCritical)
+
+	// A context deadline sooner than ReadTimeout should be used to abandon a
+	// blocking command
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	r = c.CmdContext(ctx, "BLPOP", randStr(), 5)
+	assert.True(t, time.Since(start) < 5*time.Second)
+	assert.Equal(t, context.DeadlineExceeded, r.Err)
+	assert.True(t, IsTimeout(r))
+	assert.Equal(t, context.DeadlineExceeded, c.LastCritical)
+
+	// Cancelling a context should interrupt a blocking command
+	c = dial(t)
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	r = c.CmdContext(ctx, "BLPOP", randStr(), 5)
+	assert.Equal(t, context.Canceled, r.Err)
+	assert.Equal(t, context.Canceled, c.LastCritical)
+}
+
 func TestKeyFromArg(t *T) {
 	m := map[string]interface{}{
 		"foo0": "foo0",
@@ -178,3 +213,19 @@ func TestKeyFromArg(t *T) {
 		assert.Equal(t, out, key)
 	}
 }
+
+func TestClientLimits(t *T) {
+	cmdCh := make(chan []string, 10)
+	conn := pipeServer(t, cmdCh, func([]string) *Resp {
+		return NewResp("hello world")
+	})
+	c := NewClient(conn)
+	c.Limits = RespLimits{MaxBulkLen: 5}
+
+	r := c.Cmd("GET", "foo")
+	require.True(t, r.IsType(IOErr))
+	_, ok := r.Err.(*ProtocolError)
+	assert.True(t, ok)
+	assert.Equal(t, r.Err, c.LastCritical)
+	assert.NotNil(t, c.Cmd("GET", "foo").Err)
+}
@@ -0,0 +1,389 @@
+package redis
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/golang/snappy"
+)
+
+// Codec compresses and decompresses values. Data compressed by a Codec always
+// starts with its Marker, which is how the Codec which must be used to
+// decompress a value is found (see RegisterCodec and Resp.Decompress).
+// Implementations must be safe to use from multiple go-routines.
+type Codec interface {
+	// Marker returns the bytes which all data compressed by the Codec starts
+	// with. For formats with a header of their own (e.g. gzip) this is the
+	// header's magic number, for the others it's a prefix which is added to
+	// the compressed data.
+	Marker() []byte
+
+	// Encode appends the compressed form of src, marker included, to dst and
+	// returns the resulting slice
+	Encode(dst, src []byte) ([]byte, error)
+
+	// Decode appends the decompressed form of src, which starts with the
+	// marker, to dst and returns the resulting slice
+	Decode(dst, src []byte) ([]byte, error)
+}
+
+// ErrDecodedTooLarge is returned when decompressing a value which would be
+// larger than the Codec allows, 512MB for the provided Codecs
+var ErrDecodedTooLarge = errors.New("decompressed value is too large")
+
+// defaultMaxDecodedSize is the maximum size of a single decompressed value,
+// like RespLimits' default MaxBulkLen, so that a corrupted value can't
+// exhaust memory
+const defaultMaxDecodedSize = 512 * 1024 * 1024
+
+// ErrCodecConflict is returned from RegisterCodec when the marker of the given
+// Codec could be confused with that of an already registered one
+var ErrCodecConflict = errors.New("codec marker conflicts with a registered codec")
+
+var codecs struct {
+	sync.RWMutex
+	l []Codec
+}
+
+// RegisterCodec adds the Codec to those which Resp.Decompress, and a Client
+// with Compression set, recognise compressed values by. Since values are
+// matched by their first bytes, a Codec's marker can't be a prefix of another
+// registered Codec's marker or vice versa. Markers should also be unlikely to
+// start any uncompressed value.
+func RegisterCodec(c Codec) error {
+	m := c.Marker()
+	if len(m) == 0 {
+		return errors.New("codec marker is empty")
+	}
+
+	codecs.Lock()
+	defer codecs.Unlock()
+	for _, rc := range codecs.l {
+		rm := rc.Marker()
+		if bytes.HasPrefix(m, rm) || bytes.HasPrefix(rm, m) {
+			return ErrCodecConflict
+		}
+	}
+	codecs.l = append(codecs.l, c)
+	return nil
+}
+
+// CodecFor returns the registered Codec whose marker the given data starts
+// with, or nil if there isn't one
+func CodecFor(b []byte) Codec {
+	codecs.RLock()
+	defer codecs.RUnlock()
+	for _, c := range codecs.l {
+		if bytes.HasPrefix(b, c.Marker()) {
+			return c
+		}
+	}
+	return nil
+}
+
+// decodedLener is implemented by Codecs which can tell how large the result of
+// decoding some data will be, so that a buffer of the right size can be taken
+// from a BufferPool
+type decodedLener interface {
+	decodedLen(src []byte) (int, error)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+type snappyCodec struct {
+	marker     []byte
+	maxDecoded int
+}
+
+// NewSnappyCodec returns a Codec which uses snappy's block format, prefixed
+// with the given marker. This is the same format as Resp.Compress uses.
+func NewSnappyCodec(marker []byte) Codec {
+	return snappyCodec{marker: marker, maxDecoded: defaultMaxDecodedSize}
+}
+
+func (c snappyCodec) Marker() []byte {
+	return c.marker
+}
+
+func (c snappyCodec) Encode(dst, src []byte) ([]byte, error) {
+	start := len(dst) + len(c.marker)
+	buf := grow(dst, len(c.marker)+snappy.MaxEncodedLen(len(src)))[:start]
+	copy(buf[len(dst):], c.marker)
+	enc := snappy.Encode(buf[start:cap(buf)], src)
+	return buf[:start+len(enc)], nil
+}
+
+func (c snappyCodec) Decode(dst, src []byte) ([]byte, error) {
+	n, err := c.decodedLen(src)
+	if err != nil {
+		return nil, err
+	}
+	buf := grow(dst, n)
+	dec, err := snappy.Decode(buf[len(dst):cap(buf)], src[len(c.marker):])
+	if err != nil {
+		return nil, err
+	}
+	return buf[:len(dst)+len(dec)], nil
+}
+
+func (c snappyCodec) decodedLen(src []byte) (int, error) {
+	n, err := snappy.DecodedLen(src[len(c.marker):])
+	if err != nil {
+		return 0, err
+	} else if n > c.maxDecoded {
+		return 0, ErrDecodedTooLarge
+	}
+	return n, nil
+}
+
+// grow returns b with room for at least n more bytes after its length
+func grow(b []byte, n int) []byte {
+	if cap(b)-len(b) >= n {
+		return b
+	}
+	nb := make([]byte, len(b), len(b)+n)
+	copy(nb, b)
+	return nb
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+type flateCodec struct {
+	marker     []byte
+	maxDecoded int
+	writers    sync.Pool
+	readers    sync.Pool
+}
+
+// NewFlateCodec returns a Codec which uses the raw DEFLATE format (RFC 1951),
+// prefixed with the given marker, compressing at the given level (see the
+// compress/flate package).
+func NewFlateCodec(marker []byte, level int) (Codec, error) {
+	if _, err := flate.NewWriter(nil, level); err != nil {
+		return nil, err
+	}
+	c := &flateCodec{marker: marker, maxDecoded: defaultMaxDecodedSize}
+	c.writers.New = func() interface{} {
+		w, _ := flate.NewWriter(nil, level)
+		return w
+	}
+	return c, nil
+}
+
+func (c *flateCodec) Marker() []byte {
+	return c.marker
+}
+
+func (c *flateCodec) Encode(dst, src []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(append(dst, c.marker...))
+	w := c.writers.Get().(*flate.Writer)
+	defer c.writers.Put(w)
+	w.Reset(buf)
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	} else if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c *flateCodec) Decode(dst, src []byte) ([]byte, error) {
+	br := bytes.NewReader(src[len(c.marker):])
+	r, _ := c.readers.Get().(io.ReadCloser)
+	if r == nil {
+		r = flate.NewReader(br)
+	} else if err := r.(flate.Resetter).Reset(br, nil); err != nil {
+		return nil, err
+	}
+	defer c.readers.Put(r)
+	return readAllInto(dst, r, c.maxDecoded)
+}
+
+// readAllInto appends everything read from r to dst, returning
+// ErrDecodedTooLarge if there's more than max bytes of it
+func readAllInto(dst []byte, r io.Reader, max int) ([]byte, error) {
+	buf := bytes.NewBuffer(dst)
+	n, err := buf.ReadFrom(io.LimitReader(r, int64(max)+1))
+	if err != nil {
+		return nil, err
+	} else if n > int64(max) {
+		return nil, ErrDecodedTooLarge
+	}
+	return buf.Bytes(), nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// gzipMagic is the start of every gzip member's header
+var gzipMagic = []byte{0x1f, 0x8b}
+
+type gzipCodec struct {
+	maxDecoded int
+	writers    sync.Pool
+	readers    sync.Pool
+}
+
+// NewGzipCodec returns a Codec which uses the gzip format, compressing at the
+// given level (see the compress/gzip package). Its marker is gzip's own magic
+// number, so values which were gzipped by something else can be decompressed
+// by it too.
+func NewGzipCodec(level int) (Codec, error) {
+	if _, err := gzip.NewWriterLevel(nil, level); err != nil {
+		return nil, err
+	}
+	c := &gzipCodec{maxDecoded: defaultMaxDecodedSize}
+	c.writers.New = func() interface{} {
+		w, _ := gzip.NewWriterLevel(nil, level)
+		return w
+	}
+	return c, nil
+}
+
+func (c *gzipCodec) Marker() []byte {
+	return gzipMagic
+}
+
+func (c *gzipCodec) Encode(dst, src []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(dst)
+	w := c.writers.Get().(*gzip.Writer)
+	defer c.writers.Put(w)
+	w.Reset(buf)
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	} else if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c *gzipCodec) Decode(dst, src []byte) ([]byte, error) {
+	br := bytes.NewReader(src)
+	r, _ := c.readers.Get().(*gzip.Reader)
+	if r == nil {
+		var err error
+		if r, err = gzip.NewReader(br); err != nil {
+			return nil, err
+		}
+	} else if err := r.Reset(br); err != nil {
+		return nil, err
+	}
+	defer c.readers.Put(r)
+	return readAllInto(dst, r, c.maxDecoded)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+////////////////////////////////////////////////////////////////////////////////
+
+// CompressOpts describe how a Client compresses the arguments of the commands
+// it sends, see Client.Compression
+type CompressOpts struct {
+	// The Codec values are compressed with. If nil nothing is compressed or
+	// decompressed.
+	Codec Codec
+
+	// Values shorter than this are sent as is. Default is 1024.
+	MinSize int
+}
+
+func (o CompressOpts) minSize() int {
+	if o.MinSize == 0 {
+		return 1024
+	}
+	return o.MinSize
+}
+
+// compressArgs returns the (already marshaled) args of the given command with
+// every value of at least MinSize bytes replaced by its compressed form. Only
+// the values of the commands in CommandValueArgs are compressed, keys, field
+// names, scripts and the like are always sent as they are. Like marshalArgs
+// the given slice is returned if nothing had to be changed, the caller's
+// slices are never modified.
+func (o CompressOpts) compressArgs(cmd string, args []interface{}) ([]interface{}, error) {
+	va, ok := CommandValueArgs[strings.ToUpper(cmd)]
+	if !ok {
+		return args, nil
+	}
+	var i int
+	return o.compressValues(va, &i, args)
+}
+
+// compressValues is compressArgs for the given args, the first of which is at
+// index *i of the flattened args. *i is advanced past all of them.
+func (o CompressOpts) compressValues(va ValueArgs, i *int, args []interface{}) ([]interface{}, error) {
+	var ret []interface{}
+	for j := range args {
+		m, changed, err := o.compressArg(va, i, args[j])
+		if err != nil {
+			return nil, err
+		} else if changed && ret == nil {
+			ret = make([]interface{}, len(args))
+			copy(ret, args[:j])
+		}
+		if ret != nil {
+			ret[j] = m
+		}
+	}
+	if ret == nil {
+		return args, nil
+	}
+	return ret, nil
+}
+
+func (o CompressOpts) compressArg(va ValueArgs, i *int, m interface{}) (interface{}, bool, error) {
+	switch mt := m.(type) {
+	case string:
+		*i++
+		if !va.IsValue(*i-1) || len(mt) < o.minSize() {
+			return m, false, nil
+		}
+		b, err := o.Codec.Encode(nil, []byte(mt))
+		return b, true, err
+	case []byte:
+		*i++
+		if !va.IsValue(*i-1) || len(mt) < o.minSize() {
+			return m, false, nil
+		}
+		b, err := o.Codec.Encode(nil, mt)
+		return b, true, err
+	case []string:
+		for j := range mt {
+			if va.IsValue(*i+j) && len(mt[j]) >= o.minSize() {
+				l := make([]interface{}, len(mt))
+				for j := range mt {
+					l[j] = mt[j]
+				}
+				l, err := o.compressValues(va, i, l)
+				return l, true, err
+			}
+		}
+		*i += len(mt)
+		return m, false, nil
+	case [][]byte:
+		for j := range mt {
+			if va.IsValue(*i+j) && len(mt[j]) >= o.minSize() {
+				l := make([]interface{}, len(mt))
+				for j := range mt {
+					l[j] = mt[j]
+				}
+				l, err := o.compressValues(va, i, l)
+				return l, true, err
+			}
+		}
+		*i += len(mt)
+		return m, false, nil
+	case []interface{}:
+		l, err := o.compressValues(va, i, mt)
+		if err != nil {
+			return nil, false, err
+		}
+		return l, len(l) > 0 && &l[0] != &mt[0], nil
+	}
+	*i += flattenedLength(m)
+	return m, false, nil
+}
@@ -0,0 +1,222 @@
+package redis
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"strings"
+	. "testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testCodecs(t *T) map[string]Codec {
+	fc, err := NewFlateCodec([]byte("\x00flate:"), gzip.BestSpeed)
+	require.Nil(t, err)
+	gc, err := NewGzipCodec(gzip.DefaultCompression)
+	require.Nil(t, err)
+	return map[string]Codec{
+		"snappy": NewSnappyCodec([]byte("\x00snappy:")),
+		"flate":  fc,
+		"gzip":   gc,
+	}
+}
+
+func TestCodecs(t *T) {
+	src := []byte(strings.Repeat("hello compression ", 100))
+	for name, c := range testCodecs(t) {
+		enc, err := c.Encode([]byte("pre"), src)
+		require.Nil(t, err, name)
+		assert.True(t, bytes.HasPrefix(enc, []byte("pre")), name)
+		enc = enc[3:]
+		assert.True(t, bytes.HasPrefix(enc, c.Marker()), name)
+		assert.True(t, len(enc) < len(src), name)
+
+		// Decode twice, so that pooled readers/writers are reused
+		for i := 0; i < 2; i++ {
+			dec, err := c.Decode([]byte("pre"), enc)
+			require.Nil(t, err, name)
+			assert.Equal(t, append([]byte("pre"), src...), dec, name)
+		}
+
+		_, err = c.Decode(nil, append(c.Marker(), "garbage"...))
+		assert.NotNil(t, err, name)
+	}
+
+	_, err := NewFlateCodec([]byte("x"), 100)
+	assert.NotNil(t, err)
+	_, err = NewGzipCodec(100)
+	assert.NotNil(t, err)
+}
+
+func TestCodecMaxDecoded(t *T) {
+	src := []byte(strings.Repeat("hello compression ", 100))
+	fc, err := NewFlateCodec([]byte("x"), gzip.BestSpeed)
+	require.Nil(t, err)
+	fc.(*flateCodec).maxDecoded = len(src) - 1
+	gc, err := NewGzipCodec(gzip.BestSpeed)
+	require.Nil(t, err)
+	gc.(*gzipCodec).maxDecoded = len(src) - 1
+
+	for name, c := range map[string]Codec{"flate": fc, "gzip": gc} {
+		enc, err := c.Encode(nil, src)
+		require.Nil(t, err, name)
+		_, err = c.Decode(nil, enc)
+		assert.Equal(t, ErrDecodedTooLarge, err, name)
+	}
+
+	// A snappy value's header claiming more than the limit isn't trusted
+	huge := append([]byte("x"), 0x80, 0x80, 0x80, 0x80, 0x04) // 1GB
+	_, err = NewSnappyCodec([]byte("x")).Decode(nil, huge)
+	assert.Equal(t, ErrDecodedTooLarge, err)
+}
+
+func TestRegisterCodec(t *T) {
+	c1 := NewSnappyCodec([]byte("\x00test-reg:"))
+	require.Nil(t, RegisterCodec(c1))
+	assert.Equal(t, ErrCodecConflict, RegisterCodec(c1))
+	assert.Equal(t, ErrCodecConflict, RegisterCodec(NewSnappyCodec([]byte("\x00test-reg"))))
+	assert.Equal(t, ErrCodecConflict, RegisterCodec(NewSnappyCodec([]byte("\x00test-reg:x"))))
+	assert.NotNil(t, RegisterCodec(NewSnappyCodec(nil)))
+
+	enc, err := c1.Encode(nil, []byte("foo"))
+	require.Nil(t, err)
+	assert.Equal(t, c1, CodecFor(enc))
+	assert.Nil(t, CodecFor([]byte("foo")))
+}
+
+func TestRespCompressWith(t *T) {
+	c := NewSnappyCodec([]byte("\x00test-resp:"))
+	require.Nil(t, RegisterCodec(c))
+
+	long := strings.Repeat("a", 100)
+	r := NewResp([]interface{}{long, "short", []interface{}{long}, 1})
+	require.Nil(t, r.CompressWith(c, 50))
+
+	l, err := r.Array()
+	require.Nil(t, err)
+	b, _ := l[0].Bytes()
+	assert.True(t, bytes.HasPrefix(b, c.Marker()))
+	assert.Equal(t, "short", mustStr(t, l[1]))
+	b, _ = l[2].val.([]Resp)[0].Bytes()
+	assert.True(t, bytes.HasPrefix(b, c.Marker()))
+
+	require.Nil(t, r.Decompress())
+	var i interface{}
+	require.Nil(t, r.Decode(&i))
+	assert.Equal(t, []interface{}{long, "short", []interface{}{long}, int64(1)}, i)
+
+	// A Str which can't be decompressed doesn't stop the others from being
+	bad := append(append([]byte{}, c.Marker()...), "garbage"...)
+	r = NewResp([]interface{}{long, bad, long})
+	require.Nil(t, r.CompressWith(c, 50))
+	assert.NotNil(t, r.Decompress())
+	l, err = r.Array()
+	require.Nil(t, err)
+	assert.Equal(t, long, mustStr(t, l[0]))
+	b, _ = l[1].Bytes()
+	assert.Equal(t, bad, b)
+	assert.Equal(t, long, mustStr(t, l[2]))
+
+	// A Resp read using a BufferPool is decompressed into a buffer from it
+	enc, err := c.Encode(nil, []byte(long))
+	require.Nil(t, err)
+	rr := NewRespReader(bytes.NewReader(append(
+		[]byte(fmt.Sprintf("$%d\r\n", len(enc))), append(enc, "\r\n"...)...,
+	)))
+	rr.BufferPool = NewBufferPool(1, 1024, 10)
+	r = rr.Read()
+	require.Nil(t, r.Decompress())
+	assert.Equal(t, long, mustStr(t, r))
+	assert.NotNil(t, r.pool)
+	r.ReleaseBuffers()
+
+	// Legacy Compress/Uncompress
+	r = NewResp(long)
+	assert.Nil(t, NewResp("short").Compress(50, []byte("M")))
+	require.NotNil(t, r.Compress(50, []byte("M")))
+	assert.NotEqual(t, long, mustStr(t, r))
+	assert.Nil(t, NewResp("short").Uncompress([]byte("M")))
+	require.NotNil(t, r.Uncompress([]byte("M")))
+	assert.Equal(t, long, mustStr(t, r))
+	r = NewResp([]interface{}{long, "Mgarbage"})
+	require.Nil(t, r.CompressWith(NewSnappyCodec([]byte("M")), 50))
+	require.NotNil(t, r.Uncompress([]byte("M")))
+	l, err = r.Array()
+	require.Nil(t, err)
+	assert.Equal(t, long, mustStr(t, l[0]))
+	assert.Equal(t, "Mgarbage", mustStr(t, l[1]))
+}
+
+func mustStr(t *T, r *Resp) string {
+	s, err := r.Str()
+	require.Nil(t, err)
+	return s
+}
+
+func TestClientCompression(t *T) {
+	gc, err := NewGzipCodec(gzip.DefaultCompression)
+	require.Nil(t, err)
+
+	long := strings.Repeat("compress me ", 100)
+	var stored string
+	cmdCh := make(chan []string, 10)
+	conn := pipeServer(t, cmdCh, func(cmd []string) *Resp {
+		switch cmd[0] {
+		case "SET":
+			stored = cmd[2]
+			return NewRespSimple("OK")
+		case "GET":
+			return NewResp(stored)
+		case "LRANGE":
+			return NewResp([]string{stored, string(gzipMagic) + "garbage", stored})
+		}
+		return NewResp(cmd[1:])
+	})
+
+	c, err := NewClientWithOpts(conn, DialOpts{
+		Compression: CompressOpts{Codec: gc, MinSize: 50},
+	})
+	require.Nil(t, err)
+	defer c.Close()
+
+	require.Nil(t, c.Cmd("SET", "foo", long).Err)
+	cmd := <-cmdCh
+	assert.Equal(t, "foo", cmd[1])
+	assert.True(t, strings.HasPrefix(cmd[2], string(gzipMagic)))
+	assert.True(t, len(cmd[2]) < len(long))
+
+	assert.Equal(t, long, mustStr(t, c.Cmd("GET", "foo")))
+	<-cmdCh
+
+	// Keys and field names are never compressed, only values
+	args := []string{long, long, "short", "short"}
+	l, err := c.Cmd("HSET", "h", args).List()
+	require.Nil(t, err)
+	assert.Equal(t, []string{"h", long, long, "short", "short"}, l)
+	assert.Equal(t, []string{long, long, "short", "short"}, args)
+	cmd = <-cmdCh
+	assert.Equal(t, long, cmd[2])
+	assert.True(t, strings.HasPrefix(cmd[3], string(gzipMagic)))
+	assert.Equal(t, "short", cmd[4])
+	assert.Equal(t, "short", cmd[5])
+
+	// Nor are the args of commands which don't store values
+	for _, args := range [][]interface{}{
+		{"EVAL", long, 0},
+		{"ECHO", long},
+		{"GET", long},
+	} {
+		require.Nil(t, c.Cmd(args[0].(string), args[1:]...).Err)
+		cmd = <-cmdCh
+		assert.Equal(t, long, cmd[1])
+	}
+
+	// Only the elements of a reply which can't be decompressed are left
+	// compressed
+	l, err = c.Cmd("LRANGE", "l", 0, -1).List()
+	require.Nil(t, err)
+	assert.Equal(t, []string{long, string(gzipMagic) + "garbage", long}, l)
+	<-cmdCh
+}
@@ -0,0 +1,511 @@
+package redis
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// KeySpec describes where some of a command's keys are found in its
+// arguments, following the key specifications which redis 7 returns from
+// COMMAND. Positions count the command's name as 0, and are those of the
+// arguments once flattened (see NewRespFlattenedStrings).
+//
+// The search for keys begins at Index if Keyword is empty. Otherwise it begins
+// right after the first argument equal to Keyword, which is looked for from
+// Index onwards, or from Index counted from the end backwards if Index is
+// negative. If the keyword isn't found the KeySpec has no keys.
+//
+// If KeyNum is false the keys go from where the search began up to LastKey,
+// which is relative to where the search began, or counted from the end if
+// negative (-1 being the last argument). If LastKey is negative and Limit is
+// greater than one only the first 1/Limit of the remaining arguments are
+// looked at, like with the stream names given to XREAD.
+//
+// If KeyNum is true the number of keys is given by the argument at
+// NumKeysIndex, and the keys start at FirstKey, both being relative to where
+// the search began, like with EVAL.
+//
+// In both cases KeyStep is the distance between two keys, 1 if not set.
+type KeySpec struct {
+	Index   int
+	Keyword string
+
+	LastKey int
+	Limit   int
+
+	KeyNum       bool
+	NumKeysIndex int
+	FirstKey     int
+
+	KeyStep int
+}
+
+// keys appends the keys the KeySpec finds in argv to the given slice
+func (ks KeySpec) keys(keys, argv []string) ([]string, error) {
+	begin := ks.Index
+	if ks.Keyword != "" {
+		var found bool
+		if begin >= 0 {
+			for i := begin; i < len(argv) && !found; i++ {
+				if found = strings.EqualFold(argv[i], ks.Keyword); found {
+					begin = i + 1
+				}
+			}
+		} else {
+			for i := len(argv) + begin; i > 0 && !found; i-- {
+				if found = strings.EqualFold(argv[i], ks.Keyword); found {
+					begin = i + 1
+				}
+			}
+		}
+		if !found {
+			return keys, nil
+		}
+	}
+	if begin <= 0 || begin >= len(argv) {
+		return keys, nil
+	}
+
+	step := ks.KeyStep
+	if step < 1 {
+		step = 1
+	}
+
+	first, last := begin, 0
+	if ks.KeyNum {
+		i := begin + ks.NumKeysIndex
+		if i >= len(argv) {
+			return keys, nil
+		}
+		n, err := strconv.Atoi(argv[i])
+		if err != nil || n < 0 {
+			return nil, errBadNumKeys
+		}
+		first = begin + ks.FirstKey
+		last = first + (n-1)*step
+		if last >= len(argv) {
+			return nil, errBadNumKeys
+		}
+	} else if ks.LastKey >= 0 {
+		last = begin + ks.LastKey
+	} else if ks.Limit > 1 {
+		last = begin + (len(argv)-begin)/ks.Limit + ks.LastKey
+	} else {
+		last = len(argv) + ks.LastKey
+	}
+
+	if last >= len(argv) {
+		last = len(argv) - 1
+	}
+	for i := first; i <= last; i += step {
+		keys = append(keys, argv[i])
+	}
+	return keys, nil
+}
+
+var errBadNumKeys = errors.New("number of keys can't be greater than number of args")
+
+// CommandTable maps command names to the KeySpecs giving the positions of
+// their keys. It's used to tell which keys a command is going to touch, e.g. in
+// order to route it to the right node of a cluster. It's safe to use from many
+// go-routines at once.
+//
+// A CommandTable made with NewCommandTable knows about the commands of redis
+// itself, and Refresh can be used to learn about those of the server actually
+// being used (e.g. from modules).
+type CommandTable struct {
+	mu    sync.RWMutex
+	specs map[string][]KeySpec
+
+	// The commands whose first argument is a subcommand, e.g. OBJECT, each of
+	// which has its own entry in specs as "OBJECT|ENCODING"
+	containers map[string]bool
+
+	// The commands which don't modify anything, and so can be performed on a
+	// replica
+	readOnly map[string]bool
+}
+
+// DefaultCommandTable is the CommandTable used by CmdKeys and by the other
+// packages of radix unless they're given another one
+var DefaultCommandTable = NewCommandTable()
+
+// NewCommandTable returns a CommandTable which knows about the commands of
+// redis itself
+func NewCommandTable() *CommandTable {
+	t := &CommandTable{
+		specs:      map[string][]KeySpec{},
+		containers: map[string]bool{},
+		readOnly:   map[string]bool{},
+	}
+	for cmd, specs := range builtinKeySpecs {
+		t.specs[cmd] = specs
+		if i := strings.IndexByte(cmd, '|'); i > 0 {
+			t.containers[cmd[:i]] = true
+		}
+	}
+	for _, cmd := range builtinContainers {
+		t.containers[cmd] = true
+	}
+	for _, cmd := range builtinReadOnly {
+		t.readOnly[cmd] = true
+	}
+	return t
+}
+
+// Set sets the KeySpecs of the given command, replacing any it had. A command
+// with no KeySpecs is known not to have any keys. The KeySpecs of a
+// subcommand are set using the command and subcommand separated by a pipe, e.g.
+// "XINFO|STREAM".
+func (t *CommandTable) Set(cmd string, specs ...KeySpec) {
+	cmd = strings.ToUpper(cmd)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.specs[cmd] = specs
+	if i := strings.IndexByte(cmd, '|'); i > 0 {
+		t.containers[cmd[:i]] = true
+	}
+}
+
+// SetReadOnly sets whether the given command only reads data, see ReadOnly.
+// Subcommands are given the same way as with Set.
+func (t *CommandTable) SetReadOnly(cmd string, readOnly bool) {
+	cmd = strings.ToUpper(cmd)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if readOnly {
+		t.readOnly[cmd] = true
+	} else {
+		delete(t.readOnly, cmd)
+	}
+}
+
+// ReadOnly returns whether the given command only reads data, and so can be
+// performed on a replica. Commands which the CommandTable doesn't know about
+// are assumed not to be read-only.
+func (t *CommandTable) ReadOnly(cmd string, args ...interface{}) bool {
+	ucmd := strings.ToUpper(cmd)
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if t.containers[ucmd] {
+		if len(args) == 0 {
+			return false
+		}
+		sub, err := NewRespFlattenedStrings(args[0]).List()
+		if err != nil || len(sub) == 0 {
+			return false
+		}
+		ucmd += "|" + strings.ToUpper(sub[0])
+	}
+	return t.readOnly[ucmd]
+}
+
+// Keys returns all of the keys the given command would touch, in the order
+// they appear in its arguments. Commands which the CommandTable doesn't know
+// about are assumed to take a single key as their first argument, in which
+// case an error is returned if there are no arguments at all.
+func (t *CommandTable) Keys(cmd string, args ...interface{}) ([]string, error) {
+	sargs, err := NewRespFlattenedStrings(args).List()
+	if err != nil {
+		return nil, err
+	}
+	argv := make([]string, 0, len(sargs)+1)
+	argv = append(argv, cmd)
+	argv = append(argv, sargs...)
+
+	ucmd := strings.ToUpper(cmd)
+	t.mu.RLock()
+	specs, ok := t.specs[ucmd]
+	if !ok && t.containers[ucmd] {
+		// An unknown subcommand of a known command is assumed to have no keys
+		ok = true
+		if len(argv) > 1 {
+			specs = t.specs[ucmd+"|"+strings.ToUpper(argv[1])]
+		}
+	}
+	t.mu.RUnlock()
+
+	if !ok {
+		if len(sargs) == 0 {
+			return nil, errBadCmdNoKey
+		}
+		return sargs[:1], nil
+	}
+
+	var keys []string
+	for _, spec := range specs {
+		if keys, err = spec.keys(keys, argv); err != nil {
+			return nil, err
+		}
+	}
+
+	// MIGRATE's single key argument is left empty when its KEYS option is
+	// used instead, in which case it's not actually a key
+	if ucmd == "MIGRATE" && len(keys) > 1 && keys[0] == "" {
+		keys = keys[1:]
+	}
+	return keys, nil
+}
+
+// CmdKeys is a helper function which returns all of the keys the given
+// command would touch, as known by the DefaultCommandTable. See
+// CommandTable's Keys method
+func CmdKeys(cmd string, args ...interface{}) ([]string, error) {
+	return DefaultCommandTable.Keys(cmd, args...)
+}
+
+// Refresh performs COMMAND on the given Client and loads its reply into the
+// CommandTable, see Load
+func (t *CommandTable) Refresh(c *Client) error {
+	return t.Load(c.Cmd("COMMAND"))
+}
+
+// Load sets the KeySpecs of every command found in the given reply to COMMAND
+// or COMMAND INFO, and whether it's read-only. The key specifications which servers from redis 7 on
+// return are used, along with those of subcommands. For older servers the
+// first key, last key and step are used, unless the command is flagged as
+// having movable keys, in which case whatever was already known about it is
+// kept.
+func (t *CommandTable) Load(r *Resp) error {
+	cmds, err := r.Array()
+	if err != nil {
+		return err
+	}
+	specs := map[string][]KeySpec{}
+	readOnly := map[string]bool{}
+	for _, cmd := range cmds {
+		if err := loadCommand(specs, readOnly, cmd); err != nil {
+			return err
+		}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for cmd, ro := range readOnly {
+		if ro {
+			t.readOnly[cmd] = true
+		} else {
+			delete(t.readOnly, cmd)
+		}
+	}
+	for cmd, s := range specs {
+		t.specs[cmd] = s
+		if i := strings.IndexByte(cmd, '|'); i > 0 {
+			t.containers[cmd[:i]] = true
+		}
+	}
+	return nil
+}
+
+var errBadCommandReply = errors.New("unexpected reply to COMMAND")
+
+// loadCommand adds the KeySpecs of a single command from a COMMAND reply, and
+// those of its subcommands, to the given map, along with whether it's
+// read-only
+func loadCommand(
+	specs map[string][]KeySpec, readOnly map[string]bool, r *Resp,
+) error {
+	// A nil element is what COMMAND INFO returns for an unknown command
+	if r.IsType(Nil) {
+		return nil
+	}
+	info, err := r.Array()
+	if err != nil || len(info) < 6 {
+		return errBadCommandReply
+	}
+	name, err := info[0].Str()
+	if err != nil {
+		return errBadCommandReply
+	}
+	name = strings.ToUpper(name)
+
+	flags, _ := info[2].List()
+	readOnly[name] = false
+	for _, flag := range flags {
+		if flag == "readonly" {
+			readOnly[name] = true
+		}
+	}
+
+	if len(info) >= 10 {
+		if subs, _ := info[9].Array(); len(subs) > 0 {
+			for _, sub := range subs {
+				if err := loadCommand(specs, readOnly, sub); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+
+	if len(info) >= 9 {
+		if rawSpecs, err := info[8].Array(); err == nil {
+			var s []KeySpec
+			for _, raw := range rawSpecs {
+				ks, ok, err := parseKeySpec(raw)
+				if err != nil {
+					return err
+				} else if ok {
+					s = append(s, ks)
+				}
+			}
+			specs[name] = s
+			return nil
+		}
+	}
+
+	// Servers older than redis 7 only give the first/last/step of the keys
+	firstKey, err1 := info[3].Int()
+	lastKey, err2 := info[4].Int()
+	step, err3 := info[5].Int()
+	if err1 != nil || err2 != nil || err3 != nil {
+		return errBadCommandReply
+	}
+	for _, flag := range flags {
+		if flag == "movablekeys" {
+			return nil
+		}
+	}
+	if firstKey <= 0 {
+		specs[name] = nil
+		return nil
+	}
+	if lastKey >= 0 {
+		lastKey -= firstKey
+	}
+	specs[name] = []KeySpec{{Index: firstKey, LastKey: lastKey, KeyStep: step}}
+	return nil
+}
+
+// parseKeySpec parses a single key specification from a COMMAND reply. The
+// returned bool is false if the key specification is of a type which isn't
+// supported (like "unknown"), in which case it's skipped.
+func parseKeySpec(r *Resp) (KeySpec, bool, error) {
+	var ks KeySpec
+	m, err := r.MapResp()
+	if err != nil {
+		return ks, false, errBadCommandReply
+	}
+
+	begin, ok := m["begin_search"]
+	if !ok {
+		return ks, false, errBadCommandReply
+	}
+	typ, spec, err := keySpecPart(begin)
+	if err != nil {
+		return ks, false, err
+	}
+	switch typ {
+	case "index":
+		ks.Index, err = spec["index"].Int()
+	case "keyword":
+		if ks.Keyword, err = spec["keyword"].Str(); err == nil {
+			ks.Index, err = spec["startfrom"].Int()
+		}
+	default:
+		return ks, false, nil
+	}
+	if err != nil {
+		return ks, false, errBadCommandReply
+	}
+
+	find, ok := m["find_keys"]
+	if !ok {
+		return ks, false, errBadCommandReply
+	}
+	if typ, spec, err = keySpecPart(find); err != nil {
+		return ks, false, err
+	}
+	switch typ {
+	case "range":
+		if ks.LastKey, err = spec["lastkey"].Int(); err == nil {
+			if ks.KeyStep, err = spec["keystep"].Int(); err == nil {
+				ks.Limit, err = spec["limit"].Int()
+			}
+		}
+	case "keynum":
+		ks.KeyNum = true
+		if ks.NumKeysIndex, err = spec["keynumidx"].Int(); err == nil {
+			if ks.FirstKey, err = spec["firstkey"].Int(); err == nil {
+				ks.KeyStep, err = spec["keystep"].Int()
+			}
+		}
+	default:
+		return ks, false, nil
+	}
+	if err != nil {
+		return ks, false, errBadCommandReply
+	}
+	return ks, true, nil
+}
+
+// keySpecPart returns the type and spec of either the begin_search or
+// find_keys part of a key specification. Missing fields of the spec are
+// returned as Resps of type Nil, whose Int returns an error.
+func keySpecPart(r *Resp) (string, map[string]*Resp, error) {
+	m, err := r.MapResp()
+	if err != nil {
+		return "", nil, errBadCommandReply
+	}
+	t, ok := m["type"]
+	if !ok {
+		return "", nil, errBadCommandReply
+	}
+	typ, err := t.Str()
+	if err != nil {
+		return "", nil, errBadCommandReply
+	}
+	spec := map[string]*Resp{}
+	if s, ok := m["spec"]; ok {
+		if spec, err = s.MapResp(); err != nil {
+			return "", nil, errBadCommandReply
+		}
+	}
+	for _, k := range []string{"index", "keyword", "startfrom", "lastkey", "keystep", "limit", "keynumidx", "firstkey"} {
+		if _, ok := spec[k]; !ok {
+			spec[k] = NewResp(nil)
+		}
+	}
+	return typ, spec, nil
+}
+
+// ValueArgs describes which of a command's arguments are the values it writes,
+// as opposed to its keys, field names, options and the like. Unlike with
+// KeySpec positions are those of the flattened arguments not counting the
+// command's name. The values are the argument at First, and if Step isn't zero
+// every Step arguments after it. Each value is stored under the first
+// argument, or if KeyBefore is set under the argument right before it, like
+// with MSET.
+type ValueArgs struct {
+	First, Step int
+	KeyBefore   bool
+}
+
+// IsValue returns whether the argument at index i is one of the values
+func (va ValueArgs) IsValue(i int) bool {
+	if i < va.First {
+		return false
+	} else if va.Step == 0 {
+		return i == va.First
+	}
+	return (i-va.First)%va.Step == 0
+}
+
+// CommandValueArgs are the ValueArgs of the string and hash commands which
+// write values, keyed by the command's upper case name. These are the values
+// which a Client compresses (see CompressOpts) and util.EncryptedCmder
+// encrypts. It mustn't be modified while either is in use.
+var CommandValueArgs = map[string]ValueArgs{
+	"SET":    {First: 1},
+	"SETNX":  {First: 1},
+	"GETSET": {First: 1},
+	"SETEX":  {First: 2},
+	"PSETEX": {First: 2},
+	"MSET":   {First: 1, Step: 2, KeyBefore: true},
+	"MSETNX": {First: 1, Step: 2, KeyBefore: true},
+	"HSET":   {First: 2, Step: 2},
+	"HSETNX": {First: 2},
+	"HMSET":  {First: 2, Step: 2},
+}
@@ -0,0 +1,130 @@
+package redis
+
+import (
+	. "testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCmdKeys(t *T) {
+	for _, tc := range []struct {
+		cmd  string
+		args []interface{}
+		keys []string
+	}{
+		{"GET", []interface{}{"foo"}, []string{"foo"}},
+		{"get", []interface{}{"foo"}, []string{"foo"}},
+		{"PING", nil, nil},
+		{"MGET", []interface{}{[]string{"a", "b"}, "c"}, []string{"a", "b", "c"}},
+		{"MSET", []interface{}{"a", 1, "b", 2}, []string{"a", "b"}},
+		{"BLPOP", []interface{}{"a", "b", 0}, []string{"a", "b"}},
+		{"EVAL", []interface{}{"return 1", 2, "a", "b", "arg"}, []string{"a", "b"}},
+		{"EVAL", []interface{}{"return 1", 0, "arg"}, nil},
+		{"ZUNIONSTORE", []interface{}{"dst", 2, "a", "b", "WEIGHTS", 1, 2}, []string{"dst", "a", "b"}},
+		{"XREAD", []interface{}{"COUNT", 1, "STREAMS", "a", "b", "0", "0"}, []string{"a", "b"}},
+		{"XREADGROUP", []interface{}{"GROUP", "g", "c", "STREAMS", "a", ">"}, []string{"a"}},
+		{"OBJECT", []interface{}{"ENCODING", "foo"}, []string{"foo"}},
+		{"OBJECT", []interface{}{"HELP"}, nil},
+		{"MIGRATE", []interface{}{"host", 6379, "foo", 0, 5000}, []string{"foo"}},
+		{"MIGRATE", []interface{}{"host", 6379, "", 0, 5000, "KEYS", "a", "b"}, []string{"a", "b"}},
+		{"BITOP", []interface{}{"AND", "d", "a", "b"}, []string{"d", "a", "b"}},
+		{"BITOP", []interface{}{"NOT", "d", "a"}, []string{"d", "a"}},
+		{"SORT", []interface{}{"src"}, []string{"src"}},
+		{"SORT", []interface{}{"src", "LIMIT", 0, 10, "STORE", "dst"}, []string{"src", "dst"}},
+		{"sort", []interface{}{"src", "store", "dst", "ALPHA"}, []string{"src", "dst"}},
+		{"SORT_RO", []interface{}{"src", "ALPHA"}, []string{"src"}},
+		{"GEORADIUS", []interface{}{"g", 15, 37, 200, "km"}, []string{"g"}},
+		{"GEORADIUS", []interface{}{"g", 15, 37, 200, "km", "STORE", "dst"}, []string{"g", "dst"}},
+		{"GEORADIUS", []interface{}{"g", 15, 37, 200, "km", "ASC", "STOREDIST", "dst"}, []string{"g", "dst"}},
+		{"GEORADIUSBYMEMBER", []interface{}{"g", "m", 200, "km", "STORE", "dst"}, []string{"g", "dst"}},
+		{"GEORADIUSBYMEMBER", []interface{}{"g", "m", 200, "km", "STOREDIST", "dst"}, []string{"g", "dst"}},
+		{"GEORADIUSBYMEMBER", []interface{}{"g", "m", 200, "km", "COUNT", 5}, []string{"g"}},
+		{"MODULE.CMD", []interface{}{"foo", "bar"}, []string{"foo"}},
+	} {
+		keys, err := CmdKeys(tc.cmd, tc.args...)
+		require.Nil(t, err, "%s %v", tc.cmd, tc.args)
+		assert.Equal(t, tc.keys, keys, "%s %v", tc.cmd, tc.args)
+	}
+
+	_, err := CmdKeys("EVAL", "return 1", 3, "a")
+	assert.NotNil(t, err)
+	_, err = CmdKeys("MODULE.CMD")
+	assert.NotNil(t, err)
+}
+
+func TestCommandTableLoad(t *T) {
+	t.Parallel()
+	ct := NewCommandTable()
+
+	// COMMAND INFO as returned by redis 7, for a module's command which has
+	// its keys after a keyword, and by redis 6, which only gives the first
+	// key, last key and step
+	r := NewResp([]interface{}{
+		[]interface{}{
+			"mod.cmd", -2, []string{"readonly"}, 0, 0, 0, []string{}, []string{},
+			[]interface{}{
+				[]interface{}{
+					"flags", []string{"RO"},
+					"begin_search", []interface{}{
+						"type", "keyword",
+						"spec", []interface{}{"keyword", "KEYS", "startfrom", 1},
+					},
+					"find_keys", []interface{}{
+						"type", "range",
+						"spec", []interface{}{"lastkey", -1, "keystep", 1, "limit", 0},
+					},
+				},
+			},
+			[]interface{}{},
+		},
+		[]interface{}{"old.cmd", -3, []string{"write"}, 1, -1, 2},
+		[]interface{}{"EVAL", -3, []string{"movablekeys"}, 0, 0, 0},
+		nil,
+	})
+	require.Nil(t, ct.Load(r))
+
+	keys, err := ct.Keys("MOD.CMD", "x", "KEYS", "a", "b")
+	require.Nil(t, err)
+	assert.Equal(t, []string{"a", "b"}, keys)
+
+	keys, err = ct.Keys("old.cmd", "a", 1, "b", 2)
+	require.Nil(t, err)
+	assert.Equal(t, []string{"a", "b"}, keys)
+
+	// What was known about a command with movable keys is kept
+	keys, err = ct.Keys("EVAL", "return 1", 1, "a")
+	require.Nil(t, err)
+	assert.Equal(t, []string{"a"}, keys)
+
+	// The default table is left alone
+	keys, err = CmdKeys("MOD.CMD", "x", "KEYS", "a")
+	require.Nil(t, err)
+	assert.Equal(t, []string{"x"}, keys)
+}
+
+func TestCommandTableReadOnly(t *T) {
+	ct := NewCommandTable()
+	assert.True(t, ct.ReadOnly("get", "foo"))
+	assert.False(t, ct.ReadOnly("SET", "foo", "bar"))
+	assert.True(t, ct.ReadOnly("OBJECT", "encoding", "foo"))
+	assert.False(t, ct.ReadOnly("OBJECT"))
+	assert.False(t, ct.ReadOnly("MODULE.GET", "foo"))
+
+	ct.SetReadOnly("module.get", true)
+	assert.True(t, ct.ReadOnly("MODULE.GET", "foo"))
+	assert.False(t, DefaultCommandTable.ReadOnly("MODULE.GET", "foo"))
+}
+
+func TestCommandValueArgs(t *T) {
+	set := CommandValueArgs["SET"]
+	assert.False(t, set.IsValue(0))
+	assert.True(t, set.IsValue(1))
+	assert.False(t, set.IsValue(2))
+
+	hset := CommandValueArgs["HSET"]
+	assert.False(t, hset.IsValue(1))
+	assert.True(t, hset.IsValue(2))
+	assert.False(t, hset.IsValue(3))
+	assert.True(t, hset.IsValue(4))
+}
@@ -0,0 +1,499 @@
+package redis
+
+import (
+	"encoding"
+	"errors"
+	"fmt"
+	"math/big"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// RespUnmarshaler is implemented by types which know how to decode themselves
+// from a Resp. Decode will call UnmarshalResp instead of decoding into the type
+// itself, even for a Nil Resp.
+type RespUnmarshaler interface {
+	UnmarshalResp(r *Resp) error
+}
+
+var (
+	typeOfRespUnmarshaler = reflect.TypeOf((*RespUnmarshaler)(nil)).Elem()
+	typeOfBigInt          = reflect.TypeOf(big.Int{})
+	typeOfResp            = reflect.TypeOf(Resp{})
+
+	errDecodeNotPtr = errors.New("decode destination must be a non-nil pointer")
+)
+
+// Decode fills the value pointed to by v with the contents of the Resp, using
+// reflection to interpret v's type:
+//
+//	* Strings, []byte, all numeric types, bool and big.Int are filled from Str,
+//	  Int, Double, Bool and BigNum Resps, parsing strings where needed
+//	* Slices and arrays are filled from aggregate Resps, element by element
+//	* Maps are filled from aggregate Resps of alternating keys and values (e.g.
+//	  the reply to HGETALL), with keys and values decoded into the map's types
+//	* Structs are filled the same way as maps, with each key being matched to
+//	  a field. The key for a field is given by its `redis:"name"` tag, or is
+//	  the field's name if it has none. Fields tagged with `redis:"-"` and keys
+//	  without a field are ignored. Fields of embedded structs are treated as if
+//	  they were fields of the outer struct
+//	* Pointers are allocated if nil and the value they point to is filled
+//	* An empty interface is filled with string, int64, float64, bool, *big.Int,
+//	  []interface{} or map[string]interface{}, depending on the Resp's type
+//	* Types implementing RespUnmarshaler decode themselves, and those
+//	  implementing encoding.TextUnmarshaler or encoding.BinaryUnmarshaler
+//	  (e.g. time.Time) are decoded from Str Resps using those
+//	* A Resp (or *Resp) is filled with a copy of the Resp itself
+//
+// A Nil Resp, or Nil element of an aggregate, sets the value to its zero
+// value. If r.Err != nil, or any element of an aggregate is an error, that
+// error will be returned.
+//
+//	var user struct {
+//		Name  string `redis:"name"`
+//		Age   int    `redis:"age"`
+//		Email *string
+//	}
+//	err := client.Cmd("HGETALL", "user:1").Decode(&user)
+//
+func (r *Resp) Decode(v interface{}) error {
+	if r.Err != nil {
+		return r.Err
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return errDecodeNotPtr
+	}
+	return decodeValue(r, rv.Elem())
+}
+
+func decodeErr(r *Resp, t reflect.Type) error {
+	return fmt.Errorf("cannot decode %s into %s", r, t)
+}
+
+func decodeValue(r *Resp, v reflect.Value) error {
+	if r.Err != nil {
+		return r.Err
+	}
+
+	// Check for a RespUnmarshaler before anything else, allocating the pointer
+	// it will be called on if necessary
+	if v.Kind() == reflect.Ptr && v.Type().Implements(typeOfRespUnmarshaler) {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return v.Interface().(RespUnmarshaler).UnmarshalResp(r)
+	} else if v.CanAddr() && v.Addr().Type().Implements(typeOfRespUnmarshaler) {
+		return v.Addr().Interface().(RespUnmarshaler).UnmarshalResp(r)
+	}
+
+	switch v.Type() {
+	case typeOfResp:
+		v.Set(reflect.ValueOf(*r))
+		return nil
+	case typeOfBigInt:
+		if r.IsType(Nil) {
+			v.Set(reflect.Zero(v.Type()))
+			return nil
+		}
+		bi, err := r.BigInt()
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(*bi))
+		return nil
+	}
+
+	if r.IsType(Nil) {
+		v.Set(reflect.Zero(v.Type()))
+		return nil
+	}
+
+	// Strings can be decoded by the same interfaces which are used to encode
+	// arguments, e.g. for time.Time
+	if v.CanAddr() && r.IsType(Str) {
+		switch u := v.Addr().Interface().(type) {
+		case encoding.TextUnmarshaler:
+			b, err := r.Bytes()
+			if err != nil {
+				return err
+			}
+			return u.UnmarshalText(b)
+		case encoding.BinaryUnmarshaler:
+			b, err := r.Bytes()
+			if err != nil {
+				return err
+			}
+			return u.UnmarshalBinary(b)
+		}
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return decodeValue(r, v.Elem())
+
+	case reflect.Interface:
+		if v.NumMethod() != 0 {
+			return decodeErr(r, v.Type())
+		}
+		i, err := r.natural()
+		if err != nil {
+			return err
+		}
+		if i != nil {
+			v.Set(reflect.ValueOf(i))
+		} else {
+			v.Set(reflect.Zero(v.Type()))
+		}
+		return nil
+
+	case reflect.String:
+		s, err := r.scalarStr()
+		if err != nil {
+			return err
+		}
+		v.SetString(s)
+		return nil
+
+	case reflect.Bool:
+		b, err := r.Bool()
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+		return nil
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		s, err := r.scalarStr()
+		if err != nil {
+			return err
+		}
+		i, err := strconv.ParseInt(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(i)
+		return nil
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
+		reflect.Uint64, reflect.Uintptr:
+		s, err := r.scalarStr()
+		if err != nil {
+			return err
+		}
+		u, err := strconv.ParseUint(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(u)
+		return nil
+
+	case reflect.Float32, reflect.Float64:
+		s, err := r.scalarStr()
+		if err != nil {
+			return err
+		}
+		f, err := strconv.ParseFloat(s, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+		return nil
+
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 && r.IsType(Str) {
+			b, err := r.Bytes()
+			if err != nil {
+				return err
+			}
+			// The Resp's bytes may be backed by a pooled buffer, so they're
+			// always copied
+			bb := reflect.MakeSlice(v.Type(), len(b), len(b))
+			reflect.Copy(bb, reflect.ValueOf(b))
+			v.Set(bb)
+			return nil
+		}
+		l, err := r.aggregate(v.Type())
+		if err != nil {
+			return err
+		}
+		s := reflect.MakeSlice(v.Type(), len(l), len(l))
+		for i := range l {
+			if err := decodeValue(&l[i], s.Index(i)); err != nil {
+				return err
+			}
+		}
+		v.Set(s)
+		return nil
+
+	case reflect.Array:
+		l, err := r.aggregate(v.Type())
+		if err != nil {
+			return err
+		}
+		for i := 0; i < v.Len(); i++ {
+			if i >= len(l) {
+				v.Index(i).Set(reflect.Zero(v.Type().Elem()))
+			} else if err := decodeValue(&l[i], v.Index(i)); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case reflect.Map:
+		l, err := r.pairs(v.Type())
+		if err != nil {
+			return err
+		}
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+		kt, et := v.Type().Key(), v.Type().Elem()
+		for i := 0; i < len(l); i += 2 {
+			k := reflect.New(kt).Elem()
+			if err := decodeValue(&l[i], k); err != nil {
+				return err
+			}
+			e := reflect.New(et).Elem()
+			if err := decodeValue(&l[i+1], e); err != nil {
+				return err
+			}
+			v.SetMapIndex(k, e)
+		}
+		return nil
+
+	case reflect.Struct:
+		l, err := r.pairs(v.Type())
+		if err != nil {
+			return err
+		}
+		fields := structFields(v.Type())
+		for i := 0; i < len(l); i += 2 {
+			k, err := l[i].scalarStr()
+			if err != nil {
+				return err
+			}
+			f, ok := fields.byName[k]
+			if !ok {
+				continue
+			}
+			fv, err := fieldByIndex(v, f.index)
+			if err != nil {
+				return err
+			}
+			if err := decodeValue(&l[i+1], fv); err != nil {
+				return fmt.Errorf("field %s: %s", k, err)
+			}
+		}
+		return nil
+	}
+
+	return decodeErr(r, v.Type())
+}
+
+// scalarStr returns the string form of any non-aggregate Resp, so that it can
+// be parsed into whatever type is being decoded into
+func (r *Resp) scalarStr() (string, error) {
+	switch v := r.val.(type) {
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64), nil
+	case bool:
+		if v {
+			return "1", nil
+		}
+		return "0", nil
+	case *big.Int:
+		return v.String(), nil
+	}
+	return r.Str()
+}
+
+func (r *Resp) aggregate(t reflect.Type) ([]Resp, error) {
+	if !r.IsType(Aggregate) {
+		return nil, decodeErr(r, t)
+	}
+	return r.val.([]Resp), nil
+}
+
+func (r *Resp) pairs(t reflect.Type) ([]Resp, error) {
+	l, err := r.aggregate(t)
+	if err != nil {
+		return nil, err
+	}
+	if len(l)%2 != 0 {
+		return nil, errors.New("reply has odd number of elements")
+	}
+	return l, nil
+}
+
+// natural returns the Resp's value as the go type which most naturally
+// represents it, for decoding into an empty interface
+func (r *Resp) natural() (interface{}, error) {
+	if r.Err != nil {
+		return nil, r.Err
+	}
+
+	switch v := r.val.(type) {
+	case int64, float64, bool:
+		return v, nil
+	case *big.Int:
+		return new(big.Int).Set(v), nil
+	case []Resp:
+		if r.IsType(Map | Attr) {
+			m := make(map[string]interface{}, len(v)/2)
+			for i := 0; i < len(v); i += 2 {
+				k, err := v[i].scalarStr()
+				if err != nil {
+					return nil, err
+				}
+				if m[k], err = v[i+1].natural(); err != nil {
+					return nil, err
+				}
+			}
+			return m, nil
+		}
+		l := make([]interface{}, len(v))
+		for i := range v {
+			var err error
+			if l[i], err = v[i].natural(); err != nil {
+				return nil, err
+			}
+		}
+		return l, nil
+	}
+
+	if r.IsType(Nil) {
+		return nil, nil
+	}
+	return r.Str()
+}
+
+// fieldByIndex is like reflect.Value.FieldByIndex, but allocates nil pointers
+// to embedded structs along the way
+func fieldByIndex(v reflect.Value, index []int) (reflect.Value, error) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				if !v.CanSet() {
+					return reflect.Value{}, fmt.Errorf(
+						"cannot set embedded pointer to unexported struct %s",
+						v.Type().Elem(),
+					)
+				}
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v, nil
+}
+
+// field describes a single struct field which is decoded from or encoded into
+// a key in a redis reply or command
+type field struct {
+	name      string
+	index     []int
+	omitEmpty bool
+}
+
+type fieldSet struct {
+	list   []field
+	byName map[string]field
+}
+
+var fieldCache = struct {
+	sync.RWMutex
+	m map[reflect.Type]*fieldSet
+}{m: map[reflect.Type]*fieldSet{}}
+
+// structFields returns the fields of the given struct type, taking into
+// account redis tags and embedded structs. The results are cached per type.
+func structFields(t reflect.Type) *fieldSet {
+	fieldCache.RLock()
+	fs, ok := fieldCache.m[t]
+	fieldCache.RUnlock()
+	if ok {
+		return fs
+	}
+
+	fs = &fieldSet{byName: map[string]field{}}
+	for _, f := range typeFields(t) {
+		// Fields on the outer struct take precedence over those of embedded
+		// structs with the same name, as in go itself
+		if _, ok := fs.byName[f.name]; ok {
+			continue
+		}
+		fs.byName[f.name] = f
+		fs.list = append(fs.list, f)
+	}
+
+	fieldCache.Lock()
+	fieldCache.m[t] = fs
+	fieldCache.Unlock()
+	return fs
+}
+
+// typeFields returns the fields of a struct type in breadth first order, so
+// shallower fields always come before deeper ones with the same name. The
+// embedded structs found at one depth are only looked into once all of the
+// fields at that depth have been collected.
+func typeFields(t reflect.Type) []field {
+	type embedded struct {
+		t     reflect.Type
+		index []int
+	}
+	var fields []field
+	seen := map[reflect.Type]bool{t: true}
+	next := []embedded{{t: t}}
+	for len(next) > 0 {
+		level := next
+		next = nil
+		for _, e := range level {
+			for i := 0; i < e.t.NumField(); i++ {
+				sf := e.t.Field(i)
+				tag := sf.Tag.Get("redis")
+				if tag == "-" {
+					continue
+				}
+				name, opts := tag, ""
+				if i := strings.Index(tag, ","); i >= 0 {
+					name, opts = tag[:i], tag[i:]
+				}
+
+				index := append(append([]int{}, e.index...), i)
+				ft := sf.Type
+				if ft.Kind() == reflect.Ptr {
+					ft = ft.Elem()
+				}
+				if sf.Anonymous && name == "" && ft.Kind() == reflect.Struct {
+					if !seen[ft] {
+						seen[ft] = true
+						next = append(next, embedded{t: ft, index: index})
+					}
+					continue
+				} else if sf.PkgPath != "" {
+					// unexported
+					continue
+				}
+
+				if name == "" {
+					name = sf.Name
+				}
+				fields = append(fields, field{
+					name:      name,
+					index:     index,
+					omitEmpty: strings.Contains(opts+",", ",omitempty,"),
+				})
+			}
+		}
+	}
+	return fields
+}
@@ -0,0 +1,179 @@
+package redis
+
+import (
+	"math/big"
+	. "testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type decodeInner struct {
+	Inner string `redis:"inner"`
+}
+
+type decodeStruct struct {
+	decodeInner
+	Name    string `redis:"name"`
+	Age     int    `redis:"age"`
+	Score   float64
+	Tags    []string       `redis:"tags"`
+	Attrs   map[string]int `redis:"attrs"`
+	Email   *string        `redis:"email"`
+	Skipped string         `redis:"-"`
+	Raw     []byte         `redis:"raw"`
+}
+
+// decodeShallow and decodeDeep both end up with a Name field, decodeShallow's
+// being the shallower one even though decodeDeep comes first
+type decodeNamed struct {
+	Name string
+}
+
+type decodeDeep struct {
+	decodeNamed
+}
+
+type decodeShallow struct {
+	Name string
+}
+
+type decodeEmbeds struct {
+	decodeDeep
+	decodeShallow
+}
+
+type upperStr string
+
+func (u *upperStr) UnmarshalResp(r *Resp) error {
+	s, err := r.Str()
+	if err != nil {
+		return err
+	}
+	*u = upperStr("<" + s + ">")
+	return nil
+}
+
+func TestDecode(t *T) {
+	var s string
+	require.Nil(t, pretendRead("$3\r\nfoo\r\n").Decode(&s))
+	assert.Equal(t, "foo", s)
+
+	var i int8
+	require.Nil(t, pretendRead(":12\r\n").Decode(&i))
+	assert.Equal(t, int8(12), i)
+	require.Nil(t, pretendRead("$2\r\n-3\r\n").Decode(&i))
+	assert.Equal(t, int8(-3), i)
+	assert.NotNil(t, pretendRead(":300\r\n").Decode(&i))
+
+	var u uint64
+	require.Nil(t, pretendRead("$20\r\n18446744073709551615\r\n").Decode(&u))
+	assert.Equal(t, uint64(18446744073709551615), u)
+
+	var f float32
+	require.Nil(t, pretendRead(",1.5\r\n").Decode(&f))
+	assert.Equal(t, float32(1.5), f)
+
+	var b bool
+	require.Nil(t, pretendRead("#t\r\n").Decode(&b))
+	assert.True(t, b)
+
+	var bi big.Int
+	require.Nil(t, pretendRead("(12345678901234567890123\r\n").Decode(&bi))
+	assert.Equal(t, "12345678901234567890123", bi.String())
+
+	var tm time.Time
+	require.Nil(t, pretendRead("+2020-01-02T03:04:05Z\r\n").Decode(&tm))
+	assert.Equal(t, time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC), tm)
+
+	// Nil sets the zero value
+	s = "foo"
+	require.Nil(t, pretendRead("$-1\r\n").Decode(&s))
+	assert.Equal(t, "", s)
+	sp := &s
+	require.Nil(t, pretendRead("_\r\n").Decode(&sp))
+	assert.Nil(t, sp)
+
+	var l []int
+	require.Nil(t, pretendRead("*3\r\n:1\r\n$1\r\n2\r\n:3\r\n").Decode(&l))
+	assert.Equal(t, []int{1, 2, 3}, l)
+
+	var a [2]string
+	require.Nil(t, pretendRead("*1\r\n+a\r\n").Decode(&a))
+	assert.Equal(t, [2]string{"a", ""}, a)
+
+	var m map[string]int
+	require.Nil(t, pretendRead("%2\r\n+a\r\n:1\r\n+b\r\n:2\r\n").Decode(&m))
+	assert.Equal(t, map[string]int{"a": 1, "b": 2}, m)
+	var mi map[int][]string
+	require.Nil(t, pretendRead("*2\r\n$1\r\n1\r\n*1\r\n+x\r\n").Decode(&mi))
+	assert.Equal(t, map[int][]string{1: {"x"}}, mi)
+
+	var iface interface{}
+	require.Nil(t, pretendRead("*3\r\n+a\r\n:1\r\n%1\r\n+k\r\n_\r\n").Decode(&iface))
+	assert.Equal(t, []interface{}{"a", int64(1), map[string]interface{}{"k": nil}}, iface)
+
+	var us upperStr
+	require.Nil(t, pretendRead("+foo\r\n").Decode(&us))
+	assert.Equal(t, upperStr("<foo>"), us)
+	var usl []*upperStr
+	require.Nil(t, pretendRead("*1\r\n+bar\r\n").Decode(&usl))
+	require.Len(t, usl, 1)
+	assert.Equal(t, upperStr("<bar>"), *usl[0])
+
+	var r Resp
+	require.Nil(t, pretendRead(":5\r\n").Decode(&r))
+	assert.Equal(t, Int, r.typ)
+
+	// Errors
+	assert.Equal(t, errDecodeNotPtr, pretendRead("+foo\r\n").Decode(s))
+	assert.Equal(t, &Error{Code: "ERR", Msg: "foo"}, pretendRead("-ERR foo\r\n").Decode(&s))
+	assert.Equal(t, &Error{Code: "ERR", Msg: "foo"}, pretendRead("*1\r\n-ERR foo\r\n").Decode(&l))
+	assert.NotNil(t, pretendRead("+foo\r\n").Decode(&l))
+	assert.NotNil(t, pretendRead("*1\r\n+foo\r\n").Decode(&m))
+}
+
+func TestDecodeStruct(t *T) {
+	raw := "*20\r\n" +
+		"$4\r\nname\r\n$3\r\nbob\r\n" +
+		"$3\r\nage\r\n$2\r\n42\r\n" +
+		"$5\r\nScore\r\n$3\r\n1.5\r\n" +
+		"$4\r\ntags\r\n*2\r\n+a\r\n+b\r\n" +
+		"$5\r\nattrs\r\n%1\r\n+x\r\n:1\r\n" +
+		"$5\r\nemail\r\n$5\r\na@b.c\r\n" +
+		"$7\r\nSkipped\r\n$3\r\nnop\r\n" +
+		"$3\r\nraw\r\n$3\r\nraw\r\n" +
+		"$5\r\ninner\r\n$2\r\nin\r\n" +
+		"$7\r\nunknown\r\n$3\r\nnop\r\n"
+
+	var ds decodeStruct
+	require.Nil(t, pretendRead(raw).Decode(&ds))
+	email := "a@b.c"
+	assert.Equal(t, decodeStruct{
+		decodeInner: decodeInner{Inner: "in"},
+		Name:        "bob",
+		Age:         42,
+		Score:       1.5,
+		Tags:        []string{"a", "b"},
+		Attrs:       map[string]int{"x": 1},
+		Email:       &email,
+		Raw:         []byte("raw"),
+	}, ds)
+
+	// Pointers to structs are allocated, and Nil fields are zeroed
+	var dsp *decodeStruct
+	require.Nil(t, pretendRead("%2\r\n+name\r\n+al\r\n+email\r\n_\r\n").Decode(&dsp))
+	require.NotNil(t, dsp)
+	assert.Equal(t, "al", dsp.Name)
+	assert.Nil(t, dsp.Email)
+
+	assert.NotNil(t, pretendRead("*2\r\n+age\r\n+old\r\n").Decode(&ds))
+
+	// The shallowest of the embedded fields with the same name wins, whatever
+	// the order they're embedded in
+	var de decodeEmbeds
+	require.Nil(t, pretendRead("%1\r\n+Name\r\n+al\r\n").Decode(&de))
+	assert.Equal(t, "al", de.decodeShallow.Name)
+	assert.Equal(t, "", de.decodeDeep.Name)
+}
@@ -0,0 +1,181 @@
+package redis
+
+import (
+	"crypto/tls"
+	"net"
+	"time"
+)
+
+// DialOpts are options which can be passed into DialWithOpts or
+// NewClientWithOpts. They describe how to connect to a redis instance and how
+// to initialize the connection once it's made, e.g. by authenticating and
+// selecting a database. Any fields left as their zero value are ignored.
+type DialOpts struct {
+	// The maximum time to spend establishing the connection. Default is to use
+	// the operating system's timeout, if any.
+	ConnectTimeout time.Duration
+
+	// The ReadTimeout/WriteTimeout set on the resulting Client
+	ReadTimeout, WriteTimeout time.Duration
+
+	// If Password is set the connection is authenticated using AUTH. If
+	// Username is set as well it's sent along with the password, as is needed
+	// for redis 6 ACL users.
+	Username, Password string
+
+	// The database which will be SELECTed on the connection
+	DB int
+
+	// The name which will be set on the connection using CLIENT SETNAME, so
+	// that it can be identified in CLIENT LIST
+	ClientName string
+
+	// The version of the redis protocol which will be negotiated with HELLO,
+	// see Client.Hello. Default is to not send HELLO, and therefore to use
+	// RESP2.
+	Protocol int
+
+	// If set this is used to establish the connection instead of net.Dialer.
+	// It's given the ConnectTimeout, which it should honour. This is useful
+	// for connecting through proxies or tunnels.
+	NetDial func(network, addr string, timeout time.Duration) (net.Conn, error)
+
+	// If set the connection is wrapped in TLS using this config, and the TLS
+	// handshake is done within ConnectTimeout. Client certificates and custom
+	// root CAs are configured through it as usual. If its ServerName is empty
+	// the host part of the address being dialed is used for SNI and
+	// certificate verification, so the same config can be used for every node
+	// in a cluster or every master behind a sentinel.
+	TLSConfig *tls.Config
+
+	// The Limits set on the resulting Client
+	Limits RespLimits
+
+	// The BufferPool set on the resulting Client. The same BufferPool can be,
+	// and usually is, shared by many Clients
+	BufferPool BufferPool
+
+	// The Compression set on the resulting Client
+	Compression CompressOpts
+
+	// The Hooks set on the resulting Client. They're only set once the
+	// connection has been initialized, so they aren't called for the AUTH
+	// command and its password, or for any of the other initialization
+	// commands
+	Hooks []Hook
+}
+
+// DialWithOpts connects to the given redis server, initializing the connection
+// according to the given DialOpts. If any of the initialization commands fail
+// the connection is closed and the command's error is returned.
+func DialWithOpts(network, addr string, o DialOpts) (*Client, error) {
+	netDial := o.NetDial
+	if netDial == nil {
+		netDial = net.DialTimeout
+	}
+	conn, err := netDial(network, addr, o.ConnectTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	if o.TLSConfig != nil {
+		if conn, err = tlsHandshake(conn, addr, o); err != nil {
+			return nil, err
+		}
+	}
+
+	c := newClient(conn, network, addr)
+	if err := o.init(c); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// NewClientWithOpts is like NewClient, but it also initializes the connection
+// according to the given DialOpts. ConnectTimeout and NetDial are ignored,
+// since the connection already exists. If any of the initialization commands
+// fail the connection is closed and the command's error is returned.
+func NewClientWithOpts(conn net.Conn, o DialOpts) (*Client, error) {
+	c := NewClient(conn)
+	if err := o.init(c); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// DialFunc returns a function which calls DialWithOpts with these DialOpts.
+// Its signature matches the DialFunc types of the other radix packages, so it
+// can be used anywhere one of those is accepted.
+func (o DialOpts) DialFunc() func(network, addr string) (*Client, error) {
+	return func(network, addr string) (*Client, error) {
+		return DialWithOpts(network, addr, o)
+	}
+}
+
+// tlsHandshake wraps conn in a TLS client connection and performs the
+// handshake, closing conn if it fails
+func tlsHandshake(conn net.Conn, addr string, o DialOpts) (net.Conn, error) {
+	cfg := o.TLSConfig
+	if cfg.ServerName == "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+		}
+		cfg = cfg.Clone()
+		cfg.ServerName = host
+	}
+
+	tlsConn := tls.Client(conn, cfg)
+	if o.ConnectTimeout != 0 {
+		tlsConn.SetDeadline(time.Now().Add(o.ConnectTimeout))
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	tlsConn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+func (o DialOpts) init(c *Client) error {
+	c.ReadTimeout = o.ReadTimeout
+	c.WriteTimeout = o.WriteTimeout
+	c.Limits = o.Limits
+	c.BufferPool = o.BufferPool
+
+	if o.Password != "" {
+		args := make([]interface{}, 0, 2)
+		if o.Username != "" {
+			args = append(args, o.Username)
+		}
+		args = append(args, o.Password)
+		if err := c.Cmd("AUTH", args...).Err; err != nil {
+			return err
+		}
+	}
+
+	if o.Protocol != 0 {
+		if err := c.Hello(o.Protocol).Err; err != nil {
+			return err
+		}
+	}
+
+	if o.DB != 0 {
+		if err := c.Cmd("SELECT", o.DB).Err; err != nil {
+			return err
+		}
+	}
+
+	if o.ClientName != "" {
+		if err := c.Cmd("CLIENT", "SETNAME", o.ClientName).Err; err != nil {
+			return err
+		}
+	}
+
+	// Set last, so that none of the above are affected by it
+	c.Compression = o.Compression
+	c.Hooks = o.Hooks
+	return nil
+}
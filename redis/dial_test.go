@@ -0,0 +1,219 @@
+package redis
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	. "testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// pipeServer reads commands off of one end of a net.Pipe, sends them to cmdCh
+// and replies to each with the Resp returned by the given function. The other
+// end of the pipe is returned. Replies are written from their own go-routine,
+// so like with a real connection the client can send a command before it's
+// done reading the previous reply.
+func pipeServer(
+	t *T, cmdCh chan []string, reply func(cmd []string) *Resp,
+) net.Conn {
+	client, server := net.Pipe()
+	replyCh := make(chan *Resp, 16)
+	go func() {
+		for r := range replyCh {
+			if _, err := r.WriteTo(server); err != nil {
+				return
+			}
+		}
+	}()
+	go func() {
+		defer server.Close()
+		defer close(replyCh)
+		rr := NewRespReader(server)
+		for {
+			r := rr.Read()
+			if r.Err != nil {
+				return
+			}
+			cmd, err := r.List()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			cmdCh <- cmd
+			replyCh <- reply(cmd)
+		}
+	}()
+	return client
+}
+
+func TestNewClientWithOpts(t *T) {
+	cmdCh := make(chan []string, 10)
+	conn := pipeServer(t, cmdCh, func([]string) *Resp {
+		return NewRespSimple("OK")
+	})
+
+	c, err := NewClientWithOpts(conn, DialOpts{
+		Username:   "user",
+		Password:   "pass",
+		DB:         2,
+		ClientName: "foo",
+	})
+	require.Nil(t, err)
+	defer c.Close()
+
+	assert.Equal(t, []string{"AUTH", "user", "pass"}, <-cmdCh)
+	assert.Equal(t, []string{"SELECT", "2"}, <-cmdCh)
+	assert.Equal(t, []string{"CLIENT", "SETNAME", "foo"}, <-cmdCh)
+
+	s, err := c.Cmd("ECHO", "hi").Str()
+	assert.Nil(t, err)
+	assert.Equal(t, "OK", s)
+	assert.Equal(t, []string{"ECHO", "hi"}, <-cmdCh)
+}
+
+func TestNewClientWithOptsErr(t *T) {
+	cmdCh := make(chan []string, 10)
+	conn := pipeServer(t, cmdCh, func([]string) *Resp {
+		return NewResp(errors.New("WRONGPASS invalid username-password pair"))
+	})
+
+	_, err := NewClientWithOpts(conn, DialOpts{Password: "pass", DB: 2})
+	require.NotNil(t, err)
+	assert.Equal(t, "WRONGPASS invalid username-password pair", err.Error())
+	assert.Equal(t, []string{"AUTH", "pass"}, <-cmdCh)
+
+	// The connection should have been closed without going any further
+	_, err = conn.Write([]byte("PING\r\n"))
+	assert.NotNil(t, err)
+}
+
+func TestDialWithOpts(t *T) {
+	name := randStr()
+	c, err := DialWithOpts("tcp", "127.0.0.1:6379", DialOpts{
+		DB:         1,
+		ClientName: name,
+	})
+	require.Nil(t, err)
+	defer c.Close()
+
+	gotName, err := c.Cmd("CLIENT", "GETNAME").Str()
+	require.Nil(t, err)
+	assert.Equal(t, name, gotName)
+
+	// Make sure the key isn't visible from the default database
+	k := randStr()
+	require.Nil(t, c.Cmd("SET", k, "foo").Err)
+	c2 := dial(t)
+	defer c2.Close()
+	assert.True(t, c2.Cmd("GET", k).IsType(Nil))
+}
+
+// testCert creates a certificate for 127.0.0.1 signed by parent, or a self
+// signed CA certificate if parent is nil
+func testCert(t *T, parent *tls.Certificate) tls.Certificate {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.Nil(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "radix test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{
+			x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth,
+		},
+	}
+
+	parentCert, parentKey := tmpl, interface{}(key)
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	} else {
+		parentCert = parent.Leaf
+		parentKey = parent.PrivateKey
+	}
+
+	der, err := x509.CreateCertificate(
+		rand.Reader, tmpl, parentCert, &key.PublicKey, parentKey,
+	)
+	require.Nil(t, err)
+	leaf, err := x509.ParseCertificate(der)
+	require.Nil(t, err)
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}
+}
+
+func TestDialWithOptsTLS(t *T) {
+	ca := testCert(t, nil)
+	serverCert := testCert(t, &ca)
+	clientCert := testCert(t, &ca)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Leaf)
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    roots,
+	})
+	require.Nil(t, err)
+	defer l.Close()
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				rr := NewRespReader(conn)
+				for {
+					if rr.Read().Err != nil {
+						return
+					}
+					NewRespSimple("PONG").WriteTo(conn)
+				}
+			}()
+		}
+	}()
+
+	// Without a client certificate the server should reject us
+	c, err := DialWithOpts("tcp", l.Addr().String(), DialOpts{
+		ConnectTimeout: 5 * time.Second,
+		TLSConfig:      &tls.Config{RootCAs: roots},
+	})
+	if err == nil {
+		// With TLS 1.3 the client may only find out on its first read
+		err = c.Cmd("PING").Err
+		c.Close()
+	}
+	assert.NotNil(t, err)
+
+	// ServerName isn't set, it should be taken from the address so the server's
+	// certificate can be verified
+	c, err = DialWithOpts("tcp", l.Addr().String(), DialOpts{
+		ConnectTimeout: 5 * time.Second,
+		ReadTimeout:    5 * time.Second,
+		TLSConfig: &tls.Config{
+			RootCAs:      roots,
+			Certificates: []tls.Certificate{clientCert},
+		},
+	})
+	require.Nil(t, err)
+	defer c.Close()
+	s, err := c.Cmd("PING").Str()
+	assert.Nil(t, err)
+	assert.Equal(t, "PONG", s)
+}
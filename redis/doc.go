@@ -18,6 +18,16 @@
 //		// handle err
 //	}
 //
+// DialWithOpts can be used to initialize the connection as well, e.g. to
+// authenticate and select a database:
+//
+//	client, err := redis.DialWithOpts("tcp", "localhost:6379", redis.DialOpts{
+//		Password: "SUPERSECRET",
+//		DB:       2,
+//	})
+//
+// An existing net.Conn can be wrapped with NewClient or NewClientWithOpts.
+//
 // Make sure to call Close on the client if you want to clean it up before the
 // end of the program.
 //
@@ -41,6 +51,29 @@
 //		// handle err
 //	}
 //
+// Errors sent by the server are of type *Error, whose code can be checked
+// using errors.Is and variables like ErrWrongType:
+//
+//	if errors.Is(err, redis.ErrWrongType) {
+//		// foo isn't a string
+//	}
+//
+// Contexts
+//
+// CmdContext and PipeRespContext take a context, whose deadline is used for
+// the connection's read/write deadlines if it's sooner than ReadTimeout and
+// WriteTimeout, and whose cancellation interrupts a blocking command:
+//
+//	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+//	defer cancel()
+//	r := client.CmdContext(ctx, "BLPOP", "queue", 0)
+//	if r.Err == context.DeadlineExceeded {
+//		// nothing in the queue
+//	}
+//
+// A command abandoned after being written leaves the connection unusable, so
+// it's closed and LastCritical is set to the context's error.
+//
 // Array Replies
 //
 // The elements to Array replies can be accessed as strings using List or
@@ -64,6 +97,90 @@
 //		fmt.Println(elemStr)
 //	}
 //
+// Decoding
+//
+// Decode fills structs, maps, slices and basic types from a reply, so replies
+// like those of HGETALL don't need to be converted by hand:
+//
+//	var user struct {
+//		Name string `redis:"name"`
+//		Age  int    `redis:"age"`
+//	}
+//	err := client.Cmd("HGETALL", "user:1").Decode(&user)
+//
+// Types can implement RespUnmarshaler to decode themselves.
+//
+// Streaming
+//
+// Very large replies can be read incrementally using CmdStream, without ever
+// holding the whole reply in memory. A bulk string is read as an io.Reader,
+// while the elements of an array are iterated over one at a time:
+//
+//	s := client.CmdStream("LRANGE", "biglist", 0, -1)
+//	defer s.Close()
+//	for s.More() {
+//		elem, err := s.Next().Str()
+//		if err != nil {
+//			// handle err
+//		}
+//	}
+//	if err := s.Err(); err != nil {
+//		// handle err
+//	}
+//
+// Whatever is left of a stream is discarded when it's closed, or when the next
+// command's reply is read.
+//
+// Limits
+//
+// The size of the replies a Client reads is bounded by its Limits, so that a
+// corrupted stream or misbehaving server can't exhaust memory. A reply which
+// exceeds them is returned as an IOErr whose Err is a *ProtocolError, and the
+// connection is closed. See RespLimits for the defaults.
+//
+// Compression
+//
+// Large values can be compressed transparently by setting a Codec in the
+// Client's Compression. Values above its MinSize which are stored by the
+// string and hash setting commands (SET, MSET, HSET and the like) are
+// compressed before being sent, while keys, field names and other arguments
+// never are. Strings in replies which start with the marker of that Codec, or
+// of any Codec added using RegisterCodec, are decompressed:
+//
+//	fc, err := redis.NewFlateCodec([]byte("\x00flate:"), flate.BestSpeed)
+//	if err != nil {
+//		// handle err
+//	}
+//	client, err := redis.DialWithOpts("tcp", "localhost:6379", redis.DialOpts{
+//		Compression: redis.CompressOpts{Codec: fc, MinSize: 512},
+//	})
+//
+// Codecs for snappy, DEFLATE and gzip are provided, and the redis/zstd package
+// provides one for zstd (optionally with trained dictionaries). Codecs which
+// are registered are picked automatically when decompressing, so a Client can
+// read values written by Clients using a different Codec, e.g. while migrating
+// from one to another.
+//
+// Encryption
+//
+// Values can be encrypted before being stored using an Envelope, which uses an
+// AEAD (AES-GCM, or ChaCha20-Poly1305 using the redis/chacha package) and binds
+// each value to the name of the key it's stored under:
+//
+//	k, err := redis.NewAESGCMKey("2024-01", key)
+//	if err != nil {
+//		// handle err
+//	}
+//	e, err := redis.NewEnvelope([]byte("\x00enc:"), k)
+//	if err != nil {
+//		// handle err
+//	}
+//	sealed, err := e.Seal(nil, []byte("secret"), "user:1:ssn")
+//
+// Resp.Encrypt and Resp.Decrypt do the same for whole Resps, and the util
+// package's EncryptedCmder does it transparently for string and hash
+// commands.
+//
 // Pipelining
 //
 // Pipelining is when the client sends a bunch of commands to the server at
@@ -94,6 +211,41 @@
 //		// handle err
 //	}
 //
+// Hooks
+//
+// Hooks are called before and after every command a Client performs, whether
+// through Cmd or a pipeline, and can be used for metrics, logging or tracing
+// without having to wrap every call site:
+//
+//	client.Hooks = append(client.Hooks, redis.HookFuncs{
+//		After: func(ci *redis.CmdInfo) {
+//			cmdDuration.WithLabelValues(ci.Cmd).Observe(ci.Duration.Seconds())
+//		},
+//	})
+//
+// Hooks can also be added to a pool.Pool, cluster.Cluster or sentinel.Client
+// using their AddHook methods, in which case they're called for every one of
+// their connections.
+//
+// RESP3
+//
+// Servers which support it can be switched to version 3 of the redis protocol
+// using Hello. RESP3 replies carry more type information, e.g. HGETALL returns
+// a Map and ZSCORE a Double, and can be read using the same methods as before
+// or through ones like MapResp, Bool and BigInt:
+//
+//	if err := client.Hello(3).Err; err != nil {
+//		// handle err
+//	}
+//
+//	m, err := client.Cmd("HGETALL", "myhash").MapResp()
+//	if err != nil {
+//		// handle err
+//	}
+//
+// Push messages which arrive while waiting for a reply can be handled by
+// setting OnPush on the Client.
+//
 // Flattening
 //
 // Radix will automatically flatten passed in maps and slices into the argument
@@ -112,5 +264,43 @@
 //
 // Radix is not picky about the types inside or outside the maps/slices, if they
 // don't match a subset of primitive types it will fall back to reflection to
-// figure out what they are and encode them.
+// figure out what they are and encode them. Maps are flattened in the order of
+// their keys, so the same map always results in the same command.
+//
+// Structs are flattened into their field names and values, using the same
+// `redis` tags as Decode, with omitempty leaving out fields which have their
+// zero value:
+//
+//	type User struct {
+//		Name  string `redis:"name"`
+//		Email string `redis:"email,omitempty"`
+//	}
+//	client.Cmd("HMSET", "user:1", User{Name: "bob"})
+//
+// Types implementing RespMarshaler, encoding.TextMarshaler (e.g. time.Time and
+// *big.Int) or encoding.BinaryMarshaler are encoded using those, in that order
+// of preference. A time.Duration is encoded as its number of nanoseconds. If
+// marshaling an argument fails the command isn't sent, and the error is
+// returned as an AppErr.
+//
+// Serving
+//
+// Server accepts connections speaking RESP and passes the commands read off of
+// them to a Handler, much like net/http does for HTTP. ServeMux dispatches
+// commands to Handlers by their name, which makes it easy to build proxies,
+// mocks or small services which redis clients can talk to:
+//
+//	mux := redis.NewServeMux()
+//	mux.HandleFunc("PING", func(w redis.ResponseWriter, r *redis.Request) {
+//		w.WriteResp(redis.NewRespSimple("PONG"))
+//	})
+//
+//	srv := &redis.Server{Addr: ":6380", Handler: mux}
+//	go srv.ListenAndServe()
+//
+//	// Later on
+//	srv.Shutdown(ctx)
+//
+// Inline commands, as typed into telnet, are supported as well as pipelining,
+// whose replies are flushed together.
 package redis
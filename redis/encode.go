@@ -0,0 +1,324 @@
+package redis
+
+import (
+	"bytes"
+	"encoding"
+	"fmt"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/gallir/bytebufferpool"
+)
+
+// RespMarshaler is implemented by types which know how to encode themselves as
+// arguments to a command (or as a Resp, see NewResp). MarshalResp returns the
+// value which is written in place of the type. It can be anything which could
+// be passed in as an argument directly, including slices, maps and structs,
+// which are flattened as usual.
+type RespMarshaler interface {
+	MarshalResp() (interface{}, error)
+}
+
+var (
+	typeOfRespMarshaler   = reflect.TypeOf((*RespMarshaler)(nil)).Elem()
+	typeOfTextMarshaler   = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+	typeOfBinaryMarshaler = reflect.TypeOf((*encoding.BinaryMarshaler)(nil)).Elem()
+)
+
+// marshalArgs calls marshalArg on each of the given args. If none of them had
+// to be changed the given slice itself is returned, so the common case of
+// only passing in strings, ints and the like doesn't allocate.
+func marshalArgs(args []interface{}) ([]interface{}, error) {
+	var ret []interface{}
+	for i := range args {
+		m, changed, err := marshalArg(args[i])
+		if err != nil {
+			return nil, err
+		} else if changed && ret == nil {
+			ret = make([]interface{}, len(args))
+			copy(ret, args[:i])
+		}
+		if ret != nil {
+			ret[i] = m
+		}
+	}
+	if ret == nil {
+		return args, nil
+	}
+	return ret, nil
+}
+
+// marshalArg converts the given value into one which writeTo, flatten and
+// format know how to handle without falling back to fmt.Sprint:
+//
+//	* RespMarshalers are replaced by the value they return
+//	* encoding.TextMarshalers and then encoding.BinaryMarshalers (e.g.
+//	  time.Time and *big.Int) are replaced by the bytes they return
+//	* time.Duration becomes its int64 number of nanoseconds
+//	* Maps become a slice of their keys and values, sorted by key
+//	* Structs become a slice of their field names and values (see structArg)
+//	* Arrays become slices, and byte arrays become byte slices
+//	* Pointers are dereferenced, nil pointers become nil
+//	* Named types of basic kinds (e.g. `type ID string`) become that kind
+//
+// The returned bool indicates whether the value is different than the given
+// one.
+func marshalArg(m interface{}) (interface{}, bool, error) {
+	switch mt := m.(type) {
+	case RespMarshaler:
+		if isNilPtr(m) {
+			return nil, true, nil
+		}
+		mm, err := mt.MarshalResp()
+		if err != nil {
+			return nil, false, err
+		}
+		mm, _, err = marshalArg(mm)
+		return mm, true, err
+
+	case []byte, string, bool, nil, int, int8, int16, int32, int64, uint,
+		uint8, uint16, uint32, uint64, float32, float64, error, Resp, *Resp,
+		*bytebufferpool.ByteBuffer:
+		return m, false, nil
+
+	case time.Duration:
+		return int64(mt), true, nil
+
+	case encoding.TextMarshaler:
+		if isNilPtr(m) {
+			return nil, true, nil
+		}
+		b, err := mt.MarshalText()
+		return b, true, err
+
+	case encoding.BinaryMarshaler:
+		if isNilPtr(m) {
+			return nil, true, nil
+		}
+		b, err := mt.MarshalBinary()
+		return b, true, err
+
+	case []interface{}:
+		l, err := marshalArgs(mt)
+		if err != nil {
+			return nil, false, err
+		}
+		// marshalArgs only returns the same slice if nothing changed
+		return l, len(l) > 0 && &l[0] != &mt[0], nil
+	}
+
+	rv := reflect.ValueOf(m)
+	t := rv.Type()
+
+	// The interfaces may be implemented with pointer receivers, in which case
+	// they can be called on a copy of the value
+	if t.Kind() != reflect.Ptr && hasMarshaler(reflect.PtrTo(t)) {
+		pv := reflect.New(t)
+		pv.Elem().Set(rv)
+		mm, _, err := marshalArg(pv.Interface())
+		return mm, true, err
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		if rv.IsNil() {
+			return nil, true, nil
+		}
+		mm, _, err := marshalArg(rv.Elem().Interface())
+		return mm, true, err
+
+	case reflect.String:
+		return rv.String(), true, nil
+	case reflect.Bool:
+		return rv.Bool(), true, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int(), true, nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
+		reflect.Uint64, reflect.Uintptr:
+		return rv.Uint(), true, nil
+	case reflect.Float32, reflect.Float64:
+		return rv.Float(), true, nil
+
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return rv.Bytes(), true, nil
+		} else if !needsMarshal(t.Elem()) {
+			return m, false, nil
+		}
+		l, err := sliceArg(rv)
+		return l, true, err
+
+	case reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			b := make([]byte, rv.Len())
+			reflect.Copy(reflect.ValueOf(b), rv)
+			return b, true, nil
+		}
+		l, err := sliceArg(rv)
+		return l, true, err
+
+	case reflect.Map:
+		l, err := mapArg(rv)
+		return l, true, err
+
+	case reflect.Struct:
+		l, err := structArg(rv)
+		return l, true, err
+	}
+
+	return m, false, nil
+}
+
+func isNilPtr(m interface{}) bool {
+	rv := reflect.ValueOf(m)
+	return rv.Kind() == reflect.Ptr && rv.IsNil()
+}
+
+func hasMarshaler(t reflect.Type) bool {
+	return t.Implements(typeOfRespMarshaler) ||
+		t.Implements(typeOfTextMarshaler) ||
+		t.Implements(typeOfBinaryMarshaler)
+}
+
+// needsMarshal returns whether values of the given type, as elements of a
+// slice, would be changed by marshalArg
+func needsMarshal(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.String, reflect.Bool, reflect.Int, reflect.Int8,
+		reflect.Int16, reflect.Int32, reflect.Int64, reflect.Uint,
+		reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		// Only the unnamed types are written as is
+		return t.PkgPath() != ""
+	case reflect.Slice:
+		return t != typeOfBytes
+	}
+	return true
+}
+
+func sliceArg(rv reflect.Value) ([]interface{}, error) {
+	l := make([]interface{}, rv.Len())
+	for i := range l {
+		var err error
+		if l[i], _, err = marshalArg(rv.Index(i).Interface()); err != nil {
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// mapArg returns the keys and values of the map, alternating, sorted by key so
+// that the same map always results in the same command
+func mapArg(rv reflect.Value) ([]interface{}, error) {
+	type kv struct {
+		k, v interface{}
+	}
+	kvs := make([]kv, 0, rv.Len())
+	for _, k := range rv.MapKeys() {
+		km, _, err := marshalArg(k.Interface())
+		if err != nil {
+			return nil, err
+		}
+		vm, _, err := marshalArg(rv.MapIndex(k).Interface())
+		if err != nil {
+			return nil, err
+		}
+		kvs = append(kvs, kv{km, vm})
+	}
+	sort.Slice(kvs, func(i, j int) bool {
+		return argLess(kvs[i].k, kvs[j].k)
+	})
+
+	l := make([]interface{}, 0, len(kvs)*2)
+	for _, kv := range kvs {
+		l = append(l, kv.k, kv.v)
+	}
+	return l, nil
+}
+
+// argLess orders two marshaled map keys, numerically if both are numbers and
+// by their string form otherwise
+func argLess(a, b interface{}) bool {
+	switch at := a.(type) {
+	case string:
+		if bt, ok := b.(string); ok {
+			return at < bt
+		}
+	case []byte:
+		if bt, ok := b.([]byte); ok {
+			return bytes.Compare(at, bt) < 0
+		}
+	case int, int8, int16, int32, int64:
+		switch b.(type) {
+		case int, int8, int16, int32, int64:
+			return anyIntToInt64(a) < anyIntToInt64(b)
+		}
+	case uint, uint8, uint16, uint32, uint64:
+		switch b.(type) {
+		case uint, uint8, uint16, uint32, uint64:
+			return uint64(anyIntToInt64(a)) < uint64(anyIntToInt64(b))
+		}
+	case float64:
+		if bt, ok := b.(float64); ok {
+			return at < bt
+		}
+	}
+	return fmt.Sprint(a) < fmt.Sprint(b)
+}
+
+// structArg returns the names and values of the struct's fields, alternating,
+// in the order they're defined in, with those of embedded structs coming after
+// those of the outer struct. Field names and embedded structs are
+// handled the same way as they are by Decode. Fields tagged with omitempty
+// (e.g. `redis:"name,omitempty"`) are left out if they have their zero value,
+// or are an empty slice or map.
+func structArg(rv reflect.Value) ([]interface{}, error) {
+	fs := structFields(rv.Type())
+	l := make([]interface{}, 0, len(fs.list)*2)
+outer:
+	for _, f := range fs.list {
+		fv := rv
+		for i, x := range f.index {
+			if i > 0 && fv.Kind() == reflect.Ptr {
+				if fv.IsNil() {
+					continue outer
+				}
+				fv = fv.Elem()
+			}
+			fv = fv.Field(x)
+		}
+		if f.omitEmpty && isEmptyValue(fv) {
+			continue
+		}
+
+		vm, _, err := marshalArg(fv.Interface())
+		if err != nil {
+			return nil, err
+		}
+		l = append(l, f.name, vm)
+	}
+	return l, nil
+}
+
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
+		reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	case reflect.Struct:
+		// e.g. time.Time
+		return reflect.DeepEqual(v.Interface(), reflect.Zero(v.Type()).Interface())
+	}
+	return false
+}
@@ -0,0 +1,107 @@
+package redis
+
+import (
+	"errors"
+	"math/big"
+	. "testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type encodeInner struct {
+	Inner string `redis:"inner,omitempty"`
+}
+
+type encodeStruct struct {
+	*encodeInner
+	Name    string `redis:"name"`
+	Age     int    `redis:"age,omitempty"`
+	Skipped string `redis:"-"`
+	Score   float64
+	When    time.Time `redis:"when,omitempty"`
+	private string
+}
+
+type point struct{ x, y int }
+
+func (p point) MarshalResp() (interface{}, error) {
+	return []int{p.x, p.y}, nil
+}
+
+type badArg struct{}
+
+func (badArg) MarshalResp() (interface{}, error) {
+	return nil, errors.New("bad arg")
+}
+
+type level int
+
+func TestMarshalArgs(t *T) {
+	flattened := func(v interface{}) []string {
+		l, err := NewRespFlattenedStrings(v).List()
+		require.Nil(t, err)
+		return l
+	}
+
+	// Maps are sorted by key
+	assert.Equal(t,
+		[]string{"a", "1", "b", "2", "c", "3"},
+		flattened(map[string]int{"c": 3, "a": 1, "b": 2}),
+	)
+	assert.Equal(t,
+		[]string{"2", "a", "10", "b"},
+		flattened(map[int]string{10: "b", 2: "a"}),
+	)
+
+	assert.Equal(t,
+		[]string{"name", "bob", "Score", "1.5"},
+		flattened(encodeStruct{Name: "bob", Skipped: "x", Score: 1.5}),
+	)
+	when := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	assert.Equal(t,
+		[]string{"name", "", "age", "3", "Score", "0", "when", "2020-01-02T03:04:05Z", "inner", "in"},
+		flattened(&encodeStruct{encodeInner: &encodeInner{"in"}, Age: 3, When: when}),
+	)
+
+	bi, _ := new(big.Int).SetString("123456789012345678901234567890", 10)
+	assert.Equal(t,
+		[]string{"123456789012345678901234567890", "1", "2", "1500000000", "3", "4", "5"},
+		flattened([]interface{}{bi, point{1, 2}, 1500 * time.Millisecond, level(3), [2]level{4, 5}}),
+	)
+
+	// Values which don't need marshaling are left alone
+	args := []interface{}{"foo", 1, []byte("bar"), []string{"a"}}
+	margs, err := marshalArgs(args)
+	require.Nil(t, err)
+	assert.True(t, &args[0] == &margs[0])
+
+	_, err = marshalArgs([]interface{}{"foo", badArg{}})
+	assert.Equal(t, errors.New("bad arg"), err)
+	assert.Equal(t, errors.New("bad arg"), NewResp(badArg{}).Err)
+	assert.Equal(t, Nil, NewResp((*big.Int)(nil)).typ)
+}
+
+func TestMarshalArgsClient(t *T) {
+	cmdCh := make(chan []string, 10)
+	conn := pipeServer(t, cmdCh, func([]string) *Resp {
+		return NewRespSimple("OK")
+	})
+	c := NewClient(conn)
+	defer c.Close()
+
+	require.Nil(t, c.Cmd("HMSET", "key", encodeStruct{Name: "bob"}).Err)
+	assert.Equal(t, []string{"HMSET", "key", "name", "bob", "Score", "0"}, <-cmdCh)
+
+	// A command whose args can't be marshaled isn't sent, and doesn't affect
+	// the rest of the pipeline
+	c.PipeAppend("SET", "a", badArg{})
+	c.PipeAppend("SET", "b", point{1, 2})
+	r := c.PipeResp()
+	assert.Equal(t, AppErr, r.typ)
+	assert.Equal(t, errors.New("bad arg"), r.Err)
+	assert.Nil(t, c.PipeResp().Err)
+	assert.Equal(t, []string{"SET", "b", "1", "2"}, <-cmdCh)
+	assert.Equal(t, 0, len(cmdCh))
+}
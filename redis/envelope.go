@@ -0,0 +1,222 @@
+package redis
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"io"
+)
+
+var (
+	// ErrEnvelopeUnknownKey is returned when decrypting a value which was
+	// encrypted with a key the Envelope doesn't have
+	ErrEnvelopeUnknownKey = errors.New("value was encrypted with an unknown key")
+
+	// ErrEnvelopeOpen is returned when decrypting a value fails, because it
+	// was tampered with, is corrupt, or was encrypted for a different redis
+	// key
+	ErrEnvelopeOpen = errors.New("value could not be decrypted")
+)
+
+// EnvelopeKey is one of the keys an Envelope encrypts and decrypts values with
+type EnvelopeKey struct {
+	// ID identifies the key within the values encrypted with it, so that the
+	// right key can be picked for decrypting them after the key used for
+	// encrypting has been rotated. It must be at most 255 bytes long.
+	ID string
+
+	// The AEAD values are encrypted with. Its nonce size is expected to be
+	// large enough for nonces to be picked at random.
+	AEAD cipher.AEAD
+}
+
+// NewAESGCMKey returns an EnvelopeKey using AES-GCM. The key must be 16, 24 or
+// 32 bytes long, for AES-128, AES-192 or AES-256 respectively.
+func NewAESGCMKey(id string, key []byte) (EnvelopeKey, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return EnvelopeKey{}, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return EnvelopeKey{}, err
+	}
+	return EnvelopeKey{ID: id, AEAD: aead}, nil
+}
+
+// Envelope encrypts and authenticates values before they're stored in redis,
+// so that they can't be read or modified by anyone without the key. Each
+// encrypted value is bound to the name of the redis key it's stored under, so
+// it can't be copied to another key and decrypted from there.
+//
+// An encrypted value is made up of the Envelope's marker, the ID of the key it
+// was encrypted with, a random nonce and the AEAD's output. The marker and key
+// ID are authenticated along with the redis key name.
+type Envelope struct {
+	marker  []byte
+	current EnvelopeKey
+	keys    map[string]cipher.AEAD
+}
+
+// NewEnvelope returns an Envelope which marks the values it encrypts with the
+// given marker, like Resp.Compress does. Values are encrypted using the
+// current key, and can be decrypted using it or any of the old ones. Keys are
+// rotated by making the current key an old one and adding a new current one.
+func NewEnvelope(marker []byte, current EnvelopeKey, old ...EnvelopeKey) (*Envelope, error) {
+	if len(marker) == 0 {
+		return nil, errors.New("envelope marker is empty")
+	}
+	e := &Envelope{
+		marker:  marker,
+		current: current,
+		keys:    make(map[string]cipher.AEAD, len(old)+1),
+	}
+	for _, k := range append([]EnvelopeKey{current}, old...) {
+		if len(k.ID) > 255 {
+			return nil, errors.New("envelope key ID is longer than 255 bytes")
+		} else if k.AEAD == nil {
+			return nil, errors.New("envelope key has no AEAD")
+		} else if _, ok := e.keys[k.ID]; ok {
+			return nil, errors.New("envelope key ID is used twice")
+		}
+		e.keys[k.ID] = k.AEAD
+	}
+	return e, nil
+}
+
+// IsSealed returns whether the given value looks like it was encrypted by the
+// Envelope, i.e. whether it starts with the Envelope's marker
+func (e *Envelope) IsSealed(b []byte) bool {
+	return bytes.HasPrefix(b, e.marker)
+}
+
+// header returns the marker followed by the key ID, appended to dst
+func (e *Envelope) header(dst []byte, id string) []byte {
+	dst = append(dst, e.marker...)
+	dst = append(dst, byte(len(id)))
+	return append(dst, id...)
+}
+
+// additionalData returns the data which is authenticated along with a value
+func additionalData(header []byte, key string) []byte {
+	ad := make([]byte, 0, len(header)+len(key))
+	return append(append(ad, header...), key...)
+}
+
+// Seal encrypts the plaintext for being stored under the given redis key, and
+// appends the result to dst
+func (e *Envelope) Seal(dst, plaintext []byte, key string) ([]byte, error) {
+	aead := e.current.AEAD
+	start := len(dst)
+	dst = e.header(dst, e.current.ID)
+	header := dst[start:]
+
+	nonceStart := len(dst)
+	dst = grow(dst, aead.NonceSize()+len(plaintext)+aead.Overhead())
+	dst = dst[:nonceStart+aead.NonceSize()]
+	nonce := dst[nonceStart:]
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(dst, nonce, plaintext, additionalData(header, key)), nil
+}
+
+// Open decrypts a value which was encrypted by Seal for the given redis key,
+// and appends the result to dst
+func (e *Envelope) Open(dst, sealed []byte, key string) ([]byte, error) {
+	if !e.IsSealed(sealed) || len(sealed) == len(e.marker) {
+		return nil, ErrEnvelopeOpen
+	}
+	idLen := int(sealed[len(e.marker)])
+	headerLen := len(e.marker) + 1 + idLen
+	if len(sealed) < headerLen {
+		return nil, ErrEnvelopeOpen
+	}
+	aead, ok := e.keys[string(sealed[len(e.marker)+1:headerLen])]
+	if !ok {
+		return nil, ErrEnvelopeUnknownKey
+	}
+	if len(sealed) < headerLen+aead.NonceSize() {
+		return nil, ErrEnvelopeOpen
+	}
+
+	nonce := sealed[headerLen : headerLen+aead.NonceSize()]
+	ciphertext := sealed[headerLen+aead.NonceSize():]
+	ad := additionalData(sealed[:headerLen], key)
+	b, err := aead.Open(dst, nonce, ciphertext, ad)
+	if err != nil {
+		return nil, ErrEnvelopeOpen
+	}
+	return b, nil
+}
+
+// Encrypt encrypts every Str in the Resp, including those inside of
+// aggregates, using the Envelope, for being stored under the given redis key.
+// The first error encountered is returned, in which case the rest of the Resp
+// is left as it was.
+func (r *Resp) Encrypt(e *Envelope, key string) error {
+	if r.IsType(Str) {
+		b, ok := r.val.([]byte)
+		if !ok {
+			return nil
+		}
+		sealed, err := e.Seal(nil, b, key)
+		if err != nil {
+			return err
+		}
+		r.setPooled(sealed, nil)
+		return nil
+	}
+
+	vals, ok := r.val.([]Resp)
+	if !ok {
+		return nil
+	}
+	for i := range vals {
+		if err := vals[i].Encrypt(e, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Decrypt decrypts every Str in the Resp, including those inside of
+// aggregates, which was encrypted by the Envelope for the given redis key.
+// Strs which don't start with the Envelope's marker are left alone, so values
+// which were stored before encryption was introduced can still be read. The
+// first error encountered is returned, in which case the rest of the Resp is
+// left as it was.
+func (r *Resp) Decrypt(e *Envelope, key string) error {
+	if r.IsType(Str) {
+		b, ok := r.val.([]byte)
+		if !ok || !e.IsSealed(b) {
+			return nil
+		}
+		var dst []byte
+		if r.pool != nil {
+			dst = r.pool.Get(len(b))[:0]
+		}
+		opened, err := e.Open(dst, b, key)
+		if err != nil {
+			if dst != nil {
+				r.pool.Put(dst)
+			}
+			return err
+		}
+		r.setPooled(opened, dst)
+		return nil
+	}
+
+	vals, ok := r.val.([]Resp)
+	if !ok {
+		return nil
+	}
+	for i := range vals {
+		if err := vals[i].Decrypt(e, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
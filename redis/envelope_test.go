@@ -0,0 +1,96 @@
+package redis
+
+import (
+	"bytes"
+	. "testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testEnvelopeKeys(t *T) (EnvelopeKey, EnvelopeKey) {
+	k1, err := NewAESGCMKey("k1", bytes.Repeat([]byte{1}, 32))
+	require.Nil(t, err)
+	k2, err := NewAESGCMKey("k2", bytes.Repeat([]byte{2}, 16))
+	require.Nil(t, err)
+	return k1, k2
+}
+
+func TestEnvelope(t *T) {
+	k1, k2 := testEnvelopeKeys(t)
+	marker := []byte("\x00enc:")
+	e1, err := NewEnvelope(marker, k1)
+	require.Nil(t, err)
+
+	plain := []byte("secret value")
+	sealed, err := e1.Seal(nil, plain, "foo")
+	require.Nil(t, err)
+	assert.True(t, e1.IsSealed(sealed))
+	assert.False(t, bytes.Contains(sealed, plain))
+
+	// Nonces are random, so sealing twice never gives the same result
+	sealed2, err := e1.Seal(nil, plain, "foo")
+	require.Nil(t, err)
+	assert.NotEqual(t, sealed, sealed2)
+
+	opened, err := e1.Open(nil, sealed, "foo")
+	require.Nil(t, err)
+	assert.Equal(t, plain, opened)
+
+	// Bound to the key name
+	_, err = e1.Open(nil, sealed, "bar")
+	assert.Equal(t, ErrEnvelopeOpen, err)
+
+	// Tampering is detected
+	tampered := append([]byte(nil), sealed...)
+	tampered[len(tampered)-1] ^= 1
+	_, err = e1.Open(nil, tampered, "foo")
+	assert.Equal(t, ErrEnvelopeOpen, err)
+	_, err = e1.Open(nil, sealed[:len(marker)+2], "foo")
+	assert.Equal(t, ErrEnvelopeOpen, err)
+
+	// After rotating, old values can still be opened but new ones use the new
+	// key, which the old Envelope doesn't have
+	e2, err := NewEnvelope(marker, k2, k1)
+	require.Nil(t, err)
+	opened, err = e2.Open(nil, sealed, "foo")
+	require.Nil(t, err)
+	assert.Equal(t, plain, opened)
+
+	sealed, err = e2.Seal(nil, plain, "foo")
+	require.Nil(t, err)
+	_, err = e1.Open(nil, sealed, "foo")
+	assert.Equal(t, ErrEnvelopeUnknownKey, err)
+
+	_, err = NewEnvelope(marker, k1, k1)
+	assert.NotNil(t, err)
+	_, err = NewEnvelope(nil, k1)
+	assert.NotNil(t, err)
+	_, err = NewAESGCMKey("bad", []byte("short"))
+	assert.NotNil(t, err)
+}
+
+func TestRespEncrypt(t *T) {
+	k1, _ := testEnvelopeKeys(t)
+	e, err := NewEnvelope([]byte("\x00enc:"), k1)
+	require.Nil(t, err)
+
+	r := NewResp([]interface{}{"a", []interface{}{"b"}, 1})
+	require.Nil(t, r.Encrypt(e, "foo"))
+	l, err := r.Array()
+	require.Nil(t, err)
+	b, err := l[0].Bytes()
+	require.Nil(t, err)
+	assert.True(t, e.IsSealed(b))
+
+	assert.Equal(t, ErrEnvelopeOpen, r.Decrypt(e, "bar"))
+	require.Nil(t, r.Decrypt(e, "foo"))
+	var i interface{}
+	require.Nil(t, r.Decode(&i))
+	assert.Equal(t, []interface{}{"a", []interface{}{"b"}, int64(1)}, i)
+
+	// Values which aren't encrypted are left alone
+	r = NewResp("plain")
+	require.Nil(t, r.Decrypt(e, "foo"))
+	assert.Equal(t, "plain", mustStr(t, r))
+}
@@ -0,0 +1,117 @@
+package redis
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Error is an error reply sent by the redis server, which is what the Err of
+// an AppErr Resp read off a connection is. By convention the first word of an
+// error is its code, e.g. "ERR", "WRONGTYPE" or "MOVED", and the rest is a
+// human readable message. Errors whose first word isn't all upper case have no
+// code, and are all message.
+//
+// The ErrMoved, ErrAsk, etc... variables can be used with errors.Is to check
+// an Error's code, without having to parse it:
+//
+//	r := client.Cmd("EVALSHA", sum, 0)
+//	if errors.Is(r.Err, redis.ErrNoScript) {
+//		r = client.Cmd("EVAL", script, 0)
+//	}
+//
+type Error struct {
+	Code string
+	Msg  string
+}
+
+// Errors with the codes which are commonly dealt with, for use with errors.Is
+var (
+	// The key's slot is served by another node of the cluster, see
+	// Error.Redirect
+	ErrMoved = &Error{Code: "MOVED"}
+
+	// The key's slot is being migrated to another node, which must be asked
+	// for it, see Error.Redirect
+	ErrAsk = &Error{Code: "ASK"}
+
+	// A multi-key command's keys are in a slot which is being migrated, and
+	// aren't all on the same node at the moment
+	ErrTryAgain = &Error{Code: "TRYAGAIN"}
+
+	// A multi-key command's keys don't all belong to the same slot of the
+	// cluster
+	ErrCrossSlot = &Error{Code: "CROSSSLOT"}
+
+	// The cluster can't serve any requests, or the key's slot isn't served
+	ErrClusterDown = &Error{Code: "CLUSTERDOWN"}
+
+	// The server is loading its dataset from disk
+	ErrLoading = &Error{Code: "LOADING"}
+
+	// A write was sent to a replica
+	ErrReadOnly = &Error{Code: "READONLY"}
+
+	// The server is busy running a script or function
+	ErrBusy = &Error{Code: "BUSY"}
+
+	// EVALSHA was given the sha of a script the server doesn't have
+	ErrNoScript = &Error{Code: "NOSCRIPT"}
+
+	// The command doesn't work on the type of value the key holds
+	ErrWrongType = &Error{Code: "WRONGTYPE"}
+
+	// The connection must be authenticated first
+	ErrNoAuth = &Error{Code: "NOAUTH"}
+
+	// The command would make the server use more than its maxmemory
+	ErrOOM = &Error{Code: "OOM"}
+)
+
+// parseError splits an error sent by the server into its code and message
+func parseError(s string) *Error {
+	code, msg := s, ""
+	if i := strings.IndexByte(s, ' '); i >= 0 {
+		code, msg = s[:i], s[i+1:]
+	}
+	if code == "" || strings.ToUpper(code) != code {
+		return &Error{Msg: s}
+	}
+	return &Error{Code: code, Msg: msg}
+}
+
+// Error returns the error as it was sent by the server
+func (e *Error) Error() string {
+	if e.Code == "" {
+		return e.Msg
+	} else if e.Msg == "" {
+		return e.Code
+	}
+	return e.Code + " " + e.Msg
+}
+
+// Is returns whether the target is an *Error with the same code, and if the
+// target has a message, the same message
+func (e *Error) Is(target error) bool {
+	te, ok := target.(*Error)
+	if !ok {
+		return false
+	}
+	return te.Code == e.Code && (te.Msg == "" || te.Msg == e.Msg)
+}
+
+// Redirect returns the slot and the address of the node a MOVED or ASK error
+// redirects to. ok is false if the Error isn't one of those.
+func (e *Error) Redirect() (slot int, addr string, ok bool) {
+	if e.Code != ErrMoved.Code && e.Code != ErrAsk.Code {
+		return 0, "", false
+	}
+	parts := strings.Split(e.Msg, " ")
+	if len(parts) != 2 {
+		return 0, "", false
+	}
+	slot, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, "", false
+	}
+	return slot, parts[1], true
+}
@@ -0,0 +1,56 @@
+package redis
+
+import (
+	"errors"
+	"fmt"
+	. "testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseError(t *T) {
+	tests := []struct {
+		in  string
+		out *Error
+	}{
+		{"ERR unknown command", &Error{Code: "ERR", Msg: "unknown command"}},
+		{"WRONGTYPE Operation against a key", &Error{Code: "WRONGTYPE", Msg: "Operation against a key"}},
+		{"NOAUTH", &Error{Code: "NOAUTH"}},
+		{"ohey there", &Error{Msg: "ohey there"}},
+		{"", &Error{}},
+		{" leading space", &Error{Msg: " leading space"}},
+	}
+	for _, test := range tests {
+		err := parseError(test.in)
+		assert.Equal(t, test.out, err, test.in)
+		assert.Equal(t, test.in, err.Error())
+	}
+}
+
+func TestErrorIs(t *T) {
+	r := pretendRead("-MOVED 3999 127.0.0.1:6381\r\n")
+	assert.True(t, errors.Is(r.Err, ErrMoved))
+	assert.False(t, errors.Is(r.Err, ErrAsk))
+
+	// Works through wrapping too
+	wrapped := fmt.Errorf("doing thing: %w", r.Err)
+	assert.True(t, errors.Is(wrapped, ErrMoved))
+	var rerr *Error
+	assert.True(t, errors.As(wrapped, &rerr))
+	assert.Equal(t, "MOVED", rerr.Code)
+
+	slot, addr, ok := rerr.Redirect()
+	assert.True(t, ok)
+	assert.Equal(t, 3999, slot)
+	assert.Equal(t, "127.0.0.1:6381", addr)
+
+	_, _, ok = parseError("ERR foo bar").Redirect()
+	assert.False(t, ok)
+	_, _, ok = parseError("ASK foo").Redirect()
+	assert.False(t, ok)
+
+	// A target with a message must match it too
+	assert.True(t, errors.Is(parseError("ERR foo"), &Error{Code: "ERR", Msg: "foo"}))
+	assert.False(t, errors.Is(parseError("ERR foo"), &Error{Code: "ERR", Msg: "bar"}))
+	assert.False(t, errors.Is(errors.New("MOVED 1 a:1"), ErrMoved))
+}
@@ -0,0 +1,141 @@
+package redis
+
+import (
+	"context"
+	"time"
+)
+
+// CmdInfo describes a command which is being performed by a Client, and is
+// what its Hooks are given
+type CmdInfo struct {
+	// The context of the command, which is the one given to CmdContext or
+	// PipeRespContext, or context.Background() otherwise. BeforeCmd may
+	// replace it, e.g. with one carrying a tracing span, in which case the
+	// following Hooks get the replaced one.
+	Context context.Context
+
+	// The command and its args, as they're sent, i.e. after RespMarshalers
+	// and the like have been marshaled
+	Cmd  string
+	Args []interface{}
+
+	// The address of the redis instance the command is sent to
+	Addr string
+
+	// The number of commands which are written to the connection together
+	// with this one, including itself. This is 1 for Cmd, and the number of
+	// commands in the pipeline for PipeResp.
+	PipelineSize int
+
+	// The number of times the command was already tried, by a Cluster for
+	// example, and the error which caused it to be retried. The error is
+	// usually a *Error, e.g. MOVED or ASK.
+	Attempt    int
+	RetryCause error
+
+	// The reply to the command and how long it took to get it, which are only
+	// set for AfterCmd. For pipelined commands the duration is counted from
+	// when the whole pipeline started being written.
+	Resp     *Resp
+	Duration time.Duration
+
+	start time.Time
+}
+
+// Hook is called around every command a Client performs, including the ones
+// it performs as part of a pipeline. This can be used for collecting metrics,
+// logging slow commands, tracing, etc... BeforeCmd is called before the
+// command is sent, and AfterCmd once its reply has been read, with the same
+// CmdInfo. When a Client has multiple Hooks BeforeCmd is called on them in
+// order, and AfterCmd in reverse order, so that each Hook wraps the ones after
+// it.
+//
+// Hooks are called synchronously, slow Hooks slow every command down.
+type Hook interface {
+	BeforeCmd(ci *CmdInfo)
+	AfterCmd(ci *CmdInfo)
+}
+
+// HookFuncs is a Hook made up of functions, either of which may be nil
+//
+//	client.Hooks = append(client.Hooks, redis.HookFuncs{
+//		After: func(ci *redis.CmdInfo) {
+//			if ci.Duration > 100*time.Millisecond {
+//				log.Printf("slow command %s on %s: %s", ci.Cmd, ci.Addr, ci.Duration)
+//			}
+//		},
+//	})
+//
+type HookFuncs struct {
+	Before func(ci *CmdInfo)
+	After  func(ci *CmdInfo)
+}
+
+// BeforeCmd implements the method for the Hook interface
+func (hf HookFuncs) BeforeCmd(ci *CmdInfo) {
+	if hf.Before != nil {
+		hf.Before(ci)
+	}
+}
+
+// AfterCmd implements the method for the Hook interface
+func (hf HookFuncs) AfterCmd(ci *CmdInfo) {
+	if hf.After != nil {
+		hf.After(ci)
+	}
+}
+
+type attemptKey struct{}
+
+type attempt struct {
+	n     int
+	cause error
+}
+
+// ContextWithAttempt returns a context which, when given to CmdContext or
+// PipeRespContext, sets the Attempt and RetryCause of the CmdInfos given to
+// the Client's Hooks. This is meant for wrappers like Cluster, which retry
+// commands on other Clients when they're redirected.
+func ContextWithAttempt(ctx context.Context, n int, cause error) context.Context {
+	return context.WithValue(ctx, attemptKey{}, attempt{n, cause})
+}
+
+// hookBefore calls BeforeCmd on the Client's Hooks for the given request,
+// returning the CmdInfo which must then be passed into hookAfter. nil is
+// returned if there are no Hooks
+func (c *Client) hookBefore(req request, pipelineSize int, start time.Time) *CmdInfo {
+	if len(c.Hooks) == 0 {
+		return nil
+	}
+	ctx := c.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	ci := &CmdInfo{
+		Context:      ctx,
+		Cmd:          req.cmd,
+		Args:         req.args,
+		Addr:         c.Addr,
+		PipelineSize: pipelineSize,
+		start:        start,
+	}
+	if a, ok := ctx.Value(attemptKey{}).(attempt); ok {
+		ci.Attempt, ci.RetryCause = a.n, a.cause
+	}
+	for _, h := range c.Hooks {
+		h.BeforeCmd(ci)
+	}
+	return ci
+}
+
+// hookAfter calls AfterCmd on the Client's Hooks, in reverse order, with the
+// given reply. It does nothing if ci is nil
+func (c *Client) hookAfter(ci *CmdInfo, r *Resp) {
+	if ci == nil {
+		return
+	}
+	ci.Resp, ci.Duration = r, time.Since(ci.start)
+	for i := len(c.Hooks) - 1; i >= 0; i-- {
+		c.Hooks[i].AfterCmd(ci)
+	}
+}
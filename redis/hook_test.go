@@ -0,0 +1,97 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	. "testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type ctxKey string
+
+// recordHook records the calls made to it into calls
+func recordHook(name string, calls *[]string, infos *[]CmdInfo) Hook {
+	return HookFuncs{
+		Before: func(ci *CmdInfo) {
+			*calls = append(*calls, "before "+name+" "+ci.Cmd)
+			ci.Context = context.WithValue(ci.Context, ctxKey(name), true)
+		},
+		After: func(ci *CmdInfo) {
+			*calls = append(*calls, "after "+name+" "+ci.Cmd)
+			if infos != nil {
+				*infos = append(*infos, *ci)
+			}
+		},
+	}
+}
+
+func TestHooks(t *T) {
+	cmdCh := make(chan []string, 10)
+	conn := pipeServer(t, cmdCh, func(cmd []string) *Resp {
+		if cmd[0] == "ERR" {
+			return NewResp(errors.New("ERR bad"))
+		}
+		return NewResp(cmd[0])
+	})
+	c := NewClient(conn)
+	defer c.Close()
+
+	var calls []string
+	var infos []CmdInfo
+	c.Hooks = []Hook{
+		recordHook("a", &calls, nil),
+		recordHook("b", &calls, &infos),
+	}
+
+	assert.Equal(t, "ECHO", mustStr(t, c.Cmd("ECHO", "foo")))
+	<-cmdCh
+	assert.Equal(t, []string{
+		"before a ECHO", "before b ECHO", "after b ECHO", "after a ECHO",
+	}, calls)
+	require.Len(t, infos, 1)
+	ci := infos[0]
+	assert.Equal(t, []interface{}{"foo"}, ci.Args)
+	assert.Equal(t, "ECHO", mustStr(t, ci.Resp))
+	assert.Equal(t, 1, ci.PipelineSize)
+	assert.Equal(t, 0, ci.Attempt)
+	assert.True(t, ci.Duration > 0)
+	assert.Equal(t, true, ci.Context.Value(ctxKey("a")))
+	assert.Equal(t, true, ci.Context.Value(ctxKey("b")))
+
+	// Context and attempt
+	calls, infos = nil, nil
+	cause := errors.New("MOVED 1 foo:1")
+	ctx := ContextWithAttempt(context.WithValue(context.Background(), ctxKey("c"), 1), 2, cause)
+	require.Nil(t, c.CmdContext(ctx, "ECHO", "foo").Err)
+	<-cmdCh
+	require.Len(t, infos, 1)
+	assert.Equal(t, 1, infos[0].Context.Value(ctxKey("c")))
+	assert.Equal(t, 2, infos[0].Attempt)
+	assert.Equal(t, cause, infos[0].RetryCause)
+
+	// Pipelines
+	calls, infos = nil, nil
+	c.PipeAppend("ONE")
+	c.PipeAppend("ERR")
+	c.PipeAppend("THREE")
+	for i := 0; i < 3; i++ {
+		c.PipeResp()
+		<-cmdCh
+	}
+	assert.Equal(t, []string{
+		"before a ONE", "before b ONE",
+		"before a ERR", "before b ERR",
+		"before a THREE", "before b THREE",
+		"after b ONE", "after a ONE",
+		"after b ERR", "after a ERR",
+		"after b THREE", "after a THREE",
+	}, calls)
+	require.Len(t, infos, 3)
+	for i, ci := range infos {
+		assert.Equal(t, 3, ci.PipelineSize, fmt.Sprint(i))
+	}
+	assert.Equal(t, "ERR bad", infos[1].Resp.Err.Error())
+}
@@ -0,0 +1,325 @@
+package redis
+
+// The KeySpecs of the most common ones
+var (
+	firstKey = []KeySpec{{Index: 1}}
+	allKeys  = []KeySpec{{Index: 1, LastKey: -1}}
+	twoKeys  = []KeySpec{{Index: 1, LastKey: 1}}
+)
+
+// builtinKeySpecs are the KeySpecs of the commands of redis itself, as of
+// redis 7.4. Those with subcommands are keyed as "CMD|SUBCMD".
+var builtinKeySpecs = map[string][]KeySpec{
+	// Commands taking a single key as their first argument
+	"GET":                  firstKey,
+	"SET":                  firstKey,
+	"SETNX":                firstKey,
+	"SETEX":                firstKey,
+	"PSETEX":               firstKey,
+	"GETSET":               firstKey,
+	"GETDEL":               firstKey,
+	"GETEX":                firstKey,
+	"GETRANGE":             firstKey,
+	"SETRANGE":             firstKey,
+	"SUBSTR":               firstKey,
+	"INCR":                 firstKey,
+	"DECR":                 firstKey,
+	"INCRBY":               firstKey,
+	"DECRBY":               firstKey,
+	"INCRBYFLOAT":          firstKey,
+	"APPEND":               firstKey,
+	"STRLEN":               firstKey,
+	"SETBIT":               firstKey,
+	"GETBIT":               firstKey,
+	"BITCOUNT":             firstKey,
+	"BITPOS":               firstKey,
+	"BITFIELD":             firstKey,
+	"BITFIELD_RO":          firstKey,
+	"HSET":                 firstKey,
+	"HMSET":                firstKey,
+	"HSETNX":               firstKey,
+	"HGET":                 firstKey,
+	"HMGET":                firstKey,
+	"HGETALL":              firstKey,
+	"HDEL":                 firstKey,
+	"HEXISTS":              firstKey,
+	"HLEN":                 firstKey,
+	"HKEYS":                firstKey,
+	"HVALS":                firstKey,
+	"HINCRBY":              firstKey,
+	"HINCRBYFLOAT":         firstKey,
+	"HSTRLEN":              firstKey,
+	"HSCAN":                firstKey,
+	"HRANDFIELD":           firstKey,
+	"HEXPIRE":              firstKey,
+	"HPEXPIRE":             firstKey,
+	"HEXPIREAT":            firstKey,
+	"HPEXPIREAT":           firstKey,
+	"HTTL":                 firstKey,
+	"HPTTL":                firstKey,
+	"HEXPIRETIME":          firstKey,
+	"HPEXPIRETIME":         firstKey,
+	"HPERSIST":             firstKey,
+	"HGETDEL":              firstKey,
+	"HGETEX":               firstKey,
+	"HSETEX":               firstKey,
+	"LPUSH":                firstKey,
+	"RPUSH":                firstKey,
+	"LPUSHX":               firstKey,
+	"RPUSHX":               firstKey,
+	"LPOP":                 firstKey,
+	"RPOP":                 firstKey,
+	"LLEN":                 firstKey,
+	"LRANGE":               firstKey,
+	"LINDEX":               firstKey,
+	"LSET":                 firstKey,
+	"LREM":                 firstKey,
+	"LTRIM":                firstKey,
+	"LINSERT":              firstKey,
+	"LPOS":                 firstKey,
+	"SADD":                 firstKey,
+	"SREM":                 firstKey,
+	"SMEMBERS":             firstKey,
+	"SISMEMBER":            firstKey,
+	"SMISMEMBER":           firstKey,
+	"SCARD":                firstKey,
+	"SSCAN":                firstKey,
+	"SPOP":                 firstKey,
+	"SRANDMEMBER":          firstKey,
+	"ZADD":                 firstKey,
+	"ZREM":                 firstKey,
+	"ZSCORE":               firstKey,
+	"ZMSCORE":              firstKey,
+	"ZCARD":                firstKey,
+	"ZCOUNT":               firstKey,
+	"ZLEXCOUNT":            firstKey,
+	"ZINCRBY":              firstKey,
+	"ZRANGE":               firstKey,
+	"ZREVRANGE":            firstKey,
+	"ZRANGEBYSCORE":        firstKey,
+	"ZREVRANGEBYSCORE":     firstKey,
+	"ZRANGEBYLEX":          firstKey,
+	"ZREVRANGEBYLEX":       firstKey,
+	"ZRANK":                firstKey,
+	"ZREVRANK":             firstKey,
+	"ZSCAN":                firstKey,
+	"ZPOPMIN":              firstKey,
+	"ZPOPMAX":              firstKey,
+	"ZREMRANGEBYRANK":      firstKey,
+	"ZREMRANGEBYSCORE":     firstKey,
+	"ZREMRANGEBYLEX":       firstKey,
+	"ZRANDMEMBER":          firstKey,
+	"EXPIRE":               firstKey,
+	"PEXPIRE":              firstKey,
+	"EXPIREAT":             firstKey,
+	"PEXPIREAT":            firstKey,
+	"EXPIRETIME":           firstKey,
+	"PEXPIRETIME":          firstKey,
+	"TTL":                  firstKey,
+	"PTTL":                 firstKey,
+	"PERSIST":              firstKey,
+	"TYPE":                 firstKey,
+	"DUMP":                 firstKey,
+	"RESTORE":              firstKey,
+	"SORT_RO":              firstKey,
+	"PFADD":                firstKey,
+	"PFDEBUG":              firstKey,
+	"XADD":                 firstKey,
+	"XLEN":                 firstKey,
+	"XRANGE":               firstKey,
+	"XREVRANGE":            firstKey,
+	"XDEL":                 firstKey,
+	"XTRIM":                firstKey,
+	"XACK":                 firstKey,
+	"XCLAIM":               firstKey,
+	"XAUTOCLAIM":           firstKey,
+	"XPENDING":             firstKey,
+	"XSETID":               firstKey,
+	"GEOADD":               firstKey,
+	"GEODIST":              firstKey,
+	"GEOHASH":              firstKey,
+	"GEOPOS":               firstKey,
+	"GEORADIUS_RO":         firstKey,
+	"GEORADIUSBYMEMBER_RO": firstKey,
+	"GEOSEARCH":            firstKey,
+	"SPUBLISH":             firstKey,
+	"MOVE":                 firstKey,
+
+	// Commands whose arguments are all keys
+	"DEL":          allKeys,
+	"UNLINK":       allKeys,
+	"EXISTS":       allKeys,
+	"TOUCH":        allKeys,
+	"MGET":         allKeys,
+	"WATCH":        allKeys,
+	"SINTER":       allKeys,
+	"SUNION":       allKeys,
+	"SDIFF":        allKeys,
+	"SINTERSTORE":  allKeys,
+	"SUNIONSTORE":  allKeys,
+	"SDIFFSTORE":   allKeys,
+	"PFCOUNT":      allKeys,
+	"PFMERGE":      allKeys,
+	"SSUBSCRIBE":   allKeys,
+	"SUNSUBSCRIBE": allKeys,
+
+	// Commands taking two keys
+	"RENAME":         twoKeys,
+	"RENAMENX":       twoKeys,
+	"SMOVE":          twoKeys,
+	"RPOPLPUSH":      twoKeys,
+	"LMOVE":          twoKeys,
+	"BRPOPLPUSH":     twoKeys,
+	"BLMOVE":         twoKeys,
+	"COPY":           twoKeys,
+	"ZRANGESTORE":    twoKeys,
+	"LCS":            twoKeys,
+	"GEOSEARCHSTORE": twoKeys,
+
+	// Blocking commands whose last argument is the timeout
+	"BLPOP":    {{Index: 1, LastKey: -2}},
+	"BRPOP":    {{Index: 1, LastKey: -2}},
+	"BZPOPMIN": {{Index: 1, LastKey: -2}},
+	"BZPOPMAX": {{Index: 1, LastKey: -2}},
+
+	// Commands whose keys are preceded by their number
+	"ZUNION":     {{Index: 1, KeyNum: true, FirstKey: 1}},
+	"ZINTER":     {{Index: 1, KeyNum: true, FirstKey: 1}},
+	"ZDIFF":      {{Index: 1, KeyNum: true, FirstKey: 1}},
+	"ZINTERCARD": {{Index: 1, KeyNum: true, FirstKey: 1}},
+	"SINTERCARD": {{Index: 1, KeyNum: true, FirstKey: 1}},
+	"LMPOP":      {{Index: 1, KeyNum: true, FirstKey: 1}},
+	"ZMPOP":      {{Index: 1, KeyNum: true, FirstKey: 1}},
+
+	// Commands whose keys are preceded by their number, after another argument
+	"BLMPOP":     {{Index: 2, KeyNum: true, FirstKey: 1}},
+	"BZMPOP":     {{Index: 2, KeyNum: true, FirstKey: 1}},
+	"EVAL":       {{Index: 2, KeyNum: true, FirstKey: 1}},
+	"EVALSHA":    {{Index: 2, KeyNum: true, FirstKey: 1}},
+	"EVAL_RO":    {{Index: 2, KeyNum: true, FirstKey: 1}},
+	"EVALSHA_RO": {{Index: 2, KeyNum: true, FirstKey: 1}},
+	"FCALL":      {{Index: 2, KeyNum: true, FirstKey: 1}},
+	"FCALL_RO":   {{Index: 2, KeyNum: true, FirstKey: 1}},
+
+	// Commands storing into a destination key
+	"ZUNIONSTORE": {{Index: 1}, {Index: 2, KeyNum: true, FirstKey: 1}},
+	"ZINTERSTORE": {{Index: 1}, {Index: 2, KeyNum: true, FirstKey: 1}},
+	"ZDIFFSTORE":  {{Index: 1}, {Index: 2, KeyNum: true, FirstKey: 1}},
+	"BITOP":       {{Index: 2, LastKey: -1}},
+
+	// Commands which optionally store into a destination key given after a
+	// keyword
+	"SORT":              {{Index: 1}, {Keyword: "STORE", Index: 2}},
+	"GEORADIUS":         {{Index: 1}, {Keyword: "STORE", Index: 6}, {Keyword: "STOREDIST", Index: 6}},
+	"GEORADIUSBYMEMBER": {{Index: 1}, {Keyword: "STORE", Index: 5}, {Keyword: "STOREDIST", Index: 5}},
+
+	"MSET":   {{Index: 1, LastKey: -1, KeyStep: 2}},
+	"MSETNX": {{Index: 1, LastKey: -1, KeyStep: 2}},
+
+	"XREAD":      {{Keyword: "STREAMS", Index: 1, LastKey: -1, Limit: 2}},
+	"XREADGROUP": {{Keyword: "STREAMS", Index: 4, LastKey: -1, Limit: 2}},
+
+	"MIGRATE": {{Index: 3}, {Keyword: "KEYS", Index: -2, LastKey: -1}},
+
+	// Subcommands taking a single key
+	"OBJECT|ENCODING":       {{Index: 2}},
+	"OBJECT|FREQ":           {{Index: 2}},
+	"OBJECT|IDLETIME":       {{Index: 2}},
+	"OBJECT|REFCOUNT":       {{Index: 2}},
+	"MEMORY|USAGE":          {{Index: 2}},
+	"XINFO|STREAM":          {{Index: 2}},
+	"XINFO|GROUPS":          {{Index: 2}},
+	"XINFO|CONSUMERS":       {{Index: 2}},
+	"XGROUP|CREATE":         {{Index: 2}},
+	"XGROUP|SETID":          {{Index: 2}},
+	"XGROUP|DESTROY":        {{Index: 2}},
+	"XGROUP|CREATECONSUMER": {{Index: 2}},
+	"XGROUP|DELCONSUMER":    {{Index: 2}},
+
+	// Commands without any keys
+	"PING":         nil,
+	"ECHO":         nil,
+	"INFO":         nil,
+	"TIME":         nil,
+	"DBSIZE":       nil,
+	"FLUSHDB":      nil,
+	"FLUSHALL":     nil,
+	"SCAN":         nil,
+	"KEYS":         nil,
+	"RANDOMKEY":    nil,
+	"MULTI":        nil,
+	"EXEC":         nil,
+	"DISCARD":      nil,
+	"UNWATCH":      nil,
+	"SELECT":       nil,
+	"AUTH":         nil,
+	"HELLO":        nil,
+	"QUIT":         nil,
+	"RESET":        nil,
+	"PUBLISH":      nil,
+	"SUBSCRIBE":    nil,
+	"PSUBSCRIBE":   nil,
+	"UNSUBSCRIBE":  nil,
+	"PUNSUBSCRIBE": nil,
+	"READONLY":     nil,
+	"READWRITE":    nil,
+	"ASKING":       nil,
+	"WAIT":         nil,
+	"WAITAOF":      nil,
+	"SAVE":         nil,
+	"BGSAVE":       nil,
+	"BGREWRITEAOF": nil,
+	"LASTSAVE":     nil,
+	"SWAPDB":       nil,
+	"MONITOR":      nil,
+	"ROLE":         nil,
+	"LOLWUT":       nil,
+	"SHUTDOWN":     nil,
+	"REPLICAOF":    nil,
+	"SLAVEOF":      nil,
+	"FAILOVER":     nil,
+}
+
+// builtinContainers are the commands of redis itself whose first argument is a
+// subcommand. Their subcommands which aren't in builtinKeySpecs don't take any
+// keys.
+var builtinContainers = []string{
+	"OBJECT",
+	"MEMORY",
+	"XINFO",
+	"XGROUP",
+	"CLIENT",
+	"CONFIG",
+	"CLUSTER",
+	"SCRIPT",
+	"FUNCTION",
+	"COMMAND",
+	"ACL",
+	"SLOWLOG",
+	"LATENCY",
+	"MODULE",
+	"PUBSUB",
+}
+
+// builtinReadOnly are the commands of redis itself which only read data
+var builtinReadOnly = []string{
+	"GET", "GETRANGE", "SUBSTR", "MGET", "STRLEN", "GETBIT", "BITCOUNT",
+	"BITPOS", "BITFIELD_RO", "LCS",
+	"HGET", "HMGET", "HGETALL", "HEXISTS", "HLEN", "HKEYS", "HVALS", "HSTRLEN",
+	"HSCAN", "HRANDFIELD", "HTTL", "HPTTL", "HEXPIRETIME", "HPEXPIRETIME",
+	"LLEN", "LRANGE", "LINDEX", "LPOS",
+	"SMEMBERS", "SISMEMBER", "SMISMEMBER", "SCARD", "SSCAN", "SRANDMEMBER",
+	"SINTER", "SUNION", "SDIFF", "SINTERCARD",
+	"ZSCORE", "ZMSCORE", "ZCARD", "ZCOUNT", "ZLEXCOUNT", "ZRANGE", "ZREVRANGE",
+	"ZRANGEBYSCORE", "ZREVRANGEBYSCORE", "ZRANGEBYLEX", "ZREVRANGEBYLEX",
+	"ZRANK", "ZREVRANK", "ZSCAN", "ZRANDMEMBER", "ZUNION", "ZINTER", "ZDIFF",
+	"ZINTERCARD",
+	"EXISTS", "TYPE", "TTL", "PTTL", "EXPIRETIME", "PEXPIRETIME", "DUMP",
+	"TOUCH", "SORT_RO", "PFCOUNT",
+	"XLEN", "XRANGE", "XREVRANGE", "XPENDING", "XREAD",
+	"GEODIST", "GEOHASH", "GEOPOS", "GEORADIUS_RO", "GEORADIUSBYMEMBER_RO",
+	"GEOSEARCH",
+	"EVAL_RO", "EVALSHA_RO", "FCALL_RO",
+	"OBJECT|ENCODING", "OBJECT|FREQ", "OBJECT|IDLETIME", "OBJECT|REFCOUNT",
+	"MEMORY|USAGE", "XINFO|STREAM", "XINFO|GROUPS", "XINFO|CONSUMERS",
+}
@@ -3,23 +3,30 @@ package redis
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	"math"
+	"math/big"
 	"net"
 	"reflect"
 	"strconv"
 	"strings"
 
 	"github.com/gallir/bytebufferpool"
-	"github.com/golang/snappy"
 )
 
 var (
 	delim    = []byte{'\r', '\n'}
 	delimEnd = delim[len(delim)-1]
 
-	// UsePool enable to use vayala bytes buffer pools
+	// UsePool enables pooling, using bytebufferpool, of the buffers of bulk
+	// strings of at least this size, for every Client which doesn't have a
+	// BufferPool set.
+	//
+	// Deprecated: set a BufferPool on the Client (or its DialOpts) instead,
+	// which allows for different settings for each Client or Pool.
 	UsePool = 0
 )
 
@@ -38,16 +45,30 @@ const (
 	Array
 	Nil
 
-	// Str combines both SimpleStr and BulkStr, which are considered strings to
-	// the Str() method.  This is what you want to give to IsType when
-	// determining if a response is a string
-	Str = SimpleStr | BulkStr
+	// The following types are only sent by servers speaking RESP3 (see
+	// Client.Hello)
+	Map         // Aggregate of key/value pairs, e.g. the reply to HGETALL
+	Set         // Aggregate of unordered, unique elements
+	Double      // Floating point number
+	Bool        // True or false
+	BigNum      // Integer which doesn't fit in 64 bits
+	VerbatimStr // String prefixed with a three letter format, e.g. "txt:"
+	Attr        // Auxiliary key/value pairs attached to a reply (see Attrs)
+	Push        // Out of band data, e.g. pub/sub messages or invalidations
+
+	// Str combines SimpleStr, BulkStr and VerbatimStr, which are considered
+	// strings to the Str() method.  This is what you want to give to IsType
+	// when determining if a response is a string
+	Str = SimpleStr | BulkStr | VerbatimStr
 
 	// Err combines both IOErr and AppErr, which both indicate that the Err
 	// field on their Resp is filled. To determine if a Resp is an error you'll
 	// most often want to simply check if the Err field on it is nil
 	Err = IOErr | AppErr
 
+	// Aggregate combines all types whose value is a list of other Resps
+	Aggregate = Array | Map | Set | Attr | Push
+
 	pollMinSize = 64
 )
 
@@ -60,6 +81,20 @@ var (
 	nilFormatted    = []byte("$-1\r\n")
 	byte0           = []byte{'0'}
 	byte1           = []byte{'1'}
+
+	mapPrefix      = []byte{'%'}
+	setPrefix      = []byte{'~'}
+	doublePrefix   = []byte{','}
+	boolPrefix     = []byte{'#'}
+	bigNumPrefix   = []byte{'('}
+	verbatimPrefix = []byte{'='}
+	attrPrefix     = []byte{'|'}
+	nullPrefix     = []byte{'_'}
+	pushPrefix     = []byte{'>'}
+	blobErrPrefix  = []byte{'!'}
+	trueFormatted  = []byte("#t\r\n")
+	falseFormatted = []byte("#f\r\n")
+	verbatimFmtLen = len("txt:")
 )
 
 // Parse errors
@@ -69,6 +104,7 @@ var (
 	errNotStr   = errors.New("could not convert to string")
 	errNotInt   = errors.New("could not convert to int")
 	errNotArray = errors.New("could not convert to array")
+	errNotBool  = errors.New("could not convert to bool")
 
 	// ErrRespNil is returned from methods on Resp like Str, Int, etc... when
 	// called on a Resp which is a nil response
@@ -81,7 +117,9 @@ var (
 type Resp struct {
 	typ        RespType
 	val        interface{}
-	byteBuffer *bytebufferpool.ByteBuffer
+	// pool is the BufferPool the []byte val was taken from, if any
+	pool BufferPool
+	attrs      *Resp
 
 	// Err indicates that this Resp signals some kind of error, either on the
 	// connection level or the application level. Use IsType if you need to
@@ -92,6 +130,10 @@ type Resp struct {
 // NewResp takes the given value and interprets it into a resp encoded byte
 // stream
 func NewResp(v interface{}) *Resp {
+	v, _, err := marshalArg(v)
+	if err != nil {
+		v = err
+	}
 	r := format(v, false)
 	return &r
 }
@@ -112,6 +154,10 @@ func NewRespSimple(s string) *Resp {
 // isn't already in a slice/map it will be wrapped so that it is written as a
 // Array of size one
 func NewRespFlattenedStrings(v interface{}) *Resp {
+	v, _, err := marshalArg(v)
+	if err != nil {
+		return NewResp(err)
+	}
 	fv := flatten(v)
 	r := format(fv, true)
 	return &r
@@ -125,10 +171,101 @@ func NewRespIOErr(err error) *Resp {
 	return r
 }
 
+// RespLimits are limits on the size of the replies read by a RespReader or
+// Client, which protect against a corrupted stream or a misbehaving server
+// causing huge allocations or unbounded recursion. A reply which exceeds any
+// of them results in a *ProtocolError. If any are set to zero the default
+// value will be used instead, setting them to a negative value disables them
+type RespLimits struct {
+	// The maximum length of a bulk string, verbatim string or blob error.
+	// Default is 512MB, the largest value redis itself accepts
+	MaxBulkLen int64
+
+	// The maximum number of elements in an aggregate (e.g. an array), with
+	// both the keys and values of a map counted. Default is 1 << 32
+	MaxArrayLen int64
+
+	// The maximum depth to which aggregates may be nested. Default is 64
+	MaxDepth int
+
+	// The maximum length of a simple string, error, or other reply sent as a
+	// single line, including the length line of bulk strings and aggregates.
+	// Default is 1MB
+	MaxLineLen int
+}
+
+func (l RespLimits) withDefaults() RespLimits {
+	if l.MaxBulkLen == 0 {
+		l.MaxBulkLen = 512 * 1024 * 1024
+	}
+	if l.MaxArrayLen == 0 {
+		l.MaxArrayLen = 1 << 32
+	}
+	if l.MaxDepth == 0 {
+		l.MaxDepth = 64
+	}
+	if l.MaxLineLen == 0 {
+		l.MaxLineLen = 1024 * 1024
+	}
+	return l
+}
+
+// ProtocolError is the Err of the IOErr Resp returned when a reply exceeds one
+// of the RespLimits. The connection can't be used after one, since the rest of
+// the offending reply is never read. A Client closes the connection and sets
+// LastCritical to the error.
+type ProtocolError struct {
+	// The name of the limit which was exceeded, e.g. "MaxBulkLen"
+	Limit string
+
+	// The size which exceeded the limit, and the limit itself
+	Size, Max int64
+}
+
+func (e *ProtocolError) Error() string {
+	return fmt.Sprintf(
+		"protocol error: size %d exceeds %s of %d", e.Size, e.Limit, e.Max,
+	)
+}
+
+// respBufReader is the buffered reader replies are read from, along with the
+// limits they're checked against
+type respBufReader struct {
+	*bufio.Reader
+	limits RespLimits
+	depth  int
+	pool   BufferPool
+}
+
+// Above these sizes bulk strings and aggregates are no longer allocated up
+// front, see readBulkBody and readAggregate
+const (
+	bulkPreallocMax      = 1024 * 1024
+	aggregatePreallocMax = 1024
+)
+
+// checkLimit returns a *ProtocolError if size exceeds max, unless max is
+// negative
+func checkLimit(limit string, size, max int64) error {
+	if max >= 0 && size > max {
+		return &ProtocolError{Limit: limit, Size: size, Max: max}
+	}
+	return nil
+}
+
 // RespReader is a wrapper around an io.Reader which will read Resp messages off
 // of the io.Reader
 type RespReader struct {
-	r *bufio.Reader
+	r *respBufReader
+
+	// Limits are checked against every reply read. They may be changed between
+	// calls to Read
+	Limits RespLimits
+
+	// If set, the buffers of bulk strings are taken from this pool, and can be
+	// returned to it using ReleaseBuffers. May be changed between calls to
+	// Read
+	BufferPool BufferPool
 }
 
 // NewRespReader creates and returns a new RespReader which will read from the
@@ -139,20 +276,28 @@ func NewRespReader(r io.Reader) *RespReader {
 	if !ok {
 		br = bufio.NewReader(r)
 	}
-	return &RespReader{br}
+	return &RespReader{r: &respBufReader{Reader: br}}
+}
+
+// reader returns the respBufReader, prepared for reading the next reply
+func (rr *RespReader) reader() *respBufReader {
+	rr.r.limits = rr.Limits.withDefaults()
+	rr.r.depth = 0
+	rr.r.pool = rr.BufferPool
+	return rr.r
 }
 
 // ReadResp attempts to read a message object from the given io.Reader, parse
 // it, and return a Resp representing it
 func (rr *RespReader) Read() *Resp {
-	res, err := bufioReadResp(rr.r)
+	res, err := bufioReadResp(rr.reader())
 	if err != nil {
 		res = Resp{typ: IOErr, val: err, Err: err}
 	}
 	return &res
 }
 
-func bufioReadResp(r *bufio.Reader) (Resp, error) {
+func bufioReadResp(r *respBufReader) (Resp, error) {
 	b, err := r.Peek(1)
 	if err != nil {
 		return Resp{}, err
@@ -167,104 +312,335 @@ func bufioReadResp(r *bufio.Reader) (Resp, error) {
 	case bulkStrPrefix[0]:
 		return readBulkStr(r)
 	case arrayPrefix[0]:
-		return readArray(r)
+		return readAggregate(r, Array)
+	case mapPrefix[0]:
+		return readAggregate(r, Map)
+	case setPrefix[0]:
+		return readAggregate(r, Set)
+	case pushPrefix[0]:
+		return readAggregate(r, Push)
+	case attrPrefix[0]:
+		return readAttr(r)
+	case doublePrefix[0]:
+		return readDouble(r)
+	case boolPrefix[0]:
+		return readBool(r)
+	case bigNumPrefix[0]:
+		return readBigNum(r)
+	case verbatimPrefix[0]:
+		return readVerbatimStr(r)
+	case blobErrPrefix[0]:
+		return readBlobError(r)
+	case nullPrefix[0]:
+		return readNull(r)
 	default:
 		return Resp{}, errBadType
 	}
 }
 
-func readSimpleStr(r *bufio.Reader) (Resp, error) {
-	b, err := r.ReadBytes(delimEnd)
+// readLine reads a single line off of r, returning it without its type prefix
+// or trailing delimiter
+func readLine(r *respBufReader) ([]byte, error) {
+	max := int64(r.limits.MaxLineLen)
+	b, err := r.ReadSlice(delimEnd)
+
+	// ReadSlice's result is only valid until the next read, so it's copied
+	line := append([]byte(nil), b...)
+	for err == bufio.ErrBufferFull {
+		// The prefix isn't counted towards the limit
+		if lerr := checkLimit("MaxLineLen", int64(len(line)-1), max); lerr != nil {
+			return nil, lerr
+		}
+		b, err = r.ReadSlice(delimEnd)
+		line = append(line, b...)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != delim[0] {
+		return nil, errParse
+	}
+	line = line[1 : len(line)-2]
+	if err := checkLimit("MaxLineLen", int64(len(line)), max); err != nil {
+		return nil, err
+	}
+	return line, nil
+}
+
+func readSimpleStr(r *respBufReader) (Resp, error) {
+	b, err := readLine(r)
 	if err != nil {
 		return Resp{}, err
 	}
-	return Resp{typ: SimpleStr, val: b[1 : len(b)-2]}, nil
+	return Resp{typ: SimpleStr, val: b}, nil
 }
 
-func readError(r *bufio.Reader) (Resp, error) {
-	b, err := r.ReadBytes(delimEnd)
+func readError(r *respBufReader) (Resp, error) {
+	b, err := readLine(r)
 	if err != nil {
 		return Resp{}, err
 	}
-	err = errors.New(string(b[1 : len(b)-2]))
+	err = parseError(string(b))
 	return Resp{typ: AppErr, val: err, Err: err}, nil
 }
 
-func readInt(r *bufio.Reader) (Resp, error) {
-	b, err := r.ReadBytes(delimEnd)
+func readInt(r *respBufReader) (Resp, error) {
+	b, err := readLine(r)
 	if err != nil {
 		return Resp{}, err
 	}
-	i, err := strconv.ParseInt(string(b[1:len(b)-2]), 10, 64)
+	i, err := strconv.ParseInt(string(b), 10, 64)
 	if err != nil {
 		return Resp{}, errParse
 	}
 	return Resp{typ: Int, val: i}, nil
 }
 
-func readBulkStr(r *bufio.Reader) (Resp, error) {
-	b, err := r.ReadBytes(delimEnd)
+func readSize(r *respBufReader) (int64, error) {
+	b, err := readLine(r)
 	if err != nil {
-		return Resp{}, err
+		return 0, err
 	}
-	size, err := strconv.ParseInt(string(b[1:len(b)-2]), 10, 64)
+	size, err := strconv.ParseInt(string(b), 10, 64)
 	if err != nil {
-		return Resp{}, errParse
+		return 0, errParse
+	}
+	return size, nil
+}
+
+// readBulkSize reads the size of a bulk string, verbatim string or blob error,
+// checking it against MaxBulkLen
+func readBulkSize(r *respBufReader) (int64, error) {
+	size, err := readSize(r)
+	if err != nil {
+		return 0, err
+	}
+	return size, checkLimit("MaxBulkLen", size, r.limits.MaxBulkLen)
+}
+
+func readBulkStr(r *respBufReader) (Resp, error) {
+	size, err := readBulkSize(r)
+	if err != nil {
+		return Resp{}, err
 	}
 	if size < 0 {
 		return Resp{typ: Nil}, nil
 	}
+	total, pool, err := readBulkBody(r, size)
+	if err != nil {
+		return Resp{}, err
+	}
+	return Resp{typ: BulkStr, val: total, pool: pool}, nil
+}
+
+// readBulkBody reads size bytes of data plus the trailing delimiter. The
+// returned BufferPool is only set if the data was allocated from it
+func readBulkBody(
+	r *respBufReader, size int64,
+) (
+	[]byte, BufferPool, error,
+) {
 	var total []byte
-	var bb *bytebufferpool.ByteBuffer
-	if UsePool > 0 && int(size) >= UsePool {
-		bb = bytebufferpool.GetLen(int(size))
-		total = bb.B
+	pool := r.pool
+	if pool == nil && UsePool > 0 && int(size) >= UsePool {
+		pool = byteBufferPool{}
+	}
+	if size > bulkPreallocMax {
+		pool = nil
+		// The size isn't trusted for allocating large buffers up front, the
+		// buffer only grows as the data actually arrives
+		buf := bytes.NewBuffer(make([]byte, 0, bulkPreallocMax))
+		if _, err := io.CopyN(buf, r, size); err == io.EOF {
+			return nil, nil, io.ErrUnexpectedEOF
+		} else if err != nil {
+			return nil, nil, err
+		}
+		total = buf.Bytes()
 	} else {
-		total = make([]byte, size)
-	}
-	b2 := total
-	var n int
-	for len(b2) > 0 {
-		n, err = r.Read(b2)
-		if err != nil {
-			return Resp{}, err
+		if pool != nil {
+			total = pool.Get(int(size))
+		} else {
+			total = make([]byte, size)
+		}
+		if _, err := io.ReadFull(r, total); err != nil {
+			if pool != nil {
+				pool.Put(total)
+			}
+			return nil, nil, err
 		}
-		b2 = b2[n:]
 	}
 
 	// There's a hanging \r\n there, gotta read past it
 	for i := 0; i < 2; i++ {
-		_, err := r.ReadByte()
+		if _, err := r.ReadByte(); err != nil {
+			if pool != nil {
+				pool.Put(total)
+			}
+			return nil, nil, err
+		}
+	}
+	return total, pool, nil
+}
+
+func readAggregate(r *respBufReader, typ RespType) (Resp, error) {
+	size, err := readSize(r)
+	if err != nil {
+		return Resp{}, err
+	}
+	if size < 0 {
+		return Resp{typ: Nil}, nil
+	}
+	if typ == Map || typ == Attr {
+		if size, err = pairsLen(size, r.limits.MaxArrayLen); err != nil {
+			return Resp{}, err
+		}
+	}
+	if err := checkAggregate(r, size); err != nil {
+		return Resp{}, err
+	}
+
+	r.depth++
+	defer func() { r.depth-- }()
+
+	// The size isn't trusted for allocating the whole array up front, the
+	// elements have to actually be there for it to grow that large
+	arr := make([]Resp, 0, minInt64(size, aggregatePreallocMax))
+	for i := int64(0); i < size; i++ {
+		m, err := bufioReadResp(r)
 		if err != nil {
 			return Resp{}, err
 		}
+		arr = append(arr, m)
+	}
+	return Resp{typ: typ, val: arr}, nil
+}
+
+// checkAggregate checks the size of an aggregate about to be read, and the
+// depth it's at, against the limits
+func checkAggregate(r *respBufReader, size int64) error {
+	if err := checkLimit("MaxArrayLen", size, r.limits.MaxArrayLen); err != nil {
+		return err
+	}
+	return checkLimit("MaxDepth", int64(r.depth+1), int64(r.limits.MaxDepth))
+}
+
+// pairsLen returns the number of elements of a map or attribute with the
+// given number of pairs, checking it against max (MaxArrayLen, or negative for
+// no limit) before doubling it so that a huge size can't overflow
+func pairsLen(pairs, max int64) (int64, error) {
+	if max < 0 {
+		max = math.MaxInt64
+	}
+	if pairs > max/2 {
+		size := int64(math.MaxInt64)
+		if pairs <= math.MaxInt64/2 {
+			size = pairs * 2
+		}
+		return 0, &ProtocolError{Limit: "MaxArrayLen", Size: size, Max: max}
+	}
+	return pairs * 2, nil
+}
+
+func minInt64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// readAttr reads an attribute map and the reply which follows it, attaching
+// the former to the latter
+func readAttr(r *respBufReader) (Resp, error) {
+	attrs, err := readAggregate(r, Attr)
+	if err != nil {
+		return Resp{}, err
+	}
+	m, err := bufioReadResp(r)
+	if err != nil {
+		return Resp{}, err
+	}
+	m.attrs = &attrs
+	return m, nil
+}
+
+func readDouble(r *respBufReader) (Resp, error) {
+	b, err := readLine(r)
+	if err != nil {
+		return Resp{}, err
+	}
+	f, err := strconv.ParseFloat(string(b), 64)
+	if err != nil {
+		return Resp{}, errParse
 	}
+	return Resp{typ: Double, val: f}, nil
+}
 
-	return Resp{typ: BulkStr, val: total, byteBuffer: bb}, nil
+func readBool(r *respBufReader) (Resp, error) {
+	b, err := readLine(r)
+	if err != nil {
+		return Resp{}, err
+	}
+	if len(b) != 1 || (b[0] != 't' && b[0] != 'f') {
+		return Resp{}, errParse
+	}
+	return Resp{typ: Bool, val: b[0] == 't'}, nil
 }
 
-func readArray(r *bufio.Reader) (Resp, error) {
-	b, err := r.ReadBytes(delimEnd)
+func readBigNum(r *respBufReader) (Resp, error) {
+	b, err := readLine(r)
 	if err != nil {
 		return Resp{}, err
 	}
-	size, err := strconv.ParseInt(string(b[1:len(b)-2]), 10, 64)
+	i, ok := new(big.Int).SetString(string(b), 10)
+	if !ok {
+		return Resp{}, errParse
+	}
+	return Resp{typ: BigNum, val: i}, nil
+}
+
+func readVerbatimStr(r *respBufReader) (Resp, error) {
+	size, err := readBulkSize(r)
 	if err != nil {
+		return Resp{}, err
+	}
+	if size < int64(verbatimFmtLen) {
 		return Resp{}, errParse
 	}
+	total, pool, err := readBulkBody(r, size)
+	if err != nil {
+		return Resp{}, err
+	}
+	return Resp{typ: VerbatimStr, val: total, pool: pool}, nil
+}
+
+func readBlobError(r *respBufReader) (Resp, error) {
+	size, err := readBulkSize(r)
+	if err != nil {
+		return Resp{}, err
+	}
 	if size < 0 {
-		return Resp{typ: Nil}, nil
+		return Resp{}, errParse
 	}
+	total, pool, err := readBulkBody(r, size)
+	if err != nil {
+		return Resp{}, err
+	}
+	err = parseError(string(total))
+	if pool != nil {
+		pool.Put(total)
+	}
+	return Resp{typ: AppErr, val: err, Err: err}, nil
+}
 
-	arr := make([]Resp, size)
-	for i := range arr {
-		m, err := bufioReadResp(r)
-		if err != nil {
-			return Resp{}, err
-		}
-		arr[i] = m
+func readNull(r *respBufReader) (Resp, error) {
+	b, err := readLine(r)
+	if err != nil {
+		return Resp{}, err
+	}
+	if len(b) != 0 {
+		return Resp{}, errParse
 	}
-	return Resp{typ: Array, val: arr}, nil
+	return Resp{typ: Nil}, nil
 }
 
 // IsType returns whether or or not the reply is of a given type
@@ -274,7 +650,6 @@ func readArray(r *bufio.Reader) (Resp, error) {
 // Multiple types can be checked at the same time by or'ing the desired types
 //
 //	isStrOrInt := r.IsType(redis.Str | redis.Int)
-//
 func (r *Resp) IsType(t RespType) bool {
 	return r.typ&t > 0
 }
@@ -290,22 +665,14 @@ func (r *Resp) WriteTo(w io.Writer) (int64, error) {
 		var written int
 		var b []byte
 		s := r.val.([]byte)
-		if UsePool > 0 && len(s) >= UsePool {
-			bb := bytebufferpool.Get()
-			bb.B = append(bb.B, simpleStrPrefix...)
-			bb.B = append(bb.B, s...)
-			bb.B = append(bb.B, delim...)
-			b = bb.B
-		} else {
-			b = append(make([]byte, 0, len(s)+3), simpleStrPrefix...)
-			b = append(b, s...)
-			b = append(b, delim...)
-		}
+		b = append(make([]byte, 0, len(s)+3), simpleStrPrefix...)
+		b = append(b, s...)
+		b = append(b, delim...)
 		written, err = w.Write(b)
 		return int64(written), err
 	}
 
-	return writeTo(w, nil, r.val, false, false)
+	return writeTo(w, nil, r, false, false)
 }
 
 // Bytes returns a byte slice representing the value of the Resp. Only valid for
@@ -322,11 +689,26 @@ func (r *Resp) Bytes() ([]byte, error) {
 	}
 
 	if b, ok := r.val.([]byte); ok {
+		if r.typ == VerbatimStr {
+			return b[verbatimFmtLen:], nil
+		}
 		return b, nil
 	}
 	return nil, errNotStr
 }
 
+// VerbatimFormat returns the three letter format (e.g. "txt" or "mkd") of a
+// Resp of type VerbatimStr. If r.Err != nil that will be returned
+func (r *Resp) VerbatimFormat() (string, error) {
+	if r.Err != nil {
+		return "", r.Err
+	}
+	if r.typ != VerbatimStr {
+		return "", errBadType
+	}
+	return string(r.val.([]byte)[:verbatimFmtLen-1]), nil
+}
+
 // Str is a wrapper around Bytes which returns the result as a string instead of
 // a byte slice
 func (r *Resp) Str() (string, error) {
@@ -356,6 +738,11 @@ func (r *Resp) Int64() (int64, error) {
 		return 0, ErrRespNil
 	} else if i, ok := r.val.(int64); ok {
 		return i, nil
+	} else if bi, ok := r.val.(*big.Int); ok {
+		if !bi.IsInt64() {
+			return 0, errNotInt
+		}
+		return bi.Int64(), nil
 	}
 
 	if s, err := r.Str(); err == nil {
@@ -375,6 +762,9 @@ func (r *Resp) Float64() (float64, error) {
 	if r.Err != nil {
 		return 0, r.Err
 	}
+	if f, ok := r.val.(float64); ok {
+		return f, nil
+	}
 	if b, ok := r.val.([]byte); ok {
 		f, err := strconv.ParseFloat(string(b), 64)
 		if err != nil {
@@ -385,6 +775,61 @@ func (r *Resp) Float64() (float64, error) {
 	return 0, errNotStr
 }
 
+// Bool returns a bool representing the value of the Resp. For a Resp of type
+// Bool the value will be returned directly. A Resp of type Int is true if it is
+// not zero, and a Resp of type Str is parsed with strconv.ParseBool. If r.Err
+// != nil that will be returned
+func (r *Resp) Bool() (bool, error) {
+	if r.Err != nil {
+		return false, r.Err
+	}
+
+	switch v := r.val.(type) {
+	case bool:
+		return v, nil
+	case int64:
+		return v != 0, nil
+	}
+
+	if r.IsType(Nil) {
+		return false, ErrRespNil
+	} else if s, err := r.Str(); err == nil {
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return false, err
+		}
+		return b, nil
+	}
+	return false, errNotBool
+}
+
+// BigInt returns a *big.Int representing the value of the Resp. Valid for
+// Resps of type BigNum, Int, and Str which represent an integer. If r.Err !=
+// nil that will be returned
+func (r *Resp) BigInt() (*big.Int, error) {
+	if r.Err != nil {
+		return nil, r.Err
+	}
+
+	switch v := r.val.(type) {
+	case *big.Int:
+		return new(big.Int).Set(v), nil
+	case int64:
+		return big.NewInt(v), nil
+	}
+
+	if r.IsType(Nil) {
+		return nil, ErrRespNil
+	} else if s, err := r.Str(); err == nil {
+		bi, ok := new(big.Int).SetString(s, 10)
+		if !ok {
+			return nil, errNotInt
+		}
+		return bi, nil
+	}
+	return nil, errNotInt
+}
+
 func (r *Resp) betterArray() ([]Resp, error) {
 	if r.Err != nil {
 		return nil, r.Err
@@ -502,6 +947,38 @@ func (r *Resp) Map() (map[string]string, error) {
 	}
 }
 
+// MapResp returns the key/value pairs of an aggregate Resp (usually a Map,
+// although an Array with alternating key/values works too) as a map of Resps,
+// so the type of each value is preserved. Keys must be of type Str or Int
+func (r *Resp) MapResp() (map[string]*Resp, error) {
+	l, err := r.betterArray()
+	if err != nil {
+		return nil, err
+	}
+	if len(l)%2 != 0 {
+		return nil, errors.New("reply has odd number of elements")
+	}
+
+	m := make(map[string]*Resp, len(l)/2)
+	for i := 0; i < len(l); i += 2 {
+		var ks string
+		if ki, ok := l[i].val.(int64); ok {
+			ks = strconv.FormatInt(ki, 10)
+		} else if ks, err = l[i].Str(); err != nil {
+			return nil, err
+		}
+		m[ks] = &l[i+1]
+	}
+	return m, nil
+}
+
+// Attrs returns the attributes which the server sent alongside this Resp, as a
+// Resp of type Attr which can be read using MapResp or Map. Returns nil if
+// there were none. Attributes are only sent by servers speaking RESP3
+func (r *Resp) Attrs() *Resp {
+	return r.attrs
+}
+
 // String returns a string representation of the Resp. This method is for
 // debugging, use Str() for reading a Str reply
 func (r *Resp) String() string {
@@ -511,25 +988,41 @@ func (r *Resp) String() string {
 		inner = fmt.Sprintf("AppErr %s", r.Err)
 	case IOErr:
 		inner = fmt.Sprintf("IOErr %s", r.Err)
-	case BulkStr, SimpleStr:
+	case BulkStr, SimpleStr, VerbatimStr:
 		inner = fmt.Sprintf("Str %q", string(r.val.([]byte)))
 	case Int:
 		inner = fmt.Sprintf("Int %d", r.val.(int64))
 	case Nil:
 		inner = fmt.Sprintf("Nil")
-	case Array:
+	case Double:
+		inner = fmt.Sprintf("Double %s", appendDouble(nil, r.val.(float64)))
+	case Bool:
+		inner = fmt.Sprintf("Bool %t", r.val.(bool))
+	case BigNum:
+		inner = fmt.Sprintf("BigNum %s", r.val.(*big.Int))
+	case Array, Map, Set, Attr, Push:
 		kids := r.val.([]Resp)
 		kidsStr := make([]string, len(kids))
 		for i := range kids {
 			kidsStr[i] = kids[i].String()
 		}
 		inner = strings.Join(kidsStr, " ")
+		if r.typ != Array {
+			inner = fmt.Sprintf("%s %s", aggregateNames[r.typ], inner)
+		}
 	default:
 		inner = "UNKNOWN"
 	}
 	return fmt.Sprintf("Resp(%s)", inner)
 }
 
+var aggregateNames = map[RespType]string{
+	Map:  "Map",
+	Set:  "Set",
+	Attr: "Attr",
+	Push: "Push",
+}
+
 var typeOfBytes = reflect.TypeOf([]byte(nil))
 
 func flattenedLength(mm ...interface{}) int {
@@ -736,9 +1229,15 @@ func writeTo(
 		return totalWritten, nil
 
 	case *Resp:
+		if !forceString && (mt.typ&resp3Types > 0 || mt.attrs != nil) {
+			return writeResp3(w, buf, mt)
+		}
 		return writeTo(w, buf, mt.val, forceString, noArrayHeader)
 
 	case Resp:
+		if !forceString && (mt.typ&resp3Types > 0 || mt.attrs != nil) {
+			return writeResp3(w, buf, &mt)
+		}
 		return writeTo(w, buf, mt.val, forceString, noArrayHeader)
 
 	default:
@@ -803,6 +1302,111 @@ func writeTo(
 	}
 }
 
+// resp3Types are the types which can't be written using their value alone,
+// since their encoding is only defined by RESP3
+const resp3Types = Map | Set | Double | Bool | BigNum | VerbatimStr | Attr | Push
+
+// writeResp3 writes the given Resp, including any attributes attached to it,
+// using the RESP3 encoding of its type
+func writeResp3(w io.Writer, buf []byte, r *Resp) (int64, error) {
+	var totalWritten int64
+	if r.attrs != nil {
+		written, err := writeResp3(w, buf, r.attrs)
+		totalWritten += written
+		if err != nil {
+			return totalWritten, err
+		}
+	}
+
+	var written int64
+	var err error
+	switch r.typ {
+	case Array, Map, Set, Attr, Push:
+		written, err = writeAggregate(w, buf, r.typ, r.val.([]Resp))
+	case Double:
+		buf = append(buf[:0], doublePrefix...)
+		buf = appendDouble(buf, r.val.(float64))
+		buf = append(buf, delim...)
+		written, err = writeBytesHelper(w, buf, 0, nil)
+	case Bool:
+		if r.val.(bool) {
+			written, err = writeBytesHelper(w, trueFormatted, 0, nil)
+		} else {
+			written, err = writeBytesHelper(w, falseFormatted, 0, nil)
+		}
+	case BigNum:
+		buf = append(buf[:0], bigNumPrefix...)
+		buf = r.val.(*big.Int).Append(buf, 10)
+		buf = append(buf, delim...)
+		written, err = writeBytesHelper(w, buf, 0, nil)
+	case VerbatimStr:
+		b := r.val.([]byte)
+		buf = append(buf[:0], verbatimPrefix...)
+		buf = strconv.AppendInt(buf, int64(len(b)), 10)
+		buf = append(buf, delim...)
+		written, err = writeBytesHelper(w, buf, written, err)
+		written, err = writeBytesHelper(w, b, written, err)
+		written, err = writeBytesHelper(w, delim, written, err)
+	case SimpleStr:
+		buf = append(buf[:0], simpleStrPrefix...)
+		buf = append(buf, r.val.([]byte)...)
+		buf = append(buf, delim...)
+		written, err = writeBytesHelper(w, buf, 0, nil)
+	default:
+		written, err = writeTo(w, buf, r.val, false, false)
+	}
+	return totalWritten + written, err
+}
+
+func writeAggregate(
+	w io.Writer, buf []byte, typ RespType, elems []Resp,
+) (
+	int64, error,
+) {
+	var prefix []byte
+	l := len(elems)
+	switch typ {
+	case Map:
+		prefix, l = mapPrefix, l/2
+	case Attr:
+		prefix, l = attrPrefix, l/2
+	case Set:
+		prefix = setPrefix
+	case Push:
+		prefix = pushPrefix
+	default:
+		prefix = arrayPrefix
+	}
+
+	var totalWritten, written int64
+	var err error
+	buf = append(buf[:0], prefix...)
+	buf = strconv.AppendInt(buf, int64(l), 10)
+	buf = append(buf, delim...)
+	totalWritten, err = writeBytesHelper(w, buf, 0, nil)
+	for i := range elems {
+		if err != nil {
+			return totalWritten, err
+		}
+		written, err = writeResp3(w, buf[:0], &elems[i])
+		totalWritten += written
+	}
+	return totalWritten, err
+}
+
+// appendDouble appends the RESP3 representation of f to buf
+func appendDouble(buf []byte, f float64) []byte {
+	switch {
+	case math.IsInf(f, 1):
+		return append(buf, "inf"...)
+	case math.IsInf(f, -1):
+		return append(buf, "-inf"...)
+	case math.IsNaN(f):
+		return append(buf, "nan"...)
+	}
+	return strconv.AppendFloat(buf, f, 'f', -1, 64)
+}
+
 func writeStr(w io.Writer, buf, b []byte) (int64, error) {
 	var err error
 	var written int64
@@ -862,9 +1466,13 @@ func writeNil(w io.Writer) (int64, error) {
 }
 
 // IsTimeout is a helper function for determining if an IOErr Resp was caused by
-// a network timeout
+// a network timeout, or by the deadline of the context passed into one of the
+// *Context methods passing
 func IsTimeout(r *Resp) bool {
 	if r.IsType(IOErr) {
+		if r.Err == context.DeadlineExceeded {
+			return true
+		}
 		t, ok := r.Err.(*net.OpError)
 		return ok && t.Timeout()
 	}
@@ -877,7 +1485,7 @@ func IsTimeout(r *Resp) bool {
 func format(m interface{}, forceString bool) Resp {
 	switch mt := m.(type) {
 	case *bytebufferpool.ByteBuffer:
-		return Resp{typ: BulkStr, val: mt.B, byteBuffer: mt}
+		return Resp{typ: BulkStr, val: mt.B, pool: byteBufferPool{}}
 	case []byte:
 		return Resp{typ: BulkStr, val: mt}
 	case string:
@@ -968,17 +1576,22 @@ func format(m interface{}, forceString bool) Resp {
 /* Buyffer and Compression functions
  */
 
-// ReleaseBuffers releases bytbuffers and put val to nil
+// ReleaseBuffers returns the buffers of the Resp, and of any Resps it
+// contains, to the BufferPool they were taken from (see Client.BufferPool).
+// Afterwards the Resp's value is gone, and any byte slices previously
+// returned by its methods (e.g. Bytes or ListBytes) must not be used anymore,
+// since their memory will be reused. Values which were copied out of the Resp
+// (e.g. by Str or Decode) are unaffected. Resps which weren't read using a
+// BufferPool are left alone.
 func (r *Resp) ReleaseBuffers() {
-	if UsePool == 0 {
-		return
-	}
 	if r.IsType(Str) {
-		if r.byteBuffer == nil {
+		if r.pool == nil {
 			return
 		}
-		r.val = nil
-		bytebufferpool.Put(r.byteBuffer)
+		if b, ok := r.val.([]byte); ok {
+			r.pool.Put(b)
+		}
+		r.val, r.pool = nil, nil
 		return
 	}
 
@@ -987,101 +1600,152 @@ func (r *Resp) ReleaseBuffers() {
 		return
 	}
 
-	for _, arg := range vals {
-		arg.ReleaseBuffers()
+	for i := range vals {
+		vals[i].ReleaseBuffers()
 	}
 	return
 }
 
-const compressPageSize = 256
-
-// Compress compresses an entire *Resp
+// Compress compresses an entire *Resp using snappy, prefixing each compressed
+// value with the given marker. It's the same as CompressWith using
+// NewSnappyCodec(marker), except that nil is returned for a Str which wasn't
+// compressed, or a Resp which is neither a Str nor an Array.
 func (r *Resp) Compress(minSize int, marker []byte) *Resp {
+	if !r.IsType(Str | Array) {
+		return nil
+	} else if r.IsType(Str) {
+		if b, ok := r.val.([]byte); !ok || len(b) < minSize {
+			return nil
+		}
+	}
+	if err := r.CompressWith(NewSnappyCodec(marker), minSize); err != nil {
+		return nil
+	}
+	return r
+}
+
+// Uncompress decompresses an entire *Resp which was compressed using Compress
+// with the given marker. nil is returned for a Str which wasn't compressed or
+// couldn't be decompressed, or a Resp which is neither a Str nor an Array.
+func (r *Resp) Uncompress(marker []byte) *Resp {
+	if !r.IsType(Str | Array) {
+		return nil
+	} else if r.IsType(Str) {
+		if b, ok := r.val.([]byte); !ok || !bytes.HasPrefix(b, marker) {
+			return nil
+		}
+	}
+	c := NewSnappyCodec(marker)
+	err := r.decompress(func([]byte) Codec { return c })
+	if err != nil && r.IsType(Str) {
+		return nil
+	}
+	return r
+}
+
+// CompressWith compresses every Str of at least minSize bytes in the Resp,
+// including those inside of aggregates, using the given Codec. The first error
+// returned by the Codec is returned, in which case the rest of the Resp is
+// left as it was.
+func (r *Resp) CompressWith(c Codec, minSize int) error {
 	if r.IsType(Str) {
 		b, ok := r.val.([]byte)
 		if !ok || len(b) < minSize {
 			return nil
 		}
-		n := snappy.MaxEncodedLen(len(b)) + len(marker)
-		need := (n/compressPageSize + 1) * compressPageSize
-		var buf []byte
-		var bb *bytebufferpool.ByteBuffer
-
-		if r.byteBuffer != nil {
-			bb = bytebufferpool.GetLen(need)
-			buf = bb.B
-		} else {
-			buf = make([]byte, need)
-		}
-		copy(buf, marker)
-		compressed := snappy.Encode(buf[len(marker):], b)
-		if len(buf) <= len(marker) {
-			return nil
+		var dst []byte
+		if r.pool != nil {
+			dst = r.pool.Get(len(b))[:0]
 		}
-		if r.byteBuffer != nil {
-			bytebufferpool.Put(r.byteBuffer)
-			r.byteBuffer = bb
+		enc, err := c.Encode(dst, b)
+		if err != nil {
+			return err
 		}
-		r.val = buf[:len(marker)+len(compressed)]
-		return r
-	}
-
-	if !r.IsType(Array) {
+		r.setPooled(enc, dst)
 		return nil
 	}
+
 	vals, ok := r.val.([]Resp)
 	if !ok {
 		return nil
 	}
 	for i := range vals {
-		(&vals[i]).Compress(minSize, marker)
+		if err := vals[i].CompressWith(c, minSize); err != nil {
+			return err
+		}
 	}
-	return r
+	return nil
 }
 
-// Uncompress compresses an entire *Resp
-func (r *Resp) Uncompress(marker []byte) *Resp {
+// Decompress decompresses every Str in the Resp, including those inside of
+// aggregates, which starts with the marker of a registered Codec (see
+// RegisterCodec), using that Codec. A Str which can't be decompressed is left
+// as it was, while the others are still decompressed, and the first error
+// returned by a Codec is returned.
+func (r *Resp) Decompress() error {
+	return r.decompress(CodecFor)
+}
+
+// decompress is like Decompress, but uses the given function to find the Codec
+// for each Str. Strs for which it returns nil are left alone.
+func (r *Resp) decompress(codecFor func([]byte) Codec) error {
 	if r.IsType(Str) {
 		b, ok := r.val.([]byte)
-		if !ok || !bytes.HasPrefix(b, marker) {
+		if !ok {
 			return nil
 		}
-
-		n := snappy.MaxEncodedLen(len(b)) + len(marker)
-		need := (n/compressPageSize + 1) * compressPageSize
-
-		var buf []byte
-		var bb *bytebufferpool.ByteBuffer
-
-		if r.byteBuffer != nil {
-			bb = bytebufferpool.GetLen(need)
-			buf = bb.B
-		} else {
-			buf = make([]byte, (n/compressPageSize+1)*compressPageSize)
-		}
-
-		uncompressed, e := snappy.Decode(buf, b[len(marker):])
-		if e != nil {
+		c := codecFor(b)
+		if c == nil {
 			return nil
 		}
-
-		if r.byteBuffer != nil {
-			bytebufferpool.Put(r.byteBuffer)
-			r.byteBuffer = bb
+		var dst []byte
+		if dl, ok := c.(decodedLener); ok && r.pool != nil {
+			if n, err := dl.decodedLen(b); err == nil {
+				dst = r.pool.Get(n)[:0]
+			}
 		}
-		r.val = uncompressed
-		return r
-	}
-
-	if !r.IsType(Array) {
+		dec, err := c.Decode(dst, b)
+		if err != nil {
+			if cap(dst) > 0 {
+				r.pool.Put(dst)
+			}
+			return err
+		}
+		r.setPooled(dec, dst)
 		return nil
 	}
+
 	vals, ok := r.val.([]Resp)
 	if !ok {
 		return nil
 	}
+	var err error
 	for i := range vals {
-		(&vals[i]).Uncompress(marker)
+		if verr := vals[i].decompress(codecFor); verr != nil && err == nil {
+			err = verr
+		}
 	}
-	return r
+	return err
+}
+
+// setPooled replaces the Resp's value with b, returning the previous value to
+// the Resp's BufferPool, if any. dst is the buffer which was taken from the
+// BufferPool for b to be appended to. If b doesn't use it, because it had to
+// be grown, dst is put back as well and the Resp no longer belongs to the
+// BufferPool.
+func (r *Resp) setPooled(b, dst []byte) {
+	if r.pool == nil {
+		r.val = b
+		return
+	}
+	if old, ok := r.val.([]byte); ok {
+		r.pool.Put(old)
+	}
+	if cap(dst) == 0 || cap(b) == 0 || &dst[:1][0] != &b[:1][0] {
+		if cap(dst) > 0 {
+			r.pool.Put(dst)
+		}
+		r.pool = nil
+	}
+	r.val = b
 }
@@ -4,9 +4,13 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"io"
+	"math"
+	"strings"
 	. "testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func pretendRead(s string) *Resp {
@@ -38,13 +42,13 @@ func TestRead(t *T) {
 	// Error
 	r = pretendRead("-ohey\r\n")
 	assert.Equal(t, AppErr, r.typ)
-	assert.Exactly(t, errors.New("ohey"), r.val)
+	assert.Exactly(t, &Error{Msg: "ohey"}, r.val)
 	assert.Equal(t, "ohey", r.Err.Error())
 
 	// Empty error
 	r = pretendRead("-\r\n")
 	assert.Equal(t, AppErr, r.typ)
-	assert.Exactly(t, errors.New(""), r.val)
+	assert.Exactly(t, &Error{}, r.val)
 	assert.Equal(t, "", r.Err.Error())
 
 	// Int
@@ -142,6 +146,125 @@ func TestRead(t *T) {
 	assert.Exactly(t, []byte("bar"), r.val.([]Resp)[1].val)
 }
 
+func TestReadResp3(t *T) {
+	// Null
+	r := pretendRead("_\r\n")
+	assert.Equal(t, Nil, r.typ)
+
+	// Double
+	r = pretendRead(",3.14\r\n")
+	assert.Equal(t, Double, r.typ)
+	f, err := r.Float64()
+	assert.Nil(t, err)
+	assert.Equal(t, 3.14, f)
+
+	r = pretendRead(",-inf\r\n")
+	f, err = r.Float64()
+	assert.Nil(t, err)
+	assert.True(t, math.IsInf(f, -1))
+
+	// Bool
+	r = pretendRead("#t\r\n")
+	assert.Equal(t, Bool, r.typ)
+	b, err := r.Bool()
+	assert.Nil(t, err)
+	assert.Equal(t, true, b)
+
+	r = pretendRead("#f\r\n")
+	b, err = r.Bool()
+	assert.Nil(t, err)
+	assert.Equal(t, false, b)
+
+	// Big number
+	r = pretendRead("(3492890328409238509324850943850943825024385\r\n")
+	assert.Equal(t, BigNum, r.typ)
+	bi, err := r.BigInt()
+	assert.Nil(t, err)
+	assert.Equal(t, "3492890328409238509324850943850943825024385", bi.String())
+	_, err = r.Int64()
+	assert.NotNil(t, err)
+
+	// Verbatim string
+	r = pretendRead("=15\r\ntxt:Some string\r\n")
+	assert.Equal(t, VerbatimStr, r.typ)
+	assert.True(t, r.IsType(Str))
+	s, err := r.Str()
+	assert.Nil(t, err)
+	assert.Equal(t, "Some string", s)
+	format, err := r.VerbatimFormat()
+	assert.Nil(t, err)
+	assert.Equal(t, "txt", format)
+
+	// Blob error
+	r = pretendRead("!21\r\nSYNTAX invalid syntax\r\n")
+	assert.Equal(t, AppErr, r.typ)
+	assert.Equal(t, "SYNTAX invalid syntax", r.Err.Error())
+	assert.Equal(t, &Error{Code: "SYNTAX", Msg: "invalid syntax"}, r.Err)
+
+	// Map
+	r = pretendRead("%2\r\n+first\r\n:1\r\n+second\r\n,2.5\r\n")
+	assert.Equal(t, Map, r.typ)
+	assert.True(t, r.IsType(Aggregate))
+	mr, err := r.MapResp()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(mr))
+	assert.Equal(t, Int, mr["first"].typ)
+	assert.Equal(t, Double, mr["second"].typ)
+
+	// Set
+	r = pretendRead("~2\r\n+foo\r\n+bar\r\n")
+	assert.Equal(t, Set, r.typ)
+	l, err := r.List()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"foo", "bar"}, l)
+
+	// Push
+	r = pretendRead(">3\r\n+message\r\n+chan\r\n+hi\r\n")
+	assert.Equal(t, Push, r.typ)
+	l, err = r.List()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"message", "chan", "hi"}, l)
+
+	// Attribute followed by the reply it applies to
+	r = pretendRead("|1\r\n+ttl\r\n:3600\r\n$3\r\nfoo\r\n")
+	assert.Equal(t, BulkStr, r.typ)
+	s, err = r.Str()
+	assert.Nil(t, err)
+	assert.Equal(t, "foo", s)
+	require.NotNil(t, r.Attrs())
+	am, err := r.Attrs().MapResp()
+	assert.Nil(t, err)
+	ttl, err := am["ttl"].Int()
+	assert.Nil(t, err)
+	assert.Equal(t, 3600, ttl)
+
+	// Unknown type
+	r = pretendRead("@foo\r\n")
+	assert.Equal(t, IOErr, r.typ)
+}
+
+func TestWriteResp3RoundTrip(t *T) {
+	msgs := []string{
+		"%2\r\n+first\r\n:1\r\n$6\r\nsecond\r\n,2.5\r\n",
+		"~2\r\n$3\r\nfoo\r\n$3\r\nbar\r\n",
+		">2\r\n$3\r\nfoo\r\n#t\r\n",
+		"*2\r\n#f\r\n,inf\r\n",
+		"(3492890328409238509324850943850943825024385\r\n",
+		"=15\r\ntxt:Some string\r\n",
+		"|1\r\n$3\r\nttl\r\n:3600\r\n$3\r\nfoo\r\n",
+	}
+
+	buf := bytes.NewBuffer([]byte{})
+	for _, msg := range msgs {
+		buf.Reset()
+		r := pretendRead(msg)
+		require.Nil(t, r.Err)
+		_, err := r.WriteTo(buf)
+		assert.Nil(t, err)
+		assert.Equal(t, msg, buf.String())
+	}
+}
+
 type arbitraryTest struct {
 	val    interface{}
 	expect []byte
@@ -222,3 +345,56 @@ func TestFloat64(t *T) {
 	assert.Equal(t, float64(5.0), f)
 
 }
+
+func TestReadLimits(t *T) {
+	read := func(s string, l RespLimits) *Resp {
+		rr := NewRespReader(bytes.NewBufferString(s))
+		rr.Limits = l
+		return rr.Read()
+	}
+	assertLimit := func(r *Resp, limit string) {
+		require.True(t, r.IsType(IOErr), "%s", r)
+		perr, ok := r.Err.(*ProtocolError)
+		require.True(t, ok, "%s", r.Err)
+		assert.Equal(t, limit, perr.Limit)
+	}
+
+	assertLimit(read("$11\r\nhello world\r\n", RespLimits{MaxBulkLen: 10}), "MaxBulkLen")
+	assertLimit(read("!11\r\nhello world\r\n", RespLimits{MaxBulkLen: 10}), "MaxBulkLen")
+	assert.Nil(t, read("$10\r\nhello worl\r\n", RespLimits{MaxBulkLen: 10}).Err)
+	assert.Nil(t, read("$11\r\nhello world\r\n", RespLimits{MaxBulkLen: -1}).Err)
+
+	assertLimit(read("*3\r\n:1\r\n:2\r\n:3\r\n", RespLimits{MaxArrayLen: 2}), "MaxArrayLen")
+	assertLimit(read("%2\r\n:1\r\n:2\r\n:3\r\n:4\r\n", RespLimits{MaxArrayLen: 3}), "MaxArrayLen")
+	assert.Nil(t, read("*2\r\n:1\r\n:2\r\n", RespLimits{MaxArrayLen: 2}).Err)
+
+	// The number of pairs of a map or attribute is checked before doubling
+	// it, so a huge one can't overflow
+	for _, prefix := range []string{"%", "|"} {
+		huge := prefix + "4611686018427387904\r\n"
+		assertLimit(read(huge, RespLimits{}), "MaxArrayLen")
+		assertLimit(read(huge, RespLimits{MaxArrayLen: -1}), "MaxArrayLen")
+		assertLimit(read("*1\r\n"+huge, RespLimits{}), "MaxArrayLen")
+		assertLimit(read(prefix+"9223372036854775807\r\n", RespLimits{MaxArrayLen: -1}), "MaxArrayLen")
+	}
+
+	nested := strings.Repeat("*1\r\n", 3) + ":1\r\n"
+	assertLimit(read(nested, RespLimits{MaxDepth: 2}), "MaxDepth")
+	assert.Nil(t, read(nested, RespLimits{MaxDepth: 3}).Err)
+	// The default depth protects against unbounded recursion
+	assertLimit(read(strings.Repeat("*1\r\n", 100000), RespLimits{}), "MaxDepth")
+
+	long := "+" + strings.Repeat("a", 10000) + "\r\n"
+	assertLimit(read(long, RespLimits{MaxLineLen: 9999}), "MaxLineLen")
+	assertLimit(read(long, RespLimits{MaxLineLen: 100}), "MaxLineLen")
+	r := read(long, RespLimits{MaxLineLen: 10000})
+	require.Nil(t, r.Err)
+	s, _ := r.Str()
+	assert.Equal(t, long[1:10001], s)
+
+	// A huge declared size isn't allocated up front
+	r = read("$100000000\r\nhello", RespLimits{})
+	assert.Equal(t, io.ErrUnexpectedEOF, r.Err)
+	r = read("*1000000000\r\n:1\r\n", RespLimits{})
+	assert.Equal(t, io.EOF, r.Err)
+}
@@ -0,0 +1,713 @@
+package redis
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrServerClosed is returned from the Serve and ListenAndServe methods of a
+// Server once Shutdown or Close have been called
+var ErrServerClosed = errors.New("redis: Server closed")
+
+// Request is a command received by a Server
+type Request struct {
+	// The command's name, as it was sent, and its arguments
+	Cmd  string
+	Args [][]byte
+
+	// Whether the command was sent as an inline command, i.e. as a line of
+	// space separated words like the ones typed into telnet, rather than as
+	// an array of bulk strings
+	Inline bool
+
+	// The connection the command was received on
+	Conn *ServerConn
+}
+
+// Context returns the context of the connection the command was received on,
+// which is cancelled once the connection is closed
+func (r *Request) Context() context.Context {
+	return r.Conn.ctx
+}
+
+// ResponseWriter is used by a Handler to reply to a command
+type ResponseWriter interface {
+	// WriteResp writes a reply. It's buffered, the replies to pipelined
+	// commands are flushed together once the last of them has been handled.
+	WriteResp(r *Resp) error
+
+	// Flush writes any buffered replies to the connection. It only needs to
+	// be called for replies written outside of a Handler, e.g. pub/sub
+	// messages written from another go-routine.
+	Flush() error
+}
+
+// Handler handles the commands received by a Server. ServeRESP must write
+// exactly one reply for each command, unless the command is one (like
+// SUBSCRIBE) whose protocol says otherwise, as the client will otherwise lose
+// track of which reply belongs to which of its commands. It's called on the
+// go-routine which reads the connection's commands, so the next command on the
+// same connection isn't read until it returns.
+type Handler interface {
+	ServeRESP(w ResponseWriter, r *Request)
+}
+
+// HandlerFunc is a function which implements Handler
+type HandlerFunc func(w ResponseWriter, r *Request)
+
+// ServeRESP implements the method for the Handler interface
+func (f HandlerFunc) ServeRESP(w ResponseWriter, r *Request) {
+	f(w, r)
+}
+
+// ServeMux is a Handler which dispatches commands to other Handlers based on
+// the command's name, which is matched case-insensitively. Commands which
+// don't have a Handler get an "unknown command" error, unless NotFound is set.
+//
+//	mux := redis.NewServeMux()
+//	mux.HandleFunc("PING", func(w redis.ResponseWriter, r *redis.Request) {
+//		w.WriteResp(redis.NewRespSimple("PONG"))
+//	})
+//	srv := &redis.Server{Addr: ":6380", Handler: mux}
+//	log.Fatal(srv.ListenAndServe())
+//
+type ServeMux struct {
+	mu sync.RWMutex
+	m  map[string]Handler
+
+	// If set, this is called for commands which don't have a Handler
+	NotFound Handler
+}
+
+// NewServeMux returns an empty ServeMux
+func NewServeMux() *ServeMux {
+	return &ServeMux{m: map[string]Handler{}}
+}
+
+// Handle registers the Handler for the given command, replacing any previous
+// one
+func (mux *ServeMux) Handle(cmd string, h Handler) {
+	mux.mu.Lock()
+	defer mux.mu.Unlock()
+	if mux.m == nil {
+		mux.m = map[string]Handler{}
+	}
+	mux.m[strings.ToUpper(cmd)] = h
+}
+
+// HandleFunc registers the function as the Handler for the given command
+func (mux *ServeMux) HandleFunc(cmd string, f func(w ResponseWriter, r *Request)) {
+	mux.Handle(cmd, HandlerFunc(f))
+}
+
+// Handler returns the Handler the given command is dispatched to, which is
+// NotFound if it doesn't have one, or nil if NotFound isn't set either
+func (mux *ServeMux) Handler(cmd string) Handler {
+	mux.mu.RLock()
+	h, ok := mux.m[strings.ToUpper(cmd)]
+	mux.mu.RUnlock()
+	if !ok {
+		return mux.NotFound
+	}
+	return h
+}
+
+// ServeRESP implements the method for the Handler interface
+func (mux *ServeMux) ServeRESP(w ResponseWriter, r *Request) {
+	h := mux.Handler(r.Cmd)
+	if h == nil {
+		w.WriteResp(NewResp(fmt.Errorf("ERR unknown command '%s'", r.Cmd)))
+		return
+	}
+	h.ServeRESP(w, r)
+}
+
+// Server accepts connections which speak RESP, reads commands off of them and
+// passes them to its Handler. Its zero value is valid, and the fields must not
+// be changed once it's started serving. Commands sent on the same connection
+// are handled one after the other, and pipelined commands have their replies
+// written together.
+type Server struct {
+	// The address listened on by ListenAndServe. Default is ":6379"
+	Addr string
+
+	// The Handler commands are passed to. If nil every command gets an
+	// "unknown command" error.
+	Handler Handler
+
+	// The maximum time a connection may be idle before it's closed, which is
+	// the time waited for the next command once all the previous ones have
+	// been replied to. Default is to wait forever.
+	IdleTimeout time.Duration
+
+	// The maximum time spent writing replies, each time they're flushed.
+	// Default is to wait forever.
+	WriteTimeout time.Duration
+
+	// The limits which commands are checked against when they're read. A
+	// command which exceeds them results in a protocol error, which closes
+	// its connection.
+	Limits RespLimits
+
+	// Where errors accepting connections and panics in the Handler are logged.
+	// Default is to use the standard logger of the log package.
+	ErrorLog *log.Logger
+
+	mu        sync.Mutex
+	listeners map[net.Listener]bool
+	conns     map[*ServerConn]bool
+	closed    bool
+}
+
+// ListenAndServe listens on the Server's Addr and serves connections on it,
+// see Serve
+func (s *Server) ListenAndServe() error {
+	addr := s.Addr
+	if addr == "" {
+		addr = ":6379"
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts connections on the listener, serving each one on its own
+// go-routine. It blocks until the listener fails, or until Shutdown or Close
+// are called in which case ErrServerClosed is returned. The listener is
+// always closed when Serve returns.
+func (s *Server) Serve(l net.Listener) error {
+	defer l.Close()
+	if !s.trackListener(l, true) {
+		return ErrServerClosed
+	}
+	defer s.trackListener(l, false)
+
+	var backoff time.Duration
+	for {
+		nc, err := l.Accept()
+		if err != nil {
+			if s.shuttingDown() {
+				return ErrServerClosed
+			}
+			// Errors like running out of file descriptors are temporary, and
+			// are retried after a little while like net/http does
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if backoff == 0 {
+					backoff = 5 * time.Millisecond
+				} else if backoff *= 2; backoff > time.Second {
+					backoff = time.Second
+				}
+				s.logf("redis: Accept error: %v; retrying in %v", err, backoff)
+				time.Sleep(backoff)
+				continue
+			}
+			return err
+		}
+		backoff = 0
+
+		if c := s.newConn(nc); c != nil {
+			go c.serve()
+		}
+	}
+}
+
+// ServeConn serves a single connection which was established by other means
+// (e.g. net.Pipe), blocking until it's closed
+func (s *Server) ServeConn(nc net.Conn) {
+	if c := s.newConn(nc); c != nil {
+		c.serve()
+	}
+}
+
+// Shutdown gracefully stops the Server. It stops accepting connections, closes
+// the connections which are idle, and waits for the others to finish handling
+// the commands they've already received before closing them too. If the
+// context is done before all connections are closed its error is returned,
+// and the remaining connections are left as they are (see Close).
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closed = true
+	s.closeListeners()
+	for c := range s.conns {
+		if c.idle {
+			c.close()
+		}
+	}
+	s.mu.Unlock()
+
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		s.mu.Lock()
+		n := len(s.conns)
+		s.mu.Unlock()
+		if n == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Close immediately stops the Server, closing its listeners and all of its
+// connections, whether or not they are in the middle of handling a command
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	err := s.closeListeners()
+	for c := range s.conns {
+		c.close()
+	}
+	return err
+}
+
+func (s *Server) closeListeners() error {
+	var err error
+	for l := range s.listeners {
+		if lerr := l.Close(); lerr != nil && err == nil {
+			err = lerr
+		}
+		delete(s.listeners, l)
+	}
+	return err
+}
+
+func (s *Server) trackListener(l net.Listener, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !add {
+		delete(s.listeners, l)
+		return true
+	} else if s.closed {
+		return false
+	}
+	if s.listeners == nil {
+		s.listeners = map[net.Listener]bool{}
+	}
+	s.listeners[l] = true
+	return true
+}
+
+func (s *Server) shuttingDown() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+func (s *Server) logf(format string, args ...interface{}) {
+	if s.ErrorLog != nil {
+		s.ErrorLog.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
+
+// newConn sets up the ServerConn for a new connection, returning nil if the
+// Server is closed
+func (s *Server) newConn(nc net.Conn) *ServerConn {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &ServerConn{
+		s:      s,
+		nc:     nc,
+		br:     &respBufReader{Reader: bufio.NewReader(nc), limits: s.Limits.withDefaults()},
+		bw:     bufio.NewWriter(nc),
+		ctx:    ctx,
+		cancel: cancel,
+		idle:   true,
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		nc.Close()
+		cancel()
+		return nil
+	}
+	if s.conns == nil {
+		s.conns = map[*ServerConn]bool{}
+	}
+	s.conns[c] = true
+	return c
+}
+
+// ServerConn is a connection being served by a Server. It's the
+// ResponseWriter given to Handlers, and can also be used for storing state
+// which is specific to the connection, like which database was SELECTed.
+type ServerConn struct {
+	s      *Server
+	nc     net.Conn
+	br     *respBufReader
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// wmu protects bw and closing, so that replies may be written from other
+	// go-routines
+	wmu     sync.Mutex
+	bw      *bufio.Writer
+	closing bool
+
+	// Protected by the Server's mu
+	idle bool
+
+	vmu    sync.Mutex
+	values map[interface{}]interface{}
+}
+
+// RemoteAddr returns the address of the client
+func (c *ServerConn) RemoteAddr() net.Addr {
+	return c.nc.RemoteAddr()
+}
+
+// Value returns the value stored on the connection under the key using
+// SetValue, or nil
+func (c *ServerConn) Value(key interface{}) interface{} {
+	c.vmu.Lock()
+	defer c.vmu.Unlock()
+	return c.values[key]
+}
+
+// SetValue stores a value on the connection under the key, for the Handler to
+// use when handling later commands
+func (c *ServerConn) SetValue(key, val interface{}) {
+	c.vmu.Lock()
+	defer c.vmu.Unlock()
+	if c.values == nil {
+		c.values = map[interface{}]interface{}{}
+	}
+	c.values[key] = val
+}
+
+// WriteResp implements the method for the ResponseWriter interface
+func (c *ServerConn) WriteResp(r *Resp) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	_, err := r.WriteTo(c.bw)
+	return err
+}
+
+// Flush implements the method for the ResponseWriter interface
+func (c *ServerConn) Flush() error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return c.flush()
+}
+
+// flush must be called with wmu held
+func (c *ServerConn) flush() error {
+	if c.bw.Buffered() == 0 {
+		return nil
+	}
+	if c.s.WriteTimeout > 0 {
+		c.nc.SetWriteDeadline(time.Now().Add(c.s.WriteTimeout))
+	}
+	return c.bw.Flush()
+}
+
+// Close closes the connection once the replies which have been written to it
+// are flushed, e.g. for implementing QUIT. No more commands are read off of
+// it.
+func (c *ServerConn) Close() error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.closing = true
+	return nil
+}
+
+// close closes the connection immediately
+func (c *ServerConn) close() {
+	c.cancel()
+	c.nc.Close()
+}
+
+func (c *ServerConn) setIdle(idle bool) bool {
+	c.s.mu.Lock()
+	defer c.s.mu.Unlock()
+	c.idle = idle
+	return !(idle && c.s.closed)
+}
+
+func (c *ServerConn) serve() {
+	defer func() {
+		c.close()
+		c.s.mu.Lock()
+		delete(c.s.conns, c)
+		c.s.mu.Unlock()
+	}()
+
+	h := c.s.Handler
+	if h == nil {
+		h = NewServeMux()
+	}
+
+	for {
+		// A connection is only idle if there are no pipelined commands left
+		// to be handled, otherwise a Shutdown would drop them
+		if c.br.Buffered() == 0 && !c.setIdle(true) {
+			return
+		}
+		if c.s.IdleTimeout > 0 {
+			c.nc.SetReadDeadline(time.Now().Add(c.s.IdleTimeout))
+		}
+
+		req, err := c.readRequest()
+		if err != nil {
+			if isProtocolErr(err) {
+				c.WriteResp(NewResp(fmt.Errorf("ERR Protocol error: %s", err)))
+				c.Flush()
+			}
+			return
+		} else if req == nil {
+			continue
+		}
+		c.setIdle(false)
+		c.nc.SetReadDeadline(time.Time{})
+
+		if !c.handle(h, req) {
+			return
+		}
+
+		c.wmu.Lock()
+		var err2 error
+		if c.br.Buffered() == 0 || c.closing {
+			err2 = c.flush()
+		}
+		closing := c.closing
+		c.wmu.Unlock()
+		if err2 != nil || closing {
+			return
+		}
+	}
+}
+
+// handle calls the Handler for the request, recovering from it panicking in
+// which case false is returned
+func (c *ServerConn) handle(h Handler, req *Request) (ok bool) {
+	defer func() {
+		if err := recover(); err != nil {
+			buf := make([]byte, 64<<10)
+			buf = buf[:runtime.Stack(buf, false)]
+			c.s.logf("redis: panic serving %v: %v\n%s", c.RemoteAddr(), err, buf)
+			ok = false
+		}
+	}()
+	h.ServeRESP(c, req)
+	return true
+}
+
+func isProtocolErr(err error) bool {
+	var perr *ProtocolError
+	return err == errParse || err == errBadType || err == errInlineQuotes ||
+		err == errNotBulk || errors.As(err, &perr)
+}
+
+var (
+	errInlineQuotes = errors.New("unbalanced quotes in request")
+	errNotBulk      = errors.New("expected an array of bulk strings")
+)
+
+// readRequest reads the next command off the connection. A nil Request is
+// returned for empty commands, which are skipped.
+func (c *ServerConn) readRequest() (*Request, error) {
+	c.br.depth = 0
+	b, err := c.br.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+
+	var args [][]byte
+	inline := b[0] != arrayPrefix[0]
+	if inline {
+		line, err := readInlineLine(c.br)
+		if err != nil {
+			return nil, err
+		}
+		if args, err = splitInline(line); err != nil {
+			return nil, err
+		}
+	} else {
+		if args, err = readRequestArgs(c.br); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(args) == 0 {
+		return nil, nil
+	}
+	return &Request{
+		Cmd:    string(args[0]),
+		Args:   args[1:],
+		Inline: inline,
+		Conn:   c,
+	}, nil
+}
+
+// readRequestArgs reads a command sent as an array of bulk strings. The type
+// of each element is checked before it's read, so that nothing but bulk
+// strings gets allocated.
+func readRequestArgs(r *respBufReader) ([][]byte, error) {
+	size, err := readSize(r)
+	if err != nil {
+		return nil, err
+	} else if size < 0 {
+		return nil, nil
+	}
+	if err := checkAggregate(r, size); err != nil {
+		return nil, err
+	}
+
+	args := make([][]byte, 0, minInt64(size, aggregatePreallocMax))
+	for i := int64(0); i < size; i++ {
+		b, err := r.Peek(1)
+		if err != nil {
+			return nil, err
+		} else if b[0] != bulkStrPrefix[0] {
+			return nil, errNotBulk
+		}
+		arg, err := readBulkStr(r)
+		if err != nil {
+			return nil, err
+		} else if !arg.IsType(BulkStr) {
+			return nil, errNotBulk
+		}
+		args = append(args, arg.val.([]byte))
+	}
+	return args, nil
+}
+
+// readInlineLine reads a line terminated by "\n" or "\r\n", and returns it
+// without the terminator
+func readInlineLine(r *respBufReader) ([]byte, error) {
+	max := int64(r.limits.MaxLineLen)
+	b, err := r.ReadSlice(delimEnd)
+	line := append([]byte(nil), b...)
+	for err == bufio.ErrBufferFull {
+		if lerr := checkLimit("MaxLineLen", int64(len(line)), max); lerr != nil {
+			return nil, lerr
+		}
+		b, err = r.ReadSlice(delimEnd)
+		line = append(line, b...)
+	}
+	if err != nil {
+		return nil, err
+	}
+	line = line[:len(line)-1]
+	if len(line) > 0 && line[len(line)-1] == delim[0] {
+		line = line[:len(line)-1]
+	}
+	return line, checkLimit("MaxLineLen", int64(len(line)), max)
+}
+
+// splitInline splits an inline command into its arguments the way redis does,
+// i.e. on whitespace, with double quoted arguments supporting escape sequences
+// and single quoted ones being taken literally (except for \')
+func splitInline(line []byte) ([][]byte, error) {
+	var args [][]byte
+	for i := 0; ; {
+		for i < len(line) && isSpace(line[i]) {
+			i++
+		}
+		if i == len(line) {
+			return args, nil
+		}
+
+		var arg []byte
+		switch line[i] {
+		case '"':
+			for i++; ; i++ {
+				if i >= len(line) {
+					return nil, errInlineQuotes
+				}
+				if line[i] == '"' {
+					i++
+					break
+				}
+				if line[i] == '\\' && i+1 < len(line) {
+					i++
+					if line[i] == 'x' && i+2 < len(line) && isHex(line[i+1]) && isHex(line[i+2]) {
+						arg = append(arg, unhex(line[i+1])<<4|unhex(line[i+2]))
+						i += 2
+						continue
+					}
+					arg = append(arg, unescape(line[i]))
+					continue
+				}
+				arg = append(arg, line[i])
+			}
+		case '\'':
+			for i++; ; i++ {
+				if i >= len(line) {
+					return nil, errInlineQuotes
+				}
+				if line[i] == '\'' {
+					i++
+					break
+				}
+				if line[i] == '\\' && i+1 < len(line) && line[i+1] == '\'' {
+					i++
+				}
+				arg = append(arg, line[i])
+			}
+		default:
+			for ; i < len(line) && !isSpace(line[i]); i++ {
+				arg = append(arg, line[i])
+			}
+		}
+
+		// A closing quote must be followed by a space or the end of the line
+		if i < len(line) && !isSpace(line[i]) {
+			return nil, errInlineQuotes
+		}
+		if arg == nil {
+			arg = []byte{}
+		}
+		args = append(args, arg)
+	}
+}
+
+func isSpace(b byte) bool {
+	return b == ' ' || b == '\t' || b == '\n' || b == '\r' || b == '\v' || b == '\f'
+}
+
+func isHex(b byte) bool {
+	return (b >= '0' && b <= '9') || (b >= 'a' && b <= 'f') || (b >= 'A' && b <= 'F')
+}
+
+func unhex(b byte) byte {
+	switch {
+	case b >= 'a':
+		return b - 'a' + 10
+	case b >= 'A':
+		return b - 'A' + 10
+	}
+	return b - '0'
+}
+
+func unescape(b byte) byte {
+	switch b {
+	case 'n':
+		return '\n'
+	case 'r':
+		return '\r'
+	case 't':
+		return '\t'
+	case 'b':
+		return '\b'
+	case 'a':
+		return '\a'
+	}
+	return b
+}
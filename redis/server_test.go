@@ -0,0 +1,257 @@
+package redis
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"sync"
+	. "testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testServer starts a Server with the given Handler on a random port, and
+// returns it along with its address
+func testServer(t *T, h Handler) (*Server, string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	s := &Server{Handler: h}
+	go s.Serve(l)
+	t.Cleanup(func() { s.Close() })
+	return s, l.Addr().String()
+}
+
+// kvMux returns a ServeMux implementing a tiny key/value store
+func kvMux() *ServeMux {
+	var mu sync.Mutex
+	m := map[string]string{}
+	mux := NewServeMux()
+	mux.HandleFunc("PING", func(w ResponseWriter, r *Request) {
+		w.WriteResp(NewRespSimple("PONG"))
+	})
+	mux.HandleFunc("ECHO", func(w ResponseWriter, r *Request) {
+		w.WriteResp(NewResp(r.Args))
+	})
+	mux.HandleFunc("SET", func(w ResponseWriter, r *Request) {
+		mu.Lock()
+		m[string(r.Args[0])] = string(r.Args[1])
+		mu.Unlock()
+		w.WriteResp(NewRespSimple("OK"))
+	})
+	mux.HandleFunc("GET", func(w ResponseWriter, r *Request) {
+		mu.Lock()
+		v, ok := m[string(r.Args[0])]
+		mu.Unlock()
+		if !ok {
+			w.WriteResp(NewResp(nil))
+			return
+		}
+		w.WriteResp(NewResp(v))
+	})
+	mux.HandleFunc("QUIT", func(w ResponseWriter, r *Request) {
+		w.WriteResp(NewRespSimple("OK"))
+		r.Conn.Close()
+	})
+	return mux
+}
+
+func TestServer(t *T) {
+	_, addr := testServer(t, kvMux())
+	c, err := Dial("tcp", addr)
+	require.Nil(t, err)
+	defer c.Close()
+
+	assert.Equal(t, "PONG", mustStr(t, c.Cmd("ping")))
+	require.Nil(t, c.Cmd("SET", "foo", "bar").Err)
+	assert.Equal(t, "bar", mustStr(t, c.Cmd("GET", "foo")))
+	assert.True(t, c.Cmd("GET", "baz").IsType(Nil))
+	assert.Equal(t, "ERR unknown command 'NOPE'", c.Cmd("NOPE").Err.Error())
+
+	for i := 0; i < 100; i++ {
+		c.PipeAppend("ECHO", i)
+	}
+	for i := 0; i < 100; i++ {
+		n, err := c.PipeResp().Array()
+		require.Nil(t, err)
+		j, err := n[0].Int()
+		require.Nil(t, err)
+		assert.Equal(t, i, j)
+	}
+
+	require.Nil(t, c.Cmd("QUIT").Err)
+	assert.True(t, c.Cmd("PING").IsType(IOErr))
+}
+
+func TestServerInline(t *T) {
+	_, addr := testServer(t, kvMux())
+	nc, err := net.Dial("tcp", addr)
+	require.Nil(t, err)
+	defer nc.Close()
+
+	_, err = nc.Write([]byte("PING\r\n\r\necho \"a b\\x41\" 'c\\'d' e\n*2\r\n$4\r\nECHO\r\n$1\r\nf\r\necho \"g\r\n"))
+	require.Nil(t, err)
+
+	rr := NewRespReader(nc)
+	assert.Equal(t, "PONG", mustStr(t, rr.Read()))
+	l, err := rr.Read().List()
+	require.Nil(t, err)
+	assert.Equal(t, []string{"a bA", "c'd", "e"}, l)
+	l, err = rr.Read().List()
+	require.Nil(t, err)
+	assert.Equal(t, []string{"f"}, l)
+
+	// The connection is closed after a protocol error
+	r := rr.Read()
+	assert.Equal(t, "ERR Protocol error: unbalanced quotes in request", r.Err.Error())
+	assert.True(t, rr.Read().IsType(IOErr))
+}
+
+func TestServerNotBulk(t *T) {
+	_, addr := testServer(t, kvMux())
+	for _, req := range []string{
+		"*1\r\n%4611686018427387904\r\n",
+		"*2\r\n$4\r\nECHO\r\n*1000000\r\n",
+		"*1\r\n:1\r\n",
+	} {
+		nc, err := net.Dial("tcp", addr)
+		require.Nil(t, err)
+		_, err = nc.Write([]byte(req))
+		require.Nil(t, err)
+
+		// Anything but a bulk string is rejected before being read
+		rr := NewRespReader(nc)
+		r := rr.Read()
+		assert.Equal(t, "ERR Protocol error: "+errNotBulk.Error(), r.Err.Error())
+		assert.True(t, rr.Read().IsType(IOErr))
+		nc.Close()
+	}
+
+	// The server is still up
+	c, err := Dial("tcp", addr)
+	require.Nil(t, err)
+	defer c.Close()
+	assert.Equal(t, "PONG", mustStr(t, c.Cmd("PING")))
+}
+
+func TestSplitInline(t *T) {
+	for _, tc := range []struct {
+		line string
+		args []string
+		err  error
+	}{
+		{"", nil, nil},
+		{"  a  b\t c ", []string{"a", "b", "c"}, nil},
+		{`a "" ''`, []string{"a", "", ""}, nil},
+		{`"\n\t\"\\"`, []string{"\n\t\"\\"}, nil},
+		{`'\n\''`, []string{`\n'`}, nil},
+		{`"a"b`, nil, errInlineQuotes},
+		{`"a`, nil, errInlineQuotes},
+	} {
+		args, err := splitInline([]byte(tc.line))
+		assert.Equal(t, tc.err, err, "%q", tc.line)
+		var sargs []string
+		for _, a := range args {
+			sargs = append(sargs, string(a))
+		}
+		assert.Equal(t, tc.args, sargs, "%q", tc.line)
+	}
+}
+
+func TestServerShutdown(t *T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	mux := kvMux()
+	mux.HandleFunc("SLOW", func(w ResponseWriter, r *Request) {
+		close(started)
+		<-release
+		w.WriteResp(NewRespSimple("DONE"))
+	})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	s := &Server{Handler: mux}
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- s.Serve(l) }()
+
+	idle, err := Dial("tcp", l.Addr().String())
+	require.Nil(t, err)
+	defer idle.Close()
+	require.Nil(t, idle.Cmd("PING").Err)
+
+	busy, err := Dial("tcp", l.Addr().String())
+	require.Nil(t, err)
+	defer busy.Close()
+	slowResp := make(chan *Resp, 1)
+	go func() { slowResp <- busy.Cmd("SLOW") }()
+	<-started
+
+	shutdownErr := make(chan error, 1)
+	go func() { shutdownErr <- s.Shutdown(context.Background()) }()
+	assert.Equal(t, ErrServerClosed, <-serveErr)
+
+	// The idle connection is closed right away, while the busy one gets to
+	// finish its command
+	assert.True(t, idle.Cmd("PING").IsType(IOErr))
+	select {
+	case <-shutdownErr:
+		t.Fatal("Shutdown returned before the busy connection was done")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	assert.Equal(t, "DONE", mustStr(t, <-slowResp))
+	require.Nil(t, <-shutdownErr)
+	assert.True(t, busy.Cmd("PING").IsType(IOErr))
+}
+
+func TestServerConnValues(t *T) {
+	mux := NewServeMux()
+	mux.HandleFunc("SELECT", func(w ResponseWriter, r *Request) {
+		r.Conn.SetValue("db", string(r.Args[0]))
+		w.WriteResp(NewRespSimple("OK"))
+	})
+	mux.NotFound = HandlerFunc(func(w ResponseWriter, r *Request) {
+		db, _ := r.Conn.Value("db").(string)
+		w.WriteResp(NewResp(r.Cmd + "@" + db))
+	})
+
+	s := &Server{Handler: mux}
+	cc, sc := net.Pipe()
+	go s.ServeConn(sc)
+	defer s.Close()
+
+	c := NewClient(cc)
+	assert.Equal(t, "FOO@", mustStr(t, c.Cmd("FOO")))
+	require.Nil(t, c.Cmd("SELECT", 2).Err)
+	assert.Equal(t, "foo@2", mustStr(t, c.Cmd("foo")))
+}
+
+func TestServerFlushFromOtherGoroutine(t *T) {
+	mux := NewServeMux()
+	mux.HandleFunc("SUBSCRIBE", func(w ResponseWriter, r *Request) {
+		w.WriteResp(NewResp([]interface{}{"subscribe", r.Args[0], 1}))
+		go func() {
+			w.WriteResp(NewResp([]interface{}{"message", r.Args[0], "hi"}))
+			w.Flush()
+		}()
+	})
+	_, addr := testServer(t, mux)
+	nc, err := net.Dial("tcp", addr)
+	require.Nil(t, err)
+	defer nc.Close()
+
+	_, err = nc.Write([]byte("SUBSCRIBE foo\r\n"))
+	require.Nil(t, err)
+	rr := NewRespReader(bufio.NewReader(nc))
+	arr, err := rr.Read().Array()
+	require.Nil(t, err)
+	require.Len(t, arr, 3)
+	assert.Equal(t, "subscribe", mustStr(t, arr[0]))
+	n, err := arr[2].Int()
+	require.Nil(t, err)
+	assert.Equal(t, 1, n)
+	l, err := rr.Read().List()
+	require.Nil(t, err)
+	assert.Equal(t, []string{"message", "foo", "hi"}, l)
+}
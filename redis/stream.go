@@ -0,0 +1,428 @@
+package redis
+
+import (
+	"errors"
+	"io"
+)
+
+var (
+	// ErrStreamDone is returned from RespStream's methods once the whole reply
+	// has been read, or the stream has been closed
+	ErrStreamDone = errors.New("stream is done")
+
+	errStreamTouched = errors.New("stream has already been partially read")
+)
+
+// RespStream is a reply which is read off of its connection incrementally,
+// rather than all at once like a Resp. This is useful for very large replies,
+// e.g. the GET of a huge value or the LRANGE of a huge list, which would
+// otherwise have to be held in memory in their entirety.
+//
+// A BulkStr reply is read as an io.Reader (or copied into an io.Writer using
+// WriteTo). An aggregate reply (e.g. Array or Map) is iterated over using More
+// and Next, or NextStream for elements which are themselves too large. Any
+// other type of reply is read immediately, and is returned by Resp.
+//
+// The rest of the reply must be read, or discarded using Close, before
+// anything else is read off the connection. Client does that automatically if
+// it's given another command, by calling Close on the previous stream.
+type RespStream struct {
+	r     *respBufReader
+	c     *Client
+	typ   RespType
+	attrs *Resp
+
+	// resp is the whole reply for types which aren't streamed
+	resp *Resp
+
+	// size is the size of the bulk string or aggregate, left is the number of
+	// bytes or elements which are still to be read
+	size, left int64
+	touched    bool
+	done       bool
+	child      *RespStream
+	err        error
+}
+
+// Stream reads the header of the next reply off the RespReader, and returns a
+// RespStream for reading the rest of it. See RespStream.
+func (rr *RespReader) Stream() *RespStream {
+	s := &RespStream{r: rr.reader()}
+	s.readHeader()
+	return s
+}
+
+func newRespStreamIOErr(err error) *RespStream {
+	return &RespStream{typ: IOErr, resp: NewRespIOErr(err), err: err, done: true}
+}
+
+func (s *RespStream) readHeader() {
+	b, err := s.r.Peek(1)
+	if err != nil {
+		s.fail(err)
+		return
+	}
+
+	if b[0] == attrPrefix[0] {
+		attrs, err := readAggregate(s.r, Attr)
+		if err != nil {
+			s.fail(err)
+			return
+		}
+		s.attrs = &attrs
+		if b, err = s.r.Peek(1); err != nil {
+			s.fail(err)
+			return
+		}
+	}
+
+	switch b[0] {
+	case bulkStrPrefix[0]:
+		s.typ = BulkStr
+	case arrayPrefix[0]:
+		s.typ = Array
+	case mapPrefix[0]:
+		s.typ = Map
+	case setPrefix[0]:
+		s.typ = Set
+	case pushPrefix[0]:
+		s.typ = Push
+	default:
+		r, err := bufioReadResp(s.r)
+		if err != nil {
+			s.fail(err)
+			return
+		}
+		r.attrs = s.attrs
+		s.typ, s.resp, s.done = r.typ, &r, true
+		return
+	}
+
+	size, err := readSize(s.r)
+	if err != nil {
+		s.fail(err)
+		return
+	} else if size < 0 {
+		s.typ, s.resp, s.done = Nil, &Resp{typ: Nil, attrs: s.attrs}, true
+		return
+	}
+	if s.typ == Map {
+		if size, err = pairsLen(size, s.r.limits.MaxArrayLen); err != nil {
+			s.fail(err)
+			return
+		}
+	}
+	if s.typ != BulkStr {
+		if err := checkAggregate(s.r, size); err != nil {
+			s.fail(err)
+			return
+		}
+	}
+	s.size, s.left = size, size
+	if s.typ == BulkStr && size == 0 {
+		s.finishBulk()
+	}
+}
+
+// fail marks the stream as failed with the given error. If the stream belongs
+// to a Client the connection is in an unknown state, so it's closed.
+func (s *RespStream) fail(err error) {
+	if err == io.EOF && (s.touched || s.typ != 0) {
+		err = io.ErrUnexpectedEOF
+	}
+	s.err, s.done = err, true
+	if s.typ == 0 {
+		s.typ, s.resp = IOErr, NewRespIOErr(err)
+	}
+	if s.c != nil {
+		s.c.LastCritical = err
+		s.c.Close()
+	}
+}
+
+// prepareRead is called before every read off the connection, to extend the
+// connection's read deadline
+func (s *RespStream) prepareRead() {
+	if s.c != nil && (s.c.ReadTimeout != 0 || s.c.ctxUsed) {
+		s.c.conn.SetReadDeadline(s.c.deadline(s.c.ReadTimeout))
+	}
+}
+
+// Type returns the type of the reply. For any type other than BulkStr, Nil, or
+// an aggregate type the reply has already been read, and can be retrieved
+// using Resp.
+func (s *RespStream) Type() RespType {
+	return s.typ
+}
+
+// IsType returns whether or not the reply is of the given type(s), like
+// Resp.IsType
+func (s *RespStream) IsType(t RespType) bool {
+	return s.typ&t > 0
+}
+
+// Err returns the error which was encountered while reading the reply, if
+// any, or the error which the reply itself is
+func (s *RespStream) Err() error {
+	if s.err != nil {
+		return s.err
+	} else if s.resp != nil {
+		return s.resp.Err
+	}
+	return nil
+}
+
+// Len returns the size of a BulkStr reply in bytes, or the number of elements
+// of an aggregate reply. For a Map that's twice the number of key/value pairs,
+// since the keys and values are read as separate elements.
+func (s *RespStream) Len() int64 {
+	return s.size
+}
+
+// Attrs returns the attributes sent alongside the reply, like Resp.Attrs
+func (s *RespStream) Attrs() *Resp {
+	return s.attrs
+}
+
+// Resp returns the reply as a normal Resp. For streamed types this reads the
+// whole reply, and so can only be used if none of it has been read yet.
+func (s *RespStream) Resp() *Resp {
+	if s.resp != nil {
+		return s.resp
+	} else if s.err != nil {
+		return NewRespIOErr(s.err)
+	} else if s.touched {
+		return NewResp(errStreamTouched)
+	}
+
+	s.touched = true
+	s.prepareRead()
+	r := Resp{typ: s.typ, attrs: s.attrs}
+	if s.typ == BulkStr {
+		b, pool, err := readBulkBody(s.r, s.left)
+		if err != nil {
+			s.fail(err)
+			return NewRespIOErr(s.err)
+		}
+		r.val, r.pool = b, pool
+	} else {
+		// Like with readAggregate the size isn't trusted for allocating the
+		// whole array up front
+		l := make([]Resp, 0, minInt64(s.left, aggregatePreallocMax))
+		for i := int64(0); i < s.left; i++ {
+			m, err := bufioReadResp(s.r)
+			if err != nil {
+				s.fail(err)
+				return NewRespIOErr(s.err)
+			}
+			l = append(l, m)
+		}
+		r.val = l
+	}
+	s.left, s.done, s.resp = 0, true, &r
+	return s.resp
+}
+
+// Read reads the body of a BulkStr reply. io.EOF is returned once all of it
+// has been read.
+func (s *RespStream) Read(p []byte) (int, error) {
+	if s.err != nil {
+		return 0, s.err
+	} else if s.typ != BulkStr {
+		return 0, errBadType
+	} else if s.left == 0 {
+		return 0, io.EOF
+	}
+
+	s.touched = true
+	if int64(len(p)) > s.left {
+		p = p[:s.left]
+	}
+	s.prepareRead()
+	n, err := s.r.Read(p)
+	s.left -= int64(n)
+	if err != nil {
+		s.fail(err)
+		return n, s.err
+	}
+	if s.left == 0 {
+		s.finishBulk()
+	}
+	return n, s.err
+}
+
+// finishBulk reads the delimiter following the body of a bulk string
+func (s *RespStream) finishBulk() {
+	s.prepareRead()
+	if _, err := s.r.Discard(len(delim)); err != nil {
+		s.fail(err)
+		return
+	}
+	s.done = true
+}
+
+// onlyReader hides RespStream's WriteTo method from io.Copy
+type onlyReader struct {
+	io.Reader
+}
+
+// WriteTo copies the rest of a BulkStr reply's body into the given io.Writer,
+// returning the number of bytes copied
+func (s *RespStream) WriteTo(w io.Writer) (int64, error) {
+	if s.typ != BulkStr && s.err == nil {
+		return 0, errBadType
+	}
+	return io.Copy(w, onlyReader{s})
+}
+
+// More returns whether there are elements of an aggregate reply which have yet
+// to be read using Next or NextStream
+func (s *RespStream) More() bool {
+	s.closeChild()
+	return s.err == nil && s.typ&Aggregate > 0 && s.left > 0
+}
+
+// closeChild closes the stream returned by the last call to NextStream, if
+// any. If that fails this stream has failed as well.
+func (s *RespStream) closeChild() {
+	if s.child == nil {
+		return
+	}
+	if err := s.child.Close(); err != nil {
+		s.err, s.done = err, true
+	}
+	s.child = nil
+}
+
+func (s *RespStream) startNext() error {
+	s.closeChild()
+	if s.err != nil {
+		return s.err
+	} else if s.typ&Aggregate == 0 {
+		return errBadType
+	} else if s.left == 0 {
+		return ErrStreamDone
+	}
+	s.touched = true
+	s.left--
+	if s.left == 0 {
+		s.done = true
+	}
+	s.prepareRead()
+	return nil
+}
+
+// Next reads the next element of an aggregate reply in its entirety
+func (s *RespStream) Next() *Resp {
+	if err := s.startNext(); err == ErrStreamDone || err == errBadType {
+		return NewResp(err)
+	} else if err != nil {
+		return NewRespIOErr(err)
+	}
+	r, err := bufioReadResp(s.r)
+	if err != nil {
+		s.fail(err)
+		return NewRespIOErr(s.err)
+	}
+	return &r
+}
+
+// NextStream returns the next element of an aggregate reply as a RespStream
+// itself. That stream is closed automatically when the next element is read
+// or this stream is closed.
+func (s *RespStream) NextStream() *RespStream {
+	if err := s.startNext(); err != nil {
+		return newRespStreamIOErr(err)
+	}
+	s.child = &RespStream{r: s.r, c: s.c}
+	s.child.readHeader()
+	if s.child.err != nil {
+		s.err = s.child.err
+	}
+	return s.child
+}
+
+// Close discards whatever is left of the reply, so the connection can be used
+// for reading the next one. Any error encountered while doing so is returned.
+func (s *RespStream) Close() error {
+	s.closeChild()
+	if s.c != nil && s.c.stream == s {
+		s.c.stream = nil
+	}
+	if s.err != nil {
+		return s.err
+	} else if s.done {
+		return nil
+	}
+
+	s.prepareRead()
+	if s.typ == BulkStr {
+		if _, err := s.r.Discard(int(s.left)); err != nil {
+			s.fail(err)
+			return s.err
+		}
+		s.left = 0
+		s.finishBulk()
+		return s.err
+	}
+
+	for ; s.left > 0; s.left-- {
+		if err := discardResp(s.r); err != nil {
+			s.fail(err)
+			return s.err
+		}
+	}
+	s.done = true
+	return nil
+}
+
+// discardResp reads a single reply off of r without keeping any of it
+func discardResp(r *respBufReader) error {
+	b, err := r.Peek(1)
+	if err != nil {
+		return err
+	}
+	prefix := b[0]
+
+	switch prefix {
+	case bulkStrPrefix[0], verbatimPrefix[0], blobErrPrefix[0]:
+		size, err := readSize(r)
+		if err != nil {
+			return err
+		} else if size >= 0 {
+			_, err = r.Discard(int(size) + len(delim))
+		}
+		return err
+
+	case arrayPrefix[0], mapPrefix[0], setPrefix[0], pushPrefix[0], attrPrefix[0]:
+		size, err := readSize(r)
+		if err != nil {
+			return err
+		}
+		if prefix == mapPrefix[0] || prefix == attrPrefix[0] {
+			if size, err = pairsLen(size, -1); err != nil {
+				return err
+			}
+		}
+		err = checkLimit("MaxDepth", int64(r.depth+1), int64(r.limits.MaxDepth))
+		if err != nil {
+			return err
+		}
+		r.depth++
+		for i := int64(0); i < size; i++ {
+			if err := discardResp(r); err != nil {
+				return err
+			}
+		}
+		r.depth--
+		if prefix == attrPrefix[0] {
+			// attributes are followed by the reply they're attached to
+			return discardResp(r)
+		}
+		return nil
+
+	default:
+		_, err := bufioReadResp(r)
+		return err
+	}
+}
@@ -0,0 +1,173 @@
+package redis
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+	. "testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func pretendStream(s string) (*RespStream, *RespReader) {
+	rr := NewRespReader(bytes.NewBufferString(s))
+	return rr.Stream(), rr
+}
+
+func TestStreamBulkStr(t *T) {
+	s, rr := pretendStream("$11\r\nhello world\r\n+OK\r\n")
+	require.Nil(t, s.Err())
+	assert.Equal(t, BulkStr, s.Type())
+	assert.Equal(t, int64(11), s.Len())
+
+	b := make([]byte, 5)
+	_, err := io.ReadFull(s, b)
+	require.Nil(t, err)
+	assert.Equal(t, "hello", string(b))
+
+	buf := new(bytes.Buffer)
+	n, err := s.WriteTo(buf)
+	require.Nil(t, err)
+	assert.Equal(t, int64(6), n)
+	assert.Equal(t, " world", buf.String())
+	_, err = s.Read(b)
+	assert.Equal(t, io.EOF, err)
+
+	// The delimiter has been consumed, so the next reply can be read
+	require.Nil(t, s.Close())
+	str, err := rr.Read().Str()
+	require.Nil(t, err)
+	assert.Equal(t, "OK", str)
+
+	// Closing early discards the rest of the body
+	s, rr = pretendStream("$11\r\nhello world\r\n+OK\r\n")
+	_, err = s.Read(b)
+	require.Nil(t, err)
+	require.Nil(t, s.Close())
+	str, err = rr.Read().Str()
+	require.Nil(t, err)
+	assert.Equal(t, "OK", str)
+
+	// Reading the whole thing at once
+	s, _ = pretendStream("$3\r\nfoo\r\n")
+	str, err = s.Resp().Str()
+	require.Nil(t, err)
+	assert.Equal(t, "foo", str)
+
+	s, _ = pretendStream("$0\r\n\r\n")
+	body, err := ioutil.ReadAll(s)
+	require.Nil(t, err)
+	assert.Empty(t, body)
+
+	// Truncated body
+	s, _ = pretendStream("$11\r\nhello")
+	_, err = ioutil.ReadAll(s)
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+}
+
+func TestStreamAggregate(t *T) {
+	s, rr := pretendStream("*3\r\n+a\r\n$1\r\nb\r\n*2\r\n:1\r\n:2\r\n+OK\r\n")
+	assert.Equal(t, Array, s.Type())
+	assert.Equal(t, int64(3), s.Len())
+
+	var l []*Resp
+	for s.More() {
+		r := s.Next()
+		require.Nil(t, r.Err)
+		l = append(l, r)
+	}
+	require.Len(t, l, 3)
+	str, err := l[1].Str()
+	require.Nil(t, err)
+	assert.Equal(t, "b", str)
+	assert.Equal(t, ErrStreamDone, s.Next().Err)
+	require.Nil(t, s.Close())
+	assert.Equal(t, SimpleStr, rr.Read().typ)
+
+	// Stopping early, including in the middle of a nested stream
+	s, rr = pretendStream("%2\r\n+k\r\n$5\r\nvalue\r\n+k2\r\n*1\r\n_\r\n+OK\r\n")
+	assert.Equal(t, Map, s.Type())
+	assert.Equal(t, int64(4), s.Len())
+	k, err := s.Next().Str()
+	require.Nil(t, err)
+	assert.Equal(t, "k", k)
+	v := s.NextStream()
+	assert.Equal(t, BulkStr, v.Type())
+	_, err = v.Read(make([]byte, 2))
+	require.Nil(t, err)
+	require.Nil(t, s.Close())
+	assert.Equal(t, SimpleStr, rr.Read().typ)
+
+	// Elements which can't be streamed are read immediately
+	s, _ = pretendStream("*2\r\n:1\r\n-ERR bad\r\n")
+	i, err := s.NextStream().Resp().Int()
+	require.Nil(t, err)
+	assert.Equal(t, 1, i)
+	assert.Equal(t, "ERR bad", s.NextStream().Err().Error())
+	assert.False(t, s.More())
+
+	s, _ = pretendStream("*-1\r\n")
+	assert.Equal(t, Nil, s.Type())
+	assert.False(t, s.More())
+
+	s, _ = pretendStream("*2\r\n+a\r\n+b\r\n")
+	list, err := s.Resp().List()
+	require.Nil(t, err)
+	assert.Equal(t, []string{"a", "b"}, list)
+
+	// A map whose number of pairs would overflow when doubled fails, as does
+	// discarding one
+	s, _ = pretendStream("%4611686018427387904\r\n")
+	_, ok := s.Err().(*ProtocolError)
+	assert.True(t, ok, "%v", s.Err())
+	s, _ = pretendStream("*1\r\n|4611686018427387904\r\n")
+	_, ok = s.Close().(*ProtocolError)
+	assert.True(t, ok)
+
+	// Arrays are held to MaxArrayLen, and one which is within it is only
+	// allocated as its elements are actually read
+	s, _ = pretendStream("*9223372036854775807\r\n")
+	r := s.Resp()
+	_, ok = r.Err.(*ProtocolError)
+	assert.True(t, ok, "%v", r.Err)
+	s, _ = pretendStream("*100000000\r\n:1\r\n")
+	require.Nil(t, s.Err())
+	assert.True(t, s.Resp().IsType(IOErr))
+}
+
+func TestCmdStream(t *T) {
+	big := strings.Repeat("a", 100000)
+	cmdCh := make(chan []string, 10)
+	conn := pipeServer(t, cmdCh, func(cmd []string) *Resp {
+		switch cmd[0] {
+		case "GET":
+			return NewResp(big)
+		case "LRANGE":
+			return NewResp([]string{"a", big, "c"})
+		}
+		return NewRespSimple("OK")
+	})
+	c := NewClient(conn)
+	defer c.Close()
+
+	s := c.CmdStream("GET", "foo")
+	require.Nil(t, s.Err())
+	assert.Equal(t, int64(len(big)), s.Len())
+	buf := new(bytes.Buffer)
+	_, err := s.WriteTo(buf)
+	require.Nil(t, err)
+	assert.Equal(t, big, buf.String())
+	require.Nil(t, s.Close())
+
+	// Leaving a stream unfinished doesn't affect the next command
+	s = c.CmdStream("LRANGE", "foo", 0, -1)
+	assert.Equal(t, int64(3), s.Len())
+	str, err := s.Next().Str()
+	require.Nil(t, err)
+	assert.Equal(t, "a", str)
+	require.Nil(t, c.Cmd("SET", "foo", "bar").Err)
+	assert.Equal(t, ErrStreamDone, s.Next().Err)
+	assert.Nil(t, c.LastCritical)
+}
@@ -0,0 +1,115 @@
+// Package zstd provides a redis.Codec which uses the zstd format, optionally
+// with trained dictionaries. It's kept apart from the redis package so that
+// only those who use it depend on github.com/klauspost/compress.
+//
+//	zc, err := zstd.Register(zstd.Opts{Dict: dict})
+//	if err != nil {
+//		// handle err
+//	}
+//	client, err := redis.DialWithOpts("tcp", "localhost:6379", redis.DialOpts{
+//		Compression: redis.CompressOpts{Codec: zc, MinSize: 512},
+//	})
+//
+package zstd
+
+import (
+	"fmt"
+
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/gallir/radix.improved/redis"
+)
+
+// magic is the start of every zstd frame
+var magic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+// Opts are the options which can be passed into NewCodec. Any fields left as
+// their zero value use their default.
+type Opts struct {
+	// The compression level, on the same scale as the zstd command line tool
+	// uses (1 to 22). Default is 3.
+	Level int
+
+	// If set, values are compressed using this dictionary, e.g. one trained
+	// on a sample of the values using `zstd --train`. Small values which are
+	// similar to each other compress much better with a dictionary. It's also
+	// used for decompressing.
+	Dict []byte
+
+	// Additional dictionaries which are only used for decompressing, e.g. the
+	// ones values were compressed with before Dict was replaced by a newly
+	// trained one. The dictionary a value needs is picked automatically by
+	// its ID.
+	DecodeDicts [][]byte
+
+	// The maximum size of a single decompressed value. Default is 512MB, like
+	// redis.RespLimits' MaxBulkLen.
+	MaxDecodedSize int
+}
+
+type codec struct {
+	enc *zstd.Encoder
+	dec *zstd.Decoder
+}
+
+// NewCodec returns a Codec which uses the zstd format, optionally with
+// dictionaries. Its marker is zstd's own frame magic number. Since all zstd
+// values share that marker only one zstd Codec should be registered, with all
+// the dictionaries values might have been compressed with.
+func NewCodec(o Opts) (redis.Codec, error) {
+	if o.Level == 0 {
+		o.Level = 3
+	}
+	if o.MaxDecodedSize == 0 {
+		o.MaxDecodedSize = 512 * 1024 * 1024
+	}
+
+	eopts := []zstd.EOption{
+		zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(o.Level)),
+		zstd.WithEncoderConcurrency(1),
+	}
+	dicts := o.DecodeDicts
+	if o.Dict != nil {
+		eopts = append(eopts, zstd.WithEncoderDict(o.Dict))
+		dicts = append([][]byte{o.Dict}, dicts...)
+	}
+	enc, err := zstd.NewWriter(nil, eopts...)
+	if err != nil {
+		return nil, fmt.Errorf("zstd encoder: %s", err)
+	}
+
+	dec, err := zstd.NewReader(nil,
+		zstd.WithDecoderDicts(dicts...),
+		zstd.WithDecoderConcurrency(0),
+		zstd.WithDecoderMaxMemory(uint64(o.MaxDecodedSize)),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("zstd decoder: %s", err)
+	}
+	return &codec{enc: enc, dec: dec}, nil
+}
+
+// Register is like NewCodec, but also registers the returned Codec using
+// redis.RegisterCodec, so that zstd values are decompressed by any Client
+func Register(o Opts) (redis.Codec, error) {
+	c, err := NewCodec(o)
+	if err != nil {
+		return nil, err
+	}
+	if err := redis.RegisterCodec(c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *codec) Marker() []byte {
+	return magic
+}
+
+func (c *codec) Encode(dst, src []byte) ([]byte, error) {
+	return c.enc.EncodeAll(src, dst), nil
+}
+
+func (c *codec) Decode(dst, src []byte) ([]byte, error) {
+	return c.dec.DecodeAll(src, dst)
+}
@@ -0,0 +1,97 @@
+package zstd
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	. "testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/gallir/radix.improved/redis"
+)
+
+func TestCodec(t *T) {
+	c, err := NewCodec(Opts{})
+	require.Nil(t, err)
+
+	src := []byte(strings.Repeat("hello compression ", 100))
+	enc, err := c.Encode([]byte("pre"), src)
+	require.Nil(t, err)
+	assert.True(t, bytes.HasPrefix(enc, []byte("pre")))
+	enc = enc[3:]
+	assert.True(t, bytes.HasPrefix(enc, c.Marker()))
+	assert.True(t, len(enc) < len(src))
+
+	// Decode twice, so that the decoder is reused
+	for i := 0; i < 2; i++ {
+		dec, err := c.Decode([]byte("pre"), enc)
+		require.Nil(t, err)
+		assert.Equal(t, append([]byte("pre"), src...), dec)
+	}
+
+	_, err = c.Decode(nil, append(c.Marker(), "garbage"...))
+	assert.NotNil(t, err)
+
+	small, err := NewCodec(Opts{MaxDecodedSize: len(src) - 1})
+	require.Nil(t, err)
+	_, err = small.Decode(nil, enc)
+	assert.NotNil(t, err)
+}
+
+func TestCodecDict(t *T) {
+	samples := make([][]byte, 0, 100)
+	for i := 0; i < 100; i++ {
+		samples = append(samples, []byte(fmt.Sprintf(
+			`{"id":%d,"user":"user%d","email":"user%d@example.com","active":%v}`,
+			i*7919, i, i*31, i%3 == 0,
+		)))
+	}
+	dict, err := zstd.BuildDict(zstd.BuildDictOptions{
+		ID:       1,
+		Contents: samples,
+		History:  []byte(`{"id":,"user":"user","email":"@example.com","active":false}`),
+		Offsets:  [3]int{1, 4, 8},
+	})
+	require.Nil(t, err)
+
+	withDict, err := NewCodec(Opts{Dict: dict})
+	require.Nil(t, err)
+	noDict, err := NewCodec(Opts{})
+	require.Nil(t, err)
+
+	enc, err := withDict.Encode(nil, samples[0])
+	require.Nil(t, err)
+	plain, err := noDict.Encode(nil, samples[0])
+	require.Nil(t, err)
+	assert.True(t, len(enc) < len(plain))
+
+	dec, err := withDict.Decode(nil, enc)
+	require.Nil(t, err)
+	assert.Equal(t, samples[0], dec)
+
+	// A codec which only has the dictionary for decoding can still decode
+	decodeOnly, err := NewCodec(Opts{DecodeDicts: [][]byte{dict}})
+	require.Nil(t, err)
+	dec, err = decodeOnly.Decode(nil, enc)
+	require.Nil(t, err)
+	assert.Equal(t, samples[0], dec)
+
+	// But one without it can't
+	_, err = noDict.Decode(nil, enc)
+	assert.NotNil(t, err)
+}
+
+func TestRegister(t *T) {
+	c, err := Register(Opts{})
+	require.Nil(t, err)
+	enc, err := c.Encode(nil, []byte("hello"))
+	require.Nil(t, err)
+	assert.Equal(t, c, redis.CodecFor(enc))
+
+	// All zstd values share the same marker
+	_, err = Register(Opts{})
+	assert.Equal(t, redis.ErrCodecConflict, err)
+}
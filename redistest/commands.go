@@ -0,0 +1,1874 @@
+package redistest
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gallir/radix.improved/redis"
+)
+
+// Errors replied by commands, worded like the ones of redis
+var (
+	errWrongType = errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+	errSyntax    = errors.New("ERR syntax error")
+	errNotInt    = errors.New("ERR value is not an integer or out of range")
+	errNotFloat  = errors.New("ERR value is not a valid float")
+	errNoKey     = errors.New("ERR no such key")
+	errNoAuth    = errors.New("NOAUTH Authentication required.")
+	errWrongPass = errors.New("WRONGPASS invalid username-password pair or user is disabled.")
+	errNoScript  = errors.New("NOSCRIPT No matching script. Please use EVAL.")
+
+	errNoSubscribe = errors.New("ERR subscribing isn't possible using Server.Cmd")
+)
+
+type cmdFunc func(c *conn, args []string) *redis.Resp
+
+// command is an implemented command. arity is the number of args, including
+// the command name, it takes, or if negative the minimum number.
+type command struct {
+	fn    cmdFunc
+	arity int
+}
+
+var commands map[string]command
+
+// The commands which aren't queued within a MULTI
+var txCmds = map[string]bool{
+	"MULTI":   true,
+	"EXEC":    true,
+	"DISCARD": true,
+	"WATCH":   true,
+	"UNWATCH": true,
+	"QUIT":    true,
+}
+
+// commands is filled in here rather than where it's declared because EVAL and
+// EXEC refer back to it
+func init() {
+	commands = map[string]command{
+		// connection
+		"PING":   {cmdPing, -1},
+		"ECHO":   {cmdEcho, 2},
+		"QUIT":   {cmdQuit, 1},
+		"SELECT": {cmdSelect, 2},
+		"AUTH":   {cmdAuth, -2},
+		"HELLO":  {cmdHello, -1},
+		"CLIENT": {cmdClient, -2},
+
+		// keys
+		"FLUSHDB":   {cmdFlushDB, -1},
+		"FLUSHALL":  {cmdFlushAll, -1},
+		"DBSIZE":    {cmdDBSize, 1},
+		"DEL":       {cmdDel, -2},
+		"UNLINK":    {cmdDel, -2},
+		"EXISTS":    {cmdExists, -2},
+		"TYPE":      {cmdType, 2},
+		"EXPIRE":    {cmdExpire, 3},
+		"PEXPIRE":   {cmdExpire, 3},
+		"EXPIREAT":  {cmdExpire, 3},
+		"PEXPIREAT": {cmdExpire, 3},
+		"TTL":       {cmdTTL, 2},
+		"PTTL":      {cmdTTL, 2},
+		"PERSIST":   {cmdPersist, 2},
+		"KEYS":      {cmdKeys, 2},
+		"SCAN":      {cmdScan, -2},
+		"RENAME":    {cmdRename, 3},
+
+		// strings
+		"GET":         {cmdGet, 2},
+		"SET":         {cmdSet, -3},
+		"SETNX":       {cmdSetNX, 3},
+		"SETEX":       {cmdSetEX, 4},
+		"PSETEX":      {cmdSetEX, 4},
+		"GETSET":      {cmdGetSet, 3},
+		"GETDEL":      {cmdGetDel, 2},
+		"GETEX":       {cmdGetEX, -2},
+		"MGET":        {cmdMGet, -2},
+		"MSET":        {cmdMSet, -3},
+		"MSETNX":      {cmdMSet, -3},
+		"INCR":        {cmdIncr, 2},
+		"DECR":        {cmdIncr, 2},
+		"INCRBY":      {cmdIncr, 3},
+		"DECRBY":      {cmdIncr, 3},
+		"INCRBYFLOAT": {cmdIncrByFloat, 3},
+		"APPEND":      {cmdAppend, 3},
+		"STRLEN":      {cmdStrlen, 2},
+
+		// hashes
+		"HSET":    {cmdHSet, -4},
+		"HMSET":   {cmdHSet, -4},
+		"HSETNX":  {cmdHSetNX, 4},
+		"HGET":    {cmdHGet, 3},
+		"HMGET":   {cmdHMGet, -3},
+		"HGETALL": {cmdHGetAll, 2},
+		"HDEL":    {cmdHDel, -3},
+		"HEXISTS": {cmdHExists, 3},
+		"HLEN":    {cmdHLen, 2},
+		"HKEYS":   {cmdHKeys, 2},
+		"HVALS":   {cmdHVals, 2},
+		"HINCRBY": {cmdHIncrBy, 4},
+		"HSCAN":   {cmdHScan, -3},
+
+		// lists
+		"LPUSH":  {cmdPush, -3},
+		"RPUSH":  {cmdPush, -3},
+		"LPOP":   {cmdPop, -2},
+		"RPOP":   {cmdPop, -2},
+		"LLEN":   {cmdLLen, 2},
+		"LRANGE": {cmdLRange, 4},
+		"LINDEX": {cmdLIndex, 3},
+		"LSET":   {cmdLSet, 4},
+		"LREM":   {cmdLRem, 4},
+		"LTRIM":  {cmdLTrim, 4},
+
+		// sets
+		"SADD":      {cmdSAdd, -3},
+		"SREM":      {cmdSRem, -3},
+		"SMEMBERS":  {cmdSMembers, 2},
+		"SISMEMBER": {cmdSIsMember, 3},
+		"SCARD":     {cmdSCard, 2},
+		"SSCAN":     {cmdSScan, -3},
+		"SINTER":    {cmdSetOp, -2},
+		"SUNION":    {cmdSetOp, -2},
+		"SDIFF":     {cmdSetOp, -2},
+
+		// sorted sets
+		"ZADD":          {cmdZAdd, -4},
+		"ZREM":          {cmdZRem, -3},
+		"ZSCORE":        {cmdZScore, 3},
+		"ZCARD":         {cmdZCard, 2},
+		"ZCOUNT":        {cmdZCount, 4},
+		"ZINCRBY":       {cmdZIncrBy, 4},
+		"ZRANGE":        {cmdZRange, -4},
+		"ZREVRANGE":     {cmdZRange, -4},
+		"ZRANGEBYSCORE": {cmdZRangeByScore, -4},
+		"ZRANK":         {cmdZRank, 3},
+		"ZREVRANK":      {cmdZRank, 3},
+		"ZSCAN":         {cmdZScan, -3},
+
+		// transactions
+		"MULTI":   {cmdMulti, 1},
+		"EXEC":    {cmdExec, 1},
+		"DISCARD": {cmdDiscard, 1},
+		"WATCH":   {cmdWatch, -2},
+		"UNWATCH": {cmdUnwatch, 1},
+
+		// pub/sub
+		"SUBSCRIBE":    {cmdSubscribe, -2},
+		"PSUBSCRIBE":   {cmdPSubscribe, -2},
+		"UNSUBSCRIBE":  {cmdUnsubscribe, -1},
+		"PUNSUBSCRIBE": {cmdPUnsubscribe, -1},
+		"PUBLISH":      {cmdPublish, 3},
+
+		// scripting
+		"EVAL":    {cmdEval, -3},
+		"EVALSHA": {cmdEvalSha, -3},
+		"SCRIPT":  {cmdScript, -2},
+	}
+}
+
+// call performs a single command, whose name has been upper cased, on the
+// connection. It must be called with the Server's mu held. A nil reply means
+// the command's replies were added to c.replies instead.
+func (c *conn) call(cmd string, args []string) *redis.Resp {
+	if c.nc != nil && c.s.password != "" && !c.authed &&
+		cmd != "AUTH" && cmd != "HELLO" && cmd != "QUIT" {
+		return redis.NewResp(errNoAuth)
+	}
+	if c.subscribed() && !subscribedCmds[cmd] {
+		return redis.NewResp(fmt.Errorf(
+			"ERR Can't execute '%s': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT are allowed in this context",
+			strings.ToLower(cmd),
+		))
+	}
+
+	command, ok := commands[cmd]
+	if !ok {
+		c.multiErr = c.multi
+		return redis.NewResp(fmt.Errorf("ERR unknown command '%s'", args[0]))
+	}
+	if (command.arity > 0 && len(args) != command.arity) ||
+		(command.arity < 0 && len(args) < -command.arity) {
+		c.multiErr = c.multi
+		return redis.NewResp(fmt.Errorf(
+			"ERR wrong number of arguments for '%s' command", strings.ToLower(cmd),
+		))
+	}
+
+	if c.multi && !txCmds[cmd] {
+		c.queued = append(c.queued, args)
+		return redis.NewRespSimple("QUEUED")
+	}
+	return command.fn(c, args)
+}
+
+func (c *conn) db() *db {
+	return c.s.dbs[c.selected]
+}
+
+func okResp() *redis.Resp {
+	return redis.NewRespSimple("OK")
+}
+
+func parseInt(s string) (int64, error) {
+	i, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, errNotInt
+	}
+	return i, nil
+}
+
+func parseFloat(s string) (float64, error) {
+	switch strings.ToLower(s) {
+	case "inf", "+inf":
+		return math.Inf(1), nil
+	case "-inf":
+		return math.Inf(-1), nil
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(f) {
+		return 0, errNotFloat
+	}
+	return f, nil
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "inf"
+	case math.IsInf(f, -1):
+		return "-inf"
+	}
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// normRange converts the start and stop indexes given to commands like
+// LRANGE, which are inclusive and may be negative, into a slice range of a
+// sequence of length n. ok is false if the range is empty.
+func normRange(start, stop int64, n int) (int, int, bool) {
+	if start < 0 {
+		if start += int64(n); start < 0 {
+			start = 0
+		}
+	}
+	if stop < 0 {
+		stop += int64(n)
+	}
+	if stop >= int64(n) {
+		stop = int64(n) - 1
+	}
+	if start > stop || start >= int64(n) {
+		return 0, 0, false
+	}
+	return int(start), int(stop) + 1, true
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// connection
+
+func cmdPing(c *conn, args []string) *redis.Resp {
+	if len(args) > 2 {
+		return redis.NewResp(errors.New("ERR wrong number of arguments for 'ping' command"))
+	}
+	msg := ""
+	if len(args) == 2 {
+		msg = args[1]
+	}
+	if c.subscribed() {
+		return redis.NewResp([]interface{}{"pong", msg})
+	} else if len(args) == 2 {
+		return redis.NewResp(msg)
+	}
+	return redis.NewRespSimple("PONG")
+}
+
+func cmdEcho(c *conn, args []string) *redis.Resp {
+	return redis.NewResp(args[1])
+}
+
+func cmdQuit(c *conn, args []string) *redis.Resp {
+	return okResp()
+}
+
+func cmdSelect(c *conn, args []string) *redis.Resp {
+	i, err := parseInt(args[1])
+	if err != nil {
+		return redis.NewResp(err)
+	} else if i < 0 || i >= numDBs {
+		return redis.NewResp(errors.New("ERR DB index is out of range"))
+	}
+	c.selected = int(i)
+	return okResp()
+}
+
+// auth checks the password given to AUTH or HELLO, the username is ignored
+func (c *conn) auth(password string) error {
+	if c.s.password == "" {
+		return errors.New("ERR AUTH <password> called without any password configured for the default user. Are you sure your configuration is correct?")
+	} else if password != c.s.password {
+		return errWrongPass
+	}
+	c.authed = true
+	return nil
+}
+
+func cmdAuth(c *conn, args []string) *redis.Resp {
+	if len(args) > 3 {
+		return redis.NewResp(errSyntax)
+	}
+	if err := c.auth(args[len(args)-1]); err != nil {
+		return redis.NewResp(err)
+	}
+	return okResp()
+}
+
+// HELLO is only supported for RESP2, which is the only protocol the Server
+// speaks
+func cmdHello(c *conn, args []string) *redis.Resp {
+	if len(args) > 1 {
+		if v, err := parseInt(args[1]); err != nil || v != 2 {
+			return redis.NewResp(errors.New("NOPROTO unsupported protocol version"))
+		}
+	}
+	for i := 2; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "AUTH":
+			if i+2 >= len(args) {
+				return redis.NewResp(errSyntax)
+			}
+			if err := c.auth(args[i+2]); err != nil {
+				return redis.NewResp(err)
+			}
+			i += 2
+		case "SETNAME":
+			if i+1 >= len(args) {
+				return redis.NewResp(errSyntax)
+			}
+			c.name = args[i+1]
+			i++
+		default:
+			return redis.NewResp(errSyntax)
+		}
+	}
+	if c.nc != nil && c.s.password != "" && !c.authed {
+		return redis.NewResp(errNoAuth)
+	}
+	return redis.NewResp([]interface{}{
+		"server", "redis",
+		"version", "7.0.0",
+		"proto", 2,
+		"mode", "standalone",
+		"role", "master",
+		"modules", []interface{}{},
+	})
+}
+
+func cmdClient(c *conn, args []string) *redis.Resp {
+	switch sub := strings.ToUpper(args[1]); {
+	case sub == "SETNAME" && len(args) == 3:
+		c.name = args[2]
+		return okResp()
+	case sub == "GETNAME" && len(args) == 2:
+		if c.name == "" {
+			return redis.NewResp(nil)
+		}
+		return redis.NewResp(c.name)
+	default:
+		return redis.NewResp(fmt.Errorf("ERR unknown subcommand '%s'", args[1]))
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// keys
+
+func cmdFlushDB(c *conn, args []string) *redis.Resp {
+	c.db().flush()
+	return okResp()
+}
+
+func cmdFlushAll(c *conn, args []string) *redis.Resp {
+	for _, d := range c.s.dbs {
+		d.flush()
+	}
+	return okResp()
+}
+
+func cmdDBSize(c *conn, args []string) *redis.Resp {
+	return redis.NewResp(len(c.db().keys()))
+}
+
+func cmdDel(c *conn, args []string) *redis.Resp {
+	var n int
+	for _, key := range args[1:] {
+		if c.db().del(key) {
+			n++
+		}
+	}
+	return redis.NewResp(n)
+}
+
+func cmdExists(c *conn, args []string) *redis.Resp {
+	var n int
+	for _, key := range args[1:] {
+		if c.db().get(key) != nil {
+			n++
+		}
+	}
+	return redis.NewResp(n)
+}
+
+func cmdType(c *conn, args []string) *redis.Resp {
+	if e := c.db().get(args[1]); e != nil {
+		return redis.NewRespSimple(e.typ)
+	}
+	return redis.NewRespSimple("none")
+}
+
+// parseExpiry converts the argument of an EX, PX, EXAT or PXAT option, or of
+// the equivalent commands, into the time the key expires at
+func (c *conn) parseExpiry(opt, arg string) (time.Time, error) {
+	i, err := parseInt(arg)
+	if err != nil {
+		return time.Time{}, err
+	}
+	switch opt {
+	case "EX":
+		return c.s.now().Add(time.Duration(i) * time.Second), nil
+	case "PX":
+		return c.s.now().Add(time.Duration(i) * time.Millisecond), nil
+	case "EXAT":
+		return time.Unix(i, 0), nil
+	case "PXAT":
+		return time.Unix(0, i*int64(time.Millisecond)), nil
+	}
+	return time.Time{}, errSyntax
+}
+
+var expireOpts = map[string]string{
+	"EXPIRE":    "EX",
+	"PEXPIRE":   "PX",
+	"EXPIREAT":  "EXAT",
+	"PEXPIREAT": "PXAT",
+	"SETEX":     "EX",
+	"PSETEX":    "PX",
+}
+
+func cmdExpire(c *conn, args []string) *redis.Resp {
+	at, err := c.parseExpiry(expireOpts[strings.ToUpper(args[0])], args[2])
+	if err != nil {
+		return redis.NewResp(err)
+	}
+	d := c.db()
+	e := d.get(args[1])
+	if e == nil {
+		return redis.NewResp(0)
+	}
+	if !at.After(c.s.now()) {
+		d.del(args[1])
+	} else {
+		e.expireAt = at
+		d.touch(args[1])
+	}
+	return redis.NewResp(1)
+}
+
+func cmdTTL(c *conn, args []string) *redis.Resp {
+	e := c.db().get(args[1])
+	if e == nil {
+		return redis.NewResp(-2)
+	} else if e.expireAt.IsZero() {
+		return redis.NewResp(-1)
+	}
+	ttl := e.expireAt.Sub(c.s.now())
+	if strings.ToUpper(args[0]) == "PTTL" {
+		return redis.NewResp(int64((ttl + time.Millisecond/2) / time.Millisecond))
+	}
+	return redis.NewResp(int64((ttl + time.Second/2) / time.Second))
+}
+
+func cmdPersist(c *conn, args []string) *redis.Resp {
+	e := c.db().get(args[1])
+	if e == nil || e.expireAt.IsZero() {
+		return redis.NewResp(0)
+	}
+	e.expireAt = time.Time{}
+	c.db().touch(args[1])
+	return redis.NewResp(1)
+}
+
+func cmdKeys(c *conn, args []string) *redis.Resp {
+	keys := []string{}
+	for _, k := range c.db().keys() {
+		if match(args[1], k) {
+			keys = append(keys, k)
+		}
+	}
+	return redis.NewResp(keys)
+}
+
+func cmdRename(c *conn, args []string) *redis.Resp {
+	d := c.db()
+	e := d.get(args[1])
+	if e == nil {
+		return redis.NewResp(errNoKey)
+	}
+	d.del(args[1])
+	d.entries[args[2]] = e
+	d.touch(args[2])
+	return okResp()
+}
+
+// scanOpts are the options of the SCAN family of commands
+type scanOpts struct {
+	cursor  int
+	pattern string
+	count   int
+	typ     string
+}
+
+// parseScan parses the args of a SCAN command starting at the cursor. TYPE is
+// only allowed if allowType is set.
+func parseScan(args []string, allowType bool) (scanOpts, error) {
+	so := scanOpts{count: 10}
+
+	// Like redis, an empty cursor is the same as 0
+	if args[0] != "" {
+		cursor, err := strconv.Atoi(args[0])
+		if err != nil || cursor < 0 {
+			return so, errors.New("ERR invalid cursor")
+		}
+		so.cursor = cursor
+	}
+	var err error
+	for i := 1; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			return so, errSyntax
+		}
+		switch strings.ToUpper(args[i]) {
+		case "MATCH":
+			so.pattern = args[i+1]
+		case "COUNT":
+			if so.count, err = strconv.Atoi(args[i+1]); err != nil {
+				return so, errNotInt
+			} else if so.count < 1 {
+				return so, errSyntax
+			}
+		case "TYPE":
+			if !allowType {
+				return so, errSyntax
+			}
+			so.typ = strings.ToLower(args[i+1])
+		default:
+			return so, errSyntax
+		}
+	}
+	return so, nil
+}
+
+// page returns the items, which must be sorted, which the scan returns, and
+// the cursor the next scan must start at. Like redis, COUNT limits the items
+// which are looked at, not the ones which are returned, so a page may be
+// empty when filtering with MATCH or TYPE.
+func (so scanOpts) page(items []string, keep func(string) bool) ([]string, string) {
+	if so.cursor >= len(items) {
+		return []string{}, "0"
+	}
+	end := so.cursor + so.count
+	next := strconv.Itoa(end)
+	if end >= len(items) {
+		end, next = len(items), "0"
+	}
+	page := []string{}
+	for _, item := range items[so.cursor:end] {
+		if (so.pattern == "" || match(so.pattern, item)) && (keep == nil || keep(item)) {
+			page = append(page, item)
+		}
+	}
+	return page, next
+}
+
+func cmdScan(c *conn, args []string) *redis.Resp {
+	so, err := parseScan(args[1:], true)
+	if err != nil {
+		return redis.NewResp(err)
+	}
+	d := c.db()
+	keys, next := so.page(d.keys(), func(key string) bool {
+		return so.typ == "" || d.entries[key].typ == so.typ
+	})
+	return redis.NewResp([]interface{}{next, keys})
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// strings
+
+func (c *conn) getString(key string) (*entry, error) {
+	return c.db().getType(key, typeString, false)
+}
+
+func cmdGet(c *conn, args []string) *redis.Resp {
+	e, err := c.getString(args[1])
+	if err != nil {
+		return redis.NewResp(err)
+	} else if e == nil {
+		return redis.NewResp(nil)
+	}
+	return redis.NewResp(e.str)
+}
+
+func cmdSet(c *conn, args []string) *redis.Resp {
+	key, val := args[1], args[2]
+	var nx, xx, get, keepTTL bool
+	var expireAt time.Time
+	for i := 3; i < len(args); i++ {
+		switch opt := strings.ToUpper(args[i]); opt {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "GET":
+			get = true
+		case "KEEPTTL":
+			keepTTL = true
+		case "EX", "PX", "EXAT", "PXAT":
+			if i+1 >= len(args) || !expireAt.IsZero() {
+				return redis.NewResp(errSyntax)
+			}
+			at, err := c.parseExpiry(opt, args[i+1])
+			if err != nil {
+				return redis.NewResp(err)
+			} else if n, _ := parseInt(args[i+1]); n <= 0 {
+				return redis.NewResp(errors.New("ERR invalid expire time in 'set' command"))
+			}
+			expireAt = at
+			i++
+		default:
+			return redis.NewResp(errSyntax)
+		}
+	}
+	if (nx && xx) || (keepTTL && !expireAt.IsZero()) {
+		return redis.NewResp(errSyntax)
+	}
+
+	d := c.db()
+	old := d.get(key)
+	var oldResp *redis.Resp
+	if get {
+		if old != nil && old.typ != typeString {
+			return redis.NewResp(errWrongType)
+		} else if old != nil {
+			oldResp = redis.NewResp(old.str)
+		} else {
+			oldResp = redis.NewResp(nil)
+		}
+	}
+
+	if (nx && old != nil) || (xx && old == nil) {
+		if get {
+			return oldResp
+		}
+		return redis.NewResp(nil)
+	}
+
+	e := d.set(key, val)
+	if keepTTL && old != nil {
+		e.expireAt = old.expireAt
+	} else {
+		e.expireAt = expireAt
+	}
+	if get {
+		return oldResp
+	}
+	return okResp()
+}
+
+func cmdSetNX(c *conn, args []string) *redis.Resp {
+	d := c.db()
+	if d.get(args[1]) != nil {
+		return redis.NewResp(0)
+	}
+	d.set(args[1], args[2])
+	return redis.NewResp(1)
+}
+
+func cmdSetEX(c *conn, args []string) *redis.Resp {
+	at, err := c.parseExpiry(expireOpts[strings.ToUpper(args[0])], args[2])
+	if err != nil {
+		return redis.NewResp(err)
+	} else if !at.After(c.s.now()) {
+		return redis.NewResp(fmt.Errorf(
+			"ERR invalid expire time in '%s' command", strings.ToLower(args[0]),
+		))
+	}
+	c.db().set(args[1], args[3]).expireAt = at
+	return okResp()
+}
+
+func cmdGetSet(c *conn, args []string) *redis.Resp {
+	r := cmdGet(c, args[:2])
+	if r.Err == nil {
+		c.db().set(args[1], args[2])
+	}
+	return r
+}
+
+func cmdGetDel(c *conn, args []string) *redis.Resp {
+	r := cmdGet(c, args)
+	if r.Err == nil {
+		c.db().del(args[1])
+	}
+	return r
+}
+
+func cmdGetEX(c *conn, args []string) *redis.Resp {
+	e, err := c.getString(args[1])
+	if err != nil {
+		return redis.NewResp(err)
+	}
+
+	var persist bool
+	var expireAt time.Time
+	switch {
+	case len(args) == 2:
+	case len(args) == 3 && strings.ToUpper(args[2]) == "PERSIST":
+		persist = true
+	case len(args) == 4:
+		if expireAt, err = c.parseExpiry(strings.ToUpper(args[2]), args[3]); err != nil {
+			return redis.NewResp(err)
+		}
+	default:
+		return redis.NewResp(errSyntax)
+	}
+
+	if e == nil {
+		return redis.NewResp(nil)
+	}
+	r := redis.NewResp(e.str)
+	if persist || !expireAt.IsZero() {
+		e.expireAt = expireAt
+		c.db().touch(args[1])
+	}
+	return r
+}
+
+func cmdMGet(c *conn, args []string) *redis.Resp {
+	l := make([]interface{}, 0, len(args)-1)
+	for _, key := range args[1:] {
+		if e := c.db().get(key); e != nil && e.typ == typeString {
+			l = append(l, e.str)
+		} else {
+			l = append(l, nil)
+		}
+	}
+	return redis.NewResp(l)
+}
+
+func cmdMSet(c *conn, args []string) *redis.Resp {
+	if len(args)%2 == 0 {
+		return redis.NewResp(fmt.Errorf(
+			"ERR wrong number of arguments for '%s' command", strings.ToLower(args[0]),
+		))
+	}
+	d := c.db()
+	nx := strings.ToUpper(args[0]) == "MSETNX"
+	if nx {
+		for i := 1; i < len(args); i += 2 {
+			if d.get(args[i]) != nil {
+				return redis.NewResp(0)
+			}
+		}
+	}
+	for i := 1; i < len(args); i += 2 {
+		d.set(args[i], args[i+1])
+	}
+	if nx {
+		return redis.NewResp(1)
+	}
+	return okResp()
+}
+
+func cmdIncr(c *conn, args []string) *redis.Resp {
+	by := int64(1)
+	if len(args) == 3 {
+		var err error
+		if by, err = parseInt(args[2]); err != nil {
+			return redis.NewResp(err)
+		}
+	}
+	if cmd := strings.ToUpper(args[0]); cmd == "DECR" || cmd == "DECRBY" {
+		by = -by
+	}
+
+	d := c.db()
+	e, err := d.getType(args[1], typeString, false)
+	if err != nil {
+		return redis.NewResp(err)
+	}
+	var i int64
+	if e != nil {
+		if i, err = parseInt(e.str); err != nil {
+			return redis.NewResp(err)
+		}
+	}
+	if (by > 0 && i > math.MaxInt64-by) || (by < 0 && i < math.MinInt64-by) {
+		return redis.NewResp(errors.New("ERR increment or decrement would overflow"))
+	}
+	i += by
+	setKeepTTL(d, args[1], e, strconv.FormatInt(i, 10))
+	return redis.NewResp(i)
+}
+
+func cmdIncrByFloat(c *conn, args []string) *redis.Resp {
+	by, err := parseFloat(args[2])
+	if err != nil {
+		return redis.NewResp(err)
+	}
+	d := c.db()
+	e, err := d.getType(args[1], typeString, false)
+	if err != nil {
+		return redis.NewResp(err)
+	}
+	var f float64
+	if e != nil {
+		if f, err = parseFloat(e.str); err != nil {
+			return redis.NewResp(err)
+		}
+	}
+	if f += by; math.IsInf(f, 0) {
+		return redis.NewResp(errors.New("ERR increment would produce NaN or Infinity"))
+	}
+	s := formatFloat(f)
+	setKeepTTL(d, args[1], e, s)
+	return redis.NewResp(s)
+}
+
+// setKeepTTL sets the string value of the key, whose existing entry (if any)
+// is e, keeping its expiry
+func setKeepTTL(d *db, key string, e *entry, val string) {
+	ne := d.set(key, val)
+	if e != nil {
+		ne.expireAt = e.expireAt
+	}
+}
+
+func cmdAppend(c *conn, args []string) *redis.Resp {
+	d := c.db()
+	e, err := d.getType(args[1], typeString, false)
+	if err != nil {
+		return redis.NewResp(err)
+	}
+	var s string
+	if e != nil {
+		s = e.str
+	}
+	s += args[2]
+	setKeepTTL(d, args[1], e, s)
+	return redis.NewResp(len(s))
+}
+
+func cmdStrlen(c *conn, args []string) *redis.Resp {
+	e, err := c.getString(args[1])
+	if err != nil {
+		return redis.NewResp(err)
+	} else if e == nil {
+		return redis.NewResp(0)
+	}
+	return redis.NewResp(len(e.str))
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// hashes
+
+func (c *conn) getHash(key string, create bool) (*entry, error) {
+	return c.db().getType(key, typeHash, create)
+}
+
+func cmdHSet(c *conn, args []string) *redis.Resp {
+	if len(args)%2 != 0 {
+		return redis.NewResp(fmt.Errorf(
+			"ERR wrong number of arguments for '%s' command", strings.ToLower(args[0]),
+		))
+	}
+	e, err := c.getHash(args[1], true)
+	if err != nil {
+		return redis.NewResp(err)
+	}
+	var n int
+	for i := 2; i < len(args); i += 2 {
+		if _, ok := e.hash[args[i]]; !ok {
+			n++
+		}
+		e.hash[args[i]] = args[i+1]
+	}
+	c.db().modified(args[1])
+	if strings.ToUpper(args[0]) == "HMSET" {
+		return okResp()
+	}
+	return redis.NewResp(n)
+}
+
+func cmdHSetNX(c *conn, args []string) *redis.Resp {
+	e, err := c.getHash(args[1], true)
+	if err != nil {
+		return redis.NewResp(err)
+	}
+	if _, ok := e.hash[args[2]]; ok {
+		return redis.NewResp(0)
+	}
+	e.hash[args[2]] = args[3]
+	c.db().modified(args[1])
+	return redis.NewResp(1)
+}
+
+func cmdHGet(c *conn, args []string) *redis.Resp {
+	e, err := c.getHash(args[1], false)
+	if err != nil {
+		return redis.NewResp(err)
+	} else if e == nil {
+		return redis.NewResp(nil)
+	}
+	v, ok := e.hash[args[2]]
+	if !ok {
+		return redis.NewResp(nil)
+	}
+	return redis.NewResp(v)
+}
+
+func cmdHMGet(c *conn, args []string) *redis.Resp {
+	e, err := c.getHash(args[1], false)
+	if err != nil {
+		return redis.NewResp(err)
+	}
+	l := make([]interface{}, 0, len(args)-2)
+	for _, field := range args[2:] {
+		if v, ok := e.hashField(field); ok {
+			l = append(l, v)
+		} else {
+			l = append(l, nil)
+		}
+	}
+	return redis.NewResp(l)
+}
+
+// hashField returns the value of a field of the hash, which may be nil
+func (e *entry) hashField(field string) (string, bool) {
+	if e == nil {
+		return "", false
+	}
+	v, ok := e.hash[field]
+	return v, ok
+}
+
+// hashFields returns the fields of the hash, which may be nil, sorted
+func (e *entry) hashFields() []string {
+	if e == nil {
+		return []string{}
+	}
+	fields := make([]string, 0, len(e.hash))
+	for f := range e.hash {
+		fields = append(fields, f)
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+func cmdHGetAll(c *conn, args []string) *redis.Resp {
+	e, err := c.getHash(args[1], false)
+	if err != nil {
+		return redis.NewResp(err)
+	}
+	l := []string{}
+	for _, f := range e.hashFields() {
+		l = append(l, f, e.hash[f])
+	}
+	return redis.NewResp(l)
+}
+
+func cmdHDel(c *conn, args []string) *redis.Resp {
+	e, err := c.getHash(args[1], false)
+	if err != nil || e == nil {
+		return zeroOrErr(err)
+	}
+	var n int
+	for _, field := range args[2:] {
+		if _, ok := e.hash[field]; ok {
+			delete(e.hash, field)
+			n++
+		}
+	}
+	c.db().modified(args[1])
+	return redis.NewResp(n)
+}
+
+// zeroOrErr returns the error reply for err, or 0 if it's nil, which is what
+// most commands reply when the key they're given doesn't exist
+func zeroOrErr(err error) *redis.Resp {
+	if err != nil {
+		return redis.NewResp(err)
+	}
+	return redis.NewResp(0)
+}
+
+func cmdHExists(c *conn, args []string) *redis.Resp {
+	e, err := c.getHash(args[1], false)
+	if err != nil {
+		return redis.NewResp(err)
+	}
+	if _, ok := e.hashField(args[2]); ok {
+		return redis.NewResp(1)
+	}
+	return redis.NewResp(0)
+}
+
+func cmdHLen(c *conn, args []string) *redis.Resp {
+	e, err := c.getHash(args[1], false)
+	if err != nil || e == nil {
+		return zeroOrErr(err)
+	}
+	return redis.NewResp(len(e.hash))
+}
+
+func cmdHKeys(c *conn, args []string) *redis.Resp {
+	e, err := c.getHash(args[1], false)
+	if err != nil {
+		return redis.NewResp(err)
+	}
+	return redis.NewResp(e.hashFields())
+}
+
+func cmdHVals(c *conn, args []string) *redis.Resp {
+	e, err := c.getHash(args[1], false)
+	if err != nil {
+		return redis.NewResp(err)
+	}
+	l := []string{}
+	for _, f := range e.hashFields() {
+		l = append(l, e.hash[f])
+	}
+	return redis.NewResp(l)
+}
+
+func cmdHIncrBy(c *conn, args []string) *redis.Resp {
+	by, err := parseInt(args[3])
+	if err != nil {
+		return redis.NewResp(err)
+	}
+	e, err := c.getHash(args[1], true)
+	if err != nil {
+		return redis.NewResp(err)
+	}
+	var i int64
+	if v, ok := e.hash[args[2]]; ok {
+		if i, err = parseInt(v); err != nil {
+			return redis.NewResp(errors.New("ERR hash value is not an integer"))
+		}
+	}
+	i += by
+	e.hash[args[2]] = strconv.FormatInt(i, 10)
+	c.db().modified(args[1])
+	return redis.NewResp(i)
+}
+
+func cmdHScan(c *conn, args []string) *redis.Resp {
+	so, err := parseScan(args[2:], false)
+	if err != nil {
+		return redis.NewResp(err)
+	}
+	e, err := c.getHash(args[1], false)
+	if err != nil {
+		return redis.NewResp(err)
+	}
+	fields, next := so.page(e.hashFields(), nil)
+	l := make([]string, 0, len(fields)*2)
+	for _, f := range fields {
+		l = append(l, f, e.hash[f])
+	}
+	return redis.NewResp([]interface{}{next, l})
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// lists
+
+func (c *conn) getList(key string, create bool) (*entry, error) {
+	return c.db().getType(key, typeList, create)
+}
+
+func cmdPush(c *conn, args []string) *redis.Resp {
+	e, err := c.getList(args[1], true)
+	if err != nil {
+		return redis.NewResp(err)
+	}
+	if strings.ToUpper(args[0]) == "LPUSH" {
+		for _, v := range args[2:] {
+			e.list = append([]string{v}, e.list...)
+		}
+	} else {
+		e.list = append(e.list, args[2:]...)
+	}
+	c.db().modified(args[1])
+	return redis.NewResp(len(e.list))
+}
+
+func cmdPop(c *conn, args []string) *redis.Resp {
+	if len(args) > 3 {
+		return redis.NewResp(errSyntax)
+	}
+	count := int64(-1)
+	if len(args) == 3 {
+		var err error
+		if count, err = parseInt(args[2]); err != nil || count < 0 {
+			return redis.NewResp(errors.New("ERR value is out of range, must be positive"))
+		}
+	}
+
+	e, err := c.getList(args[1], false)
+	if err != nil {
+		return redis.NewResp(err)
+	} else if e == nil {
+		return redis.NewResp(nil)
+	}
+
+	n := int(count)
+	if count < 0 {
+		n = 1
+	} else if n > len(e.list) {
+		n = len(e.list)
+	}
+	var popped []string
+	if strings.ToUpper(args[0]) == "LPOP" {
+		popped = append(popped, e.list[:n]...)
+		e.list = e.list[n:]
+	} else {
+		for i := 0; i < n; i++ {
+			popped = append(popped, e.list[len(e.list)-1-i])
+		}
+		e.list = e.list[:len(e.list)-n]
+	}
+	c.db().modified(args[1])
+
+	if count < 0 {
+		return redis.NewResp(popped[0])
+	}
+	return redis.NewResp(popped)
+}
+
+func cmdLLen(c *conn, args []string) *redis.Resp {
+	e, err := c.getList(args[1], false)
+	if err != nil || e == nil {
+		return zeroOrErr(err)
+	}
+	return redis.NewResp(len(e.list))
+}
+
+func cmdLRange(c *conn, args []string) *redis.Resp {
+	start, err := parseInt(args[2])
+	if err != nil {
+		return redis.NewResp(err)
+	}
+	stop, err := parseInt(args[3])
+	if err != nil {
+		return redis.NewResp(err)
+	}
+	e, err := c.getList(args[1], false)
+	if err != nil {
+		return redis.NewResp(err)
+	} else if e == nil {
+		return redis.NewResp([]string{})
+	}
+	i, j, ok := normRange(start, stop, len(e.list))
+	if !ok {
+		return redis.NewResp([]string{})
+	}
+	return redis.NewResp(e.list[i:j])
+}
+
+// listIndex returns the index into the list for the given index, which may be
+// negative. in is false if it's out of range.
+func listIndex(e *entry, arg string) (int, bool, error) {
+	i, err := parseInt(arg)
+	if err != nil {
+		return 0, false, err
+	}
+	if i < 0 {
+		i += int64(len(e.list))
+	}
+	if i < 0 || i >= int64(len(e.list)) {
+		return 0, false, nil
+	}
+	return int(i), true, nil
+}
+
+func cmdLIndex(c *conn, args []string) *redis.Resp {
+	e, err := c.getList(args[1], false)
+	if err != nil {
+		return redis.NewResp(err)
+	} else if e == nil {
+		return redis.NewResp(nil)
+	}
+	i, in, err := listIndex(e, args[2])
+	if err != nil {
+		return redis.NewResp(err)
+	} else if !in {
+		return redis.NewResp(nil)
+	}
+	return redis.NewResp(e.list[i])
+}
+
+func cmdLSet(c *conn, args []string) *redis.Resp {
+	e, err := c.getList(args[1], false)
+	if err != nil {
+		return redis.NewResp(err)
+	} else if e == nil {
+		return redis.NewResp(errNoKey)
+	}
+	i, in, err := listIndex(e, args[2])
+	if err != nil {
+		return redis.NewResp(err)
+	} else if !in {
+		return redis.NewResp(errors.New("ERR index out of range"))
+	}
+	e.list[i] = args[3]
+	c.db().modified(args[1])
+	return okResp()
+}
+
+func cmdLRem(c *conn, args []string) *redis.Resp {
+	count, err := parseInt(args[2])
+	if err != nil {
+		return redis.NewResp(err)
+	}
+	e, err := c.getList(args[1], false)
+	if err != nil || e == nil {
+		return zeroOrErr(err)
+	}
+
+	// A negative count removes from the tail, which is done by going through
+	// the list backwards
+	l, fromTail := e.list, count < 0
+	if fromTail {
+		l = reversed(l)
+		count = -count
+	}
+	kept := make([]string, 0, len(l))
+	var n int64
+	for _, v := range l {
+		if v == args[3] && (count == 0 || n < count) {
+			n++
+			continue
+		}
+		kept = append(kept, v)
+	}
+	if fromTail {
+		kept = reversed(kept)
+	}
+	e.list = kept
+	c.db().modified(args[1])
+	return redis.NewResp(n)
+}
+
+func reversed(l []string) []string {
+	r := make([]string, len(l))
+	for i, v := range l {
+		r[len(l)-1-i] = v
+	}
+	return r
+}
+
+func cmdLTrim(c *conn, args []string) *redis.Resp {
+	start, err := parseInt(args[2])
+	if err != nil {
+		return redis.NewResp(err)
+	}
+	stop, err := parseInt(args[3])
+	if err != nil {
+		return redis.NewResp(err)
+	}
+	e, err := c.getList(args[1], false)
+	if err != nil {
+		return redis.NewResp(err)
+	} else if e == nil {
+		return okResp()
+	}
+	if i, j, ok := normRange(start, stop, len(e.list)); ok {
+		e.list = e.list[i:j]
+	} else {
+		e.list = nil
+	}
+	c.db().modified(args[1])
+	return okResp()
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// sets
+
+func (c *conn) getSet(key string, create bool) (*entry, error) {
+	return c.db().getType(key, typeSet, create)
+}
+
+func cmdSAdd(c *conn, args []string) *redis.Resp {
+	e, err := c.getSet(args[1], true)
+	if err != nil {
+		return redis.NewResp(err)
+	}
+	var n int
+	for _, m := range args[2:] {
+		if _, ok := e.set[m]; !ok {
+			e.set[m] = struct{}{}
+			n++
+		}
+	}
+	c.db().modified(args[1])
+	return redis.NewResp(n)
+}
+
+func cmdSRem(c *conn, args []string) *redis.Resp {
+	e, err := c.getSet(args[1], false)
+	if err != nil || e == nil {
+		return zeroOrErr(err)
+	}
+	var n int
+	for _, m := range args[2:] {
+		if _, ok := e.set[m]; ok {
+			delete(e.set, m)
+			n++
+		}
+	}
+	c.db().modified(args[1])
+	return redis.NewResp(n)
+}
+
+func cmdSMembers(c *conn, args []string) *redis.Resp {
+	e, err := c.getSet(args[1], false)
+	if err != nil {
+		return redis.NewResp(err)
+	} else if e == nil {
+		return redis.NewResp([]string{})
+	}
+	return redis.NewResp(sortedKeys(e.set))
+}
+
+func cmdSIsMember(c *conn, args []string) *redis.Resp {
+	e, err := c.getSet(args[1], false)
+	if err != nil || e == nil {
+		return zeroOrErr(err)
+	}
+	if _, ok := e.set[args[2]]; ok {
+		return redis.NewResp(1)
+	}
+	return redis.NewResp(0)
+}
+
+func cmdSCard(c *conn, args []string) *redis.Resp {
+	e, err := c.getSet(args[1], false)
+	if err != nil || e == nil {
+		return zeroOrErr(err)
+	}
+	return redis.NewResp(len(e.set))
+}
+
+func cmdSScan(c *conn, args []string) *redis.Resp {
+	so, err := parseScan(args[2:], false)
+	if err != nil {
+		return redis.NewResp(err)
+	}
+	e, err := c.getSet(args[1], false)
+	if err != nil {
+		return redis.NewResp(err)
+	}
+	var members []string
+	if e != nil {
+		members = sortedKeys(e.set)
+	}
+	members, next := so.page(members, nil)
+	return redis.NewResp([]interface{}{next, members})
+}
+
+// cmdSetOp implements SINTER, SUNION and SDIFF
+func cmdSetOp(c *conn, args []string) *redis.Resp {
+	op := strings.ToUpper(args[0])
+	var result map[string]struct{}
+	for i, key := range args[1:] {
+		e, err := c.getSet(key, false)
+		if err != nil {
+			return redis.NewResp(err)
+		}
+		var set map[string]struct{}
+		if e != nil {
+			set = e.set
+		}
+
+		if i == 0 {
+			result = map[string]struct{}{}
+			for m := range set {
+				result[m] = struct{}{}
+			}
+			continue
+		}
+		for m := range result {
+			_, in := set[m]
+			if (op == "SINTER" && !in) || (op == "SDIFF" && in) {
+				delete(result, m)
+			}
+		}
+		if op == "SUNION" {
+			for m := range set {
+				result[m] = struct{}{}
+			}
+		}
+	}
+	return redis.NewResp(sortedKeys(result))
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// sorted sets
+
+func (c *conn) getZSet(key string, create bool) (*entry, error) {
+	return c.db().getType(key, typeZSet, create)
+}
+
+func cmdZAdd(c *conn, args []string) *redis.Resp {
+	var nx, xx, ch, incr bool
+	i := 2
+opts:
+	for ; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "CH":
+			ch = true
+		case "INCR":
+			incr = true
+		default:
+			break opts
+		}
+	}
+	pairs := args[i:]
+	if len(pairs) == 0 || len(pairs)%2 != 0 || (nx && xx) || (incr && len(pairs) != 2) {
+		return redis.NewResp(errSyntax)
+	}
+	scores := make([]float64, len(pairs)/2)
+	for i := range scores {
+		var err error
+		if scores[i], err = parseFloat(pairs[i*2]); err != nil {
+			return redis.NewResp(err)
+		}
+	}
+
+	e, err := c.getZSet(args[1], true)
+	if err != nil {
+		return redis.NewResp(err)
+	}
+	defer c.db().modified(args[1])
+
+	var n int
+	for i, score := range scores {
+		m := pairs[i*2+1]
+		old, exists := e.zset[m]
+		if (nx && exists) || (xx && !exists) {
+			if incr {
+				return redis.NewResp(nil)
+			}
+			continue
+		}
+		if incr {
+			score += old
+		}
+		if !exists || (ch && old != score) {
+			n++
+		}
+		e.zset[m] = score
+		if incr {
+			return redis.NewResp(formatFloat(score))
+		}
+	}
+	return redis.NewResp(n)
+}
+
+func cmdZRem(c *conn, args []string) *redis.Resp {
+	e, err := c.getZSet(args[1], false)
+	if err != nil || e == nil {
+		return zeroOrErr(err)
+	}
+	var n int
+	for _, m := range args[2:] {
+		if _, ok := e.zset[m]; ok {
+			delete(e.zset, m)
+			n++
+		}
+	}
+	c.db().modified(args[1])
+	return redis.NewResp(n)
+}
+
+func cmdZScore(c *conn, args []string) *redis.Resp {
+	e, err := c.getZSet(args[1], false)
+	if err != nil {
+		return redis.NewResp(err)
+	} else if e == nil {
+		return redis.NewResp(nil)
+	}
+	score, ok := e.zset[args[2]]
+	if !ok {
+		return redis.NewResp(nil)
+	}
+	return redis.NewResp(formatFloat(score))
+}
+
+func cmdZCard(c *conn, args []string) *redis.Resp {
+	e, err := c.getZSet(args[1], false)
+	if err != nil || e == nil {
+		return zeroOrErr(err)
+	}
+	return redis.NewResp(len(e.zset))
+}
+
+func cmdZIncrBy(c *conn, args []string) *redis.Resp {
+	by, err := parseFloat(args[2])
+	if err != nil {
+		return redis.NewResp(err)
+	}
+	e, err := c.getZSet(args[1], true)
+	if err != nil {
+		return redis.NewResp(err)
+	}
+	e.zset[args[3]] += by
+	c.db().modified(args[1])
+	return redis.NewResp(formatFloat(e.zset[args[3]]))
+}
+
+// zsetReply returns the reply for the given members of a sorted set, with
+// their scores if withScores is set
+func zsetReply(members []zsetMember, withScores bool) *redis.Resp {
+	l := make([]string, 0, len(members)*2)
+	for _, m := range members {
+		l = append(l, m.member)
+		if withScores {
+			l = append(l, formatFloat(m.score))
+		}
+	}
+	return redis.NewResp(l)
+}
+
+func cmdZRange(c *conn, args []string) *redis.Resp {
+	start, err := parseInt(args[2])
+	if err != nil {
+		return redis.NewResp(err)
+	}
+	stop, err := parseInt(args[3])
+	if err != nil {
+		return redis.NewResp(err)
+	}
+	rev := strings.ToUpper(args[0]) == "ZREVRANGE"
+	var withScores bool
+	for _, opt := range args[4:] {
+		switch strings.ToUpper(opt) {
+		case "WITHSCORES":
+			withScores = true
+		case "REV":
+			if rev {
+				return redis.NewResp(errSyntax)
+			}
+			rev = true
+		default:
+			return redis.NewResp(errSyntax)
+		}
+	}
+
+	e, err := c.getZSet(args[1], false)
+	if err != nil {
+		return redis.NewResp(err)
+	} else if e == nil {
+		return redis.NewResp([]string{})
+	}
+	members := sortedZSet(e.zset)
+	if rev {
+		for i, j := 0, len(members)-1; i < j; i, j = i+1, j-1 {
+			members[i], members[j] = members[j], members[i]
+		}
+	}
+	i, j, ok := normRange(start, stop, len(members))
+	if !ok {
+		return redis.NewResp([]string{})
+	}
+	return zsetReply(members[i:j], withScores)
+}
+
+// parseScoreBound parses a min or max argument of ZRANGEBYSCORE or ZCOUNT,
+// which may be exclusive if it starts with "("
+func parseScoreBound(s string) (float64, bool, error) {
+	excl := strings.HasPrefix(s, "(")
+	if excl {
+		s = s[1:]
+	}
+	f, err := parseFloat(s)
+	if err != nil {
+		return 0, false, errors.New("ERR min or max is not a float")
+	}
+	return f, excl, nil
+}
+
+// zsetByScore returns the members of the sorted set whose scores are within
+// the given bounds
+func zsetByScore(e *entry, minArg, maxArg string) ([]zsetMember, error) {
+	min, minExcl, err := parseScoreBound(minArg)
+	if err != nil {
+		return nil, err
+	}
+	max, maxExcl, err := parseScoreBound(maxArg)
+	if err != nil {
+		return nil, err
+	}
+	if e == nil {
+		return nil, nil
+	}
+	var l []zsetMember
+	for _, m := range sortedZSet(e.zset) {
+		if (m.score > min || (!minExcl && m.score == min)) &&
+			(m.score < max || (!maxExcl && m.score == max)) {
+			l = append(l, m)
+		}
+	}
+	return l, nil
+}
+
+func cmdZRangeByScore(c *conn, args []string) *redis.Resp {
+	var withScores bool
+	offset, count := int64(0), int64(-1)
+	for i := 4; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "WITHSCORES":
+			withScores = true
+		case "LIMIT":
+			if i+2 >= len(args) {
+				return redis.NewResp(errSyntax)
+			}
+			var err error
+			if offset, err = parseInt(args[i+1]); err != nil {
+				return redis.NewResp(err)
+			} else if count, err = parseInt(args[i+2]); err != nil {
+				return redis.NewResp(err)
+			}
+			i += 2
+		default:
+			return redis.NewResp(errSyntax)
+		}
+	}
+
+	e, err := c.getZSet(args[1], false)
+	if err != nil {
+		return redis.NewResp(err)
+	}
+	members, err := zsetByScore(e, args[2], args[3])
+	if err != nil {
+		return redis.NewResp(err)
+	}
+	if offset < 0 || offset >= int64(len(members)) {
+		members = nil
+	} else {
+		members = members[offset:]
+		if count >= 0 && count < int64(len(members)) {
+			members = members[:count]
+		}
+	}
+	return zsetReply(members, withScores)
+}
+
+func cmdZCount(c *conn, args []string) *redis.Resp {
+	e, err := c.getZSet(args[1], false)
+	if err != nil {
+		return redis.NewResp(err)
+	}
+	members, err := zsetByScore(e, args[2], args[3])
+	if err != nil {
+		return redis.NewResp(err)
+	}
+	return redis.NewResp(len(members))
+}
+
+func cmdZRank(c *conn, args []string) *redis.Resp {
+	e, err := c.getZSet(args[1], false)
+	if err != nil {
+		return redis.NewResp(err)
+	} else if e == nil {
+		return redis.NewResp(nil)
+	}
+	members := sortedZSet(e.zset)
+	for i, m := range members {
+		if m.member != args[2] {
+			continue
+		}
+		if strings.ToUpper(args[0]) == "ZREVRANK" {
+			i = len(members) - 1 - i
+		}
+		return redis.NewResp(i)
+	}
+	return redis.NewResp(nil)
+}
+
+func cmdZScan(c *conn, args []string) *redis.Resp {
+	so, err := parseScan(args[2:], false)
+	if err != nil {
+		return redis.NewResp(err)
+	}
+	e, err := c.getZSet(args[1], false)
+	if err != nil {
+		return redis.NewResp(err)
+	}
+	var members []string
+	if e != nil {
+		members = make([]string, 0, len(e.zset))
+		for m := range e.zset {
+			members = append(members, m)
+		}
+		sort.Strings(members)
+	}
+	members, next := so.page(members, nil)
+	l := make([]string, 0, len(members)*2)
+	for _, m := range members {
+		l = append(l, m, formatFloat(e.zset[m]))
+	}
+	return redis.NewResp([]interface{}{next, l})
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// transactions
+
+func cmdMulti(c *conn, args []string) *redis.Resp {
+	if c.multi {
+		return redis.NewResp(errors.New("ERR MULTI calls can not be nested"))
+	}
+	c.multi = true
+	return okResp()
+}
+
+func cmdExec(c *conn, args []string) *redis.Resp {
+	if !c.multi {
+		return redis.NewResp(errors.New("ERR EXEC without MULTI"))
+	}
+	queued, multiErr, watched := c.queued, c.multiErr, c.watched
+	c.multi, c.multiErr, c.queued, c.watched = false, false, nil, nil
+
+	if multiErr {
+		return redis.NewResp(errors.New("EXECABORT Transaction discarded because of previous errors."))
+	}
+	for wk, version := range watched {
+		d := c.s.dbs[wk.db]
+		d.get(wk.key)
+		if d.versions[wk.key] != version {
+			return redis.NewResp(nil)
+		}
+	}
+
+	l := make([]interface{}, len(queued))
+	for i, args := range queued {
+		l[i] = c.call(strings.ToUpper(args[0]), args)
+	}
+	return redis.NewResp(l)
+}
+
+func cmdDiscard(c *conn, args []string) *redis.Resp {
+	if !c.multi {
+		return redis.NewResp(errors.New("ERR DISCARD without MULTI"))
+	}
+	c.multi, c.multiErr, c.queued, c.watched = false, false, nil, nil
+	return okResp()
+}
+
+func cmdWatch(c *conn, args []string) *redis.Resp {
+	if c.multi {
+		return redis.NewResp(errors.New("ERR WATCH inside MULTI is not allowed"))
+	}
+	if c.watched == nil {
+		c.watched = map[watchKey]uint64{}
+	}
+	d := c.db()
+	for _, key := range args[1:] {
+		d.get(key)
+		c.watched[watchKey{c.selected, key}] = d.versions[key]
+	}
+	return okResp()
+}
+
+func cmdUnwatch(c *conn, args []string) *redis.Resp {
+	c.watched = nil
+	return okResp()
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// scripting
+
+func scriptSum(script string) string {
+	sum := sha1.Sum([]byte(script))
+	return hex.EncodeToString(sum[:])
+}
+
+func cmdEval(c *conn, args []string) *redis.Resp {
+	c.s.scripts[scriptSum(args[1])] = args[1]
+	return c.runScript(args[1], args[2:])
+}
+
+func cmdEvalSha(c *conn, args []string) *redis.Resp {
+	script, ok := c.s.scripts[strings.ToLower(args[1])]
+	if !ok {
+		return redis.NewResp(errNoScript)
+	}
+	return c.runScript(script, args[2:])
+}
+
+// runScript calls the ScriptFunc registered for the script, given the
+// numkeys argument of EVAL and the ones following it
+func (c *conn) runScript(script string, args []string) *redis.Resp {
+	fn, ok := c.s.funcs[script]
+	if !ok {
+		return redis.NewResp(errors.New("ERR redistest: no ScriptFunc was registered for the script"))
+	}
+	numKeys, err := parseInt(args[0])
+	if err != nil {
+		return redis.NewResp(err)
+	} else if numKeys < 0 {
+		return redis.NewResp(errors.New("ERR Number of keys can't be negative"))
+	} else if numKeys > int64(len(args)-1) {
+		return redis.NewResp(errors.New("ERR Number of keys can't be greater than number of args"))
+	}
+
+	call := func(cmd string, cargs ...interface{}) *redis.Resp {
+		sargs, err := redis.NewRespFlattenedStrings(cargs).List()
+		if err != nil {
+			return redis.NewResp(err)
+		}
+		return c.call(strings.ToUpper(cmd), append([]string{cmd}, sargs...))
+	}
+	keys, rest := args[1:1+numKeys], args[1+numKeys:]
+	return redis.NewResp(fn(call, keys, rest))
+}
+
+func cmdScript(c *conn, args []string) *redis.Resp {
+	switch sub := strings.ToUpper(args[1]); {
+	case sub == "LOAD" && len(args) == 3:
+		sum := scriptSum(args[2])
+		c.s.scripts[sum] = args[2]
+		return redis.NewResp(sum)
+	case sub == "EXISTS" && len(args) > 2:
+		l := make([]int, len(args)-2)
+		for i, sum := range args[2:] {
+			if _, ok := c.s.scripts[strings.ToLower(sum)]; ok {
+				l[i] = 1
+			}
+		}
+		return redis.NewResp(l)
+	case sub == "FLUSH":
+		c.s.scripts = map[string]string{}
+		return okResp()
+	default:
+		return redis.NewResp(fmt.Errorf("ERR unknown subcommand '%s'", args[1]))
+	}
+}
@@ -0,0 +1,186 @@
+package redistest
+
+import (
+	"sort"
+	"time"
+)
+
+// The type names of values, as returned by TYPE
+const (
+	typeString = "string"
+	typeHash   = "hash"
+	typeList   = "list"
+	typeSet    = "set"
+	typeZSet   = "zset"
+)
+
+// entry is a single key's value. Only the field corresponding to typ is used.
+type entry struct {
+	typ  string
+	str  string
+	hash map[string]string
+	list []string
+	set  map[string]struct{}
+	zset map[string]float64
+
+	// The zero value means the key doesn't expire
+	expireAt time.Time
+}
+
+// empty returns whether the entry is a collection without any elements, which
+// redis never keeps around
+func (e *entry) empty() bool {
+	switch e.typ {
+	case typeHash:
+		return len(e.hash) == 0
+	case typeList:
+		return len(e.list) == 0
+	case typeSet:
+		return len(e.set) == 0
+	case typeZSet:
+		return len(e.zset) == 0
+	}
+	return false
+}
+
+// db is a single database of a Server. All of its methods must be called with
+// the Server's mu held.
+type db struct {
+	s       *Server
+	entries map[string]*entry
+
+	// versions holds, for every key which was ever modified, a number which
+	// changes each time it is, which is what WATCH compares
+	versions map[string]uint64
+}
+
+func newDB(s *Server) *db {
+	return &db{
+		s:        s,
+		entries:  map[string]*entry{},
+		versions: map[string]uint64{},
+	}
+}
+
+// get returns the entry for the key, or nil if it doesn't exist or has expired
+func (d *db) get(key string) *entry {
+	e, ok := d.entries[key]
+	if !ok {
+		return nil
+	}
+	if !e.expireAt.IsZero() && !d.s.now().Before(e.expireAt) {
+		delete(d.entries, key)
+		d.touch(key)
+		return nil
+	}
+	return e
+}
+
+// getType is like get, but returns errWrongType if the key holds a value of
+// another type. If create is set a new empty value is created if the key
+// doesn't exist.
+func (d *db) getType(key, typ string, create bool) (*entry, error) {
+	e := d.get(key)
+	if e == nil {
+		if !create {
+			return nil, nil
+		}
+		e = &entry{typ: typ}
+		switch typ {
+		case typeHash:
+			e.hash = map[string]string{}
+		case typeSet:
+			e.set = map[string]struct{}{}
+		case typeZSet:
+			e.zset = map[string]float64{}
+		}
+		d.entries[key] = e
+	} else if e.typ != typ {
+		return nil, errWrongType
+	}
+	return e, nil
+}
+
+// set replaces the key's value with the given string, removing any expiry
+func (d *db) set(key, val string) *entry {
+	e := &entry{typ: typeString, str: val}
+	d.entries[key] = e
+	d.touch(key)
+	return e
+}
+
+// del removes the key, returning whether it existed
+func (d *db) del(key string) bool {
+	if d.get(key) == nil {
+		return false
+	}
+	delete(d.entries, key)
+	d.touch(key)
+	return true
+}
+
+// modified must be called after the key's value was modified in place. It
+// removes the key if its value has become empty.
+func (d *db) modified(key string) {
+	if e, ok := d.entries[key]; ok && e.empty() {
+		delete(d.entries, key)
+	}
+	d.touch(key)
+}
+
+func (d *db) touch(key string) {
+	d.s.version++
+	d.versions[key] = d.s.version
+}
+
+// keys returns the keys which haven't expired, sorted
+func (d *db) keys() []string {
+	keys := make([]string, 0, len(d.entries))
+	for k := range d.entries {
+		if d.get(k) != nil {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// flush removes every key
+func (d *db) flush() {
+	for k := range d.entries {
+		d.touch(k)
+	}
+	d.entries = map[string]*entry{}
+}
+
+// zsetMember is a member of a sorted set along with its score
+type zsetMember struct {
+	member string
+	score  float64
+}
+
+// sortedZSet returns the members of the sorted set in order of their scores,
+// and then lexicographically
+func sortedZSet(zset map[string]float64) []zsetMember {
+	l := make([]zsetMember, 0, len(zset))
+	for m, s := range zset {
+		l = append(l, zsetMember{m, s})
+	}
+	sort.Slice(l, func(i, j int) bool {
+		if l[i].score != l[j].score {
+			return l[i].score < l[j].score
+		}
+		return l[i].member < l[j].member
+	})
+	return l
+}
+
+// sortedKeys returns the keys of the set, sorted
+func sortedKeys(set map[string]struct{}) []string {
+	l := make([]string, 0, len(set))
+	for k := range set {
+		l = append(l, k)
+	}
+	sort.Strings(l)
+	return l
+}
@@ -0,0 +1,206 @@
+package redistest
+
+import (
+	"github.com/gallir/radix.improved/redis"
+)
+
+// The commands which may be used while a connection is subscribed to any
+// channels or patterns
+var subscribedCmds = map[string]bool{
+	"SUBSCRIBE":    true,
+	"UNSUBSCRIBE":  true,
+	"PSUBSCRIBE":   true,
+	"PUNSUBSCRIBE": true,
+	"PING":         true,
+	"QUIT":         true,
+}
+
+// subscribed returns whether the connection is in subscribed mode
+func (c *conn) subscribed() bool {
+	return len(c.channels)+len(c.patterns) > 0
+}
+
+func (c *conn) subCount() int {
+	return len(c.channels) + len(c.patterns)
+}
+
+func cmdSubscribe(c *conn, args []string) *redis.Resp {
+	return c.subscribe("subscribe", args[1:], &c.channels, c.s.channels)
+}
+
+func cmdPSubscribe(c *conn, args []string) *redis.Resp {
+	return c.subscribe("psubscribe", args[1:], &c.patterns, c.s.patterns)
+}
+
+func cmdUnsubscribe(c *conn, args []string) *redis.Resp {
+	return c.unsubscribe("unsubscribe", args[1:], c.channels, c.s.channels)
+}
+
+func cmdPUnsubscribe(c *conn, args []string) *redis.Resp {
+	return c.unsubscribe("punsubscribe", args[1:], c.patterns, c.s.patterns)
+}
+
+func (c *conn) subscribe(
+	kind string, names []string, mine *map[string]bool, all map[string]map[*conn]bool,
+) *redis.Resp {
+	if c.nc == nil {
+		return redis.NewResp(errNoSubscribe)
+	}
+	if *mine == nil {
+		*mine = map[string]bool{}
+	}
+	for _, name := range names {
+		(*mine)[name] = true
+		if all[name] == nil {
+			all[name] = map[*conn]bool{}
+		}
+		all[name][c] = true
+		c.replies = append(c.replies, redis.NewResp([]interface{}{kind, name, c.subCount()}))
+	}
+	return nil
+}
+
+func (c *conn) unsubscribe(
+	kind string, names []string, mine map[string]bool, all map[string]map[*conn]bool,
+) *redis.Resp {
+	if len(names) == 0 {
+		for name := range mine {
+			names = append(names, name)
+		}
+		if len(names) == 0 {
+			return redis.NewResp([]interface{}{kind, nil, c.subCount()})
+		}
+	}
+	for _, name := range names {
+		delete(mine, name)
+		if conns := all[name]; conns != nil {
+			delete(conns, c)
+			if len(conns) == 0 {
+				delete(all, name)
+			}
+		}
+		c.replies = append(c.replies, redis.NewResp([]interface{}{kind, name, c.subCount()}))
+	}
+	return nil
+}
+
+// unsubscribeAll removes the connection from every channel and pattern, once
+// it's closed
+func (c *conn) unsubscribeAll() {
+	for name := range c.channels {
+		delete(c.s.channels[name], c)
+		if len(c.s.channels[name]) == 0 {
+			delete(c.s.channels, name)
+		}
+	}
+	for name := range c.patterns {
+		delete(c.s.patterns[name], c)
+		if len(c.s.patterns[name]) == 0 {
+			delete(c.s.patterns, name)
+		}
+	}
+	c.channels, c.patterns = nil, nil
+}
+
+func cmdPublish(c *conn, args []string) *redis.Resp {
+	channel, msg := args[1], args[2]
+	var n int
+	for sc := range c.s.channels[channel] {
+		sc.push(redis.NewResp([]interface{}{"message", channel, msg}))
+		n++
+	}
+	for pattern, conns := range c.s.patterns {
+		if !match(pattern, channel) {
+			continue
+		}
+		for sc := range conns {
+			sc.push(redis.NewResp([]interface{}{"pmessage", pattern, channel, msg}))
+			n++
+		}
+	}
+	return redis.NewResp(n)
+}
+
+// match returns whether the string matches the glob-style pattern, as used by
+// PSUBSCRIBE, KEYS and the MATCH option of SCAN. *, ?, [abc], [^abc], [a-z]
+// and \ escapes are supported.
+func match(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 1 {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if match(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+			s = s[1:]
+			pattern = pattern[1:]
+
+		case '[':
+			if len(s) == 0 {
+				return false
+			}
+			rest, ok := matchClass(pattern[1:], s[0])
+			if !ok {
+				return false
+			}
+			s, pattern = s[1:], rest
+
+		case '\\':
+			if len(pattern) >= 2 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+
+		default:
+			if len(s) == 0 || s[0] != pattern[0] {
+				return false
+			}
+			s, pattern = s[1:], pattern[1:]
+		}
+	}
+	return len(s) == 0
+}
+
+// matchClass matches the byte against a [...] class, given the pattern right
+// after the opening bracket, and returns the pattern after the closing one
+func matchClass(pattern string, b byte) (string, bool) {
+	not := len(pattern) > 0 && pattern[0] == '^'
+	if not {
+		pattern = pattern[1:]
+	}
+	matched := false
+	for len(pattern) > 0 && pattern[0] != ']' {
+		switch {
+		case pattern[0] == '\\' && len(pattern) >= 2:
+			matched = matched || pattern[1] == b
+			pattern = pattern[2:]
+		case len(pattern) >= 3 && pattern[1] == '-' && pattern[2] != ']':
+			lo, hi := pattern[0], pattern[2]
+			if lo > hi {
+				lo, hi = hi, lo
+			}
+			matched = matched || (b >= lo && b <= hi)
+			pattern = pattern[3:]
+		default:
+			matched = matched || pattern[0] == b
+			pattern = pattern[1:]
+		}
+	}
+	if len(pattern) > 0 {
+		pattern = pattern[1:]
+	}
+	return pattern, matched != not
+}
@@ -0,0 +1,514 @@
+// Package redistest implements an in-memory redis server, for testing code
+// which talks to redis without needing a real redis server to be running.
+//
+// The Server speaks RESP2 and implements a subset of the redis commands which
+// is useful for most tests: strings, hashes, lists, sets, sorted sets, key
+// expiry, MULTI/EXEC with WATCH, pub/sub, SCAN and friends, and stubs for
+// EVAL/EVALSHA whose scripts are implemented in go (see Server.Script).
+// Commands which aren't implemented result in an "unknown command" error.
+//
+// A Server listens on a random port on the loopback interface, so it can be
+// used with anything that connects to an address:
+//
+//	s, err := redistest.NewServer()
+//	if err != nil {
+//		// handle err
+//	}
+//	defer s.Close()
+//
+//	p, err := pool.New("tcp", s.Addr(), 10)
+//
+// Connections can also be made without going through the network, using
+// net.Pipe, see Client, Conn and DialFunc. NewPipeServer returns a Server
+// which doesn't listen at all.
+//
+// Time
+//
+// Expiry is computed using the Server's own clock, which follows the real one
+// but can be moved forward using FastForward, so that tests don't have to
+// sleep for keys to expire:
+//
+//	s.Cmd("SET", "foo", "bar", "EX", 10)
+//	s.FastForward(11 * time.Second)
+//	s.Cmd("GET", "foo") // nil
+//
+// Faults
+//
+// Errors, latency and dropped connections can be injected into the handling
+// of commands using Inject, to test how code copes with a misbehaving server:
+//
+//	s.Inject(redistest.Fault{Cmd: "GET", Err: errors.New("LOADING loading")})
+//	s.Inject(redistest.Fault{Cmd: "SET", Latency: time.Second, Times: 1})
+//
+package redistest
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gallir/radix.improved/redis"
+)
+
+// The number of replies and messages which may be queued on a connection
+// before it's written to. A connection which falls further behind than this
+// on pub/sub messages is closed, as redis does when the client output buffer
+// limit is reached.
+const outBufferSize = 1024
+
+// The number of databases which can be SELECTed
+const numDBs = 16
+
+// Fault describes a misbehaviour of the Server when handling a command, see
+// Server.Inject
+type Fault struct {
+	// The name of the command the Fault applies to, case insensitive. If empty
+	// it applies to every command.
+	Cmd string
+
+	// The time waited before the command is handled. This is applied before
+	// Err and Close.
+	Latency time.Duration
+
+	// If set the error is replied instead of the command being performed. The
+	// error is sent as it is formatted, e.g. "MOVED 3999 127.0.0.1:7001", so
+	// *redis.Error can be used as well.
+	Err error
+
+	// If set the connection is closed instead of the command being performed
+	Close bool
+
+	// The number of commands the Fault applies to, after which it's removed.
+	// If zero it applies until ClearFaults is called.
+	Times int
+}
+
+// ScriptFunc is a go implementation of a lua script, see Server.Script. It's
+// given the keys and args passed into EVAL or EVALSHA, and a call function
+// which performs a command on the same database the script is run on, like
+// redis.call. Its return value is converted into a reply using redis.NewResp,
+// so it may be a *redis.Resp, an error, nil, etc...
+//
+// Scripts are run atomically, nothing else can happen on the Server while
+// they are. call must not be used after the script has returned.
+type ScriptFunc func(call func(cmd string, args ...interface{}) *redis.Resp, keys, args []string) interface{}
+
+// Server is an in-memory redis server. All of its methods are safe to call
+// concurrently.
+type Server struct {
+	l  net.Listener
+	wg sync.WaitGroup
+
+	// mu protects everything below it, commands are performed while holding
+	// it so they are all atomic
+	mu       sync.Mutex
+	dbs      [numDBs]*db
+	offset   time.Duration
+	version  uint64
+	password string
+	faults   []*Fault
+	scripts  map[string]string
+	funcs    map[string]ScriptFunc
+	conns    map[*conn]bool
+	channels map[string]map[*conn]bool
+	patterns map[string]map[*conn]bool
+	closed   bool
+
+	// local is used by Cmd
+	local *conn
+}
+
+// NewPipeServer returns a Server which doesn't listen on any address.
+// Connections to it can only be made using Client, Conn or DialFunc.
+func NewPipeServer() *Server {
+	s := &Server{
+		scripts:  map[string]string{},
+		funcs:    map[string]ScriptFunc{},
+		conns:    map[*conn]bool{},
+		channels: map[string]map[*conn]bool{},
+		patterns: map[string]map[*conn]bool{},
+	}
+	for i := range s.dbs {
+		s.dbs[i] = newDB(s)
+	}
+	s.local = &conn{s: s}
+	return s
+}
+
+// NewServer returns a Server listening on a random port on the loopback
+// interface, see Addr
+func NewServer() (*Server, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := NewPipeServer()
+	s.l = l
+	s.wg.Add(1)
+	go s.acceptLoop()
+	return s, nil
+}
+
+// Addr returns the address the Server is listening on, or an empty string if
+// it was created using NewPipeServer
+func (s *Server) Addr() string {
+	if s.l == nil {
+		return ""
+	}
+	return s.l.Addr().String()
+}
+
+func (s *Server) acceptLoop() {
+	defer s.wg.Done()
+	for {
+		nc, err := s.l.Accept()
+		if err != nil {
+			return
+		}
+		s.serve(nc)
+	}
+}
+
+// Conn returns a connection to the Server made using net.Pipe
+func (s *Server) Conn() net.Conn {
+	cc, sc := net.Pipe()
+	s.serve(sc)
+	return cc
+}
+
+// Client returns a Client connected to the Server using net.Pipe
+func (s *Server) Client() *redis.Client {
+	return redis.NewClient(s.Conn())
+}
+
+// DialFunc returns a function which makes connections to the Server using
+// net.Pipe, whatever network and address it's given. It can be used with
+// pool.NewCustom, or anywhere else a Client is dialed.
+func (s *Server) DialFunc() func(network, addr string) (*redis.Client, error) {
+	return func(network, addr string) (*redis.Client, error) {
+		s.mu.Lock()
+		closed := s.closed
+		s.mu.Unlock()
+		if closed {
+			return nil, errors.New("redistest: server closed")
+		}
+		return s.Client(), nil
+	}
+}
+
+// Close stops the Server from listening and closes all of its connections
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	conns := make([]*conn, 0, len(s.conns))
+	for c := range s.conns {
+		conns = append(conns, c)
+	}
+	s.mu.Unlock()
+
+	var err error
+	if s.l != nil {
+		err = s.l.Close()
+	}
+	for _, c := range conns {
+		c.close()
+	}
+	s.wg.Wait()
+	return err
+}
+
+// Cmd performs the command directly on the Server's first database, without
+// going through a connection, and returns its reply. Faults aren't applied to
+// it. This is useful for setting up and checking the Server's data from
+// within tests, and makes the Server a util.Cmder.
+func (s *Server) Cmd(cmd string, args ...interface{}) *redis.Resp {
+	sargs, err := redis.NewRespFlattenedStrings(args).List()
+	if err != nil {
+		return redis.NewResp(err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.local.selected = 0
+	return s.local.call(strings.ToUpper(cmd), append([]string{cmd}, sargs...))
+}
+
+// FastForward moves the Server's clock forward by the given duration, which
+// expires any keys whose time to live is shorter than it
+func (s *Server) FastForward(d time.Duration) {
+	s.mu.Lock()
+	s.offset += d
+	s.mu.Unlock()
+}
+
+// now returns the current time according to the Server's clock, and must be
+// called with mu held
+func (s *Server) now() time.Time {
+	return time.Now().Add(s.offset)
+}
+
+// RequirePass makes the Server require connections to AUTH with the given
+// password before performing any other command. An empty password disables
+// this again.
+func (s *Server) RequirePass(password string) {
+	s.mu.Lock()
+	s.password = password
+	s.mu.Unlock()
+}
+
+// Inject adds a Fault to the Server. When a command is received the first
+// Fault which applies to it is used, so more specific Faults should be
+// injected first.
+func (s *Server) Inject(f Fault) {
+	f.Cmd = strings.ToUpper(f.Cmd)
+	s.mu.Lock()
+	s.faults = append(s.faults, &f)
+	s.mu.Unlock()
+}
+
+// ClearFaults removes all Faults which were added using Inject
+func (s *Server) ClearFaults() {
+	s.mu.Lock()
+	s.faults = nil
+	s.mu.Unlock()
+}
+
+// fault returns the Fault which applies to the given command, if any
+func (s *Server) fault(cmd string) (Fault, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, f := range s.faults {
+		if f.Cmd != "" && f.Cmd != cmd {
+			continue
+		}
+		if f.Times > 0 {
+			if f.Times--; f.Times == 0 {
+				s.faults = append(s.faults[:i:i], s.faults[i+1:]...)
+			}
+		}
+		return *f, true
+	}
+	return Fault{}, false
+}
+
+// Script registers a go implementation of the given lua script. EVAL and
+// EVALSHA with the script, or its sha1 sum, call fn instead of running the
+// script, which the Server doesn't know how to do. EVAL with any script which
+// wasn't registered results in an error.
+//
+//	s.Script(`return redis.call('GET', KEYS[1])`,
+//		func(call func(string, ...interface{}) *redis.Resp, keys, args []string) interface{} {
+//			return call("GET", keys[0])
+//		})
+//
+func (s *Server) Script(script string, fn ScriptFunc) {
+	s.mu.Lock()
+	s.funcs[script] = fn
+	s.mu.Unlock()
+}
+
+func (s *Server) serve(nc net.Conn) {
+	c := &conn{
+		s:    s,
+		nc:   nc,
+		out:  make(chan *redis.Resp, outBufferSize),
+		done: make(chan struct{}),
+		quit: make(chan struct{}),
+	}
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		nc.Close()
+		return
+	}
+	s.conns[c] = true
+	s.mu.Unlock()
+
+	s.wg.Add(2)
+	go c.readLoop()
+	go c.writeLoop()
+}
+
+// conn is a single connection to the Server, along with its state
+type conn struct {
+	s    *Server
+	nc   net.Conn
+	out  chan *redis.Resp
+	done chan struct{}
+
+	// quit is closed once readLoop is done, so that writeLoop closes the
+	// connection after writing the replies which have been queued
+	quit chan struct{}
+	once sync.Once
+
+	// Everything below is protected by the Server's mu
+	selected int
+	authed   bool
+	name     string
+	multi    bool
+	multiErr bool
+	queued   [][]string
+	watched  map[watchKey]uint64
+	channels map[string]bool
+	patterns map[string]bool
+
+	// replies are the replies to the command currently being performed, when
+	// there are multiple of them
+	replies []*redis.Resp
+}
+
+type watchKey struct {
+	db  int
+	key string
+}
+
+func (c *conn) close() {
+	c.once.Do(func() {
+		close(c.done)
+		c.nc.Close()
+		c.s.mu.Lock()
+		c.unsubscribeAll()
+		delete(c.s.conns, c)
+		c.s.mu.Unlock()
+	})
+}
+
+func (c *conn) readLoop() {
+	defer c.s.wg.Done()
+	defer close(c.quit)
+
+	rr := redis.NewRespReader(c.nc)
+	for {
+		r := rr.Read()
+		if r.IsType(redis.IOErr) {
+			if !isClosed(r.Err) {
+				c.send(redis.NewResp(errors.New("ERR Protocol error: " + r.Err.Error())))
+			}
+			return
+		}
+
+		args, err := r.List()
+		if err != nil || len(args) == 0 {
+			c.send(redis.NewResp(errors.New("ERR Protocol error: expected an array of bulk strings")))
+			return
+		}
+
+		if !c.handle(args) {
+			return
+		}
+	}
+}
+
+func isClosed(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrClosedPipe) ||
+		errors.Is(err, net.ErrClosed)
+}
+
+// handle performs a single command received on the connection and sends its
+// replies. It returns false if the connection should be closed.
+func (c *conn) handle(args []string) bool {
+	cmd := strings.ToUpper(args[0])
+	if f, ok := c.s.fault(cmd); ok {
+		if f.Latency > 0 {
+			select {
+			case <-time.After(f.Latency):
+			case <-c.done:
+				return false
+			}
+		}
+		if f.Close {
+			return false
+		} else if f.Err != nil {
+			return c.send(redis.NewResp(f.Err))
+		}
+	}
+
+	c.s.mu.Lock()
+	r := c.call(cmd, args)
+	replies := c.replies
+	c.replies = nil
+	c.s.mu.Unlock()
+
+	for _, rr := range replies {
+		if !c.send(rr) {
+			return false
+		}
+	}
+	if r == nil {
+		return true
+	} else if cmd == "QUIT" {
+		c.send(r)
+		return false
+	}
+	return c.send(r)
+}
+
+// send queues the reply to be written to the connection, blocking if the
+// queue is full. It returns false if the connection is closed.
+func (c *conn) send(r *redis.Resp) bool {
+	select {
+	case c.out <- r:
+		return true
+	case <-c.done:
+		return false
+	}
+}
+
+// push queues a pub/sub message to be written to the connection without
+// blocking, closing the connection if it's too far behind. It's called with
+// the Server's mu held.
+func (c *conn) push(r *redis.Resp) {
+	select {
+	case c.out <- r:
+	case <-c.done:
+	default:
+		go c.close()
+	}
+}
+
+func (c *conn) writeLoop() {
+	defer c.s.wg.Done()
+	defer c.close()
+
+	bw := bufio.NewWriter(c.nc)
+	for {
+		select {
+		case r := <-c.out:
+			if _, err := r.WriteTo(bw); err != nil {
+				return
+			}
+			// Flush once there's nothing else to write, so that pipelined
+			// replies are written together
+			if len(c.out) == 0 {
+				if err := bw.Flush(); err != nil {
+					return
+				}
+			}
+		case <-c.quit:
+			c.drain(bw)
+			return
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// drain writes and flushes whatever replies are left in the queue, e.g. the
+// reply to QUIT or to a protocol error
+func (c *conn) drain(bw *bufio.Writer) {
+	for {
+		select {
+		case r := <-c.out:
+			if _, err := r.WriteTo(bw); err != nil {
+				return
+			}
+		default:
+			bw.Flush()
+			return
+		}
+	}
+}
@@ -0,0 +1,332 @@
+package redistest
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"strconv"
+	. "testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/gallir/radix.improved/pool"
+	"github.com/gallir/radix.improved/pubsub"
+	"github.com/gallir/radix.improved/redis"
+	"github.com/gallir/radix.improved/util"
+)
+
+func testServer(t *T) (*Server, *redis.Client) {
+	s, err := NewServer()
+	require.Nil(t, err)
+	t.Cleanup(func() { s.Close() })
+	c, err := redis.Dial("tcp", s.Addr())
+	require.Nil(t, err)
+	t.Cleanup(func() { c.Close() })
+	return s, c
+}
+
+func TestStrings(t *T) {
+	_, c := testServer(t)
+
+	assert.Equal(t, "PONG", mustStr(t, c.Cmd("PING")))
+	require.Nil(t, c.Cmd("SET", "foo", "bar").Err)
+	assert.Equal(t, "bar", mustStr(t, c.Cmd("GET", "foo")))
+	assert.True(t, c.Cmd("GET", "nope").IsType(redis.Nil))
+	assert.True(t, c.Cmd("SET", "foo", "baz", "NX").IsType(redis.Nil))
+	assert.Equal(t, "bar", mustStr(t, c.Cmd("SET", "foo", "baz", "GET")))
+
+	n, err := c.Cmd("INCRBY", "n", 5).Int()
+	require.Nil(t, err)
+	assert.Equal(t, 5, n)
+	assert.True(t, errors.Is(c.Cmd("INCR", "foo").Err, &redis.Error{Code: "ERR"}))
+
+	require.Nil(t, c.Cmd("MSET", "a", 1, "b", 2).Err)
+	l, err := c.Cmd("MGET", "a", "nope", "b").ListBytes()
+	require.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("1"), nil, []byte("2")}, l)
+
+	require.Nil(t, c.Cmd("HSET", "h", "f", "v").Err)
+	assert.True(t, errors.Is(c.Cmd("GET", "h").Err, redis.ErrWrongType))
+	assert.True(t, errors.Is(c.Cmd("NOPE").Err, &redis.Error{Code: "ERR"}))
+	assert.True(t, errors.Is(c.Cmd("GET").Err, &redis.Error{Code: "ERR"}))
+}
+
+func TestCollections(t *T) {
+	_, c := testServer(t)
+
+	require.Nil(t, c.Cmd("HMSET", "h", map[string]string{"a": "1", "b": "2"}).Err)
+	m, err := c.Cmd("HGETALL", "h").Map()
+	require.Nil(t, err)
+	assert.Equal(t, map[string]string{"a": "1", "b": "2"}, m)
+	assert.Equal(t, 1, mustInt(t, c.Cmd("HDEL", "h", "a", "c")))
+
+	require.Nil(t, c.Cmd("RPUSH", "l", "b", "c").Err)
+	require.Nil(t, c.Cmd("LPUSH", "l", "a").Err)
+	assert.Equal(t, []string{"a", "b", "c"}, mustList(t, c.Cmd("LRANGE", "l", 0, -1)))
+	assert.Equal(t, "c", mustStr(t, c.Cmd("RPOP", "l")))
+	require.Nil(t, c.Cmd("LTRIM", "l", 1, 1).Err)
+	assert.Equal(t, []string{"b"}, mustList(t, c.Cmd("LRANGE", "l", 0, -1)))
+
+	require.Nil(t, c.Cmd("SADD", "s1", "a", "b", "c").Err)
+	require.Nil(t, c.Cmd("SADD", "s2", "b", "c", "d").Err)
+	assert.Equal(t, []string{"b", "c"}, mustList(t, c.Cmd("SINTER", "s1", "s2")))
+	assert.Equal(t, []string{"a"}, mustList(t, c.Cmd("SDIFF", "s1", "s2")))
+	assert.Equal(t, 4, len(mustList(t, c.Cmd("SUNION", "s1", "s2"))))
+
+	require.Nil(t, c.Cmd("ZADD", "z", 2, "b", 1, "a", 3, "c").Err)
+	assert.Equal(t, []string{"a", "1", "b", "2"}, mustList(t, c.Cmd("ZRANGE", "z", 0, 1, "WITHSCORES")))
+	assert.Equal(t, []string{"c", "b", "a"}, mustList(t, c.Cmd("ZREVRANGE", "z", 0, -1)))
+	assert.Equal(t, []string{"b", "c"}, mustList(t, c.Cmd("ZRANGEBYSCORE", "z", "(1", "+inf")))
+	assert.Equal(t, "4.5", mustStr(t, c.Cmd("ZINCRBY", "z", 1.5, "c")))
+	assert.Equal(t, 2, mustInt(t, c.Cmd("ZRANK", "z", "c")))
+
+	// Collections are removed once they're empty
+	require.Nil(t, c.Cmd("SREM", "s1", "a", "b", "c").Err)
+	assert.Equal(t, 0, mustInt(t, c.Cmd("EXISTS", "s1")))
+}
+
+func TestExpiry(t *T) {
+	s, c := testServer(t)
+
+	require.Nil(t, c.Cmd("SET", "foo", "bar", "EX", 10).Err)
+	assert.Equal(t, 10, mustInt(t, c.Cmd("TTL", "foo")))
+	s.FastForward(5 * time.Second)
+	assert.Equal(t, 5, mustInt(t, c.Cmd("TTL", "foo")))
+	s.FastForward(5 * time.Second)
+	assert.True(t, c.Cmd("GET", "foo").IsType(redis.Nil))
+	assert.Equal(t, -2, mustInt(t, c.Cmd("TTL", "foo")))
+
+	require.Nil(t, c.Cmd("SET", "foo", "bar").Err)
+	assert.Equal(t, -1, mustInt(t, c.Cmd("TTL", "foo")))
+	assert.Equal(t, 1, mustInt(t, c.Cmd("PEXPIRE", "foo", 100)))
+	assert.Equal(t, 1, mustInt(t, c.Cmd("PERSIST", "foo")))
+	s.FastForward(time.Second)
+	assert.Equal(t, "bar", mustStr(t, s.Cmd("GET", "foo")))
+}
+
+func TestTransaction(t *T) {
+	s := NewPipeServer()
+	defer s.Close()
+	p, err := pool.NewCustom("tcp", "", 2, s.DialFunc())
+	require.Nil(t, err)
+	defer p.Empty()
+
+	require.Nil(t, p.Cmd("SET", "counter", 1).Err)
+	var attempts int
+	rr, err := util.Transaction(p, []string{"counter"}, func(tx *util.Tx) error {
+		n, err := tx.Cmd("GET", "counter").Int()
+		if err != nil {
+			return err
+		}
+		// Modify the watched key behind the transaction's back, the first
+		// time only, so that it's aborted once
+		if attempts++; attempts == 1 {
+			s.Cmd("SET", "counter", n+10)
+		}
+		tx.Queue("SET", "counter", n+1)
+		return nil
+	})
+	require.Nil(t, err)
+	assert.Len(t, rr, 1)
+	assert.Equal(t, 2, attempts)
+	assert.Equal(t, 12, mustInt(t, p.Cmd("GET", "counter")))
+
+	c := s.Client()
+	defer c.Close()
+	require.Nil(t, c.Cmd("MULTI").Err)
+	assert.Equal(t, "QUEUED", mustStr(t, c.Cmd("INCR", "counter")))
+	assert.NotNil(t, c.Cmd("NOPE").Err)
+	assert.True(t, errors.Is(c.Cmd("EXEC").Err, &redis.Error{Code: "EXECABORT"}))
+	assert.Equal(t, 12, mustInt(t, c.Cmd("GET", "counter")))
+}
+
+func TestPubSub(t *T) {
+	s := NewPipeServer()
+	defer s.Close()
+	pub := s.Client()
+	defer pub.Close()
+	sub := pubsub.NewSubClient(s.Client())
+
+	sr := sub.Subscribe("foo")
+	require.Nil(t, sr.Err)
+	assert.Equal(t, 1, sr.SubCount)
+	sr = sub.PSubscribe("ba[rz]*")
+	require.Nil(t, sr.Err)
+	assert.Equal(t, 2, sr.SubCount)
+	assert.True(t, errors.Is(sub.Client.Cmd("GET", "foo").Err, &redis.Error{Code: "ERR"}))
+
+	assert.Equal(t, 1, mustInt(t, pub.Cmd("PUBLISH", "foo", "hi")))
+	assert.Equal(t, 1, mustInt(t, pub.Cmd("PUBLISH", "bazooka", "ho")))
+	assert.Equal(t, 0, mustInt(t, pub.Cmd("PUBLISH", "bat", "no")))
+
+	sr = sub.Receive()
+	require.Nil(t, sr.Err)
+	assert.Equal(t, "foo", sr.Channel)
+	assert.Equal(t, "hi", sr.Message)
+	sr = sub.Receive()
+	require.Nil(t, sr.Err)
+	assert.Equal(t, "ba[rz]*", sr.Pattern)
+	assert.Equal(t, "bazooka", sr.Channel)
+	assert.Equal(t, "ho", sr.Message)
+
+	assert.Equal(t, pubsub.Pong, sub.Ping().Type)
+	sr = sub.Unsubscribe("foo")
+	require.Nil(t, sr.Err)
+	assert.Equal(t, 1, sr.SubCount)
+}
+
+func TestScan(t *T) {
+	s := NewPipeServer()
+	defer s.Close()
+	c := s.Client()
+	defer c.Close()
+
+	var want []string
+	for i := 0; i < 35; i++ {
+		key := "key:" + strconv.Itoa(i)
+		want = append(want, key)
+		require.Nil(t, c.Cmd("SET", key, i).Err)
+	}
+	require.Nil(t, c.Cmd("SADD", "set", "a").Err)
+
+	var got []string
+	sc := util.NewScanner(c, util.ScanOpts{Command: "SCAN", Pattern: "key:*"})
+	for sc.HasNext() {
+		got = append(got, sc.Next())
+	}
+	require.Nil(t, sc.Err())
+	sort.Strings(want)
+	assert.Equal(t, want, got)
+
+	r, err := c.Cmd("SCAN", 0, "COUNT", 100, "TYPE", "set").Array()
+	require.Nil(t, err)
+	assert.Equal(t, "0", mustStr(t, r[0]))
+	assert.Equal(t, []string{"set"}, mustList(t, r[1]))
+}
+
+func TestScripts(t *T) {
+	s := NewPipeServer()
+	defer s.Close()
+	c := s.Client()
+	defer c.Close()
+
+	script := `return redis.call('INCRBY', KEYS[1], ARGV[1])`
+	s.Script(script, func(call func(string, ...interface{}) *redis.Resp, keys, args []string) interface{} {
+		return call("INCRBY", keys[0], args[0])
+	})
+
+	assert.True(t, errors.Is(c.Cmd("EVALSHA", scriptSum(script), 1, "n", 2).Err, redis.ErrNoScript))
+	assert.Equal(t, 2, mustInt(t, util.LuaEval(c, script, 1, "n", 2)))
+	assert.Equal(t, 4, mustInt(t, c.Cmd("EVALSHA", scriptSum(script), 1, "n", 2)))
+	assert.NotNil(t, c.Cmd("EVAL", "return 1", 0).Err)
+}
+
+func TestFaults(t *T) {
+	s, c := testServer(t)
+
+	s.Inject(Fault{Cmd: "get", Err: &redis.Error{Code: "LOADING", Msg: "loading"}, Times: 1})
+	assert.True(t, errors.Is(c.Cmd("GET", "foo").Err, redis.ErrLoading))
+	assert.True(t, c.Cmd("GET", "foo").IsType(redis.Nil))
+
+	s.Inject(Fault{Latency: 50 * time.Millisecond})
+	start := time.Now()
+	require.Nil(t, c.Cmd("PING").Err)
+	assert.True(t, time.Since(start) >= 50*time.Millisecond)
+	s.ClearFaults()
+
+	s.Inject(Fault{Cmd: "SET", Close: true})
+	assert.True(t, c.Cmd("SET", "foo", "bar").IsType(redis.IOErr))
+
+	// Other connections are unaffected
+	c2, err := redis.Dial("tcp", s.Addr())
+	require.Nil(t, err)
+	defer c2.Close()
+	require.Nil(t, c2.Cmd("PING").Err)
+}
+
+func TestQuit(t *T) {
+	s, _ := testServer(t)
+
+	// The reply is written before the connection is closed
+	for i := 0; i < 50; i++ {
+		c, err := redis.Dial("tcp", s.Addr())
+		require.Nil(t, err)
+		s, err := c.Cmd("QUIT").Str()
+		require.Nil(t, err)
+		assert.Equal(t, "OK", s)
+		assert.True(t, c.Cmd("PING").IsType(redis.IOErr))
+		c.Close()
+	}
+
+	// As is the reply to a protocol error
+	nc, err := net.Dial("tcp", s.Addr())
+	require.Nil(t, err)
+	defer nc.Close()
+	_, err = nc.Write([]byte("*1\r\n:1\r\n"))
+	require.Nil(t, err)
+	rr := redis.NewRespReader(nc)
+	r := rr.Read()
+	require.True(t, r.IsType(redis.AppErr), "%v", r)
+	assert.Contains(t, r.Err.Error(), "Protocol error")
+	assert.True(t, rr.Read().IsType(redis.IOErr))
+}
+
+func TestAuth(t *T) {
+	s := NewPipeServer()
+	defer s.Close()
+	s.RequirePass("secret")
+
+	c := s.Client()
+	defer c.Close()
+	assert.True(t, errors.Is(c.Cmd("GET", "foo").Err, redis.ErrNoAuth))
+	assert.NotNil(t, c.Cmd("AUTH", "wrong").Err)
+	require.Nil(t, c.Cmd("AUTH", "secret").Err)
+	require.Nil(t, c.Cmd("GET", "foo").Err)
+
+	c2, err := redis.NewClientWithOpts(s.Conn(), redis.DialOpts{Password: "secret", DB: 3})
+	require.Nil(t, err)
+	defer c2.Close()
+	require.Nil(t, c2.Cmd("SET", "foo", "bar").Err)
+	assert.True(t, c.Cmd("GET", "foo").IsType(redis.Nil))
+}
+
+func TestMatch(t *T) {
+	for _, tc := range []struct {
+		pattern, s string
+		match      bool
+	}{
+		{"*", "", true},
+		{"foo*", "foobar", true},
+		{"foo*", "fo", false},
+		{"f?o", "foo", true},
+		{"*bar", "foobar", true},
+		{"*bar", "barfoo", false},
+		{"h[ae]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-b]llo", "hbllo", true},
+		{"h\\*llo", "h*llo", true},
+		{"h\\*llo", "hello", false},
+	} {
+		assert.Equal(t, tc.match, match(tc.pattern, tc.s), "%q %q", tc.pattern, tc.s)
+	}
+}
+
+func mustStr(t *T, r *redis.Resp) string {
+	s, err := r.Str()
+	require.Nil(t, err)
+	return s
+}
+
+func mustInt(t *T, r *redis.Resp) int {
+	i, err := r.Int()
+	require.Nil(t, err)
+	return i
+}
+
+func mustList(t *T, r *redis.Resp) []string {
+	l, err := r.List()
+	require.Nil(t, err)
+	return l
+}
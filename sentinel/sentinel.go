@@ -50,6 +50,7 @@
 package sentinel
 
 import (
+	"context"
 	"errors"
 	"strings"
 
@@ -82,6 +83,7 @@ type getReqRet struct {
 }
 
 type getReq struct {
+	ctx   context.Context
 	name  string
 	retCh chan *getReqRet
 }
@@ -115,6 +117,9 @@ type Client struct {
 	alwaysErr      *ClientError
 	alwaysErrCh    chan *ClientError
 	switchMasterCh chan *switchMaster
+
+	hooks     []redis.Hook
+	addHookCh chan redis.Hook
 }
 
 // DialFunc is a function which can be passed into NewClientCustom
@@ -134,17 +139,52 @@ func NewClient(
 }
 
 // NewClientCustom is the same as NewClient, except it takes in a DialFunc which
-// will be used to create all new connections to the master instances. This can
-// be used to implement authentication, custom timeouts, etc...
+// will be used to create all new connections, both to the sentinel instance and
+// to the master instances. This can be used to implement authentication, custom
+// timeouts, etc... Use NewClientWithOpts if the sentinel and the masters need
+// to be connected to differently.
 func NewClientCustom(
 	network, address string, poolSize int, df DialFunc, names ...string,
 ) (
 	*Client, error,
 ) {
+	return newClient(network, address, poolSize, df, df, names...)
+}
+
+// Opts are options which can be passed into NewClientWithOpts
+type Opts struct {
+	// Options used to connect to the sentinel instance itself
+	SentinelDialOpts redis.DialOpts
+
+	// Options used to connect to the master instances, including any master
+	// which sentinel fails over to
+	DialOpts redis.DialOpts
+}
+
+// NewClientWithOpts is the same as NewClient, except connections to the
+// sentinel instance and to the master instances are made using
+// redis.DialWithOpts with the respective DialOpts in the given Opts
+func NewClientWithOpts(
+	network, address string, poolSize int, o Opts, names ...string,
+) (
+	*Client, error,
+) {
+	return newClient(
+		network, address, poolSize,
+		o.SentinelDialOpts.DialFunc(), o.DialOpts.DialFunc(), names...,
+	)
+}
+
+func newClient(
+	network, address string, poolSize int, sentinelDF, df DialFunc,
+	names ...string,
+) (
+	*Client, error,
+) {
 
 	// We use this to fetch initial details about masters before we upgrade it
 	// to a pubsub client
-	client, err := redis.Dial(network, address)
+	client, err := sentinelDF(network, address)
 	if err != nil {
 		return nil, &ClientError{err: err}
 	}
@@ -180,6 +220,7 @@ func NewClientCustom(
 		closeCh:        make(chan struct{}),
 		alwaysErrCh:    make(chan *ClientError),
 		switchMasterCh: make(chan *switchMaster),
+		addHookCh:      make(chan redis.Hook),
 	}
 
 	go c.subSpin()
@@ -234,7 +275,7 @@ func (c *Client) spin() {
 				req.retCh <- &getReqRet{nil, &ClientError{err: err}}
 				continue
 			}
-			conn, err := pool.Get()
+			conn, err := pool.GetContext(req.ctx)
 			if err != nil {
 				req.retCh <- &getReqRet{nil, &ClientError{err: err}}
 				continue
@@ -253,9 +294,18 @@ func (c *Client) spin() {
 			if p, ok := c.masterPools[sm.name]; ok {
 				p.Empty()
 				p, _ = pool.NewCustom("tcp", sm.addr, c.poolSize, c.dialFunc)
+				for _, h := range c.hooks {
+					p.AddHook(h)
+				}
 				c.masterPools[sm.name] = p
 			}
 
+		case h := <-c.addHookCh:
+			c.hooks = append(c.hooks, h)
+			for _, p := range c.masterPools {
+				p.AddHook(h)
+			}
+
 		case <-c.closeCh:
 			for name := range c.masterPools {
 				c.masterPools[name].Empty()
@@ -272,13 +322,47 @@ func (c *Client) spin() {
 // sentinel has become unreachable this will always return an error. Close
 // should be called in that case. The returned error is a *ClientError.
 func (c *Client) GetMaster(name string) (*redis.Client, error) {
-	req := getReq{name, make(chan *getReqRet)}
-	c.getCh <- &req
-	ret := <-req.retCh
-	if ret.err != nil {
-		return nil, ret.err
+	return c.GetMasterContext(context.Background(), name)
+}
+
+// GetMasterContext is like GetMaster, but gives up and returns the context's
+// error, wrapped in a *ClientError, if the context is cancelled or its deadline
+// passes before a connection is available.
+func (c *Client) GetMasterContext(
+	ctx context.Context, name string,
+) (
+	*redis.Client, error,
+) {
+	// retCh is buffered so that the spin routine doesn't block if we've given
+	// up on the request by the time it's answered
+	req := getReq{ctx, name, make(chan *getReqRet, 1)}
+	select {
+	case c.getCh <- &req:
+	case <-ctx.Done():
+		return nil, &ClientError{err: ctx.Err()}
 	}
-	return ret.conn, nil
+
+	select {
+	case ret := <-req.retCh:
+		if ret.err != nil {
+			return nil, ret.err
+		}
+		return ret.conn, nil
+	case <-ctx.Done():
+		go func() {
+			if ret := <-req.retCh; ret.err == nil {
+				c.PutMaster(name, ret.conn)
+			}
+		}()
+		return nil, &ClientError{err: ctx.Err()}
+	}
+}
+
+// AddHook adds a Hook which is called around every command performed by the
+// connections to the masters, including the masters sentinel fails over to,
+// see redis.Hook and pool.Pool's AddHook
+func (c *Client) AddHook(h redis.Hook) {
+	c.addHookCh <- h
 }
 
 // PutMaster return a connection for a master of a given name
@@ -0,0 +1,134 @@
+package util
+
+import (
+	"strings"
+
+	"github.com/gallir/radix.improved/redis"
+)
+
+// EncryptedCmder wraps a Cmder, transparently encrypting the values written by
+// string and hash commands using an Envelope, and decrypting them out of the
+// replies of the commands which read them. Each value is bound to the key it's
+// written to, see redis.Envelope.
+//
+// The commands which are handled are:
+//
+//	SET, SETNX, SETEX, PSETEX, GETSET, MSET, MSETNX
+//	GET, GETDEL, GETEX, MGET
+//	HSET, HSETNX, HMSET
+//	HGET, HMGET, HGETALL, HVALS
+//
+// Every other command is passed through as is. APPEND, SETRANGE, GETRANGE,
+// INCR and the like can't work on encrypted values, and mustn't be used on
+// keys which hold them. Values within a hash are bound to the hash's key but
+// not to their field, so a value could be moved from one field of a hash to
+// another without being detected.
+//
+//	e, err := redis.NewEnvelope([]byte("\x00enc:"), key)
+//	if err != nil {
+//		// handle err
+//	}
+//	ec := util.NewEncryptedCmder(p, e)
+//	ec.Cmd("SET", "user:1:ssn", "078-05-1120")
+//	ssn, err := ec.Cmd("GET", "user:1:ssn").Str()
+//
+type EncryptedCmder struct {
+	Cmder
+	Envelope *redis.Envelope
+}
+
+// NewEncryptedCmder returns an EncryptedCmder which wraps the given Cmder
+func NewEncryptedCmder(c Cmder, e *redis.Envelope) *EncryptedCmder {
+	return &EncryptedCmder{Cmder: c, Envelope: e}
+}
+
+// Cmd performs the command on the wrapped Cmder, encrypting and decrypting
+// values as described on EncryptedCmder. Values which weren't encrypted (e.g.
+// because they were written before encryption was introduced) are returned as
+// they are. A value which can't be decrypted results in an AppErr.
+func (ec *EncryptedCmder) Cmd(cmd string, args ...interface{}) *redis.Resp {
+	ucmd := strings.ToUpper(cmd)
+	va, ok := redis.CommandValueArgs[ucmd]
+	if !ok {
+		return ec.decrypt(ucmd, args, ec.Cmder.Cmd(cmd, args...))
+	}
+
+	flat, err := redis.NewRespFlattenedStrings(args).ListBytes()
+	if err != nil {
+		return redis.NewResp(err)
+	}
+	eargs := make([]interface{}, len(flat))
+	for i := range flat {
+		eargs[i] = flat[i]
+	}
+	for i := va.First; i < len(flat); i += va.Step {
+		key := string(flat[0])
+		if va.KeyBefore {
+			key = string(flat[i-1])
+		}
+		if eargs[i], err = ec.Envelope.Seal(nil, flat[i], key); err != nil {
+			return redis.NewResp(err)
+		}
+		if va.Step == 0 {
+			break
+		}
+	}
+	return ec.decrypt(ucmd, eargs, ec.Cmder.Cmd(cmd, eargs...))
+}
+
+// decrypt decrypts the values in the reply to the given command, if the
+// command is one which returns values
+func (ec *EncryptedCmder) decrypt(ucmd string, args []interface{}, r *redis.Resp) *redis.Resp {
+	if r.Err != nil {
+		return r
+	}
+
+	var err error
+	switch ucmd {
+	case "GET", "GETDEL", "GETEX", "GETSET", "SET", "HGET", "HMGET", "HVALS":
+		// SET only returns a value, the previous one, if given the GET option
+		var key string
+		if key, err = redis.KeyFromArgs(args...); err != nil {
+			return redis.NewResp(err)
+		}
+		err = r.Decrypt(ec.Envelope, key)
+
+	case "MGET":
+		var keys []string
+		if keys, err = redis.NewRespFlattenedStrings(args).List(); err != nil {
+			return redis.NewResp(err)
+		}
+		var l []*redis.Resp
+		if l, err = r.Array(); err != nil {
+			return redis.NewResp(err)
+		}
+		for i := range l {
+			if i < len(keys) {
+				if err = l[i].Decrypt(ec.Envelope, keys[i]); err != nil {
+					break
+				}
+			}
+		}
+
+	case "HGETALL":
+		var key string
+		if key, err = redis.KeyFromArgs(args...); err != nil {
+			return redis.NewResp(err)
+		}
+		var l []*redis.Resp
+		if l, err = r.Array(); err != nil {
+			return redis.NewResp(err)
+		}
+		// Fields and values alternate, for both RESP2 Arrays and RESP3 Maps
+		for i := 1; i < len(l); i += 2 {
+			if err = l[i].Decrypt(ec.Envelope, key); err != nil {
+				break
+			}
+		}
+	}
+
+	if err != nil {
+		return redis.NewResp(err)
+	}
+	return r
+}
@@ -0,0 +1,68 @@
+package util
+
+import (
+	"bytes"
+	. "testing"
+
+	"github.com/levenlabs/golib/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/gallir/radix.improved/cluster"
+	"github.com/gallir/radix.improved/pool"
+	"github.com/gallir/radix.improved/redis"
+)
+
+func TestEncryptedCmder(t *T) {
+	k, err := redis.NewAESGCMKey("k1", bytes.Repeat([]byte{1}, 32))
+	require.Nil(t, err)
+	e, err := redis.NewEnvelope([]byte("\x00enc:"), k)
+	require.Nil(t, err)
+
+	p, err := pool.New("tcp", "127.0.0.1:6379", 10)
+	require.Nil(t, err)
+	c, err := cluster.New("127.0.0.1:7000")
+	require.Nil(t, err)
+
+	for _, c := range []Cmder{p, c} {
+		ec := NewEncryptedCmder(c, e)
+		key, key2 := "{"+testutil.RandStr()+"}", "{"+testutil.RandStr()+"}"
+
+		require.Nil(t, ec.Cmd("SET", key, "secret").Err)
+		raw, err := c.Cmd("GET", key).Bytes()
+		require.Nil(t, err)
+		assert.True(t, e.IsSealed(raw))
+		s, err := ec.Cmd("GET", key).Str()
+		require.Nil(t, err)
+		assert.Equal(t, "secret", s)
+
+		// A value copied to another key can't be decrypted from there
+		require.Nil(t, c.Cmd("SET", key2, raw).Err)
+		assert.Equal(t, redis.ErrEnvelopeOpen, ec.Cmd("GET", key2).Err)
+
+		// Values which were never encrypted are returned as they are
+		require.Nil(t, c.Cmd("SET", key2, "plain").Err)
+		s, err = ec.Cmd("GET", key2).Str()
+		require.Nil(t, err)
+		assert.Equal(t, "plain", s)
+
+		hkey := key + "hash"
+		require.Nil(t, ec.Cmd("HSET", hkey, map[string]string{"a": "1", "b": "2"}).Err)
+		raw, err = c.Cmd("HGET", hkey, "b").Bytes()
+		require.Nil(t, err)
+		assert.True(t, e.IsSealed(raw))
+		m, err := ec.Cmd("HGETALL", hkey).Map()
+		require.Nil(t, err)
+		assert.Equal(t, map[string]string{"a": "1", "b": "2"}, m)
+		l, err := ec.Cmd("HMGET", hkey, "a", "b").List()
+		require.Nil(t, err)
+		assert.Equal(t, []string{"1", "2"}, l)
+
+		if _, ok := c.(*pool.Pool); ok {
+			require.Nil(t, ec.Cmd("MSET", key, "x", key2, "y").Err)
+			l, err = ec.Cmd("MGET", key, key2).List()
+			require.Nil(t, err)
+			assert.Equal(t, []string{"x", "y"}, l)
+		}
+	}
+}
@@ -0,0 +1,269 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/gallir/radix.improved/cluster"
+	"github.com/gallir/radix.improved/pool"
+	"github.com/gallir/radix.improved/redis"
+)
+
+// ErrNotExecuted is the error of a Future whose Pipeline hasn't been executed
+// yet
+var ErrNotExecuted = errors.New("pipeline not executed yet")
+
+// Future is returned from Pipeline's Append, and holds the reply to that one
+// command once the Pipeline has been executed. Its methods are the same as
+// Resp's, and apply to that reply.
+type Future struct {
+	cmd  string
+	args []interface{}
+	r    *redis.Resp
+}
+
+// Resp returns the reply to the command. If the Pipeline hasn't been executed
+// yet the Resp's Err is ErrNotExecuted.
+func (f *Future) Resp() *redis.Resp {
+	if f.r == nil {
+		return redis.NewResp(ErrNotExecuted)
+	}
+	return f.r
+}
+
+// Err returns the error of the command, whether it's an application error
+// returned by redis or the network error which kept the command from being
+// performed or its reply from being read
+func (f *Future) Err() error {
+	return f.Resp().Err
+}
+
+// Str is a wrapper around Resp's Str method
+func (f *Future) Str() (string, error) {
+	return f.Resp().Str()
+}
+
+// Bytes is a wrapper around Resp's Bytes method
+func (f *Future) Bytes() ([]byte, error) {
+	return f.Resp().Bytes()
+}
+
+// Int is a wrapper around Resp's Int method
+func (f *Future) Int() (int, error) {
+	return f.Resp().Int()
+}
+
+// Int64 is a wrapper around Resp's Int64 method
+func (f *Future) Int64() (int64, error) {
+	return f.Resp().Int64()
+}
+
+// Float64 is a wrapper around Resp's Float64 method
+func (f *Future) Float64() (float64, error) {
+	return f.Resp().Float64()
+}
+
+// Bool is a wrapper around Resp's Bool method
+func (f *Future) Bool() (bool, error) {
+	return f.Resp().Bool()
+}
+
+// Array is a wrapper around Resp's Array method
+func (f *Future) Array() ([]*redis.Resp, error) {
+	return f.Resp().Array()
+}
+
+// List is a wrapper around Resp's List method
+func (f *Future) List() ([]string, error) {
+	return f.Resp().List()
+}
+
+// Map is a wrapper around Resp's Map method
+func (f *Future) Map() (map[string]string, error) {
+	return f.Resp().Map()
+}
+
+// Pipeline collects commands to be sent to redis all at once, and hands out a
+// Future for each which holds its reply once the Pipeline is executed. Unlike
+// with PipeAppend/PipeResp the replies don't have to be read back in order, and
+// each command's Future gets its own outcome, even when the connection fails
+// part way through.
+//
+//	p := util.NewPipeline(c)
+//	set := p.Append("SET", "foo", "bar")
+//	incr := p.Append("INCR", "counter")
+//	if err := p.Exec(); err != nil {
+//		// a connection failed, some commands may not have been performed
+//	}
+//	n, err := incr.Int()
+//
+// The Cmder may be a Client, Pool, or Cluster. With a Client the commands are
+// pipelined on it, which must not have anything pending from PipeAppend. With a
+// Pool they're pipelined on a single connection taken from it. With a Cluster
+// they're grouped by the node which handles their key, and each group is
+// pipelined on a connection to its node, all groups at once. Any other Cmder
+// has the commands performed one after the other using its Cmd method.
+//
+// A Pipeline isn't thread-safe. Once executed it's empty again, and can be
+// reused for another set of commands.
+type Pipeline struct {
+	c    Cmder
+	futs []*Future
+}
+
+// NewPipeline returns an empty Pipeline which executes its commands on the
+// given Cmder
+func NewPipeline(c Cmder) *Pipeline {
+	return &Pipeline{c: c}
+}
+
+// Append adds the given command to the Pipeline, returning the Future which
+// will hold its reply once the Pipeline is executed
+func (p *Pipeline) Append(cmd string, args ...interface{}) *Future {
+	f := &Future{cmd: cmd, args: args}
+	p.futs = append(p.futs, f)
+	return f
+}
+
+// Len returns the number of commands appended since the Pipeline was last
+// executed
+func (p *Pipeline) Len() int {
+	return len(p.futs)
+}
+
+// Exec sends every command appended to the Pipeline and reads their replies
+// into their Futures, then empties the Pipeline.
+//
+// The returned error is the first network error encountered, if any. Every
+// command which was affected by it has it as its Future's error, and may or
+// may not have been performed by redis. Application errors (e.g. WRONGTYPE)
+// only show up in their command's Future and aren't returned.
+func (p *Pipeline) Exec() error {
+	return p.ExecContext(context.Background())
+}
+
+// ExecContext is like Exec, but the Pipeline is abandoned if the given context
+// is cancelled or its deadline passes, in the same way as with the Client's
+// PipeRespContext. Commands whose replies hadn't been read by then get the
+// context's error.
+func (p *Pipeline) ExecContext(ctx context.Context) error {
+	futs := p.futs
+	p.futs = nil
+	if len(futs) == 0 {
+		return nil
+	}
+
+	switch c := p.c.(type) {
+	case *redis.Client:
+		return execClient(ctx, c, futs)
+
+	case *pool.Pool:
+		client, err := c.Get()
+		if err != nil {
+			return failAll(futs, err)
+		}
+		defer c.Put(client)
+		return execClient(ctx, client, futs)
+
+	case *cluster.Cluster:
+		return execCluster(ctx, c, futs)
+
+	default:
+		for i, f := range futs {
+			if err := ctx.Err(); err != nil {
+				return failAll(futs[i:], err)
+			}
+			f.r = c.Cmd(f.cmd, f.args...)
+		}
+		return firstIOErr(futs)
+	}
+}
+
+// execClient pipelines the commands of the given Futures on the Client. Once
+// an IOErr is read the connection is of no more use, so it's given to every
+// Future whose reply hadn't been read yet.
+func execClient(ctx context.Context, c *redis.Client, futs []*Future) error {
+	for _, f := range futs {
+		c.PipeAppend(f.cmd, f.args...)
+	}
+	for i, f := range futs {
+		f.r = c.PipeRespContext(ctx)
+		if f.r.IsType(redis.IOErr) {
+			c.PipeClear()
+			for _, rest := range futs[i+1:] {
+				rest.r = f.r
+			}
+			return f.r.Err
+		}
+	}
+	return nil
+}
+
+// execCluster groups the commands of the given Futures by the node their key
+// belongs to, and pipelines each group on a connection to its node. Commands
+// which get redirected (because the node doesn't handle their slot anymore)
+// are performed again using the Cluster's Cmd, which follows redirects.
+func execCluster(ctx context.Context, c *cluster.Cluster, futs []*Future) error {
+	groups := map[string][]*Future{}
+	for _, f := range futs {
+		key, err := c.KeyForCmd(f.cmd, f.args...)
+		if err != nil {
+			f.r = redis.NewResp(err)
+			continue
+		}
+		addr := c.GetAddrForKey(key)
+		groups[addr] = append(groups[addr], f)
+	}
+
+	var wg sync.WaitGroup
+	for addr, group := range groups {
+		wg.Add(1)
+		go func(addr string, group []*Future) {
+			defer wg.Done()
+			var client *redis.Client
+			var err error
+			if addr == "" {
+				client, err = c.GetForKey("")
+			} else {
+				client, err = c.GetForAddr(addr)
+			}
+			if err != nil {
+				failAll(group, err)
+				return
+			}
+			execClient(ctx, client, group)
+			c.Put(client)
+
+			for _, f := range group {
+				if isRedirect(f.r.Err) {
+					f.r = c.CmdContext(ctx, f.cmd, f.args...)
+				}
+			}
+		}(addr, group)
+	}
+	wg.Wait()
+	return firstIOErr(futs)
+}
+
+func isRedirect(err error) bool {
+	return errors.Is(err, redis.ErrMoved) || errors.Is(err, redis.ErrAsk)
+}
+
+// failAll gives the error to each of the Futures as an IOErr, and returns it
+func failAll(futs []*Future, err error) error {
+	r := redis.NewRespIOErr(err)
+	for _, f := range futs {
+		f.r = r
+	}
+	return err
+}
+
+func firstIOErr(futs []*Future) error {
+	for _, f := range futs {
+		if f.r.IsType(redis.IOErr) {
+			return f.r.Err
+		}
+	}
+	return nil
+}
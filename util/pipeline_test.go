@@ -0,0 +1,106 @@
+package util
+
+import (
+	"context"
+	"strconv"
+	. "testing"
+	"time"
+
+	"github.com/levenlabs/golib/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/gallir/radix.improved/cluster"
+	"github.com/gallir/radix.improved/pool"
+	"github.com/gallir/radix.improved/redis"
+	"github.com/gallir/radix.improved/redistest"
+)
+
+func TestPipelineOffline(t *T) {
+	s := redistest.NewPipeServer()
+	defer s.Close()
+	p, err := pool.NewCustom("tcp", "", 2, s.DialFunc())
+	require.Nil(t, err)
+	defer p.Empty()
+	client := s.Client()
+	defer client.Close()
+
+	for _, c := range []Cmder{client, p, s} {
+		pipe := NewPipeline(c)
+		set := pipe.Append("SET", "foo", "bar")
+		hset := pipe.Append("HSET", "hash", "a", 1)
+		get := pipe.Append("GET", "foo")
+		wrong := pipe.Append("GET", "hash")
+		assert.Equal(t, 4, pipe.Len())
+		assert.Equal(t, ErrNotExecuted, get.Err())
+
+		require.Nil(t, pipe.Exec())
+		assert.Equal(t, 0, pipe.Len())
+		assert.Nil(t, set.Err())
+		assert.Nil(t, hset.Err())
+		str, err := get.Str()
+		require.Nil(t, err)
+		assert.Equal(t, "bar", str)
+		require.NotNil(t, wrong.Err())
+		assert.Contains(t, wrong.Err().Error(), "WRONGTYPE")
+		require.Nil(t, s.Cmd("FLUSHALL").Err)
+	}
+}
+
+func TestPipelineFailure(t *T) {
+	// A real network connection is used so that the commands are all written
+	// before the server gets to them
+	s, err := redistest.NewServer()
+	require.Nil(t, err)
+	defer s.Close()
+	client, err := redis.Dial("tcp", s.Addr())
+	require.Nil(t, err)
+	defer client.Close()
+
+	// The latency gives the reply to SET time to be written before the
+	// connection is closed
+	s.Inject(redistest.Fault{Cmd: "INCR", Latency: 50 * time.Millisecond, Close: true, Times: 1})
+	pipe := NewPipeline(client)
+	set := pipe.Append("SET", "foo", "bar")
+	incr := pipe.Append("INCR", "counter")
+	get := pipe.Append("GET", "foo")
+
+	err = pipe.Exec()
+	require.NotNil(t, err)
+	assert.Nil(t, set.Err())
+	assert.True(t, incr.Resp().IsType(redis.IOErr))
+	assert.True(t, get.Resp().IsType(redis.IOErr))
+	assert.Equal(t, err, get.Err())
+
+	// Nothing is left over on the Client
+	assert.Equal(t, redis.ErrPipelineEmpty, client.PipeResp().Err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	pipe = NewPipeline(s)
+	ping := pipe.Append("PING")
+	assert.Equal(t, context.Canceled, pipe.ExecContext(ctx))
+	assert.Equal(t, context.Canceled, ping.Err())
+}
+
+func TestPipelineCluster(t *T) {
+	c, err := cluster.New("127.0.0.1:7000")
+	require.Nil(t, err)
+	defer c.Close()
+
+	prefix := testutil.RandStr()
+	pipe := NewPipeline(c)
+	futs := make([]*Future, 100)
+	for i := range futs {
+		key := prefix + strconv.Itoa(i)
+		pipe.Append("SET", key, i)
+		futs[i] = pipe.Append("GET", key)
+	}
+	require.Nil(t, pipe.Exec())
+
+	for i, f := range futs {
+		n, err := f.Int()
+		require.Nil(t, err)
+		assert.Equal(t, i, n)
+	}
+}
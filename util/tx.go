@@ -0,0 +1,220 @@
+package util
+
+import (
+	"errors"
+	"math/rand"
+	"time"
+
+	"github.com/gallir/radix.improved/cluster"
+	"github.com/gallir/radix.improved/pool"
+	"github.com/gallir/radix.improved/redis"
+)
+
+var (
+	// ErrTxMaxAttempts is returned from Transaction when every attempt at the
+	// transaction was aborted because one of the watched keys was modified
+	ErrTxMaxAttempts = errors.New("transaction aborted too many times")
+
+	// ErrTxCrossSlot is returned from Transaction when it's given a Cluster
+	// and the watched keys don't all belong to the same slot
+	ErrTxCrossSlot = errors.New("transaction keys must all be in the same slot")
+
+	// ErrTxNoKeys is returned from Transaction when it's not given any keys
+	ErrTxNoKeys = errors.New("transaction needs at least one key to watch")
+
+	// ErrTxUnsupported is returned from Transaction when the given Cmder
+	// can't be pinned to a single connection
+	ErrTxUnsupported = errors.New("transaction needs a Client, Pool or Cluster")
+)
+
+// TxOpts are various parameters which can be passed into TransactionWithOpts.
+// If any are set to their zero value the default value will be used instead
+type TxOpts struct {
+	// The maximum number of times the transaction is attempted before giving
+	// up with ErrTxMaxAttempts. Default is 10
+	MaxAttempts int
+
+	// The time waited after the first aborted attempt. It doubles with every
+	// subsequent aborted attempt, and a random amount of up to the same time
+	// again is added to it. There's no waiting after the last attempt. Default
+	// is 10 milliseconds, a negative value means attempts aren't waited
+	// between at all
+	Backoff time.Duration
+
+	// The maximum time waited between two attempts. Default is one second
+	MaxBackoff time.Duration
+}
+
+type txCmd struct {
+	cmd  string
+	args []interface{}
+}
+
+// Tx is given to the function passed into Transaction, and is used to perform
+// the reads and queue the writes of a single attempt at the transaction
+type Tx struct {
+	client *redis.Client
+	queued []txCmd
+}
+
+// Cmd performs the given command immediately, on the same connection the
+// watched keys were WATCHed on, and returns its reply. This is meant for the
+// reads the queued writes depend on.
+func (tx *Tx) Cmd(cmd string, args ...interface{}) *redis.Resp {
+	return tx.client.Cmd(cmd, args...)
+}
+
+// Queue adds the given command to the ones which will be performed atomically
+// within MULTI/EXEC once the function passed into Transaction returns
+func (tx *Tx) Queue(cmd string, args ...interface{}) {
+	tx.queued = append(tx.queued, txCmd{cmd, args})
+}
+
+// Transaction performs an optimistic transaction using WATCH, MULTI and EXEC.
+// The given keys are WATCHed on a single connection, fn is called to read
+// whatever it needs using Tx.Cmd and to queue its writes using Tx.Queue, and
+// the queued writes are then performed within MULTI/EXEC. If any of the
+// watched keys was modified by someone else in the meantime EXEC does nothing,
+// in which case the whole process, including calling fn, is retried after
+// a backoff.
+//
+// The replies to the queued commands are returned in the order they were
+// queued. Each may still be an application error (e.g. WRONGTYPE), since redis
+// doesn't roll back a transaction when one of its commands fails. If fn
+// returns an error the transaction is abandoned and that error is returned.
+//
+// The Cmder may be a Client, Pool, or Cluster. In the case of a Cluster all of
+// the keys must belong to the same slot (see hash tags in the redis cluster
+// spec), and so must any keys fn uses.
+//
+//	var newVal int
+//	_, err := util.Transaction(c, []string{"counter"}, func(tx *util.Tx) error {
+//		i, err := tx.Cmd("GET", "counter").Int()
+//		if err != nil && err != redis.ErrRespNil {
+//			return err
+//		}
+//		newVal = i * 2
+//		tx.Queue("SET", "counter", newVal)
+//		return nil
+//	})
+//
+func Transaction(
+	c Cmder, keys []string, fn func(tx *Tx) error,
+) (
+	[]*redis.Resp, error,
+) {
+	return TransactionWithOpts(c, TxOpts{}, keys, fn)
+}
+
+// TransactionWithOpts is like Transaction, but with more fine-tuned
+// configuration options. See TxOpts for more available options
+func TransactionWithOpts(
+	c Cmder, o TxOpts, keys []string, fn func(tx *Tx) error,
+) (
+	[]*redis.Resp, error,
+) {
+	if o.MaxAttempts == 0 {
+		o.MaxAttempts = 10
+	}
+	if o.Backoff == 0 {
+		o.Backoff = 10 * time.Millisecond
+	}
+	if o.MaxBackoff == 0 {
+		o.MaxBackoff = time.Second
+	}
+
+	if len(keys) == 0 {
+		return nil, ErrTxNoKeys
+	}
+
+	switch c.(type) {
+	case *cluster.Cluster:
+		slot := cluster.Slot(keys[0])
+		for _, key := range keys[1:] {
+			if cluster.Slot(key) != slot {
+				return nil, ErrTxCrossSlot
+			}
+		}
+	case *pool.Pool, *redis.Client:
+	default:
+		return nil, ErrTxUnsupported
+	}
+
+	var rr []*redis.Resp
+	var txErr error
+	err := withClientForKey(c, keys[0], func(cc Cmder) {
+		client := cc.(*redis.Client)
+		backoff := o.Backoff
+		for i := 0; i < o.MaxAttempts; i++ {
+			var aborted bool
+			rr, aborted, txErr = txAttempt(client, keys, fn)
+			if txErr != nil || !aborted {
+				return
+			}
+
+			if i == o.MaxAttempts-1 || backoff <= 0 {
+				continue
+			}
+			time.Sleep(backoff + time.Duration(rand.Int63n(int64(backoff))))
+			if backoff *= 2; backoff > o.MaxBackoff {
+				backoff = o.MaxBackoff
+			}
+		}
+		rr, txErr = nil, ErrTxMaxAttempts
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rr, txErr
+}
+
+// txAttempt performs a single attempt at a transaction, returning true if EXEC
+// was aborted due to a watched key being modified
+func txAttempt(
+	client *redis.Client, keys []string, fn func(tx *Tx) error,
+) (
+	[]*redis.Resp, bool, error,
+) {
+	if err := client.Cmd("WATCH", keys).Err; err != nil {
+		return nil, false, err
+	}
+
+	tx := &Tx{client: client}
+	if err := fn(tx); err != nil {
+		client.Cmd("UNWATCH")
+		return nil, false, err
+	}
+	if len(tx.queued) == 0 {
+		return nil, false, client.Cmd("UNWATCH").Err
+	}
+
+	client.PipeAppend("MULTI")
+	for _, q := range tx.queued {
+		client.PipeAppend(q.cmd, q.args...)
+	}
+	client.PipeAppend("EXEC")
+
+	// The replies to MULTI and to each queued command (which should be QUEUED)
+	// are read first. If one of the commands couldn't be queued EXEC will
+	// return an EXECABORT error, which is what's returned. Network errors are
+	// returned immediately though, there's no reading further after those.
+	for i := 0; i < len(tx.queued)+1; i++ {
+		if r := client.PipeResp(); r.IsType(redis.IOErr) {
+			client.PipeClear()
+			return nil, false, r.Err
+		}
+	}
+
+	execR := client.PipeResp()
+	if execR.IsType(redis.Nil) {
+		return nil, true, nil
+	} else if execR.Err != nil {
+		return nil, false, execR.Err
+	}
+
+	rr, err := execR.Array()
+	if err != nil {
+		return nil, false, err
+	}
+	return rr, false, nil
+}
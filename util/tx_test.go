@@ -0,0 +1,116 @@
+package util
+
+import (
+	"sync"
+	. "testing"
+	"time"
+
+	"github.com/levenlabs/golib/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/gallir/radix.improved/cluster"
+	"github.com/gallir/radix.improved/pool"
+	"github.com/gallir/radix.improved/redis"
+	"github.com/gallir/radix.improved/redistest"
+)
+
+func TestTransaction(t *T) {
+	p, err := pool.New("tcp", "127.0.0.1:6379", 10)
+	require.Nil(t, err)
+	c, err := cluster.New("127.0.0.1:7000")
+	require.Nil(t, err)
+
+	cs := []Cmder{p, c}
+	for _, c := range cs {
+		key := "{" + testutil.RandStr() + "}"
+		other := key + "other"
+
+		// Increment the key concurrently from a bunch of routines, WATCH
+		// should make sure that no increment is lost
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				rr, err := TransactionWithOpts(c, TxOpts{MaxAttempts: 100}, []string{key, other}, func(tx *Tx) error {
+					i, err := tx.Cmd("GET", key).Int()
+					if err != nil && err != redis.ErrRespNil {
+						return err
+					}
+					tx.Queue("SET", key, i+1)
+					tx.Queue("INCR", other)
+					return nil
+				})
+				assert.Nil(t, err)
+				assert.Equal(t, 2, len(rr))
+			}()
+		}
+		wg.Wait()
+
+		i, err := c.Cmd("GET", key).Int()
+		require.Nil(t, err)
+		assert.Equal(t, 10, i)
+		i, err = c.Cmd("GET", other).Int()
+		require.Nil(t, err)
+		assert.Equal(t, 10, i)
+	}
+
+	_, err = Transaction(c, []string{"foo", "bar"}, func(*Tx) error { return nil })
+	assert.Equal(t, ErrTxCrossSlot, err)
+}
+
+func TestTransactionAborted(t *T) {
+	p, err := pool.New("tcp", "127.0.0.1:6379", 10)
+	require.Nil(t, err)
+	key := testutil.RandStr()
+
+	// Modifying the key from another connection during every attempt should
+	// make the transaction give up
+	attempts := 0
+	_, err = TransactionWithOpts(p, TxOpts{MaxAttempts: 3}, []string{key}, func(tx *Tx) error {
+		attempts++
+		require.Nil(t, p.Cmd("INCR", key).Err)
+		tx.Queue("SET", key, "foo")
+		return nil
+	})
+	assert.Equal(t, ErrTxMaxAttempts, err)
+	assert.Equal(t, 3, attempts)
+
+	i, err := p.Cmd("GET", key).Int()
+	require.Nil(t, err)
+	assert.Equal(t, 3, i)
+}
+
+func TestTransactionBackoff(t *T) {
+	s, err := redistest.NewServer()
+	require.Nil(t, err)
+	defer s.Close()
+	c := s.Client()
+	defer c.Close()
+
+	abort := func(tx *Tx) error {
+		require.Nil(t, s.Cmd("INCR", "foo").Err)
+		tx.Queue("SET", "foo", "bar")
+		return nil
+	}
+
+	// There's no waiting after the last attempt
+	start := time.Now()
+	o := TxOpts{MaxAttempts: 1, Backoff: time.Minute}
+	_, err = TransactionWithOpts(c, o, []string{"foo"}, abort)
+	assert.Equal(t, ErrTxMaxAttempts, err)
+	assert.True(t, time.Since(start) < time.Second)
+
+	// Nor between any of them with a negative Backoff
+	for _, o := range []TxOpts{
+		{MaxAttempts: 3, Backoff: -1},
+		{MaxAttempts: 3, MaxBackoff: -1},
+	} {
+		_, err = TransactionWithOpts(c, o, []string{"foo"}, abort)
+		assert.Equal(t, ErrTxMaxAttempts, err)
+	}
+	i, err := s.Cmd("GET", "foo").Int()
+	require.Nil(t, err)
+	assert.Equal(t, 7, i)
+}